@@ -2,6 +2,7 @@
 package client
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -21,8 +22,14 @@ import (
 	"time"
 )
 
+// TTLNever can be passed to Copy and CopyFiles to request a file that never expires. The server may not allow
+// this, in which case the file expires after the server's max. TTL.
+const TTLNever = time.Duration(-1)
+
 const (
 	useDefaultAuthTTL = 0
+	waitForBackoffMin = 100 * time.Millisecond
+	waitForBackoffMax = 2 * time.Second
 )
 
 // Client represents a pcopy client. It can be used to communicate with the server to
@@ -59,7 +66,9 @@ func (c *Client) Copy(reader io.ReadCloser, id string, ttl time.Duration, mode s
 		return nil, err
 	}
 	req.Header.Set(server.HeaderFormat, server.HeaderFormatNone)
-	if ttl > 0 {
+	if ttl == TTLNever {
+		req.Header.Set(server.HeaderTTL, "never")
+	} else if ttl > 0 {
 		req.Header.Set(server.HeaderTTL, ttl.String())
 	}
 	if mode != "" {
@@ -72,12 +81,8 @@ func (c *Client) Copy(reader io.ReadCloser, id string, ttl time.Duration, mode s
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
-	} else if resp.StatusCode == http.StatusPartialContent {
-		return nil, server.ErrHTTPPartialContent
-	} else if resp.StatusCode == http.StatusRequestEntityTooLarge {
-		return nil, server.ErrHTTPPayloadTooLarge
 	} else if resp.StatusCode != http.StatusCreated {
-		return nil, &server.ErrHTTP{Code: resp.StatusCode, Status: resp.Status}
+		return nil, errFromResponse(resp)
 	}
 
 	return c.parseFileInfoResponse(resp)
@@ -115,7 +120,7 @@ func (c *Client) Reserve(id string) (*server.File, error) {
 	if err != nil {
 		return nil, err
 	} else if resp.StatusCode != http.StatusCreated {
-		return nil, &server.ErrHTTP{Code: resp.StatusCode, Status: resp.Status}
+		return nil, errFromResponse(resp)
 	}
 
 	return c.parseFileInfoResponse(resp)
@@ -123,43 +128,87 @@ func (c *Client) Reserve(id string) (*server.File, error) {
 
 // Paste reads the file with the given id from the server and writes it to writer.
 func (c *Client) Paste(writer io.Writer, id string) error {
-	client, err := c.newHTTPClient(nil)
+	reader, _, err := c.Open(id)
 	if err != nil {
 		return err
 	}
+	defer reader.Close()
+
+	if _, err := io.Copy(writer, reader); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Open opens the file with the given id for reading and returns a reader over the response body, as well as
+// the file metadata. Unlike Paste, nothing is buffered or copied, so large files can be processed incrementally.
+// The caller must close the returned reader.
+func (c *Client) Open(id string) (io.ReadCloser, *server.File, error) {
+	return c.OpenAt(id, 0)
+}
+
+// OpenAt is like Open, but starts reading at the given byte offset. It sends a "Range:" header so that interrupted
+// reads can be resumed. If the server ignores the range request, the first offset bytes of the response are skipped.
+func (c *Client) OpenAt(id string, offset int64) (io.ReadCloser, *server.File, error) {
+	client, err := c.newHTTPClient(nil)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	url := fmt.Sprintf("%s/%s", config.ExpandServerAddr(c.config.ServerAddr), id)
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	if err := c.addAuthHeader(req, nil); err != nil {
-		return err
+		return nil, nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return nil, nil, err
 	} else if resp.Body == nil {
-		return errResponseBodyEmpty
-	} else if resp.StatusCode != http.StatusOK {
-		return &server.ErrHTTP{Code: resp.StatusCode, Status: resp.Status}
+		return nil, nil, errResponseBodyEmpty
+	} else if resp.StatusCode != http.StatusOK && (offset == 0 || resp.StatusCode != http.StatusPartialContent) {
+		resp.Body.Close()
+		return nil, nil, errFromResponse(resp)
 	}
 
-	var total int
-	total, err = strconv.Atoi(resp.Header.Get("Length"))
-	if err != nil {
-		total = 0
+	if offset > 0 && resp.StatusCode == http.StatusOK {
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, nil, err
+		}
 	}
 
-	reader := c.withProgressReader(resp.Body, int64(total))
-	defer reader.Close()
+	info, err := c.parseFileInfoResponse(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	if info.File == "" {
+		info.File = id
+	}
 
-	if _, err := io.Copy(writer, reader); err != nil {
-		return err
+	length := resp.Header.Get("Length")
+	if length == "" { // Streams only have a size if the uploader announced it
+		length = resp.Header.Get(server.HeaderExpectedSize)
+		if length == "" && resp.ContentLength > 0 {
+			length = strconv.FormatInt(resp.ContentLength, 10)
+		}
+	}
+	total, err := strconv.ParseInt(length, 10, 64)
+	if err != nil || total < offset {
+		total = 0
+	} else {
+		total -= offset
 	}
 
-	return nil
+	return c.withProgressReader(resp.Body, total), info, nil
 }
 
 // PasteFiles reads the file with the given id from the server (assuming that it is a ZIP archive)
@@ -196,13 +245,50 @@ func (c *Client) PasteFiles(dir string, id string) error {
 
 // FileInfo retrieves file metadata for the given file
 func (c *Client) FileInfo(id string) (*server.File, error) {
+	return c.fileInfo(context.Background(), id)
+}
+
+// SignedURL returns a download URL for the given file ID that carries its own authorization, so that it can be
+// shared with someone who does not have the key. The URL expires after the given duration. The file is not
+// checked for existence. If the clipboard has no key, the plain URL is returned.
+func (c *Client) SignedURL(id string, validFor time.Duration) (string, error) {
+	return server.GenerateSignedURL(c.config, id, validFor)
+}
+
+// WaitFor blocks until the file with the given id exists and is ready to be read, and then returns its metadata.
+// Reserved files (see Reserve) are not considered ready until they are replaced by an actual stream or file.
+// The server is polled with exponential backoff. WaitFor returns early if the context is cancelled, or if the
+// server returns an error other than "404 Not Found".
+func (c *Client) WaitFor(ctx context.Context, id string) (*server.File, error) {
+	backoff := waitForBackoffMin
+	for {
+		info, err := c.fileInfo(ctx, id)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if err == nil && info.Available {
+			return info, nil
+		} else if httpErr, ok := err.(*server.ErrHTTP); err != nil && (!ok || httpErr.Code != http.StatusNotFound) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > waitForBackoffMax {
+			backoff = waitForBackoffMax
+		}
+	}
+}
+
+func (c *Client) fileInfo(ctx context.Context, id string) (*server.File, error) {
 	client, err := c.newHTTPClient(nil)
 	if err != nil {
 		return nil, err
 	}
 
 	url := fmt.Sprintf("%s/%s", config.ExpandServerAddr(c.config.ServerAddr), id)
-	req, err := http.NewRequest(http.MethodHead, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -214,12 +300,46 @@ func (c *Client) FileInfo(id string) (*server.File, error) {
 	if err != nil {
 		return nil, err
 	} else if resp.StatusCode != http.StatusOK {
-		return nil, &server.ErrHTTP{Code: resp.StatusCode, Status: resp.Status}
+		return nil, errFromResponse(resp)
 	}
 
 	return c.parseFileInfoResponse(resp)
 }
 
+// Info retrieves the full metadata of the given file from the server's meta endpoint. Unlike FileInfo, which
+// only reads the response headers of a HEAD request, this includes details such as mode, content type and checksum.
+func (c *Client) Info(id string) (*server.FileMetadata, error) {
+	client, err := c.newHTTPClient(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/%s:meta", config.ExpandServerAddr(c.config.ServerAddr), id)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.addAuthHeader(req, nil); err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errFromResponse(resp)
+	}
+
+	var meta server.FileMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return nil, err
+	}
+
+	return &meta, nil
+}
+
 // ServerInfo queries the server for information (password salt, advertised address) required during the
 // join operation. This method will first attempt to securely connect over HTTPS, and (if that fails)
 // fall back to skipping certificate verification. In the latter case, it will download and return
@@ -273,12 +393,46 @@ func (c *Client) Verify(cert *x509.Certificate, key *crypto.Key) error {
 	if err != nil {
 		return err
 	} else if resp.StatusCode != http.StatusOK {
-		return &server.ErrHTTP{Code: resp.StatusCode, Status: resp.Status}
+		return errFromResponse(resp)
 	}
 
 	return nil
 }
 
+// Stats retrieves live statistics about the clipboard contents, its visitors and recent copy/paste actions
+// from the server's stats endpoint. This requires the same auth as copying/pasting.
+func (c *Client) Stats() (*server.Stats, error) {
+	client, err := c.newHTTPClient(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/stats", config.ExpandServerAddr(c.config.ServerAddr))
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.addAuthHeader(req, nil); err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errFromResponse(resp)
+	}
+
+	var stats server.Stats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
 func (c *Client) addAuthHeader(req *http.Request, key *crypto.Key) error {
 	if key == nil {
 		key = c.config.Key
@@ -296,6 +450,25 @@ func (c *Client) addAuthHeader(req *http.Request, key *crypto.Key) error {
 	return nil
 }
 
+// errFromResponse returns the error for an unexpected response status. Common errors are mapped to the server's
+// error values, so that callers can compare them directly, e.g. err == server.ErrHTTPNotFound.
+func errFromResponse(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return server.ErrHTTPPartialContent
+	case http.StatusUnauthorized:
+		return server.ErrHTTPUnauthorized
+	case http.StatusNotFound:
+		return server.ErrHTTPNotFound
+	case http.StatusRequestEntityTooLarge:
+		return server.ErrHTTPPayloadTooLarge
+	case http.StatusTooManyRequests:
+		return server.ErrHTTPTooManyRequests
+	default:
+		return &server.ErrHTTP{Code: resp.StatusCode, Status: resp.Status}
+	}
+}
+
 func (c *Client) withProgressReader(reader io.ReadCloser, total int64) io.ReadCloser {
 	if c.config.ProgressFunc != nil {
 		return util.NewProgressReader(reader, total, c.config.ProgressFunc)
@@ -313,11 +486,15 @@ func (c *Client) parseFileInfoResponse(resp *http.Response) (*server.File, error
 		ttl = 0
 	}
 	return &server.File{
-		File:    resp.Header.Get(server.HeaderFile),
-		URL:     resp.Header.Get(server.HeaderURL),
-		Expires: time.Unix(expires, 0),
-		TTL:     time.Duration(ttl) * time.Second,
-		Curl:    resp.Header.Get(server.HeaderCurl),
+		File:       resp.Header.Get(server.HeaderFile),
+		URL:        resp.Header.Get(server.HeaderURL),
+		Expires:    time.Unix(expires, 0),
+		TTL:        time.Duration(ttl) * time.Second,
+		TTLClamped: resp.Header.Get(server.HeaderTTLClamped) == server.HeaderTTLClampedYes,
+		Curl:       resp.Header.Get(server.HeaderCurl),
+		Available:  resp.Header.Get(server.HeaderAvailable) != server.HeaderAvailableNo,
+		Streaming:  resp.Header.Get(server.HeaderStreaming) == server.HeaderStreamingYes,
+		ReadyURL:   resp.Header.Get(server.HeaderStreamReadyURL),
 	}, nil
 }
 
@@ -360,22 +537,38 @@ func (c *Client) retrieveCert() (*x509.Certificate, error) {
 	return conn.ConnectionState().PeerCertificates[0], nil
 }
 
+// newHTTPClient returns a HTTP client that only accepts the public key of the given cert, or of the cert in CertFile.
+// Pinning the public key (and not the entire cert) means that the pin remains valid if the server's cert is renewed
+// with the same key. If there is no cert, the system's CAs are used.
 func (c *Client) newHTTPClient(cert *x509.Certificate) (*http.Client, error) {
 	if c.httpClient != nil { // For testing only!
 		return c.httpClient, nil
 	} else if cert != nil {
-		return util.NewHTTPClientWithPinnedCert(cert)
+		return newHTTPClientWithPinnedPublicKey(cert)
 	} else if c.config.CertFile != "" {
 		cert, err := crypto.LoadCertFromFile(c.config.CertFile)
 		if err != nil {
 			return nil, err
 		}
-		return util.NewHTTPClientWithPinnedCert(cert)
+		return newHTTPClientWithPinnedPublicKey(cert)
 	} else {
 		return util.NewHTTPClient(), nil
 	}
 }
 
+func newHTTPClientWithPinnedPublicKey(cert *x509.Certificate) (*http.Client, error) {
+	pin := crypto.CalculatePublicKeyPin(cert)
+	if pin == "" {
+		return nil, errInvalidPinnedCert
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: crypto.NewTLSConfigWithPinnedPublicKey(pin),
+		},
+	}, nil
+}
+
 var errMissingServerAddr = errors.New("server address missing")
+var errInvalidPinnedCert = errors.New("cannot read public key of pinned cert")
 var errResponseBodyEmpty = errors.New("response body was empty")
 var errNoPeerCert = errors.New("no peer cert found")
@@ -3,6 +3,11 @@ package client
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"heckel.io/pcopy/config"
@@ -11,6 +16,7 @@ import (
 	"heckel.io/pcopy/test"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -38,6 +44,19 @@ func TestClient_CopyNoAuthSuccess(t *testing.T) {
 	}
 }
 
+func TestClient_CopyTTLNever(t *testing.T) {
+	conf := config.New()
+	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		test.StrEquals(t, "never", r.Header.Get(server.HeaderTTL))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer serv.Close()
+
+	if _, err := client.Copy(ioutil.NopCloser(strings.NewReader("something")), "default", TTLNever, config.FileModeReadWrite, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestClient_CopyWithHMACAuthSuccess(t *testing.T) {
 	conf := config.New()
 	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
@@ -59,6 +78,24 @@ func TestClient_CopyWithHMACAuthSuccess(t *testing.T) {
 	}
 }
 
+func TestClient_SignedURL(t *testing.T) {
+	conf := config.New()
+	conf.ServerAddr = "pcopy.example.com:443"
+	client, _ := NewClient(conf)
+	u, err := client.SignedURL("some-file", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "https://pcopy.example.com/some-file", u)
+
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	u, err = client.SignedURL("some-file", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.BoolEquals(t, true, strings.HasPrefix(u, "https://pcopy.example.com/some-file?a=HMAC+"))
+}
+
 func TestClient_CopyFilesSuccess(t *testing.T) {
 	conf := config.New()
 	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -112,6 +149,58 @@ func TestClient_PasteNoAuthSuccess(t *testing.T) {
 	test.StrEquals(t, "hi there what's up", buf.String())
 }
 
+func TestClient_OpenSuccess(t *testing.T) {
+	conf := config.New()
+	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		test.StrEquals(t, "", r.Header.Get("Range"))
+		w.Header().Set(server.HeaderFile, "hi.txt")
+		w.Header().Set(server.HeaderExpires, "1611323111")
+		w.Write([]byte("hi there what's up"))
+	}))
+	defer serv.Close()
+
+	reader, info, err := client.Open("hi.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	test.StrEquals(t, "hi there what's up", readAllToString(t, reader))
+	test.StrEquals(t, "hi.txt", info.File)
+	test.Int64Equals(t, 1611323111, info.Expires.Unix())
+}
+
+func TestClient_OpenAtWithRangeSupport(t *testing.T) {
+	conf := config.New()
+	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		test.StrEquals(t, "bytes=9-", r.Header.Get("Range"))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("what's up"))
+	}))
+	defer serv.Close()
+
+	reader, _, err := client.OpenAt("hi.txt", 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	test.StrEquals(t, "what's up", readAllToString(t, reader))
+}
+
+func TestClient_OpenAtWithoutRangeSupport(t *testing.T) {
+	conf := config.New()
+	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi there what's up"))
+	}))
+	defer serv.Close()
+
+	reader, _, err := client.OpenAt("hi.txt", 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	test.StrEquals(t, "what's up", readAllToString(t, reader))
+}
+
 func TestClient_PasteFilesSuccess(t *testing.T) {
 	conf := config.New()
 	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -174,6 +263,43 @@ func TestClient_PasteNoAuthNotFound(t *testing.T) {
 	}
 }
 
+func TestClient_CopyAndPasteErrors(t *testing.T) {
+	for _, tt := range []struct {
+		code     int
+		expected error
+	}{
+		{http.StatusUnauthorized, server.ErrHTTPUnauthorized},
+		{http.StatusNotFound, server.ErrHTTPNotFound},
+		{http.StatusRequestEntityTooLarge, server.ErrHTTPPayloadTooLarge},
+		{http.StatusTooManyRequests, server.ErrHTTPTooManyRequests},
+	} {
+		conf := config.New()
+		client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.code)
+		}))
+
+		if _, err := client.Copy(ioutil.NopCloser(strings.NewReader("something")), "default", time.Hour, config.FileModeReadWrite, false); err != tt.expected {
+			t.Fatalf("expected %v for copy, got %v", tt.expected, err)
+		}
+		if _, _, err := client.Open("default"); err != tt.expected {
+			t.Fatalf("expected %v for paste, got %v", tt.expected, err)
+		}
+		serv.Close()
+	}
+
+	// Other errors are still returned as server.ErrHTTP
+	conf := config.New()
+	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer serv.Close()
+	var httpErr *server.ErrHTTP
+	if _, err := client.Copy(ioutil.NopCloser(strings.NewReader("something")), "default", time.Hour, config.FileModeReadWrite, false); !errors.As(err, &httpErr) {
+		t.Fatalf("expected server.ErrHTTP, got %v", err)
+	}
+	test.Int64Equals(t, http.StatusServiceUnavailable, int64(httpErr.Code))
+}
+
 func TestClient_PasteWithCertFile(t *testing.T) {
 	conf := config.New()
 	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -267,6 +393,99 @@ func TestClient_FileInfoSuccess(t *testing.T) {
 	test.Int64Equals(t, 1611323111, info.Expires.Unix())
 	test.Int64Equals(t, 360, int64(info.TTL.Seconds()))
 	test.StrEquals(t, "curl https://sup.com/hi.txt", info.Curl)
+	test.BoolEquals(t, false, info.Streaming)
+}
+
+func TestClient_WaitForSuccess(t *testing.T) {
+	conf := config.New()
+	requests := 0
+	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		test.StrEquals(t, http.MethodHead, r.Method)
+		test.StrEquals(t, "/hi.txt", r.RequestURI)
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(server.HeaderFile, "hi.txt")
+		if requests == 2 {
+			w.Header().Set(server.HeaderAvailable, server.HeaderAvailableNo) // Reserved
+		} else {
+			w.Header().Set(server.HeaderAvailable, server.HeaderAvailableYes)
+		}
+	}))
+	defer serv.Close()
+
+	info, err := client.WaitFor(context.Background(), "hi.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "hi.txt", info.File)
+	test.BoolEquals(t, true, info.Available)
+	test.Int64Equals(t, 3, int64(requests))
+}
+
+func TestClient_WaitForTimeout(t *testing.T) {
+	conf := config.New()
+	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer serv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err := client.WaitFor(ctx, "hi.txt")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestClient_WaitForUnauthorized(t *testing.T) {
+	conf := config.New()
+	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer serv.Close()
+
+	_, err := client.WaitFor(context.Background(), "hi.txt")
+	if httpErr, ok := err.(*server.ErrHTTP); !ok || httpErr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 error, got %v", err)
+	}
+}
+
+func TestClient_InfoSuccess(t *testing.T) {
+	conf := config.New()
+	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		test.StrEquals(t, http.MethodGet, r.Method)
+		test.StrEquals(t, "/hi.txt:meta", r.RequestURI)
+		w.Write([]byte(`{"id":"hi.txt","mode":"ro","size":123,"contentType":"text/plain","checksum":"abc","created":1611323000,"expires":1611323111,"stream":false,"reserved":false}`))
+	}))
+	defer serv.Close()
+
+	meta, err := client.Info("hi.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "hi.txt", meta.ID)
+	test.StrEquals(t, "ro", meta.Mode)
+	test.Int64Equals(t, 123, meta.Size)
+	test.StrEquals(t, "text/plain", meta.ContentType)
+	test.StrEquals(t, "abc", meta.Checksum)
+	test.Int64Equals(t, 1611323000, meta.Created)
+	test.Int64Equals(t, 1611323111, meta.Expires)
+}
+
+func TestClient_InfoNotFound(t *testing.T) {
+	conf := config.New()
+	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer serv.Close()
+
+	_, err := client.Info("hi.txt")
+	if httpErr, ok := err.(*server.ErrHTTP); !ok || httpErr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 error, got %v", err)
+	}
 }
 
 func TestClient_ReserveSuccess(t *testing.T) {
@@ -278,7 +497,9 @@ func TestClient_ReserveSuccess(t *testing.T) {
 		w.Header().Set(server.HeaderURL, "https://sup.com/hi.txt")
 		w.Header().Set(server.HeaderExpires, "1611323111")
 		w.Header().Set(server.HeaderTTL, "360")
+		w.Header().Set(server.HeaderTTLClamped, server.HeaderTTLClampedYes)
 		w.Header().Set(server.HeaderCurl, "curl https://sup.com/hi.txt")
+		w.Header().Set(server.HeaderStreamReadyURL, "https://sup.com/hi.txt?token=abc")
 		w.WriteHeader(http.StatusCreated)
 	}))
 	defer serv.Close()
@@ -291,7 +512,9 @@ func TestClient_ReserveSuccess(t *testing.T) {
 	test.StrEquals(t, "https://sup.com/hi.txt", info.URL)
 	test.Int64Equals(t, 1611323111, info.Expires.Unix())
 	test.Int64Equals(t, 360, int64(info.TTL.Seconds()))
+	test.BoolEquals(t, true, info.TTLClamped)
 	test.StrEquals(t, "curl https://sup.com/hi.txt", info.Curl)
+	test.StrEquals(t, "https://sup.com/hi.txt?token=abc", info.ReadyURL)
 }
 
 // TODO add TestReserveFailureTimeout
@@ -312,6 +535,35 @@ func TestClient_VerifyWithPinnedCertNoAuthSuccess(t *testing.T) {
 	}
 }
 
+func TestClient_VerifyWithPinnedCertRenewedWithSameKey(t *testing.T) {
+	conf := config.New()
+	client, serv := newTestClientAndServer(t, conf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer serv.Close()
+	client.httpClient = nil
+
+	// The pin is the public key, so a different cert with the same key is accepted
+	template := *serv.Certificate()
+	template.SerialNumber = big.NewInt(1234)
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, serv.Certificate().PublicKey, serv.TLS.Certificates[0].PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed, _ := x509.ParseCertificate(der)
+	if err := client.Verify(renewed, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A cert with another key is rejected
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ = x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	other, _ := x509.ParseCertificate(der)
+	if err := client.Verify(other, nil); err == nil {
+		t.Fatal("expected error, got none")
+	}
+}
+
 func newTestClientAndServer(t *testing.T, conf *config.Config, handler http.Handler) (*Client, *httptest.Server) {
 	serv := httptest.NewTLSServer(handler)
 	conf.ServerAddr = config.ExpandServerAddr(serv.URL)
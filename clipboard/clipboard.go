@@ -2,42 +2,126 @@
 package clipboard
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	_ "embed" // Required for go:embed instructions
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"golang.org/x/sys/unix"
 	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/crypto"
 	"heckel.io/pcopy/util"
 	"io"
 	"io/fs"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 const (
-	// FileRegexPart defines the regex for a valid file ID. Note that this does not include start/end markers,
-	// as they can be different depending on the use case.
-	FileRegexPart = `(?i)([a-z0-9][-_.a-z0-9]{1,100})`
+	// FileRegexPart defines the regex for the characters of a valid file ID. Note that this does not include start/end
+	// markers, as they can be different depending on the use case. The length of file IDs is limited separately,
+	// see config.IDMaxLength.
+	FileRegexPart = `(?i)([a-z0-9][-_.a-z0-9]+)`
 
 	metaFileSuffix = ":meta"
+
+	// uploadsDir is the directory within the clipboard dir in which partial resumable uploads are kept
+	// until they are committed, see StartUpload
+	uploadsDir = ".uploads"
+
+	// shardCount is the number of shard directories (00 to ff) if config.ShardDir is enabled, see shardDir
+	shardCount = 256
+
+	// reshardPrefix is prepended to files that are temporarily moved aside in the clipboard dir, see reshard
+	reshardPrefix = ".reshard-"
+
+	// followPollInterval is the interval in which FollowFile checks for appended content, in case it
+	// missed a notification, e.g. because the content was appended by another process
+	followPollInterval = time.Second
+
+	// pipeWaitInterval is the interval in which a stream checks if a reader has opened the pipe, if the time it
+	// waits for a reader is limited, see config.StreamWaitTimeout
+	pipeWaitInterval = 100 * time.Millisecond
+
+	// searchSnippetContext is the number of bytes before and after a match that are part of the snippet
+	searchSnippetContext = 40
 )
 
 var (
 	// ErrBrokenPipe is returned when the target file is a pipe and the consumer prematurely interrupts reading
 	ErrBrokenPipe = errors.New("broken pipe")
 
+	// ErrStreamAborted is returned by ReadFile if the file is a pipe and the producer failed before it was done
+	// writing (because the size limit was reached, or the input ended prematurely), i.e. if the content that was
+	// read is incomplete
+	ErrStreamAborted = errors.New("stream aborted")
+
+	// ErrFileCorrupt is returned by Verify if the file content does not match the length or checksum in its
+	// metadata file, or if a previous write was interrupted (e.g. due to a crash)
+	ErrFileCorrupt = errors.New("file corrupt")
+
+	// ErrUploadNotFound is returned by AppendUpload, OpenUpload and CommitUpload if there is no pending
+	// upload for the file ID (and token)
+	ErrUploadNotFound = errors.New("upload not found")
+
+	// ErrUploadOffsetMismatch is returned by AppendUpload if the given offset does not match the number
+	// of bytes uploaded so far
+	ErrUploadOffsetMismatch = errors.New("upload offset mismatch")
+
+	// ErrLinkChain is returned by WriteLink if the link target is itself an alias (or the alias itself), since
+	// aliases are only resolved one level deep, see Stat
+	ErrLinkChain = errors.New("link target is an alias")
+
+	// ErrStreamWaitTimeout is returned by WriteFile if the file is a pipe and no reader opened it within the
+	// configured time, see config.StreamWaitTimeout. The pipe is deleted in that case.
+	ErrStreamWaitTimeout = errors.New("no reader for stream")
+
+	// ErrNotAppendable is returned by AppendFile if the entry is a pipe, an alias, compressed or encrypted,
+	// or if it is currently being written
+	ErrNotAppendable = errors.New("entry cannot be appended to")
+
+	// ErrStorageFull is returned by WriteFile and AppendFile if there is no space left in the clipboard directory
+	// (or the disk quota is exceeded). WriteFile deletes the partially written file in that case.
+	ErrStorageFull = errors.New("no space left in clipboard directory")
+
+	// ErrStorageNotWritable is returned by WriteFile, AppendFile and MakePipe if the clipboard directory is not writable
+	// (anymore), e.g. because its permissions changed or the file system was remounted read-only
+	ErrStorageNotWritable = errors.New("clipboard directory not writable")
+
 	// ErrInvalidFileID is returned in any method that deals with file ID input for reserved identifiers (ReadFile, WriteFile, ...)
 	ErrInvalidFileID = errors.New("invalid file id")
 
-	validIDRegex               = regexp.MustCompile("^" + FileRegexPart + "$")
-	reservedFiles              = []string{"help", "version", "info", "verify", "random", "curl", "nc", "static", "robots.txt", "favicon.ico"}
+	validIDRegex          = regexp.MustCompile("^" + FileRegexPart + "$")
+	validUploadTokenRegex = regexp.MustCompile("^[a-zA-Z0-9]{1,64}$")
+	shardDirRegex         = regexp.MustCompile("^[0-9a-f]{2}$")
+
+	// textContentTypes are the non-"text/*" content types that are searched, see Search
+	textContentTypes = map[string]bool{
+		"application/json":       true,
+		"application/xml":        true,
+		"application/javascript": true,
+		"application/x-sh":       true,
+		"application/x-yaml":     true,
+		"application/yaml":       true,
+	}
+
+	// reservedFiles are IDs that are always reserved. Names of server endpoints are not listed here, since the
+	// server reserves them itself based on its routes (see Reserve).
+	reservedFiles              = []string{"help", "version", "robots.txt"}
 	errClipboardDirNotWritable = errors.New("clipboard dir not writable by user")
+	errAtRestKeyMissing        = errors.New("at-rest encryption key missing, set Key or AtRestKey")
 )
 
 // Clipboard is responsible for storing files on the file system. In addition to storage, it also takes care
@@ -46,6 +130,13 @@ type Clipboard struct {
 	config       *config.Config
 	countLimiter *util.Limiter
 	sizeLimiter  *util.Limiter
+	writing      map[string]bool
+	reserved     map[string]bool
+	aborted      map[string]bool          // Pipes whose producer failed, see ErrStreamAborted
+	appended     map[string]chan struct{} // Closed whenever content is appended to an entry, see FollowFile
+	idPattern    *regexp.Regexp           // Additional restriction for file IDs, see config.IDPattern; may be nil
+	atRestKey    []byte                   // Key to encrypt/decrypt files at rest (see config.EncryptAtRest); may be nil
+	mu           sync.Mutex
 }
 
 // Stats holds statistics about the current clipboard usage
@@ -56,38 +147,115 @@ type Stats struct {
 
 // File defines the metadata file format stored next to each file
 type File struct {
-	ID      string    `json:"-"`
-	Size    int64     `json:"-"`
-	ModTime time.Time `json:"-"`
-	Pipe    bool      `json:"-"`
-	Mode    string    `json:"mode"`
-	Expires int64     `json:"expires"`
-	Secret  string    `json:"secret"`
+	ID            string            `json:"-"`
+	Size          int64             `json:"-"`
+	ModTime       time.Time         `json:"-"`
+	Pipe          bool              `json:"-"`
+	Mode          string            `json:"mode"`
+	Expires       int64             `json:"expires"`
+	Secret        string            `json:"secret"`
+	Reserved      bool              `json:"reserved,omitempty"`
+	Notify        string            `json:"notify,omitempty"`
+	KeyID         string            `json:"keyid,omitempty"`
+	Visitor       string            `json:"visitor,omitempty"`
+	Type          string            `json:"type,omitempty"`
+	Hidden        bool              `json:"hidden,omitempty"`
+	Public        bool              `json:"public,omitempty"` // True if the file can be read without authorization
+	DownloadLimit int               `json:"downloadlimit,omitempty"`
+	Downloads     int               `json:"downloads,omitempty"`
+	PasswordKey   string            `json:"passwordkey,omitempty"`
+	Notified      bool              `json:"notified,omitempty"`
+	Pending       bool              `json:"pending,omitempty"`
+	Compressed    bool              `json:"compressed,omitempty"`
+	Length        int64             `json:"length,omitempty"`
+	Checksum      string            `json:"checksum,omitempty"`
+	ExpectedSize  int64             `json:"expectedsize,omitempty"`  // Size announced by the uploader of a stream, if any
+	ExpectedExact bool              `json:"expectedexact,omitempty"` // True if ExpectedSize is enforced (i.e. from Content-Length)
+	Filename      string            `json:"filename,omitempty"`      // Original file name passed by the uploader, if any
+	Link          string            `json:"link,omitempty"`          // ID of the linked entry, if this entry is an alias, see WriteLink
+	Target        *File             `json:"-"`                       // Linked entry as resolved by Stat; nil if it is gone or an alias itself
+	Encrypted     bool              `json:"encrypted,omitempty"`     // True if the content is encrypted at rest, see config.EncryptAtRest
+	Nonce         string            `json:"nonce,omitempty"`         // Hex-encoded nonce of the encrypted content, see crypto.NewEncryptWriter
+	Appending     bool              `json:"appending,omitempty"`     // True if more content may be appended, see AppendFile
+	Normalized    string            `json:"normalized,omitempty"`    // Line ending normalization applied when storing ("lf" or "crlf"), if any
+	UserMeta      map[string]string `json:"usermeta,omitempty"`      // Arbitrary metadata passed by the uploader via X-Meta-* headers
+	StreamToken   string            `json:"streamtoken,omitempty"`   // Ties a reservation to the stream that replaces it
+	Binary        bool              `json:"binary,omitempty"`        // True if the content is not text, based on its detected type; set by the caller
+	Lines         int64             `json:"lines,omitempty"`         // Number of lines of text content, counted while writing (not for binary content)
 }
 
 // New creates a new Clipboard using the given config
 func New(config *config.Config) (*Clipboard, error) {
-	if err := os.MkdirAll(config.ClipboardDir, 0700); err != nil {
+	if err := os.MkdirAll(config.ClipboardDir, config.DirMode); err != nil {
 		return nil, errClipboardDirNotWritable
 	}
 	if unix.Access(config.ClipboardDir, unix.W_OK) != nil {
 		return nil, errClipboardDirNotWritable
 	}
-	return &Clipboard{
+	reserved := make(map[string]bool)
+	for _, id := range config.ReservedIDs {
+		reserved[id] = true
+	}
+	var idPattern *regexp.Regexp
+	if config.IDPattern != "" {
+		var err error
+		if idPattern, err = regexp.Compile("^(?:" + config.IDPattern + ")$"); err != nil {
+			return nil, err
+		}
+	}
+	var atRestKey []byte
+	if len(config.AtRestKey) > 0 {
+		atRestKey = config.AtRestKey
+	} else if config.Key != nil {
+		atRestKey = crypto.DeriveAtRestKey(config.Key)
+	}
+	if config.EncryptAtRest && atRestKey == nil {
+		return nil, errAtRestKeyMissing
+	}
+	c := &Clipboard{
 		config:       config,
 		sizeLimiter:  util.NewLimiter(config.ClipboardSizeLimit),
 		countLimiter: util.NewLimiter(int64(config.ClipboardCountLimit)),
-	}, nil
+		writing:      make(map[string]bool),
+		aborted:      make(map[string]bool),
+		appended:     make(map[string]chan struct{}),
+		reserved:     reserved,
+		idPattern:    idPattern,
+		atRestKey:    atRestKey,
+	}
+	if err := c.reshard(); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
-// DeleteFile removes the file with the given ID from the clipboard, including its metadata file
+// Reserve marks the given IDs as reserved, in addition to the built-in ones and the ones in the config
+// (see config.ReservedIDs). Reserved IDs cannot be used as file IDs. This must be called before the clipboard
+// is used by multiple goroutines.
+func (c *Clipboard) Reserve(ids ...string) {
+	for _, id := range ids {
+		c.reserved[id] = true
+	}
+}
+
+// IsReserved returns true if the given ID is reserved, either built-in, in the config, or via Reserve
+func (c *Clipboard) IsReserved(id string) bool {
+	return c.reserved[id] || isReservedFile(id)
+}
+
+// DeleteFile removes the file with the given ID from the clipboard, including its metadata file. If the file
+// is a pipe, a writer that is still waiting for a reader is unblocked, and will fail with ErrBrokenPipe.
 func (c *Clipboard) DeleteFile(id string) error {
 	file, metafile, err := c.getFilenames(id)
 	if err != nil {
 		return err
 	}
+	if stat, err := os.Stat(file); err == nil && stat.Mode()&os.ModeNamedPipe == os.ModeNamedPipe {
+		unblockPipe(file)
+	}
 	err1 := os.Remove(metafile)
 	err2 := os.Remove(file)
+	c.notifyAppended(id) // Followers stop once the entry is gone, see FollowFile
 	if err1 != nil {
 		return err1
 	} else if err2 != nil {
@@ -96,12 +264,14 @@ func (c *Clipboard) DeleteFile(id string) error {
 	return nil
 }
 
-// Expire will use List to list all clipboard entries and delete the ones that have expired
-func (c *Clipboard) Expire() error {
+// Expire will use List to list all clipboard entries and delete the ones that have expired. It returns the
+// number of deleted entries.
+func (c *Clipboard) Expire() ([]*File, error) {
 	entries, err := c.List()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	expired := make([]*File, 0)
 	for _, entry := range entries {
 		if entry.Expires == 0 || time.Until(time.Unix(entry.Expires, 0)) > 0 {
 			continue
@@ -110,9 +280,66 @@ func (c *Clipboard) Expire() error {
 			log.Printf("failed to remove clipboard entry after expiry: %s", err.Error())
 			continue
 		}
-		log.Printf("removed expired entry: %s (%s)", entry.ID, util.BytesToHuman(entry.Size))
+		log.Printf("removed expired entry: %s (%s)", c.logID(entry.ID), util.BytesToHuman(entry.Size))
+		expired = append(expired, entry)
 	}
-	return nil
+	return expired, nil
+}
+
+// PurgeOrphans removes clipboard files without a metadata file, and metadata files without a clipboard file, e.g.
+// after a crash or if files were removed manually. Files that are currently being written and pipes are skipped,
+// since they may legitimately exist without their counterpart for a moment. It returns the IDs of the removed files.
+func (c *Clipboard) PurgeOrphans() ([]string, error) {
+	files, err := c.readDir()
+	if err != nil {
+		return nil, err
+	}
+	purged := make([]string, 0)
+	for _, f := range files {
+		if f.IsDir() || f.Mode()&os.ModeNamedPipe == os.ModeNamedPipe {
+			continue
+		}
+		id := strings.TrimSuffix(f.Name(), metaFileSuffix)
+		if !IsValidID(id) || c.isWriting(id) {
+			continue
+		}
+		counterpart := id + metaFileSuffix
+		if id != f.Name() {
+			counterpart = id
+		}
+		if _, err := os.Lstat(filepath.Join(c.shardDir(id), counterpart)); !os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.shardDir(id), f.Name())); err != nil {
+			log.Printf("failed to remove orphaned file: %s", err.Error())
+			continue
+		}
+		if id == f.Name() {
+			log.Printf("removed orphaned file without metadata: %s", c.logID(id))
+		} else {
+			log.Printf("removed orphaned metadata without file: %s", c.logID(id))
+		}
+		purged = append(purged, id)
+	}
+	return purged, nil
+}
+
+// DiskUsage returns the number of bytes the clipboard directory takes up on disk, including metadata files and
+// pending resumable uploads. Unlike the size in Stats, this is the size of the (possibly compressed) files on disk.
+func (c *Clipboard) DiskUsage() (int64, error) {
+	usage := int64(0)
+	err := filepath.Walk(c.config.ClipboardDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.Mode().IsRegular() {
+			usage += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return usage, nil
 }
 
 // Stats returns statistics about the current clipboard. It also updates the limiters with the current
@@ -134,15 +361,15 @@ func (c *Clipboard) Stats() (*Stats, error) {
 // List returns a metadata about the files in the clipboard
 func (c *Clipboard) List() ([]*File, error) {
 	entries := make([]*File, 0)
-	files, err := ioutil.ReadDir(c.config.ClipboardDir)
+	files, err := c.readDir()
 	if err != nil {
 		return nil, err
 	}
 	for _, f := range files {
-		if !strings.HasSuffix(f.Name(), metaFileSuffix) {
-			cf, err := c.Stat(f.Name())
+		if !f.IsDir() && !strings.HasSuffix(f.Name(), metaFileSuffix) {
+			cf, err := c.stat(f.Name()) // Aliases are not resolved, their size is their own (i.e. zero)
 			if err != nil {
-				log.Printf("error reading metadata for %s: %s", f.Name(), err.Error())
+				log.Printf("error reading metadata for %s: %s", c.logID(f.Name()), err.Error())
 				continue
 			}
 			entries = append(entries, cf)
@@ -151,8 +378,23 @@ func (c *Clipboard) List() ([]*File, error) {
 	return entries, nil
 }
 
-// Stat returns metadata about a file in a clipboard
+// Stat returns metadata about a file in a clipboard. If the file is an alias (see WriteLink), the linked entry is
+// resolved and returned as Target. Links are only resolved one level deep: if the linked entry no longer exists, or
+// has been replaced by an alias in the meantime, Target is nil.
 func (c *Clipboard) Stat(id string) (*File, error) {
+	cf, err := c.stat(id)
+	if err != nil {
+		return nil, err
+	}
+	if cf.Link != "" {
+		if target, err := c.stat(cf.Link); err == nil && target.Link == "" {
+			cf.Target = target
+		}
+	}
+	return cf, nil
+}
+
+func (c *Clipboard) stat(id string) (*File, error) {
 	file, metafile, err := c.getFilenames(id)
 	if err != nil {
 		return nil, err
@@ -164,18 +406,25 @@ func (c *Clipboard) Stat(id string) (*File, error) {
 
 	mf, err := os.Open(metafile)
 	if err != nil {
-		c.DeleteFile(id) // A file without a metafile is undesired!
+		// A file without a metafile is undesired! Pipes are the exception: the metadata file is only written after
+		// the pipe is created (see MakePipe), so a reader that checks in between must not delete the pipe.
+		if stat.Mode()&os.ModeNamedPipe != os.ModeNamedPipe {
+			c.DeleteFile(id)
+		}
 		return nil, err
 	}
 	defer mf.Close()
 
 	var cf File
 	if err := json.NewDecoder(mf).Decode(&cf); err != nil {
-		log.Printf("error reading meta file for %s: %s", id, err.Error())
+		log.Printf("error reading meta file for %s: %s", c.logID(id), err.Error())
 		cf.Expires = int64(c.config.FileExpireAfterDefault.Seconds())
 	}
 	cf.ID = id
 	cf.Size = stat.Size()
+	if (cf.Compressed || cf.Encrypted) && !cf.Pending {
+		cf.Size = cf.Length // Limits and stats always refer to the original size
+	}
 	cf.ModTime = stat.ModTime()
 	cf.Pipe = stat.Mode()&os.ModeNamedPipe == os.ModeNamedPipe
 
@@ -188,99 +437,1110 @@ func (c *Clipboard) Allow() bool {
 	return err == nil
 }
 
+// Fits returns true if count new files with a total size of size bytes could be added without exceeding the
+// clipboard's count and size limits. Unlike Allow, it does not increase the file counter, so it can be used to
+// check an upload in advance.
+func (c *Clipboard) Fits(count int, size int64) bool {
+	return c.countLimiter.Allowed(int64(count)) && c.sizeLimiter.Allowed(size)
+}
+
 // WriteFile writes the entire content of rc to the clipboard entry as well as a metadata file.
 // The method observes the per-file size limit as defined in the config, as well as the total clipboard
 // size limit. If a limit is reached, it will return util.ErrLimitReached. When the target file is a FIFO
 // pipe (see MakePipe) and the consumer prematurely interrupts reading, ErrBrokenPipe may be returned.
 func (c *Clipboard) WriteFile(id string, meta *File, rc io.ReadCloser) error {
+	return c.WriteFileWithLimit(id, meta, rc, c.config.FileSizeLimit)
+}
+
+// WriteFileWithLimit is like WriteFile, but uses the given per-file size limit instead of the one defined
+// in the config. A limit of zero disables the per-file limit; the total clipboard size limit still applies.
+func (c *Clipboard) WriteFileWithLimit(id string, meta *File, rc io.ReadCloser, fileSizeLimit int64) error {
 	file, metafile, err := c.getFilenames(id)
 	if err != nil {
 		return err
 	}
 
-	// Write metadata file
-	mf, err := os.OpenFile(metafile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
-	if err != nil {
-		return err
+	c.setWriting(id, true)
+	defer c.setWriting(id, false)
+
+	// Pipes are never compressed, since they are read while being written
+	compress := c.config.CompressFiles
+	pipe := false
+	if stat, err := os.Lstat(file); err == nil && stat.Mode()&os.ModeNamedPipe == os.ModeNamedPipe {
+		compress = false
+		pipe = true
 	}
-	defer mf.Close()
-	if err := json.NewEncoder(mf).Encode(meta); err != nil {
-		return err
+
+	// Pipes are encrypted too, the content is encrypted while it passes through the pipe
+	var nonce []byte
+	if c.config.EncryptAtRest {
+		if nonce, err = crypto.GenerateAtRestNonce(); err != nil {
+			return err
+		}
+	}
+
+	// Write metadata file; it is marked as pending until the content is fully written
+	pending := *meta
+	pending.Pending = true
+	pending.Compressed = compress
+	pending.Encrypted = nonce != nil
+	pending.Nonce = hex.EncodeToString(nonce)
+	if err := writeMeta(metafile, &pending, c.config.FileMode); err != nil {
+		c.DeleteFile(id)
+		return storageError(err)
 	}
 
-	// Write actual file
-	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	// Write actual file; opening a pipe blocks until it is opened for reading
+	var f *os.File
+	if pipe && c.config.StreamWaitTimeout > 0 {
+		f, err = openPipeWithTimeout(file, c.config.StreamWaitTimeout)
+		if err == ErrStreamWaitTimeout {
+			c.DeleteFile(id)
+		}
+	} else {
+		f, err = os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, c.config.FileMode)
+	}
 	if err != nil {
-		return err
+		c.DeleteFile(id)
+		return storageError(err)
 	}
 	defer f.Close()
 
-	fileSizeLimiter := util.NewLimiter(c.config.FileSizeLimit)
-	limitWriter := util.NewLimitWriter(f, fileSizeLimiter, c.sizeLimiter)
+	// The limiters and the checksum see the original content, so that limits do not depend on compression
+	// or encryption. Content is compressed before it is encrypted, since encrypted bytes do not compress.
+	var out io.Writer = f
+	var enc io.WriteCloser
+	if nonce != nil {
+		if enc, err = crypto.NewEncryptWriter(f, c.atRestKey, nonce); err != nil {
+			c.DeleteFile(id)
+			return err
+		}
+		out = enc
+	}
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(out)
+		out = gz
+	}
+	hash := sha256.New()
+	lines := newLineCounter(!meta.Binary)
+	fileSizeLimiter := util.NewLimiter(fileSizeLimit)
+	limitWriter := util.NewLimitWriter(io.MultiWriter(out, hash, lines), fileSizeLimiter, c.sizeLimiter)
 
-	if _, err := io.Copy(limitWriter, rc); err != nil {
-		c.DeleteFile(id)
+	length, err := io.Copy(limitWriter, rc)
+	if err != nil {
 		if pe, ok := err.(*fs.PathError); ok {
 			err = pe.Err
 		}
 		if se, ok := err.(*os.SyscallError); ok {
 			err = se.Err
 		}
+		if pipe && (err == util.ErrLimitReached || err == io.ErrUnexpectedEOF || err == context.DeadlineExceeded || err == util.ErrChecksumMismatch) {
+			// The producer sent too much, disconnected prematurely, took too long, or sent corrupt content. This must be recorded before the
+			// pipe is closed, so the consumer knows about it as soon as it reads EOF.
+			c.setAborted(id, true)
+		}
+		c.DeleteFile(id)
 		if err == syscall.EPIPE {
 			return ErrBrokenPipe
 		}
-		return err // most likely this is errLimitReached
+		return storageError(err) // most likely this is errLimitReached
 	}
 
 	if err := rc.Close(); err != nil {
 		c.DeleteFile(id)
 		return err
 	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			c.DeleteFile(id)
+			return storageError(err)
+		}
+	}
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			c.DeleteFile(id)
+			return storageError(err)
+		}
+	}
+
+	// Record length and checksum, so that corrupt files can be detected (see Verify). This is pointless for pipes.
+	if stat, err := f.Stat(); err == nil && stat.Mode().IsRegular() {
+		complete := *meta
+		complete.Length = length
+		complete.Checksum = hex.EncodeToString(hash.Sum(nil))
+		complete.Lines = lines.Lines()
+		complete.Compressed = compress
+		complete.Encrypted = pending.Encrypted
+		complete.Nonce = pending.Nonce
+		if err := writeMeta(metafile, &complete, c.config.FileMode); err != nil {
+			c.DeleteFile(id)
+			return storageError(err)
+		}
+	}
+
+	return nil
+}
+
+// WriteLink creates the entry with the given ID as an alias of the existing entry target. The alias has no content
+// of its own, but its own metadata (mode, TTL, secret, ...), and is resolved to the target by Stat. Aliases of aliases
+// are rejected with ErrLinkChain.
+func (c *Clipboard) WriteLink(id string, target string, meta *File) error {
+	if id == target {
+		return ErrLinkChain
+	}
+	stat, err := c.stat(target)
+	if err != nil {
+		return err
+	} else if stat.Link != "" {
+		return ErrLinkChain
+	}
+	link := *meta
+	link.Link = target
+	return c.WriteFileWithLimit(id, &link, ioutil.NopCloser(strings.NewReader("")), 0)
+}
+
+// AppendFile appends the content of r to the entry with the given ID, and creates the entry with the given metadata
+// if it does not exist. Appended entries are stored as they are, i.e. neither compressed nor encrypted, so that they
+// can be read while content is appended (see FollowFile). Unless close is true, the entry is marked as Appending.
+// Pipes, aliases, compressed and encrypted entries cannot be appended to, and neither can entries that are currently
+// being written; ErrNotAppendable is returned in that case. Like WriteFileWithLimit, it observes the given per-file
+// size limit (which applies to the entire entry) and the total clipboard size limit. If a limit is reached,
+// util.ErrLimitReached is returned, but the content appended up to that point is kept.
+func (c *Clipboard) AppendFile(id string, meta *File, r io.Reader, fileSizeLimit int64, close bool) error {
+	file, metafile, err := c.getFilenames(id)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.writing[id] {
+		c.mu.Unlock()
+		return ErrNotAppendable
+	}
+	c.writing[id] = true
+	c.mu.Unlock()
+	defer c.setWriting(id, false)
+
+	// Pipes are checked separately, since their metadata file is only written once a producer connects
+	if stat, err := os.Lstat(file); err == nil && stat.Mode()&os.ModeNamedPipe == os.ModeNamedPipe {
+		return ErrNotAppendable
+	}
+
+	// Existing entries keep their metadata (mode, TTL, secret, ...); only the length is updated
+	var length int64
+	stat, err := c.stat(id)
+	if err == nil {
+		if stat.Link != "" || stat.Compressed || stat.Encrypted || stat.Pending {
+			return ErrNotAppendable
+		}
+		meta = stat
+		length = stat.Size
+	} else if !os.IsNotExist(err) {
+		return err
+	} else {
+		// New entries need a metadata file before the content is written, since it can be read right away
+		created := *meta
+		created.Appending = true
+		if err := writeMeta(metafile, &created, c.config.FileMode); err != nil {
+			return storageError(err)
+		}
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, c.config.FileMode)
+	if err != nil {
+		return storageError(err)
+	}
+	defer f.Close()
+
+	fileSizeLimiter := util.NewLimiter(fileSizeLimit)
+	fileSizeLimiter.Set(length)
+	limitWriter := util.NewLimitWriter(&appendWriter{f, c, id}, fileSizeLimiter, c.sizeLimiter)
+	written, copyErr := io.Copy(limitWriter, r)
+
+	// The checksum cannot be updated without reading the entire content, so appended entries are not verified.
+	// Neither are the lines counted, since the entry may be appended to in the middle of a line.
+	updated := *meta
+	updated.Length = length + written
+	updated.Checksum = ""
+	updated.Lines = 0
+	updated.Appending = !close
+	if err := writeMeta(metafile, &updated, c.config.FileMode); err != nil {
+		return storageError(err)
+	}
+	c.notifyAppended(id)
+	return storageError(copyErr)
+}
+
+// FollowFile writes the content of the entry with the given ID to w, and then keeps writing content as it is appended
+// (see AppendFile), similar to "tail -f". It returns once the entry is no longer Appending, if it is deleted (e.g.
+// because it expired) or replaced, or if ctx is done. Any number of followers may follow the same entry.
+func (c *Clipboard) FollowFile(ctx context.Context, id string, w io.Writer) error {
+	file, metafile, err := c.getFilenames(id)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		appended := c.appendedChan(id) // Must be retrieved before reading, so that no notification is missed
+		if _, err := io.Copy(w, f); err != nil {
+			return err
+		}
+		opened, err1 := f.Stat()
+		current, err2 := os.Stat(file)
+		if err1 != nil || err2 != nil || !os.SameFile(opened, current) {
+			return nil // Deleted or replaced
+		} else if !c.isAppending(id, metafile) {
+			_, err := io.Copy(w, f) // Content may have been appended right before the entry was closed
+			return err
+		}
+		select {
+		case <-appended:
+		case <-time.After(followPollInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// isAppending returns true if the given entry is marked as Appending, or if it is currently being written
+func (c *Clipboard) isAppending(id string, metafile string) bool {
+	if c.isWriting(id) {
+		return true
+	}
+	mf, err := os.Open(metafile)
+	if err != nil {
+		return false
+	}
+	defer mf.Close()
+	var meta File
+	if err := json.NewDecoder(mf).Decode(&meta); err != nil {
+		return true // The metadata file is being rewritten, see writeMeta
+	}
+	return meta.Appending
+}
+
+// WriteMeta replaces the metadata file of an existing clipboard entry, e.g. to record that a notification was sent.
+// Entries that are currently being written are not touched.
+func (c *Clipboard) WriteMeta(id string, meta *File) error {
+	_, metafile, err := c.getFilenames(id)
+	if err != nil {
+		return err
+	}
+	if c.isWriting(id) {
+		return nil
+	}
+	return writeMeta(metafile, meta, c.config.FileMode)
+}
+
+// StartUpload starts a resumable upload for the given file ID, replacing any pending upload for the same ID.
+// The chunks are appended to a partial file in a separate directory (see AppendUpload), and only become a
+// clipboard entry once the upload is committed (see CommitUpload). The token must be passed to AppendUpload,
+// so that chunks of a replaced upload are not mixed up with the new one.
+func (c *Clipboard) StartUpload(id string, token string) error {
+	if !c.IsValidID(id) || !validUploadTokenRegex.MatchString(token) {
+		return ErrInvalidFileID
+	}
+	dir := filepath.Join(c.config.ClipboardDir, uploadsDir)
+	if err := os.MkdirAll(dir, c.config.DirMode); err != nil {
+		return err
+	}
+	if existing, err := c.uploadFilename(id); err == nil {
+		os.Remove(existing)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, id+":"+token), os.O_CREATE|os.O_WRONLY|os.O_EXCL, c.config.FileMode)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// AppendUpload appends the content of r to the pending upload with the given ID and token, and returns the
+// number of bytes uploaded so far. The offset must match the number of bytes uploaded so far, otherwise
+// ErrUploadOffsetMismatch is returned along with the actual offset, so the client can resume from there.
+// If the per-file size limit is reached, util.ErrLimitReached is returned, and the chunk is discarded.
+func (c *Clipboard) AppendUpload(id string, token string, offset int64, r io.Reader, fileSizeLimit int64) (int64, error) {
+	if !c.IsValidID(id) || !validUploadTokenRegex.MatchString(token) {
+		return 0, ErrUploadNotFound
+	}
+	f, err := os.OpenFile(filepath.Join(c.config.ClipboardDir, uploadsDir, id+":"+token), os.O_WRONLY, c.config.FileMode)
+	if err != nil {
+		return 0, ErrUploadNotFound
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	} else if stat.Size() != offset {
+		return stat.Size(), ErrUploadOffsetMismatch
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	fileSizeLimiter := util.NewLimiter(fileSizeLimit)
+	fileSizeLimiter.Set(offset)
+	written, err := io.Copy(util.NewLimitWriter(f, fileSizeLimiter), r)
+	if err != nil {
+		f.Truncate(offset) // Discard the partial chunk, so the client can retry it
+		return offset, err
+	}
+	return offset + written, nil
+}
+
+// OpenUpload opens the pending upload for the given file ID for reading, e.g. to detect its content type
+// before it is committed
+func (c *Clipboard) OpenUpload(id string) (io.ReadCloser, error) {
+	file, err := c.uploadFilename(id)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(file)
+}
+
+// CommitUpload turns the pending upload for the given file ID into a clipboard entry with the given metadata.
+// Like WriteFileWithLimit, it observes the given per-file size limit and the total clipboard size limit. If
+// compression and encryption are disabled, the partial file is moved into place instead of being copied.
+func (c *Clipboard) CommitUpload(id string, meta *File, fileSizeLimit int64) error {
+	upload, err := c.uploadFilename(id)
+	if err != nil {
+		return err
+	}
+	return c.commitFile(id, upload, meta, fileSizeLimit)
+}
+
+// commitFile turns the given partial file into the clipboard entry with the given ID, see CommitUpload and
+// CreateFile. The partial file is removed in any case.
+func (c *Clipboard) commitFile(id string, upload string, meta *File, fileSizeLimit int64) error {
+	file, metafile, err := c.getFilenames(id)
+	if err != nil {
+		os.Remove(upload)
+		return err
+	}
+	defer os.Remove(upload)
+	if c.config.CompressFiles || c.config.EncryptAtRest {
+		f, err := os.Open(upload)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return c.WriteFileWithLimit(id, meta, f, fileSizeLimit)
+	}
 
+	c.setWriting(id, true)
+	defer c.setWriting(id, false)
+
+	f, err := os.Open(upload)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	lines := newLineCounter(!meta.Binary)
+	length, err := io.Copy(io.MultiWriter(hash, lines), f)
+	if err != nil {
+		return err
+	}
+	if fileSizeLimit > 0 && length > fileSizeLimit {
+		return util.ErrLimitReached
+	} else if err := c.sizeLimiter.Add(length); err != nil {
+		return err
+	}
+	pending := *meta
+	pending.Pending = true
+	if err := writeMeta(metafile, &pending, c.config.FileMode); err != nil {
+		c.sizeLimiter.Sub(length)
+		return err
+	}
+	if err := os.Rename(upload, file); err != nil {
+		c.sizeLimiter.Sub(length)
+		os.Remove(metafile)
+		return err
+	}
+	complete := *meta
+	complete.Length = length
+	complete.Checksum = hex.EncodeToString(hash.Sum(nil))
+	complete.Lines = lines.Lines()
+	if err := writeMeta(metafile, &complete, c.config.FileMode); err != nil {
+		c.DeleteFile(id)
+		return err
+	}
 	return nil
 }
 
+// CreateFile returns a writer for the clipboard entry with the given ID, so that content can be written in chunks.
+// The content is written to a partial file first, and only becomes the entry (with the given metadata) when the
+// writer is closed, just like a committed upload (see CommitUpload). If the per-file size limit defined in the
+// config is reached, the write fails with util.ErrLimitReached, and closing the writer discards the content. If the
+// writer is never closed, the partial file is deleted by ExpireUploads. Use OpenFile to read the entry.
+func (c *Clipboard) CreateFile(id string, meta *File) (io.WriteCloser, error) {
+	if !c.IsValidID(id) {
+		return nil, ErrInvalidFileID
+	}
+	dir := filepath.Join(c.config.ClipboardDir, uploadsDir)
+	if err := os.MkdirAll(dir, c.config.DirMode); err != nil {
+		return nil, storageError(err)
+	}
+	// The leading dot keeps the partial file apart from resumable uploads, since IDs cannot start with a dot
+	f, err := ioutil.TempFile(dir, "."+id+":*")
+	if err != nil {
+		return nil, storageError(err)
+	}
+	if err := f.Chmod(c.config.FileMode); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, storageError(err)
+	}
+	return &fileWriter{
+		f:             f,
+		c:             c,
+		id:            id,
+		meta:          meta,
+		fileSizeLimit: c.config.FileSizeLimit,
+		limitWriter:   util.NewLimitWriter(f, util.NewLimiter(c.config.FileSizeLimit)),
+	}, nil
+}
+
+// ExpireUploads deletes pending uploads that have not received a chunk for the given duration. This includes
+// the partial files of writers returned by CreateFile that were never closed.
+func (c *Clipboard) ExpireUploads(maxAge time.Duration) error {
+	files, err := ioutil.ReadDir(filepath.Join(c.config.ClipboardDir, uploadsDir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if time.Since(f.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.config.ClipboardDir, uploadsDir, f.Name())); err != nil {
+			log.Printf("failed to remove stale upload: %s", err.Error())
+			continue
+		}
+		log.Printf("removed stale upload: %s", c.logID(strings.TrimPrefix(strings.Split(f.Name(), ":")[0], ".")))
+	}
+	return nil
+}
+
+// Verify checks whether the content of the given file matches the length and checksum recorded in its metadata
+// file. If it does not, or if the file was never completely written (e.g. the server crashed during an upload),
+// ErrFileCorrupt is returned. Pipes and files without checksum (i.e. files written by older versions) are
+// not verified.
+func (c *Clipboard) Verify(meta *File) error {
+	if meta.Pipe || c.isWriting(meta.ID) {
+		return nil
+	} else if meta.Pending {
+		return ErrFileCorrupt
+	} else if meta.Checksum == "" {
+		return nil
+	} else if meta.Size != meta.Length {
+		return ErrFileCorrupt
+	}
+	// For compressed and encrypted files, any error while decompressing or decrypting means that the file is corrupt
+	rc, err := c.OpenFile(meta.ID)
+	if err != nil && (meta.Compressed || meta.Encrypted) {
+		return ErrFileCorrupt
+	} else if err != nil {
+		return err
+	}
+	defer rc.Close()
+	hash := sha256.New()
+	length, err := io.Copy(hash, rc)
+	if err != nil && (meta.Compressed || meta.Encrypted) {
+		return ErrFileCorrupt
+	} else if err != nil {
+		return err
+	}
+	if length != meta.Length || hex.EncodeToString(hash.Sum(nil)) != meta.Checksum {
+		return ErrFileCorrupt
+	}
+	return nil
+}
+
+// SearchMatch is a file whose content contains the search query, see Search
+type SearchMatch struct {
+	File    *File
+	Snippet string // Text around the first occurrence of the query, newlines replaced by spaces
+}
+
+// Search returns all text files that contain the given query (case-sensitive). Only the first maxBytes of each
+// file are searched. Streams, reserved and pending files, as well as files whose content type is not textual (or
+// whose content is not valid UTF-8, if they have no content type) are skipped. If ctx is done before all files
+// are searched, the matches found so far are returned along with the context's error.
+func (c *Clipboard) Search(ctx context.Context, query string, maxBytes int64) ([]*SearchMatch, error) {
+	files, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]*SearchMatch, 0)
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return matches, err
+		}
+		if f.Pipe || f.Reserved || f.Pending || (f.Type != "" && !IsText(f.Type)) {
+			continue
+		}
+		content, err := c.readHead(f.ID, maxBytes)
+		if err != nil {
+			log.Printf("cannot search %s: %s", c.logID(f.ID), err.Error())
+			continue
+		} else if f.Type == "" && !utf8.Valid(trimIncompleteRune(content)) {
+			continue
+		}
+		if i := bytes.Index(content, []byte(query)); i != -1 {
+			matches = append(matches, &SearchMatch{File: f, Snippet: snippet(content, i, len(query))})
+		}
+	}
+	return matches, nil
+}
+
+func (c *Clipboard) readHead(id string, maxBytes int64) ([]byte, error) {
+	rc, err := c.OpenFile(id)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(io.LimitReader(rc, maxBytes))
+}
+
+// IsText returns true if the given content type (as stored in the metadata file) is text-based, i.e. "text/*",
+// a "+json" or "+xml" type, or one of the textual application types
+func IsText(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml") || textContentTypes[mediaType]
+}
+
+// trimIncompleteRune cuts off an incomplete UTF-8 sequence at the end of b, e.g. if it was truncated
+func trimIncompleteRune(b []byte) []byte {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		if utf8.RuneStart(b[len(b)-i]) {
+			if !utf8.FullRune(b[len(b)-i:]) {
+				return b[:len(b)-i]
+			}
+			break
+		}
+	}
+	return b
+}
+
+// snippet returns the text around the match at index i with the given length, cut at rune boundaries
+func snippet(content []byte, i int, length int) string {
+	start, end := i-searchSnippetContext, i+length+searchSnippetContext
+	if start < 0 {
+		start = 0
+	}
+	if end > len(content) {
+		end = len(content)
+	}
+	for start > 0 && !utf8.RuneStart(content[start]) {
+		start++
+	}
+	for end < len(content) && end > start && !utf8.RuneStart(content[end]) {
+		end--
+	}
+	if start >= end {
+		return ""
+	}
+	return strings.Join(strings.Fields(string(content[start:end])), " ")
+}
+
 // MakePipe creates a FIFO pipe that can be used for streaming
 func (c *Clipboard) MakePipe(id string) error {
 	file, _, err := c.getFilenames(id)
 	if err != nil {
 		return err
 	}
-	return unix.Mkfifo(file, 0600)
+	c.setAborted(id, false)
+	return storageError(unix.Mkfifo(file, uint32(c.config.FileMode)))
 }
 
-// ReadFile reads the file content from the clipboard and writes it to w
+// openPipeWithTimeout opens the given pipe for writing, like os.OpenFile, but only waits for a reader for the given
+// duration. Opening a pipe for writing without blocking fails until a reader opened it, so this polls.
+func openPipeWithTimeout(file string, timeout time.Duration) (*os.File, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		fd, err := unix.Open(file, unix.O_WRONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+		if err == nil {
+			if err := unix.SetNonblock(fd, false); err != nil {
+				unix.Close(fd)
+				return nil, err
+			}
+			return os.NewFile(uintptr(fd), file), nil
+		} else if err != unix.ENXIO {
+			return nil, &fs.PathError{Op: "open", Path: file, Err: err}
+		} else if time.Now().After(deadline) {
+			return nil, ErrStreamWaitTimeout
+		}
+		time.Sleep(pipeWaitInterval)
+	}
+}
+
+// unblockPipe briefly opens the given pipe for reading without blocking. This wakes up a writer that is
+// blocked opening the pipe, which then fails writing to it as soon as the pipe is closed again.
+func unblockPipe(file string) {
+	if f, err := os.OpenFile(file, os.O_RDONLY|unix.O_NONBLOCK, 0); err == nil {
+		f.Close()
+	}
+}
+
+// ReadFile reads the file content from the clipboard and writes it to w. Compressed files are decompressed.
+// If the file is a pipe and its producer failed while writing, ErrStreamAborted is returned.
 func (c *Clipboard) ReadFile(id string, w io.Writer) error {
-	file, _, err := c.getFilenames(id)
+	rc, err := c.OpenFile(id)
 	if err != nil {
 		return err
 	}
+	defer rc.Close()
+
+	_, err = io.Copy(w, rc)
+	if c.takeAborted(id) {
+		return ErrStreamAborted // Encrypted pipes fail with an error instead of EOF, since the last chunk is missing
+	}
+	return err
+}
+
+// ReadFileRaw reads the file content as it is stored on disk, i.e. without decompressing it, and writes it to w.
+// For files stored with CompressFiles enabled, this is the gzip-compressed content. Encrypted files are decrypted.
+func (c *Clipboard) ReadFileRaw(id string, w io.Writer) error {
+	rc, err := c.openFile(id, false)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+// OpenFile opens the file content for reading. Compressed files are transparently decompressed, and encrypted
+// files are transparently decrypted.
+func (c *Clipboard) OpenFile(id string) (io.ReadCloser, error) {
+	return c.openFile(id, true)
+}
+
+func (c *Clipboard) openFile(id string, decompress bool) (io.ReadCloser, error) {
+	file, metafile, err := c.getFilenames(id)
+	if err != nil {
+		return nil, err
+	}
+	// The metadata file is opened first: if the file is a pipe whose producer fails, the metadata file is deleted
+	// right after the pipe is opened, but it can still be read through the open handle
+	mf, _ := os.Open(metafile)
 	f, err := os.Open(file)
+	if err != nil {
+		if mf != nil {
+			mf.Close()
+		}
+		return nil, err
+	}
+	meta := readMeta(mf, metafile)
+	var r io.Reader = f
+	if meta.Encrypted {
+		nonce, err := hex.DecodeString(meta.Nonce)
+		if err != nil {
+			f.Close()
+			return nil, ErrFileCorrupt
+		} else if c.atRestKey == nil {
+			f.Close()
+			return nil, errAtRestKeyMissing
+		}
+		if r, err = crypto.NewDecryptReader(f, c.atRestKey, nonce); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if decompress && meta.Compressed {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &gzipReadCloser{gz, f}, nil
+	} else if meta.Encrypted {
+		return &decryptReadCloser{r, f}, nil
+	}
+	return f, nil
+}
+
+// readMeta reads the metadata file from the given handle, or opens it if the handle is nil. Missing or unreadable
+// metadata files are treated as uncompressed and unencrypted.
+func readMeta(mf *os.File, metafile string) *File {
+	if mf == nil {
+		var err error
+		if mf, err = os.Open(metafile); err != nil {
+			return &File{}
+		}
+	}
+	defer mf.Close()
+	var meta File
+	if err := json.NewDecoder(mf).Decode(&meta); err != nil {
+		return &File{}
+	}
+	return &meta
+}
+
+type decryptReadCloser struct {
+	io.Reader
+	f *os.File
+}
+
+func (r *decryptReadCloser) Close() error {
+	return r.f.Close()
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (r *gzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.f.Close()
+}
+
+func (c *Clipboard) setWriting(id string, writing bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if writing {
+		c.writing[id] = true
+	} else {
+		delete(c.writing, id)
+	}
+}
+
+func (c *Clipboard) isWriting(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writing[id]
+}
+
+func (c *Clipboard) setAborted(id string, aborted bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if aborted {
+		c.aborted[id] = true
+	} else {
+		delete(c.aborted, id)
+	}
+}
+
+// takeAborted returns true if the producer of the given pipe failed, and resets the flag
+func (c *Clipboard) takeAborted(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	aborted := c.aborted[id]
+	delete(c.aborted, id)
+	return aborted
+}
+
+// appendedChan returns a channel that is closed the next time content is appended to the given entry
+func (c *Clipboard) appendedChan(id string) chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.appended[id]
+	if !ok {
+		ch = make(chan struct{})
+		c.appended[id] = ch
+	}
+	return ch
+}
+
+// notifyAppended wakes up all followers of the given entry, see FollowFile
+func (c *Clipboard) notifyAppended(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch, ok := c.appended[id]; ok {
+		close(ch)
+		delete(c.appended, id)
+	}
+}
+
+// appendWriter notifies the followers of an entry after every write, see AppendFile
+type appendWriter struct {
+	f  *os.File
+	c  *Clipboard
+	id string
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.c.notifyAppended(w.id)
+	return n, err
+}
+
+// fileWriter writes the content of an entry to a partial file, and commits it when it is closed, see CreateFile
+type fileWriter struct {
+	f             *os.File
+	c             *Clipboard
+	id            string
+	meta          *File
+	fileSizeLimit int64
+	limitWriter   io.Writer
+	err           error // First write error; the content is discarded on Close if set
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.limitWriter.Write(p)
+	if err != nil {
+		w.err = storageError(err)
+	}
+	return n, w.err
+}
+
+func (w *fileWriter) Close() error {
+	if w.f == nil {
+		return os.ErrClosed
+	}
+	name := w.f.Name()
+	err := w.f.Close()
+	w.f = nil
+	if w.err != nil {
+		os.Remove(name)
+		return w.err
+	} else if err != nil {
+		os.Remove(name)
+		return storageError(err)
+	}
+	return w.c.commitFile(w.id, name, w.meta, w.fileSizeLimit)
+}
+
+// lineCounter is a writer that counts the lines of the content written to it, including a last line without a
+// trailing newline. Counting can be disabled, e.g. for binary content, in which case it discards everything.
+type lineCounter struct {
+	enabled bool
+	lines   int64
+	partial bool // True if the content written so far ends in the middle of a line
+}
+
+func newLineCounter(enabled bool) *lineCounter {
+	return &lineCounter{enabled: enabled}
+}
+
+func (l *lineCounter) Write(p []byte) (int, error) {
+	if l.enabled && len(p) > 0 {
+		l.lines += int64(bytes.Count(p, []byte{'\n'}))
+		l.partial = p[len(p)-1] != '\n'
+	}
+	return len(p), nil
+}
+
+// Lines returns the number of lines written so far, or 0 if counting is disabled
+func (l *lineCounter) Lines() int64 {
+	if l.partial {
+		return l.lines + 1
+	}
+	return l.lines
+}
+
+func writeMeta(metafile string, meta *File, perm os.FileMode) error {
+	mf, err := os.OpenFile(metafile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	if err := json.NewEncoder(mf).Encode(meta); err != nil {
+		mf.Close()
+		return err
+	}
+	return mf.Close() // Writes may only fail when the file is closed, e.g. if the disk is full
+}
 
-	_, err = io.Copy(w, f)
+// storageError translates errors caused by a full or unwritable clipboard directory to ErrStorageFull or
+// ErrStorageNotWritable, so that callers do not have to deal with OS-specific errors. Other errors are
+// returned as they are.
+func storageError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return ErrStorageFull
+	} else if errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EROFS) {
+		return ErrStorageNotWritable
+	}
 	return err
 }
 
+// FreeSpace returns the number of bytes available to the server in the clipboard directory
+func (c *Clipboard) FreeSpace() (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(c.config.ClipboardDir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
 func (c *Clipboard) getFilenames(id string) (string, string, error) {
-	if !c.isValidID(id) {
+	if !c.IsValidID(id) {
 		return "", "", ErrInvalidFileID
 	}
-	file := fmt.Sprintf("%s/%s", c.config.ClipboardDir, id)
+	file := fmt.Sprintf("%s/%s", c.shardDir(id), id)
 	return file, file + metaFileSuffix, nil
 }
 
-func (c *Clipboard) isValidID(id string) bool {
-	if !validIDRegex.MatchString(id) {
+// shardDir returns the directory in which the file with the given ID is stored: the clipboard directory, or if
+// config.ShardDir is enabled, one of its subdirectories, named after the first byte of the hash of the ID
+func (c *Clipboard) shardDir(id string) string {
+	if !c.config.ShardDir {
+		return c.config.ClipboardDir
+	}
+	hash := sha256.Sum256([]byte(id))
+	return filepath.Join(c.config.ClipboardDir, hex.EncodeToString(hash[:1]))
+}
+
+// readDir lists the clipboard files and metadata files, i.e. the contents of the clipboard directory, or of all
+// shard directories if config.ShardDir is enabled. Directories are included, but never contain clipboard files.
+func (c *Clipboard) readDir() ([]os.FileInfo, error) {
+	if !c.config.ShardDir {
+		return ioutil.ReadDir(c.config.ClipboardDir)
+	}
+	files := make([]os.FileInfo, 0)
+	for i := 0; i < shardCount; i++ {
+		shardFiles, err := ioutil.ReadDir(filepath.Join(c.config.ClipboardDir, fmt.Sprintf("%02x", i)))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, shardFiles...)
+	}
+	return files, nil
+}
+
+// reshard creates the shard directories if config.ShardDir is enabled, and moves existing files into the directory
+// they belong in (see shardDir). This way, the option can be enabled (or disabled) for an existing clipboard: files
+// written with the other setting are moved into (or out of) the shard directories once, when the clipboard is created.
+//
+// Files whose ID looks like a shard directory (e.g. "ab") are in the way of that directory in the clipboard
+// directory, so they are moved aside (see reshardPrefix) before the shard directories are created, or until
+// they have been removed.
+func (c *Clipboard) reshard() error {
+	entries, err := ioutil.ReadDir(c.config.ClipboardDir)
+	if err != nil {
+		return err
+	}
+	moved := 0
+	if c.config.ShardDir {
+		for _, f := range entries {
+			if !f.IsDir() && shardDirRegex.MatchString(f.Name()) {
+				if err := os.Rename(filepath.Join(c.config.ClipboardDir, f.Name()), filepath.Join(c.config.ClipboardDir, reshardPrefix+f.Name())); err != nil {
+					return err
+				}
+			}
+		}
+		for i := 0; i < shardCount; i++ {
+			if err := os.MkdirAll(filepath.Join(c.config.ClipboardDir, fmt.Sprintf("%02x", i)), c.config.DirMode); err != nil {
+				return err
+			}
+		}
+		for _, f := range entries {
+			name := strings.TrimPrefix(f.Name(), reshardPrefix)
+			id := strings.TrimSuffix(name, metaFileSuffix)
+			if f.IsDir() || !IsValidID(id) {
+				continue
+			}
+			from := filepath.Join(c.config.ClipboardDir, f.Name())
+			if shardDirRegex.MatchString(f.Name()) {
+				from = filepath.Join(c.config.ClipboardDir, reshardPrefix+f.Name()) // Moved aside above
+			}
+			if err := os.Rename(from, filepath.Join(c.shardDir(id), name)); err != nil {
+				return err
+			}
+			moved++
+		}
+	} else {
+		for _, d := range entries {
+			if !d.IsDir() || !shardDirRegex.MatchString(d.Name()) {
+				continue
+			}
+			shard := filepath.Join(c.config.ClipboardDir, d.Name())
+			files, err := ioutil.ReadDir(shard)
+			if err != nil {
+				return err
+			}
+			for _, f := range files {
+				to := filepath.Join(c.config.ClipboardDir, f.Name())
+				if shardDirRegex.MatchString(f.Name()) {
+					to = filepath.Join(c.config.ClipboardDir, reshardPrefix+f.Name()) // The shard directory may still exist
+				}
+				if err := os.Rename(filepath.Join(shard, f.Name()), to); err != nil {
+					return err
+				}
+				moved++
+			}
+			os.Remove(shard) // Only removed if empty
+		}
+		aside, err := ioutil.ReadDir(c.config.ClipboardDir)
+		if err != nil {
+			return err
+		}
+		for _, f := range aside {
+			if f.IsDir() || !strings.HasPrefix(f.Name(), reshardPrefix) {
+				continue
+			}
+			if err := os.Rename(filepath.Join(c.config.ClipboardDir, f.Name()), filepath.Join(c.config.ClipboardDir, strings.TrimPrefix(f.Name(), reshardPrefix))); err != nil {
+				return err
+			}
+		}
+	}
+	if moved > 0 {
+		log.Printf("moved %d clipboard file(s) to match the ShardDir setting", moved)
+	}
+	return nil
+}
+
+// uploadFilename returns the name of the partial file of the pending upload for the given file ID
+func (c *Clipboard) uploadFilename(id string) (string, error) {
+	if !c.IsValidID(id) {
+		return "", ErrInvalidFileID
+	}
+	matches, err := filepath.Glob(filepath.Join(c.config.ClipboardDir, uploadsDir, id+":*"))
+	if err != nil {
+		return "", err
+	} else if len(matches) == 0 {
+		return "", ErrUploadNotFound
+	}
+	return matches[0], nil
+}
+
+// IsValidID returns true if the given ID is a valid file ID for this clipboard: in addition to the checks of the
+// package-level IsValidID, this observes the configured maximum length and pattern, as well as the reserved IDs.
+func (c *Clipboard) IsValidID(id string) bool {
+	if !IsValidID(id) || c.reserved[id] {
+		return false
+	} else if c.config.IDMaxLength > 0 && len(id) > c.config.IDMaxLength {
 		return false
 	}
+	return c.idPattern == nil || c.idPattern.MatchString(id)
+}
+
+// logID returns the file ID as it should appear in the log, see RedactID
+func (c *Clipboard) logID(id string) string {
+	if c.config.RedactIDsInLogs {
+		return RedactID(id)
+	}
+	return id
+}
+
+// IsValidID returns true if the given ID consists of valid characters, and is not one of the built-in reserved
+// identifiers. The config (length, pattern and reserved IDs) is not considered, see Clipboard.IsValidID.
+func IsValidID(id string) bool {
+	return validIDRegex.MatchString(id) && !isReservedFile(id)
+}
+
+func isReservedFile(id string) bool {
 	for _, reserved := range reservedFiles {
 		if id == reserved {
-			return false
+			return true
 		}
 	}
-	return true
+	return false
+}
+
+// RedactID returns a short, stable hash of the given file ID that can be logged instead of the ID itself,
+// so that requests for the same file can be correlated without revealing the ID
+func RedactID(id string) string {
+	hash := sha256.Sum256([]byte(id))
+	return "id-" + hex.EncodeToString(hash[:4])
 }
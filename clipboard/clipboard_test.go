@@ -2,6 +2,7 @@ package clipboard
 
 import (
 	"bytes"
+	"context"
 	_ "embed" // Required for go:embed instructions
 	"heckel.io/pcopy/clipboard/clipboardtest"
 	"heckel.io/pcopy/config"
@@ -9,8 +10,12 @@ import (
 	"heckel.io/pcopy/test"
 	"heckel.io/pcopy/util"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -60,6 +65,197 @@ func TestClipboard_WriteFile_ReadFile(t *testing.T) {
 	test.StrEquals(t, "7 bytes", buf.String())
 }
 
+func TestClipboard_RedactID(t *testing.T) {
+	test.StrEquals(t, "id-43314422", RedactID("secret-name"))
+	test.StrEquals(t, RedactID("secret-name"), RedactID("secret-name"))
+	test.BoolEquals(t, false, RedactID("secret-name") == RedactID("other-name"))
+}
+
+func TestClipboard_VerifySuccess(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+	meta := &File{Mode: config.FileModeReadWrite, Expires: time.Now().Add(time.Hour).Unix()}
+	clip.WriteFile("sup", meta, io.NopCloser(strings.NewReader("7 bytes")))
+
+	stat, err := clip.Stat("sup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 7, stat.Length)
+	test.StrEquals(t, "b26a752e0dd4206380edc25c3f4fb64be1acec020ed9a88f1b552a2e4ea6d4ca", stat.Checksum)
+	if err := clip.Verify(stat); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClipboard_VerifyCorrupt(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+	meta := &File{Mode: config.FileModeReadWrite, Expires: time.Now().Add(time.Hour).Unix()}
+	clip.WriteFile("sup", meta, io.NopCloser(strings.NewReader("7 bytes")))
+
+	file, _, _ := clip.getFilenames("sup")
+	ioutil.WriteFile(file, []byte("7 bytez"), 0600)
+	stat, _ := clip.Stat("sup")
+	if err := clip.Verify(stat); err != ErrFileCorrupt {
+		t.Fatalf("expected ErrFileCorrupt, got %#v", err)
+	}
+
+	ioutil.WriteFile(file, []byte("7 b"), 0600)
+	stat, _ = clip.Stat("sup")
+	if err := clip.Verify(stat); err != ErrFileCorrupt {
+		t.Fatalf("expected ErrFileCorrupt, got %#v", err)
+	}
+}
+
+func TestClipboard_VerifyInterruptedWrite(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+
+	file, metafile, _ := clip.getFilenames("sup")
+	ioutil.WriteFile(file, []byte("partial"), 0600)
+	ioutil.WriteFile(metafile, []byte(`{"mode":"rw","pending":true}`), 0600)
+	stat, _ := clip.Stat("sup")
+	if err := clip.Verify(stat); err != ErrFileCorrupt {
+		t.Fatalf("expected ErrFileCorrupt, got %#v", err)
+	}
+
+	ioutil.WriteFile(metafile, []byte(`{"mode":"rw"}`), 0600) // Written by older version, cannot be verified
+	stat, _ = clip.Stat("sup")
+	if err := clip.Verify(stat); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClipboard_WriteFileCompressed(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.CompressFiles = true
+	clip, _ := New(conf)
+	content := strings.Repeat("this compresses really well. ", 100)
+	meta := &File{Mode: config.FileModeReadWrite, Expires: time.Now().Add(time.Hour).Unix()}
+	if err := clip.WriteFile("sup", meta, io.NopCloser(strings.NewReader(content))); err != nil {
+		t.Fatal(err)
+	}
+
+	file, _, _ := clip.getFilenames("sup")
+	raw, _ := ioutil.ReadFile(file)
+	test.BoolEquals(t, true, bytes.HasPrefix(raw, []byte{0x1f, 0x8b})) // gzip magic bytes
+	test.BoolEquals(t, true, len(raw) < len(content))
+
+	stat, err := clip.Stat("sup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.BoolEquals(t, true, stat.Compressed)
+	test.Int64Equals(t, int64(len(content)), stat.Size)
+	if err := clip.Verify(stat); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	clip.ReadFile("sup", &buf)
+	test.StrEquals(t, content, buf.String())
+
+	buf.Reset()
+	clip.ReadFileRaw("sup", &buf)
+	test.BytesEquals(t, raw, buf.Bytes())
+}
+
+func TestClipboard_WriteFileCompressedSizeLimit(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.CompressFiles = true
+	conf.FileSizeLimit = 100
+	clip, _ := New(conf)
+	meta := &File{Mode: config.FileModeReadWrite, Expires: time.Now().Add(time.Hour).Unix()}
+	err := clip.WriteFile("sup", meta, io.NopCloser(strings.NewReader(strings.Repeat("a", 200)))) // Compresses to <100 bytes
+	if err != util.ErrLimitReached {
+		t.Fatalf("expected ErrLimitReached, got %#v", err)
+	}
+}
+
+func TestClipboard_ReadFileAfterTogglingCompression(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+	meta := &File{Mode: config.FileModeReadWrite, Expires: time.Now().Add(time.Hour).Unix()}
+	clip.WriteFile("plain", meta, io.NopCloser(strings.NewReader("stored as is")))
+	conf.CompressFiles = true
+	clip.WriteFile("gzipped", meta, io.NopCloser(strings.NewReader("stored compressed")))
+	conf.CompressFiles = false
+
+	var buf bytes.Buffer
+	clip.ReadFile("plain", &buf)
+	test.StrEquals(t, "stored as is", buf.String())
+	buf.Reset()
+	clip.ReadFile("gzipped", &buf)
+	test.StrEquals(t, "stored compressed", buf.String())
+}
+
+func TestClipboard_VerifyCorruptCompressed(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.CompressFiles = true
+	clip, _ := New(conf)
+	meta := &File{Mode: config.FileModeReadWrite, Expires: time.Now().Add(time.Hour).Unix()}
+	clip.WriteFile("sup", meta, io.NopCloser(strings.NewReader("some compressed bytes")))
+
+	file, _, _ := clip.getFilenames("sup")
+	raw, _ := ioutil.ReadFile(file)
+	ioutil.WriteFile(file, raw[:len(raw)-4], 0600) // Truncated
+	stat, _ := clip.Stat("sup")
+	if err := clip.Verify(stat); err != ErrFileCorrupt {
+		t.Fatalf("expected ErrFileCorrupt, got %#v", err)
+	}
+
+	ioutil.WriteFile(file, []byte("not gzip at all"), 0600)
+	stat, _ = clip.Stat("sup")
+	if err := clip.Verify(stat); err != ErrFileCorrupt {
+		t.Fatalf("expected ErrFileCorrupt, got %#v", err)
+	}
+}
+
+func TestClipboard_WriteLink(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+	meta := &File{Mode: config.FileModeReadWrite, Expires: time.Now().Add(time.Hour).Unix()}
+	clip.WriteFile("target", meta, io.NopCloser(strings.NewReader("linked content")))
+
+	linkMeta := &File{Mode: config.FileModeReadOnly, Expires: time.Now().Add(2 * time.Hour).Unix()}
+	if err := clip.WriteLink("alias", "target", linkMeta); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := clip.Stat("alias")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "target", stat.Link)
+	test.Int64Equals(t, 0, stat.Size)
+	test.Int64Equals(t, linkMeta.Expires, stat.Expires)
+	test.StrEquals(t, "target", stat.Target.ID)
+	test.Int64Equals(t, 14, stat.Target.Size)
+
+	// No chains, and the alias does not count towards the clipboard size
+	if err := clip.WriteLink("alias2", "alias", linkMeta); err != ErrLinkChain {
+		t.Fatalf("expected ErrLinkChain, got %v", err)
+	}
+	if err := clip.WriteLink("self", "self", linkMeta); err != ErrLinkChain {
+		t.Fatalf("expected ErrLinkChain, got %v", err)
+	}
+	if err := clip.WriteLink("alias3", "missing", linkMeta); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+	stats, _ := clip.Stats()
+	test.Int64Equals(t, 14, stats.Size)
+
+	// Target is gone
+	clip.DeleteFile("target")
+	stat, err = clip.Stat("alias")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Target != nil {
+		t.Fatalf("expected no target, got %v", stat.Target)
+	}
+}
+
 func TestClipboard_Stats(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	clip, _ := New(conf)
@@ -84,6 +280,21 @@ func TestClipboard_Allow(t *testing.T) {
 	test.BoolEquals(t, false, clip.Allow())
 }
 
+func TestClipboard_Fits(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ClipboardCountLimit = 2
+	conf.ClipboardSizeLimit = 10
+	clip, _ := New(conf)
+
+	clip.WriteFile("one", &File{Mode: config.FileModeReadWrite}, io.NopCloser(strings.NewReader("7 bytes")))
+	clip.Stats()
+	test.BoolEquals(t, true, clip.Fits(1, 3))
+	test.BoolEquals(t, false, clip.Fits(1, 4))
+	test.BoolEquals(t, false, clip.Fits(2, 0))
+	test.BoolEquals(t, true, clip.Allow()) // Fits does not count
+	test.BoolEquals(t, false, clip.Fits(1, 0))
+}
+
 func TestClipboard_Expire(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	clip, _ := New(conf)
@@ -94,7 +305,12 @@ func TestClipboard_Expire(t *testing.T) {
 	stat, _ := clip.Stat("sup")
 	test.StrEquals(t, "sup", stat.ID)
 
-	clip.Expire()
+	expired, err := clip.Expire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 1, int64(len(expired)))
+	test.StrEquals(t, "sup", expired[0].ID)
 
 	stat, _ = clip.Stat("sup")
 	if stat != nil {
@@ -102,6 +318,320 @@ func TestClipboard_Expire(t *testing.T) {
 	}
 }
 
+func TestClipboard_PurgeOrphans(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+
+	meta := &File{Mode: config.FileModeReadWrite}
+	clip.WriteFile("complete", meta, io.NopCloser(strings.NewReader("complete")))
+	ioutil.WriteFile(filepath.Join(conf.ClipboardDir, "nometa"), []byte("no meta"), 0600)
+	ioutil.WriteFile(filepath.Join(conf.ClipboardDir, "nofile:meta"), []byte(`{"mode":"rw"}`), 0600)
+
+	purged, err := clip.PurgeOrphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(purged)
+	test.StrEquals(t, "nofile nometa", strings.Join(purged, " "))
+	test.FileNotExist(t, filepath.Join(conf.ClipboardDir, "nometa"))
+	test.FileNotExist(t, filepath.Join(conf.ClipboardDir, "nofile:meta"))
+	clipboardtest.Content(t, conf, "complete", "complete")
+
+	usage, err := clip.DiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := os.Stat(filepath.Join(conf.ClipboardDir, "complete:meta"))
+	test.Int64Equals(t, int64(len("complete"))+stat.Size(), usage)
+}
+
+func TestClipboard_WriteFileWithFileModeAndDirMode(t *testing.T) {
+	umask := syscall.Umask(0)
+	syscall.Umask(umask)
+
+	_, conf := configtest.NewTestConfig(t)
+	conf.ClipboardDir = filepath.Join(conf.ClipboardDir, "sub")
+	conf.ShardDir = true
+	conf.FileMode = 0640
+	conf.DirMode = 0750
+	clip, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clip.WriteFile("file1", &File{Mode: config.FileModeReadWrite}, io.NopCloser(strings.NewReader("shared"))); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct {
+		path string
+		mode os.FileMode
+	}{
+		{conf.ClipboardDir, 0750},
+		{clip.shardDir("file1"), 0750},
+		{filepath.Join(clip.shardDir("file1"), "file1"), 0640},
+		{filepath.Join(clip.shardDir("file1"), "file1:meta"), 0640},
+	} {
+		stat, err := os.Stat(f.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.Int64Equals(t, int64(f.mode&^os.FileMode(umask)), int64(stat.Mode().Perm()))
+	}
+}
+
+func TestClipboard_ShardDir(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+	clip.WriteFile("flat", &File{Mode: config.FileModeReadWrite}, io.NopCloser(strings.NewReader("written flat")))
+
+	// Enabling the option moves existing files into the shard directories
+	conf.ShardDir = true
+	clip, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.FileNotExist(t, filepath.Join(conf.ClipboardDir, "flat"))
+	test.FileExist(t, filepath.Join(clip.shardDir("flat"), "flat"))
+	test.FileExist(t, filepath.Join(clip.shardDir("flat"), "flat:meta"))
+	test.FileExist(t, filepath.Join(conf.ClipboardDir, "ff"))
+
+	clip.WriteFile("sharded", &File{Mode: config.FileModeReadWrite, Expires: time.Now().Add(-time.Minute).Unix()}, io.NopCloser(strings.NewReader("written sharded")))
+	test.FileExist(t, filepath.Join(clip.shardDir("sharded"), "sharded"))
+	var buf bytes.Buffer
+	if err := clip.ReadFile("flat", &buf); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "written flat", buf.String())
+	stat, err := clip.Stat("sharded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 15, stat.Size)
+	files, _ := clip.List()
+	test.Int64Equals(t, 2, int64(len(files)))
+
+	expired, _ := clip.Expire()
+	test.Int64Equals(t, 1, int64(len(expired)))
+	test.StrEquals(t, "sharded", expired[0].ID)
+	test.FileNotExist(t, filepath.Join(clip.shardDir("sharded"), "sharded"))
+
+	// Disabling it again moves them back, and removes the (empty) shard directories
+	conf.ShardDir = false
+	if _, err := New(conf); err != nil {
+		t.Fatal(err)
+	}
+	clipboardtest.Content(t, conf, "flat", "written flat")
+	test.FileNotExist(t, filepath.Join(conf.ClipboardDir, "ff"))
+}
+
+func TestClipboard_ShardDirWithShardLikeIDs(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+	for _, id := range []string{"ab", "ff", "00"} {
+		clip.WriteFile(id, &File{Mode: config.FileModeReadWrite}, io.NopCloser(strings.NewReader("content of "+id)))
+	}
+
+	// Files named like a shard directory do not block the directory
+	conf.ShardDir = true
+	clip, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"ab", "ff", "00"} {
+		test.FileExist(t, filepath.Join(clip.shardDir(id), id))
+		test.FileExist(t, filepath.Join(clip.shardDir(id), id+":meta"))
+		var buf bytes.Buffer
+		if err := clip.ReadFile(id, &buf); err != nil {
+			t.Fatal(err)
+		}
+		test.StrEquals(t, "content of "+id, buf.String())
+	}
+
+	// ... and the shard directories do not block the files when moving them back
+	conf.ShardDir = false
+	if _, err := New(conf); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"ab", "ff", "00"} {
+		clipboardtest.Content(t, conf, id, "content of "+id)
+		test.FileExist(t, filepath.Join(conf.ClipboardDir, id+":meta"))
+	}
+	files, _ := ioutil.ReadDir(conf.ClipboardDir)
+	for _, f := range files {
+		test.BoolEquals(t, false, strings.HasPrefix(f.Name(), reshardPrefix))
+	}
+}
+
+func TestClipboard_ResumableUpload(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+
+	if err := clip.StartUpload("big", "token1"); err != nil {
+		t.Fatal(err)
+	}
+	offset, err := clip.AppendUpload("big", "token1", 0, strings.NewReader("first "), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 6, offset)
+
+	// Chunk at the wrong offset (e.g. a retry of a chunk that was already received) is rejected
+	offset, err = clip.AppendUpload("big", "token1", 0, strings.NewReader("first "), 0)
+	if err != ErrUploadOffsetMismatch {
+		t.Fatalf("expected ErrUploadOffsetMismatch, got %v", err)
+	}
+	test.Int64Equals(t, 6, offset)
+	if _, err := clip.AppendUpload("big", "wrongtoken", 6, strings.NewReader("second"), 0); err != ErrUploadNotFound {
+		t.Fatalf("expected ErrUploadNotFound, got %v", err)
+	}
+	offset, _ = clip.AppendUpload("big", "token1", 6, strings.NewReader("second"), 0)
+	test.Int64Equals(t, 12, offset)
+
+	// The partial upload is not part of the clipboard until it is committed
+	clipboardtest.NotExist(t, conf, "big")
+	files, _ := clip.List()
+	test.Int64Equals(t, 0, int64(len(files)))
+
+	meta := &File{Mode: config.FileModeReadWrite, Expires: time.Now().Add(time.Hour).Unix()}
+	if err := clip.CommitUpload("big", meta, 0); err != nil {
+		t.Fatal(err)
+	}
+	clipboardtest.Content(t, conf, "big", "first second")
+	stat, _ := clip.Stat("big")
+	test.Int64Equals(t, 12, stat.Length)
+	if err := clip.Verify(stat); err != nil {
+		t.Fatal(err)
+	}
+	if err := clip.CommitUpload("big", meta, 0); err != ErrUploadNotFound {
+		t.Fatalf("expected ErrUploadNotFound, got %v", err)
+	}
+}
+
+func TestClipboard_ResumableUploadFileSizeLimit(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+
+	clip.StartUpload("big", "token1")
+	offset, _ := clip.AppendUpload("big", "token1", 0, strings.NewReader("12345678"), 10)
+	test.Int64Equals(t, 8, offset)
+	offset, err := clip.AppendUpload("big", "token1", 8, strings.NewReader("12345"), 10)
+	if err != util.ErrLimitReached {
+		t.Fatalf("expected ErrLimitReached, got %v", err)
+	}
+	test.Int64Equals(t, 8, offset)
+
+	// The rejected chunk was discarded
+	offset, err = clip.AppendUpload("big", "token1", 8, strings.NewReader("12"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 10, offset)
+}
+
+func TestClipboard_CreateFile(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+
+	meta := &File{Mode: config.FileModeReadWrite, Expires: time.Now().Add(time.Hour).Unix()}
+	w, err := clip.CreateFile("chunked", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("first\n"))
+	w.Write([]byte("second"))
+
+	// The entry does not exist until the writer is closed, and a pending upload is not affected
+	clipboardtest.NotExist(t, conf, "chunked")
+	if _, err := clip.OpenUpload("chunked"); err != ErrUploadNotFound {
+		t.Fatalf("expected ErrUploadNotFound, got %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	clipboardtest.Content(t, conf, "chunked", "first\nsecond")
+	stat, _ := clip.Stat("chunked")
+	test.Int64Equals(t, 12, stat.Length)
+	test.Int64Equals(t, 2, stat.Lines)
+	test.BoolEquals(t, false, stat.Pending)
+	if err := w.Close(); err != os.ErrClosed {
+		t.Fatalf("expected os.ErrClosed, got %v", err)
+	}
+
+	r, err := clip.OpenFile("chunked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, _ := ioutil.ReadAll(r)
+	test.StrEquals(t, "first\nsecond", string(b))
+}
+
+func TestClipboard_CreateFileLimitReached(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileSizeLimit = 10
+	clip, _ := New(conf)
+
+	w, _ := clip.CreateFile("big", &File{Mode: config.FileModeReadWrite})
+	w.Write([]byte("12345678"))
+	if _, err := w.Write([]byte("12345")); err != util.ErrLimitReached {
+		t.Fatalf("expected ErrLimitReached, got %v", err)
+	}
+	if err := w.Close(); err != util.ErrLimitReached {
+		t.Fatalf("expected ErrLimitReached, got %v", err)
+	}
+	clipboardtest.NotExist(t, conf, "big")
+}
+
+func TestClipboard_CreateFileNotClosed(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+
+	w, _ := clip.CreateFile("abandoned", &File{Mode: config.FileModeReadWrite})
+	w.Write([]byte("some bytes"))
+	if err := clip.ExpireUploads(0); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(conf.ClipboardDir, uploadsDir))
+	test.Int64Equals(t, 0, int64(len(files)))
+	clipboardtest.NotExist(t, conf, "abandoned")
+}
+
+func TestClipboard_ExpireUploads(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+
+	clip.StartUpload("stale", "token1")
+	clip.AppendUpload("stale", "token1", 0, strings.NewReader("some bytes"), 0)
+	if err := clip.ExpireUploads(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	f, err := clip.OpenUpload("stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := clip.ExpireUploads(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clip.OpenUpload("stale"); err != ErrUploadNotFound {
+		t.Fatalf("expected ErrUploadNotFound, got %v", err)
+	}
+}
+
+func TestClipboard_ReservedIDsFromConfig(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ReservedIDs = []string{"health", "admin"}
+	clip, _ := New(conf)
+	test.BoolEquals(t, false, clip.IsValidID("health"))
+	test.BoolEquals(t, false, clip.IsValidID("admin"))
+	test.BoolEquals(t, true, clip.IsValidID("healthy"))
+	test.BoolEquals(t, true, clip.IsReserved("robots.txt"))
+
+	err := clip.WriteFile("health", &File{}, io.NopCloser(strings.NewReader("ok")))
+	if err != ErrInvalidFileID {
+		t.Fatalf("expected ErrInvalidFileID, got %v", err)
+	}
+}
+
 func TestClipboard_MakePipe(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	clip, _ := New(conf)
@@ -112,16 +642,379 @@ func TestClipboard_MakePipe(t *testing.T) {
 	test.BoolEquals(t, true, stat.Mode()&os.ModeNamedPipe == os.ModeNamedPipe)
 }
 
+func TestClipboard_WriteFilePipeWaitTimeout(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.StreamWaitTimeout = 200 * time.Millisecond
+	clip, _ := New(conf)
+	clip.MakePipe("sup")
+
+	err := clip.WriteFile("sup", &File{}, io.NopCloser(strings.NewReader("nobody reads this")))
+	if err != ErrStreamWaitTimeout {
+		t.Fatalf("expected ErrStreamWaitTimeout, got %v", err)
+	}
+	file, _, _ := clip.getFilenames("sup")
+	stat, _ := os.Stat(file)
+	test.BoolEquals(t, true, stat == nil)
+}
+
+func TestClipboard_WriteFilePipeWaitTimeoutWithReader(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.StreamWaitTimeout = 5 * time.Second
+	clip, _ := New(conf)
+	clip.MakePipe("sup")
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- clip.WriteFile("sup", &File{}, io.NopCloser(strings.NewReader("someone reads this")))
+	}()
+	time.Sleep(300 * time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := clip.ReadFile("sup", &buf); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "someone reads this", buf.String())
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClipboard_StatPipeWithoutMetaNotDeleted(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+	clip.MakePipe("sup")
+
+	if _, err := clip.Stat("sup"); err == nil {
+		t.Fatalf("expected error, got none")
+	}
+	file, _, _ := clip.getFilenames("sup")
+	stat, _ := os.Stat(file)
+	test.BoolEquals(t, true, stat != nil && stat.Mode()&os.ModeNamedPipe == os.ModeNamedPipe)
+}
+
+func TestClipboard_ReadFilePipeAborted(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileSizeLimit = 10
+	clip, _ := New(conf)
+	clip.MakePipe("sup")
+
+	errs := make(chan error, 1)
+	go func() {
+		content := io.MultiReader(strings.NewReader("0123456789"), strings.NewReader("more than 10 bytes"))
+		errs <- clip.WriteFile("sup", &File{}, io.NopCloser(content))
+	}()
+
+	var buf bytes.Buffer
+	if err := clip.ReadFile("sup", &buf); err != ErrStreamAborted {
+		t.Fatalf("expected ErrStreamAborted, got %v", err)
+	}
+	test.StrEquals(t, "0123456789", buf.String())
+	if err := <-errs; err != util.ErrLimitReached {
+		t.Fatalf("expected ErrLimitReached, got %v", err)
+	}
+
+	// A new pipe with the same ID is not affected
+	clip.MakePipe("sup")
+	go clip.WriteFile("sup", &File{}, io.NopCloser(strings.NewReader("short")))
+	buf.Reset()
+	if err := clip.ReadFile("sup", &buf); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "short", buf.String())
+}
+
+func TestClipboard_WriteFileEncrypted(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.EncryptAtRest = true
+	conf.AtRestKey = bytes.Repeat([]byte{0x86}, 32)
+	for _, compress := range []bool{false, true} {
+		conf.CompressFiles = compress
+		clip, _ := New(conf)
+		content := strings.Repeat("this is a secret ", 100)
+		if err := clip.WriteFile("secret", &File{}, io.NopCloser(strings.NewReader(content))); err != nil {
+			t.Fatal(err)
+		}
+		file, _, _ := clip.getFilenames("secret")
+		raw, _ := ioutil.ReadFile(file)
+		if bytes.Contains(raw, []byte("this is a secret")) {
+			t.Fatalf("expected file to be encrypted on disk")
+		}
+
+		// Size and verification refer to the plaintext
+		stat, _ := clip.Stat("secret")
+		test.BoolEquals(t, true, stat.Encrypted)
+		test.Int64Equals(t, int64(len(content)), stat.Size)
+		if err := clip.Verify(stat); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := clip.ReadFile("secret", &buf); err != nil {
+			t.Fatal(err)
+		}
+		test.StrEquals(t, content, buf.String())
+
+		// Files cannot be read with another key, or if they were modified
+		otherConf := *conf
+		otherConf.AtRestKey = bytes.Repeat([]byte{0x87}, 32)
+		other, _ := New(&otherConf)
+		if err := other.ReadFile("secret", ioutil.Discard); err == nil {
+			t.Fatalf("expected error reading file with wrong key")
+		}
+		raw[len(raw)-1] ^= 0x01
+		ioutil.WriteFile(file, raw, 0600)
+		if err := clip.Verify(stat); err != ErrFileCorrupt {
+			t.Fatalf("expected ErrFileCorrupt, got %v", err)
+		}
+	}
+}
+
+func TestClipboard_NewEncryptAtRestKeyMissing(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.EncryptAtRest = true
+	if _, err := New(conf); err != errAtRestKeyMissing {
+		t.Fatalf("expected errAtRestKeyMissing, got %v", err)
+	}
+}
+
+func TestClipboard_ReadFilePipeEncrypted(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.EncryptAtRest = true
+	conf.AtRestKey = bytes.Repeat([]byte{0x86}, 32)
+	conf.FileSizeLimit = 10
+	clip, _ := New(conf)
+
+	errs := make(chan error, 1)
+	clip.MakePipe("sup")
+	go func() {
+		errs <- clip.WriteFile("sup", &File{}, io.NopCloser(strings.NewReader("short")))
+	}()
+	var buf bytes.Buffer
+	if err := clip.ReadFile("sup", &buf); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "short", buf.String())
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	clip.DeleteFile("sup") // Consumed pipes are removed by the server
+
+	// The producer failed, so the last chunk is missing
+	clip.MakePipe("sup")
+	go func() {
+		content := io.MultiReader(strings.NewReader("0123456789"), strings.NewReader("more than 10 bytes"))
+		errs <- clip.WriteFile("sup", &File{}, io.NopCloser(content))
+	}()
+	_, metafile, _ := clip.getFilenames("sup")
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(metafile); err == nil {
+			break // Like the server, only read once the stream's metadata exists
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	buf.Reset()
+	if err := clip.ReadFile("sup", &buf); err != ErrStreamAborted {
+		t.Fatalf("expected ErrStreamAborted, got %v", err)
+	}
+	test.StrEquals(t, "0123456789", buf.String())
+	if err := <-errs; err != util.ErrLimitReached {
+		t.Fatalf("expected ErrLimitReached, got %v", err)
+	}
+}
+
+func TestClipboard_AppendFile(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileSizeLimit = 10
+	clip, _ := New(conf)
+	meta := &File{Mode: config.FileModeReadWrite, Expires: time.Now().Add(time.Hour).Unix()}
+	if err := clip.AppendFile("log", meta, strings.NewReader("line1\n"), conf.FileSizeLimit, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := clip.AppendFile("log", &File{}, strings.NewReader("line2"), conf.FileSizeLimit, false); err != util.ErrLimitReached {
+		t.Fatalf("expected ErrLimitReached, got %v", err)
+	}
+	if err := clip.AppendFile("log", &File{}, strings.NewReader("abc"), conf.FileSizeLimit, true); err != nil {
+		t.Fatal(err)
+	}
+	clipboardtest.Content(t, conf, "log", "line1\nabc")
+
+	stat, _ := clip.Stat("log")
+	test.BoolEquals(t, false, stat.Appending)
+	test.StrEquals(t, config.FileModeReadWrite, stat.Mode)
+	test.Int64Equals(t, meta.Expires, stat.Expires)
+	test.Int64Equals(t, 9, stat.Length)
+	if err := clip.Verify(stat); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClipboard_AppendFileNotAppendable(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.CompressFiles = true
+	clip, _ := New(conf)
+	meta := &File{Mode: config.FileModeReadWrite, Expires: time.Now().Add(time.Hour).Unix()}
+	clip.WriteFile("compressed", meta, io.NopCloser(strings.NewReader("some content")))
+	if err := clip.AppendFile("compressed", meta, strings.NewReader("more"), 0, false); err != ErrNotAppendable {
+		t.Fatalf("expected ErrNotAppendable, got %v", err)
+	}
+	clip.MakePipe("pipe")
+	if err := clip.AppendFile("pipe", meta, strings.NewReader("more"), 0, false); err != ErrNotAppendable {
+		t.Fatalf("expected ErrNotAppendable, got %v", err)
+	}
+}
+
+func TestClipboard_FollowFile(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+	meta := &File{Mode: config.FileModeReadWrite, Expires: time.Now().Add(time.Hour).Unix()}
+	clip.AppendFile("log", meta, strings.NewReader("line1\n"), 0, false)
+
+	// Two followers, both must receive all appended content
+	results := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			var buf bytes.Buffer
+			if err := clip.FollowFile(context.Background(), "log", &buf); err != nil {
+				t.Error(err)
+			}
+			results <- buf.String()
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	clip.AppendFile("log", meta, strings.NewReader("line2\n"), 0, false)
+	time.Sleep(100 * time.Millisecond)
+	clip.AppendFile("log", meta, strings.NewReader("line3\n"), 0, true)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-results:
+			test.StrEquals(t, "line1\nline2\nline3\n", s)
+		case <-time.After(5 * time.Second):
+			t.Fatal("follower did not return after the entry was closed")
+		}
+	}
+}
+
+func TestClipboard_FollowFileDeleted(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+	meta := &File{Mode: config.FileModeReadWrite, Expires: time.Now().Add(time.Hour).Unix()}
+	clip.AppendFile("log", meta, strings.NewReader("line1\n"), 0, false)
+
+	done := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		clip.FollowFile(context.Background(), "log", &buf)
+		done <- buf.String()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	clip.DeleteFile("log")
+	select {
+	case s := <-done:
+		test.StrEquals(t, "line1\n", s)
+	case <-time.After(time.Second):
+		t.Fatal("follower did not return after the entry was deleted")
+	}
+}
+
+func TestClipboard_Search(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.CompressFiles = true
+	clip, _ := New(conf)
+
+	text := strings.Repeat("lorem ipsum ", 10) + "the needle\nin the haystack" + strings.Repeat(" dolor sit", 10)
+	clip.WriteFile("text", &File{Type: "text/plain; charset=utf-8"}, io.NopCloser(strings.NewReader(text)))
+	clip.WriteFile("json", &File{Type: "application/json"}, io.NopCloser(strings.NewReader(`{"needle":1}`)))
+	clip.WriteFile("binary", &File{Type: "image/png"}, io.NopCloser(strings.NewReader("needle")))
+	clip.WriteFile("invalid-utf8", &File{}, io.NopCloser(strings.NewReader("needle \xff\xfe")))
+	clip.WriteFile("reserved", &File{Reserved: true}, io.NopCloser(strings.NewReader("needle")))
+	clip.WriteFile("far-away", &File{}, io.NopCloser(strings.NewReader(strings.Repeat("x", 300)+"needle")))
+
+	matches, err := clip.Search(context.Background(), "needle", 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 2, int64(len(matches)))
+	test.StrEquals(t, "json", matches[0].File.ID)
+	test.StrEquals(t, `{"needle":1}`, matches[0].Snippet)
+	test.StrEquals(t, "text", matches[1].File.ID)
+	test.StrEquals(t, "lorem ipsum lorem ipsum lorem ipsum the needle in the haystack dolor sit dolor sit dol", matches[1].Snippet)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := clip.Search(ctx, "needle", 50); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestClipboard_WriteFileCountsLines(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+	clip.WriteFile("text", &File{Mode: config.FileModeReadWrite}, io.NopCloser(strings.NewReader("a\nb\n\nc")))
+	clip.WriteFile("trailing", &File{Mode: config.FileModeReadWrite}, io.NopCloser(strings.NewReader("a\nb\n")))
+	clip.WriteFile("binary", &File{Mode: config.FileModeReadWrite, Binary: true}, io.NopCloser(strings.NewReader("a\nb\n")))
+
+	stat, _ := clip.Stat("text")
+	test.Int64Equals(t, 4, stat.Lines)
+	stat, _ = clip.Stat("trailing")
+	test.Int64Equals(t, 2, stat.Lines)
+	stat, _ = clip.Stat("binary")
+	test.Int64Equals(t, 0, stat.Lines)
+}
+
+func TestClipboard_StorageError(t *testing.T) {
+	test.BoolEquals(t, true, storageError(&os.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC}) == ErrStorageFull)
+	test.BoolEquals(t, true, storageError(syscall.EDQUOT) == ErrStorageFull)
+	test.BoolEquals(t, true, storageError(&os.PathError{Op: "open", Path: "x", Err: syscall.EROFS}) == ErrStorageNotWritable)
+	test.BoolEquals(t, true, storageError(io.ErrUnexpectedEOF) == io.ErrUnexpectedEOF)
+	test.BoolEquals(t, true, storageError(nil) == nil)
+}
+
+func TestClipboard_FreeSpace(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	clip, _ := New(conf)
+	free, err := clip.FreeSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.BoolEquals(t, true, free > 0)
+}
+
 func TestClipboard_ValidID(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	clip, _ := New(conf)
-	test.BoolEquals(t, true, clip.isValidID("valid-id"))
-	test.BoolEquals(t, true, clip.isValidID("valid.txt"))
-	test.BoolEquals(t, false, clip.isValidID("robots.txt"))
-	test.BoolEquals(t, false, clip.isValidID("favicon.ico"))
-	test.BoolEquals(t, false, clip.isValidID(""))
-	test.BoolEquals(t, false, clip.isValidID("/hi"))
-	test.BoolEquals(t, false, clip.isValidID("äöüß.txt"))
-	test.BoolEquals(t, false, clip.isValidID(".invalid"))
-	test.BoolEquals(t, false, clip.isValidID("this-is-so-log-that-it-cannot-by-any-possible-reasoning-be-valid-so-this-is-really-rally-invalid-because-it-is-too-long"))
+	test.BoolEquals(t, true, clip.IsValidID("valid-id"))
+	test.BoolEquals(t, true, clip.IsValidID("valid.txt"))
+	test.BoolEquals(t, false, clip.IsValidID("robots.txt"))
+	test.BoolEquals(t, true, clip.IsValidID("favicon.ico"))
+	clip.Reserve("favicon.ico")
+	test.BoolEquals(t, false, clip.IsValidID("favicon.ico"))
+	test.BoolEquals(t, true, clip.IsReserved("favicon.ico"))
+	test.BoolEquals(t, false, clip.IsValidID(""))
+	test.BoolEquals(t, false, clip.IsValidID("/hi"))
+	test.BoolEquals(t, false, clip.IsValidID("äöüß.txt"))
+	test.BoolEquals(t, false, clip.IsValidID(".invalid"))
+	test.BoolEquals(t, false, clip.IsValidID("this-is-so-log-that-it-cannot-by-any-possible-reasoning-be-valid-so-this-is-really-rally-invalid-because-it-is-too-long"))
+}
+
+func TestClipboard_ValidIDWithMaxLengthAndPattern(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.IDMaxLength = 5
+	conf.IDPattern = "[a-z0-9]+"
+	clip, _ := New(conf)
+	test.BoolEquals(t, true, clip.IsValidID("abc12"))
+	test.BoolEquals(t, false, clip.IsValidID("abc123"))
+	test.BoolEquals(t, false, clip.IsValidID("ABC"))
+	test.BoolEquals(t, false, clip.IsValidID("a.txt"))
+	test.BoolEquals(t, false, clip.IsValidID("ab\x00c"))
+
+	err := clip.WriteFile("ABC", &File{}, io.NopCloser(strings.NewReader("hi")))
+	test.StrEquals(t, ErrInvalidFileID.Error(), err.Error())
+}
+
+func TestClipboard_NewWithInvalidIDPattern(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.IDPattern = "[a-z"
+	if _, err := New(conf); err == nil {
+		t.Fatalf("expected error due to invalid IDPattern, got none")
+	}
 }
@@ -32,6 +32,9 @@ func New() *cli.App {
 			cmdLeave,
 			cmdList,
 			cmdLink,
+			cmdTop,
+			cmdWait,
+			cmdInfo,
 
 			// Server commands
 			cmdServe,
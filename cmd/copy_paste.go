@@ -36,7 +36,7 @@ var cmdCopy = &cli.Command{
 		&cli.BoolFlag{Name: "random", Aliases: []string{"r"}, Usage: "pick random file name and ignore name that has been passed"},
 		&cli.BoolFlag{Name: "read-only", Aliases: []string{"ro"}, Usage: "make remote file read-only (if supported by the server)"},
 		&cli.BoolFlag{Name: "read-write", Aliases: []string{"rw"}, Usage: "allow file to be overwritten (if supported by the server)"},
-		&cli.StringFlag{Name: "ttl", Aliases: []string{"t"}, DefaultText: "server default", Usage: "set duration the link is valid for to `TTL`"},
+		&cli.StringFlag{Name: "ttl", Aliases: []string{"t"}, DefaultText: "server default", Usage: "set duration the link is valid for to `TTL`, or never"},
 	},
 	Description: `Without FILE arguments, this command reads STDIN and copies it to the remote clipboard. ID is
 the remote file name, and CLIPBOARD is the name of the clipboard (both default to 'default').
@@ -130,10 +130,14 @@ func execCopy(c *cli.Context) error {
 	// Set TTL
 	ttl := time.Duration(0)
 	ttlStr := c.String("ttl")
-	if ttlStr != "" {
+	if ttlStr == "never" {
+		ttl = client.TTLNever
+	} else if ttlStr != "" {
 		ttl, err = util.ParseDuration(ttlStr)
 		if err != nil {
 			return err
+		} else if ttl == 0 {
+			ttl = client.TTLNever
 		}
 	}
 
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/pcopy/client"
+	"heckel.io/pcopy/server"
+	"heckel.io/pcopy/util"
+	"io"
+	"net/http"
+	"time"
+)
+
+var cmdInfo = &cli.Command{
+	Name:      "info",
+	Usage:     "Show metadata of a clipboard file",
+	UsageText: "pcopy info [OPTIONS..] [[CLIPBOARD]:[ID]]",
+	Action:    execInfo,
+	Category:  categoryClient,
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "config", Aliases: []string{"c"}, Usage: "load config file from `FILE`"},
+	},
+	Description: `Retrieves and prints the metadata of a clipboard file without downloading it, including
+its mode, size, content type, checksum, and when it was created and will expire.
+
+Examples:
+  pcopy info                 # Shows metadata of the default file in the default clipboard
+  pcopy info work:backup     # Shows metadata of file 'backup' in clipboard 'work'`,
+}
+
+func execInfo(c *cli.Context) error {
+	conf, id, err := parseLinkArgs(c)
+	if err != nil {
+		return err
+	}
+	pclient, err := client.NewClient(conf)
+	if err != nil {
+		return err
+	}
+	meta, err := pclient.Info(id)
+	if httpErr, ok := err.(*server.ErrHTTP); ok && httpErr.Code == http.StatusNotFound {
+		return fmt.Errorf("no such entry: %s", id)
+	} else if err != nil {
+		return err
+	}
+	printFileMetadata(c.App.Writer, meta)
+	return nil
+}
+
+func printFileMetadata(w io.Writer, meta *server.FileMetadata) {
+	size, contentType, checksum, expires := util.BytesToHuman(meta.Size), meta.ContentType, meta.Checksum, "never"
+	if meta.Stream {
+		size = "(stream)"
+	} else if meta.Lines == 1 {
+		size += ", 1 line"
+	} else if meta.Lines > 1 {
+		size += fmt.Sprintf(", %d lines", meta.Lines)
+	}
+	if contentType == "" {
+		contentType = "-"
+	}
+	if checksum == "" {
+		checksum = "-"
+	}
+	if meta.Expires > 0 {
+		expiresAt := time.Unix(meta.Expires, 0)
+		expires = fmt.Sprintf("%s (in %s)", expiresAt.Format(time.RFC3339), util.DurationToHuman(time.Until(expiresAt)))
+	}
+	fmt.Fprintf(w, "ID:           %s\n", meta.ID)
+	fmt.Fprintf(w, "Mode:         %s\n", meta.Mode)
+	fmt.Fprintf(w, "Size:         %s\n", size)
+	fmt.Fprintf(w, "Content type: %s\n", contentType)
+	fmt.Fprintf(w, "Checksum:     %s\n", checksum)
+	fmt.Fprintf(w, "Created:      %s\n", time.Unix(meta.Created, 0).Format(time.RFC3339))
+	fmt.Fprintf(w, "Expires:      %s\n", expires)
+	if meta.DownloadLimit > 0 {
+		fmt.Fprintf(w, "Downloads:    %d of %d\n", meta.Downloads, meta.DownloadLimit)
+	}
+	if meta.Reserved {
+		fmt.Fprintln(w, "Reserved:     yes (waiting for stream)")
+	}
+}
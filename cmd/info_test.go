@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"heckel.io/pcopy/config/configtest"
+	"heckel.io/pcopy/test"
+	"testing"
+)
+
+func TestCLI_InfoSuccess(t *testing.T) {
+	filename, config := configtest.NewTestConfig(t)
+	serverRouter := startTestServerRouter(t, config)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "12345")
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("some text")
+	if err := Run(app, "pcp", "-c", filename, "--ro", "notes"); err != nil {
+		t.Fatal(err)
+	}
+
+	app, _, stdout, _ := newTestApp()
+	if err := Run(app, "pcopy", "info", "-c", filename, "notes"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, stdout.String(), "ID:           notes")
+	test.StrContains(t, stdout.String(), "Mode:         ro")
+	test.StrContains(t, stdout.String(), "Size:         9 B, 1 line")
+	test.StrContains(t, stdout.String(), "Content type: text/plain")
+	test.StrContains(t, stdout.String(), "Checksum:     ")
+}
+
+func TestCLI_InfoNotFound(t *testing.T) {
+	filename, config := configtest.NewTestConfig(t)
+	serverRouter := startTestServerRouter(t, config)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "12345")
+
+	app, _, _, _ := newTestApp()
+	err := Run(app, "pcopy", "info", "-c", filename, "missing")
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	test.StrEquals(t, "no such entry: missing", err.Error())
+}
@@ -91,8 +91,7 @@ func execJoin(c *cli.Context) error {
 			if err != nil {
 				return err
 			}
-			key = crypto.DeriveKey(password, info.Salt)
-			err = pclient.Verify(info.Cert, key)
+			key, err = deriveAndVerifyKey(pclient, info, password)
 			if err != nil {
 				return fmt.Errorf("failed to join clipboard: %s", err.Error())
 			}
@@ -202,6 +201,26 @@ func readPassword(c *cli.Context) ([]byte, error) {
 	return password, nil
 }
 
+// deriveAndVerifyKey derives the key from the password and verifies it against the server. If the server
+// advertises multiple salts (e.g. during key rotation), each of them is tried, starting with the primary salt.
+func deriveAndVerifyKey(pclient *client.Client, info *server.Info, password []byte) (*crypto.Key, error) {
+	salts := [][]byte{info.Salt}
+	if len(info.Salts) > 0 {
+		salts = make([][]byte, 0)
+		for _, s := range info.Salts {
+			salts = append(salts, s.Salt)
+		}
+	}
+	var err error
+	for _, salt := range salts {
+		key := crypto.DeriveKey(password, salt)
+		if err = pclient.Verify(info.Cert, key); err == nil {
+			return key, nil
+		}
+	}
+	return nil, err
+}
+
 func printInstructions(c *cli.Context, configFile string, clipboard string, info *server.Info) {
 	clipboardPrefix := ""
 	if clipboard != config.DefaultClipboard {
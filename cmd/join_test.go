@@ -79,3 +79,29 @@ func TestCLI_JoinWithPasswordAndCopyAndPaste(t *testing.T) {
 	test.StrContains(t, string(content), saltBase64)
 	test.FileExist(t, filepath.Join(configDir, "default.conf"))
 }
+
+func TestCLI_JoinWithOldPasswordDuringKeyRotation(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("new password"), []byte("new salt"))
+	conf.Keys = []*crypto.Key{crypto.DeriveKey([]byte("some password"), []byte("some salt"))}
+	serverRouter := startTestServerRouter(t, conf)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "12345")
+
+	configDir := t.TempDir()
+	os.Setenv(config.EnvConfigDir, configDir)
+
+	app, stdin, _, stderr := newTestApp()
+	stdin.WriteString("some password")
+
+	if err := Run(app, "pcopy", "join", "localhost:12345"); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := os.ReadFile(filepath.Join(configDir, "default.conf"))
+	saltBase64 := base64.StdEncoding.EncodeToString(conf.Keys[0].Salt)
+
+	test.StrContains(t, stderr.String(), "Successfully joined clipboard, config written to")
+	test.StrContains(t, string(content), saltBase64)
+}
@@ -46,5 +46,6 @@ func execKeygen(c *cli.Context) error {
 	}
 
 	fmt.Fprintf(c.App.Writer, "\rKey %s\n", crypto.EncodeKey(key))
+	fmt.Fprintf(c.App.ErrWriter, "Key ID: %s (for use in KeyLimits)\n", crypto.KeyID(key))
 	return nil
 }
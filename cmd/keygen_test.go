@@ -8,7 +8,7 @@ import (
 )
 
 func TestCLI_Keygen(t *testing.T) {
-	app, stdin, stdout, _ := newTestApp()
+	app, stdin, stdout, stderr := newTestApp()
 	stdin.WriteString("this is my password\nthis is my password")
 
 	if err := Run(app, "pcopy", "keygen"); err != nil {
@@ -25,4 +25,5 @@ func TestCLI_Keygen(t *testing.T) {
 
 	test.BytesEquals(t, key.Salt, derivedKey.Salt)
 	test.BytesEquals(t, key.Bytes, derivedKey.Bytes)
+	test.StrContains(t, stderr.String(), "Key ID: "+crypto.KeyID(key))
 }
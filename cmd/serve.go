@@ -1,10 +1,12 @@
 package cmd
 
 import (
+	"fmt"
 	"github.com/urfave/cli/v2"
 	"heckel.io/pcopy/config"
 	"heckel.io/pcopy/crypto"
 	"heckel.io/pcopy/server"
+	"heckel.io/pcopy/util"
 	"log"
 	"os"
 )
@@ -24,6 +26,7 @@ var cmdServe = &cli.Command{
 		&cli.StringFlag{Name: "key", Aliases: []string{"K"}, Usage: "set private key file for TLS connections to `KEY`"},
 		&cli.StringFlag{Name: "cert", Aliases: []string{"C"}, Usage: "set certificate file for TLS connections to `CERT`"},
 		&cli.StringFlag{Name: "dir", Aliases: []string{"d"}, Usage: "set clipboard directory to keep clipboard contents to `DIR`"},
+		&cli.BoolFlag{Name: "check", Usage: "validate the config(s) and exit without serving"},
 	},
 	Description: `Start pcopy server and listen for incoming requests.
 
@@ -36,6 +39,7 @@ Examples:
   pcopy serve                      # Starts server in the foreground
   pcopy serve --listen-https :9999 # Starts server with alternate port
   PCOPY_KEY=.. pcopy serve         # Starts server with alternate key (see 'pcopy keygen')
+  pcopy serve --check              # Validates the config (certs, clipboard dir, limits, ..) and exits
 
 To override or specify the remote server key, you may pass the PCOPY_KEY variable.`,
 }
@@ -62,9 +66,49 @@ func execServe(c *cli.Context) error {
 	if len(configs) == 0 {
 		return cli.Exit("No valid config files found. Exiting", 1)
 	}
+	if c.Bool("check") {
+		return checkServerConfigs(c, configs)
+	}
+	if err := maybeSetupLogFile(configs[0]); err != nil {
+		return err
+	}
 	return server.Serve(configs...)
 }
 
+// checkServerConfigs runs the server self-test for all configs, and prints a report of all problems
+func checkServerConfigs(c *cli.Context, configs []*config.Config) error {
+	failed := 0
+	for _, conf := range configs {
+		fmt.Fprintf(c.App.ErrWriter, "Checking config for %s ... ", config.CollapseServerAddr(conf.ServerAddr))
+		if err := server.SelfTest(conf); err != nil {
+			fmt.Fprintf(c.App.ErrWriter, "failed, %s\n", err.Error())
+			failed++
+			continue
+		}
+		fmt.Fprintln(c.App.ErrWriter, "ok")
+	}
+	if failed > 0 {
+		return fmt.Errorf("self-test failed for %d of %d config(s)", failed, len(configs))
+	}
+	return nil
+}
+
+// maybeSetupLogFile redirects the log output to the configured log file, rotating it once it reaches
+// its maximum size. Since the logger is shared by all servers, only one log file is supported.
+func maybeSetupLogFile(conf *config.Config) error {
+	if conf.LogFile == "" {
+		return nil
+	}
+	maxSize := int64(conf.LogMaxSizeMB) * 1024 * 1024
+	writer, err := util.NewRotatingWriter(conf.LogFile, maxSize, conf.LogMaxBackups, conf.LogCompress)
+	if err != nil {
+		return err
+	}
+	log.Printf("Writing logs to %s", conf.LogFile)
+	log.SetOutput(writer)
+	return nil
+}
+
 func loadDefaultServerConfigWithOverrides(listenHTTPS, listenHTTP, serverAddr, keyFile, certFile, clipboardDir string) ([]*config.Config, error) {
 	store := config.NewStore()
 	filename := store.FileFromName(defaultServerClipboardName)
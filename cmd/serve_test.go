@@ -31,3 +31,31 @@ func TestCLI_ServeAndJoin(t *testing.T) {
 	test.StrContains(t, stderr.String(), "Successfully joined clipboard, config written to")
 	test.FileExist(t, filepath.Join(configDir, "default.conf"))
 }
+
+func TestCLI_ServeCheckSuccess(t *testing.T) {
+	filename, _ := configtest.NewTestConfig(t)
+	app, _, _, stderr := newTestApp()
+	if err := Run(app, "pcopy", "serve", "--check", "-c", filename); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, stderr.String(), "Checking config for localhost:12345 ... ok")
+}
+
+func TestCLI_ServeCheckFailed(t *testing.T) {
+	filename, config := configtest.NewTestConfig(t)
+	_, otherConfig := configtest.NewTestConfig(t)
+	config.CertFile = otherConfig.CertFile // Does not match key
+	config.ClipboardSizeLimit = 10
+	config.FileSizeLimit = 20
+	config.WriteFile(filename)
+
+	app, _, _, stderr := newTestApp()
+	err := Run(app, "pcopy", "serve", "--check", "-c", filename)
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	test.StrEquals(t, "self-test failed for 1 of 1 config(s)", err.Error())
+	test.StrContains(t, stderr.String(), "self-test found 2 problem(s)")
+	test.StrContains(t, stderr.String(), "cannot load certificate")
+	test.StrContains(t, stderr.String(), "FileSizeLimit is larger than ClipboardSizeLimit")
+}
@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+	"heckel.io/pcopy/client"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/server"
+	"heckel.io/pcopy/util"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	topDefaultWidth  = 80
+	topDefaultHeight = 24
+	topClearScreen   = "\033[H\033[2J"
+	topHideCursor    = "\033[?25l"
+	topShowCursor    = "\033[?25h"
+)
+
+var cmdTop = &cli.Command{
+	Name:      "top",
+	Usage:     "Show live clipboard stats and activity",
+	UsageText: "pcopy top [OPTIONS..] [CLIPBOARD]",
+	Action:    execTop,
+	Category:  categoryClient,
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "config", Aliases: []string{"c"}, Usage: "load config file from `FILE`"},
+		&cli.DurationFlag{Name: "interval", Aliases: []string{"d"}, Value: 2 * time.Second, Usage: "refresh stats every `DURATION`"},
+		&cli.IntFlag{Name: "iterations", Aliases: []string{"n"}, Usage: "exit after `NUM` refreshes (0 = run until interrupted)"},
+	},
+	Description: `Renders a live dashboard of the remote clipboard, showing the current entries, active streams,
+per-visitor usage and the most recent copy/paste actions. The dashboard is refreshed periodically
+and adapts to the terminal size. Press Ctrl-C to exit.
+
+This command is primarily meant for operators monitoring a busy server. If the clipboard is
+password-protected, the key from the clipboard config is used to authenticate.
+
+Examples:
+  pcopy top               # Shows live stats for the default clipboard
+  pcopy top -d 10s work   # Shows live stats for clipboard 'work', refreshing every 10 seconds`,
+}
+
+func execTop(c *cli.Context) error {
+	conf, err := parseTopArgs(c)
+	if err != nil {
+		return err
+	}
+	pclient, err := client.NewClient(conf)
+	if err != nil {
+		return err
+	}
+	interval := c.Duration("interval")
+	if interval <= 0 {
+		return fmt.Errorf("invalid interval %s", interval.String())
+	}
+	iterations := c.Int("iterations")
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGWINCH)
+	defer signal.Stop(sigs)
+
+	_, _, interactive := terminalSize(c.App.Writer)
+	if interactive {
+		fmt.Fprint(c.App.Writer, topHideCursor)
+		defer fmt.Fprint(c.App.Writer, topShowCursor)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	stats, err := pclient.Stats()
+	if err != nil {
+		return err
+	}
+	for i := 1; ; i++ {
+		renderTop(c.App.Writer, conf, stats)
+		if iterations > 0 && i >= iterations {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+			if stats, err = pclient.Stats(); err != nil {
+				return err
+			}
+		case sig := <-sigs:
+			if sig != syscall.SIGWINCH {
+				fmt.Fprintln(c.App.Writer)
+				return nil
+			}
+			i-- // Redraw after resize does not count as a refresh
+		}
+	}
+}
+
+func parseTopArgs(c *cli.Context) (*config.Config, error) {
+	configFileOverride := c.String("config")
+	clipboard := config.DefaultClipboard
+	if c.NArg() > 0 {
+		if configFileOverride != "" {
+			return nil, cli.Exit("invalid argument, -config cannot be set when clipboard is given", 1)
+		}
+		clipboard = c.Args().First()
+	}
+	configFile, conf, err := parseAndLoadConfig(configFileOverride, clipboard)
+	if err != nil {
+		return nil, cli.Exit("clipboard does not exist", 1)
+	}
+	if conf.CertFile == "" {
+		conf.CertFile = config.DefaultCertFile(configFile, true)
+	}
+	return conf, nil
+}
+
+// renderTop draws a single frame of the dashboard. If the writer is a terminal, the screen is cleared first
+// and the output is cut to fit the terminal size. Otherwise, the frame is simply appended to the output.
+func renderTop(w io.Writer, conf *config.Config, stats *server.Stats) {
+	width, height, interactive := terminalSize(w)
+
+	var countLimit, sizeLimit string
+	if stats.CountLimit == 0 {
+		countLimit = "no limit"
+	} else {
+		countLimit = fmt.Sprintf("max %d", stats.CountLimit)
+	}
+	if stats.SizeLimit == 0 {
+		sizeLimit = "no limit"
+	} else {
+		sizeLimit = fmt.Sprintf("max %s", util.BytesToHuman(stats.SizeLimit))
+	}
+
+	// Divide available lines between the sections: 4 header lines and 3 section titles (+ blank lines)
+	available := height - 10
+	if available < 3 {
+		available = 3
+	}
+	maxEntries, maxVisitors := available/2, available/4
+	maxEvents := available - maxEntries - maxVisitors
+
+	lines := []string{
+		fmt.Sprintf("pcopy top - %s - %s", config.CollapseServerAddr(conf.ServerAddr), time.Now().Format("15:04:05")),
+		fmt.Sprintf("Files: %d (%s), size: %s (%s), active streams: %d, visitors: %d",
+			stats.Count, countLimit, util.BytesToHuman(stats.Size), sizeLimit, stats.Streams, len(stats.Visitors)),
+		"",
+		fmt.Sprintf("%-30s %10s %-4s %s", "FILE", "SIZE", "MODE", "EXPIRES"),
+	}
+	for i, e := range stats.Entries {
+		if i >= maxEntries {
+			lines = append(lines, fmt.Sprintf("... and %d more", len(stats.Entries)-maxEntries))
+			break
+		}
+		size, expires := util.BytesToHuman(e.Size), "never"
+		if e.Stream {
+			size = "(stream)"
+		}
+		if e.Expires > 0 {
+			expires = util.DurationToHuman(time.Until(time.Unix(e.Expires, 0)))
+		}
+		lines = append(lines, fmt.Sprintf("%-30s %10s %-4s %s", e.ID, size, e.Mode, expires))
+	}
+	lines = append(lines, "", fmt.Sprintf("%-30s %10s %s", "VISITOR", "REQUESTS", "LAST SEEN"))
+	for i, v := range stats.Visitors {
+		if i >= maxVisitors {
+			lines = append(lines, fmt.Sprintf("... and %d more", len(stats.Visitors)-maxVisitors))
+			break
+		}
+		lastSeen := util.DurationToHuman(time.Since(time.Unix(v.LastSeen, 0)))
+		lines = append(lines, fmt.Sprintf("%-30s %10d %s ago", v.Addr, v.Requests, lastSeen))
+	}
+	lines = append(lines, "", fmt.Sprintf("%-8s %-30s %-7s %s", "TIME", "VISITOR", "ACTION", "FILE"))
+	for i := len(stats.Events) - 1; i >= 0 && len(stats.Events)-i <= maxEvents; i-- {
+		e := stats.Events[i]
+		lines = append(lines, fmt.Sprintf("%-8s %-30s %-7s %s", time.Unix(e.Time, 0).Format("15:04:05"), e.Addr, e.Action, e.ID))
+	}
+
+	if interactive {
+		if len(lines) > height {
+			lines = lines[:height]
+		}
+		for i, line := range lines {
+			if len(line) > width {
+				lines[i] = line[:width]
+			}
+		}
+		fmt.Fprint(w, topClearScreen)
+	}
+	fmt.Fprint(w, strings.Join(lines, "\n"))
+	if !interactive {
+		fmt.Fprintln(w)
+	}
+}
+
+// terminalSize returns the width and height of the terminal behind w, and true if w is a terminal.
+// If it is not, a default size is returned.
+func terminalSize(w io.Writer) (int, int, bool) {
+	if f, ok := w.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		if width, height, err := term.GetSize(int(f.Fd())); err == nil {
+			return width, height, true
+		}
+	}
+	return topDefaultWidth, topDefaultHeight, false
+}
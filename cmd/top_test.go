@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"heckel.io/pcopy/config/configtest"
+	"heckel.io/pcopy/test"
+	"testing"
+)
+
+func TestCLI_Top(t *testing.T) {
+	filename, config := configtest.NewTestConfig(t)
+	serverRouter := startTestServerRouter(t, config)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "12345")
+
+	app, stdin, stdout, _ := newTestApp()
+	stdin.WriteString("test stdin")
+
+	if err := Run(app, "pcp", "-c", filename, "some-file"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Run(app, "pcopy", "top", "-c", filename, "-n", "1"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, stdout.String(), "pcopy top - localhost:12345")
+	test.StrContains(t, stdout.String(), "Files: 1 (no limit)")
+	test.StrContains(t, stdout.String(), "some-file")
+	test.StrContains(t, stdout.String(), "copy    some-file")
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/pcopy/client"
+	"heckel.io/pcopy/server"
+)
+
+var cmdWait = &cli.Command{
+	Name:      "wait",
+	Usage:     "Wait until a clipboard file is ready to be pasted",
+	UsageText: "pcopy wait [OPTIONS..] [[CLIPBOARD]:[ID]]",
+	Action:    execWait,
+	Category:  categoryClient,
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "config", Aliases: []string{"c"}, Usage: "load config file from `FILE`"},
+		&cli.DurationFlag{Name: "timeout", Aliases: []string{"t"}, Usage: "give up after `DURATION` (0 = wait forever)"},
+		&cli.BoolFlag{Name: "quiet", Aliases: []string{"q"}, Usage: "do not print instructions once the file is ready"},
+	},
+	Description: `Blocks until the given clipboard file exists and is ready to be pasted, i.e. it is
+not just reserved or still being uploaded. This is useful to coordinate scripts on different
+machines, e.g. one machine streams a file, and another one waits for it before pasting it.
+
+The command exits with a non-zero exit code if the timeout is reached.
+
+Examples:
+  pcopy wait                       # Waits for the default file in the default clipboard
+  pcopy wait -t 5m work:backup     # Waits up to 5 minutes for file 'backup' in clipboard 'work'
+  pcopy wait -q build && ppaste build > build.tar`,
+}
+
+func execWait(c *cli.Context) error {
+	conf, id, err := parseLinkArgs(c)
+	if err != nil {
+		return err
+	}
+	pclient, err := client.NewClient(conf)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if timeout := c.Duration("timeout"); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	info, err := pclient.WaitFor(ctx, id)
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("timed out waiting for %s", id)
+	} else if err != nil {
+		return err
+	}
+	if !c.Bool("quiet") {
+		fmt.Fprint(c.App.ErrWriter, server.FileInfoInstructions(info))
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"heckel.io/pcopy/config/configtest"
+	"heckel.io/pcopy/test"
+	"testing"
+	"time"
+)
+
+func TestCLI_WaitSuccess(t *testing.T) {
+	filename, config := configtest.NewTestConfig(t)
+	serverRouter := startTestServerRouter(t, config)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "12345")
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		app, stdin, _, _ := newTestApp()
+		stdin.WriteString("ready now")
+		if err := Run(app, "pcp", "-c", filename, "later"); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	app, _, _, stderr := newTestApp()
+	if err := Run(app, "pcopy", "wait", "-c", filename, "-t", "10s", "later"); err != nil {
+		t.Fatal(err)
+	}
+	test.StrContains(t, stderr.String(), "https://localhost:12345/later")
+}
+
+func TestCLI_WaitTimeout(t *testing.T) {
+	filename, config := configtest.NewTestConfig(t)
+	serverRouter := startTestServerRouter(t, config)
+	defer serverRouter.Stop()
+
+	test.WaitForPortUp(t, "12345")
+
+	app, _, _, _ := newTestApp()
+	err := Run(app, "pcopy", "wait", "-c", filename, "-t", "300ms", "never")
+	if err == nil {
+		t.Fatal("expected timeout error, got none")
+	}
+	test.StrContains(t, err.Error(), "timed out waiting for never")
+}
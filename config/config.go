@@ -4,11 +4,16 @@ package config
 import (
 	"bufio"
 	_ "embed" // Required for go:embed instructions
+	"encoding/base64"
 	"fmt"
 	"golang.org/x/time/rate"
 	"heckel.io/pcopy/crypto"
 	"heckel.io/pcopy/util"
 	"io"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -34,6 +39,18 @@ const (
 	// relevant for the server.
 	DefaultClipboardDir = "/var/cache/pcopy"
 
+	// DefaultStorageFileMode defines the permissions of the files in the clipboard directory (content and
+	// metadata). This setting is only relevant for the server.
+	DefaultStorageFileMode os.FileMode = 0600
+
+	// DefaultStorageDirMode defines the permissions of the directories created in the clipboard directory
+	// (and the clipboard directory itself, if it does not exist). This setting is only relevant for the server.
+	DefaultStorageDirMode os.FileMode = 0700
+
+	// DefaultAutoCertCacheDir defines the default location to store certificates and the account key obtained
+	// via ACME (see AutoCertDomains). This setting is only relevant for the server.
+	DefaultAutoCertCacheDir = "/var/lib/pcopy/autocert"
+
 	// DefaultClipboard defines the default clipboard name if it's not overridden by the user. This is primarily
 	// used to find the config file location. This setting is only relevant for the client.
 	DefaultClipboard = "default"
@@ -53,18 +70,71 @@ const (
 	// will reject files larger than that.
 	DefaultFileSizeLimit = 0
 
+	// DefaultPutRateLimitPerMinute is the number of uploads (PUT/POST) per minute that a visitor (by IP address) is
+	// allowed on average, after the burst of DefaultPutRateBurst uploads is used up
+	DefaultPutRateLimitPerMinute = 1
+
+	// DefaultPutRateBurst is the number of uploads a visitor is allowed to make at once, see DefaultPutRateLimitPerMinute
+	DefaultPutRateBurst = 50
+
+	// DefaultAuthFailureThreshold is the number of failed authentication attempts from a visitor (by IP address)
+	// within DefaultAuthFailureWindow, after which all requests from that visitor requiring authentication are
+	// rejected until the window has passed
+	DefaultAuthFailureThreshold = 10
+
+	// DefaultAuthFailureWindow is the window in which failed authentication attempts are counted, and the time a
+	// visitor is blocked after reaching DefaultAuthFailureThreshold
+	DefaultAuthFailureWindow = 10 * time.Minute
+
+	// DefaultLogMaxSizeMB is the size in megabytes after which the server log file is rotated. This setting is
+	// only relevant for the server, and only if LogFile is set.
+	DefaultLogMaxSizeMB = 100
+
+	// DefaultLogMaxBackups is the number of rotated server log files that are kept
+	DefaultLogMaxBackups = 5
+
 	// DefaultFileExpireAfter is the duration after which the server will delete a clipboard file.
 	DefaultFileExpireAfter = time.Hour * 24 * 7
 
 	// DefaultFileModesAllowed is the default setting for whether files are overwritable
 	DefaultFileModesAllowed = "rw ro"
 
+	// DefaultIDMaxLength is the maximum length of clipboard file IDs, see IDMaxLength
+	DefaultIDMaxLength = 100
+
+	// DefaultAuthParamMethods is the default setting for which HTTP methods may be authorized using the "a" query param
+	DefaultAuthParamMethods = "GET HEAD"
+
+	// DefaultAuthRealm is the default realm in the "WWW-Authenticate" header, see AuthRealm
+	DefaultAuthRealm = "pcopy"
+
+	// VerifyOnReadDisabled serves clipboard files without checking them against their metadata file
+	VerifyOnReadDisabled = "off"
+
+	// VerifyOnReadFail verifies length and checksum of clipboard files before serving them, and fails
+	// the request if a file is corrupt
+	VerifyOnReadFail = "fail"
+
+	// VerifyOnReadDelete is like VerifyOnReadFail, but also deletes corrupt files
+	VerifyOnReadDelete = "delete"
+
+	// LogFormatText logs each request as a free-form text line
+	LogFormatText = "text"
+
+	// LogFormatJSON logs each request as a structured JSON line (access log), see LogFormat
+	LogFormatJSON = "json"
+
 	// FileModeReadWrite allows files to be overwritten
 	FileModeReadWrite = "rw"
 
-	// FileModeReadOnly ensures that files cannot be overwritten
+	// FileModeReadOnly ensures that files are immutable: they cannot be overwritten or deleted, and their
+	// metadata (e.g. the TTL) cannot be changed either, so they live exactly as long as set during upload
 	FileModeReadOnly = "ro"
 
+	// FileModeBurn marks files that are deleted after they have been read once ("burn after reading"). Like
+	// read-only files, they cannot be overwritten. This mode is not set via FileModesAllowed, but per upload.
+	FileModeBurn = "burn"
+
 	// EnvKey provides the ability to provide a key for certain CLI commands
 	EnvKey = "PCOPY_KEY"
 
@@ -90,14 +160,15 @@ var (
 
 	templateFnMap = template.FuncMap{
 		"encodeKey":       crypto.EncodeKey,
+		"encodeBase64":    base64.StdEncoding.EncodeToString,
 		"durationToHuman": util.DurationToHuman,
 		"stringsJoin":     strings.Join,
+		"escapeNewlines":  func(s string) string { return strings.ReplaceAll(s, "\n", `\n`) },
+		"octal":           func(m os.FileMode) string { return fmt.Sprintf("%04o", uint32(m)) },
 	}
 
 	defaultLimitGET      = rate.Every(time.Second)
 	defaultLimitGETBurst = 200
-	defaultLimitPUT      = rate.Every(time.Minute)
-	defaultLimitPUTBurst = 50
 )
 
 // Config is the configuration struct used to configure the client and the server. Some settings only apply to
@@ -110,23 +181,92 @@ type Config struct {
 	ServerAddr                string
 	DefaultID                 string
 	Key                       *crypto.Key
+	Keys                      []*crypto.Key
+	NamespaceByKey            bool
+	AuthParamMethods          []string
+	AuthReadRequired          bool
+	AuthWriteRequired         bool
+	AuthRealm                 string
 	KeyFile                   string
 	CertFile                  string
+	AutoCertDomains           []string
+	AutoCertCacheDir          string
+	TLSMinVersion             string
+	TLSCipherSuites           []string
 	ClipboardName             string
 	ClipboardDir              string
+	ShardDir                  bool
+	FileMode                  os.FileMode // Permissions of stored files, see DefaultStorageFileMode
+	DirMode                   os.FileMode // Permissions of created directories, see DefaultStorageDirMode
 	ClipboardSizeLimit        int64
+	MinFreeDiskBytes          int64
 	ClipboardCountLimit       int
+	SizePerVisitorLimit       int64
+	MaxConcurrentUploads      int
+	MaxConcurrentStreams      int
+	ReadTimeout               time.Duration // Zero means no timeout, see http.Server
+	WriteTimeout              time.Duration // Zero means no timeout, see http.Server
+	MaxUploadDuration         time.Duration
+	StreamWaitTimeout         time.Duration
+	PutRateLimitPerMinute     int
+	PutRateBurst              int
+	TrustedProxies            []string
+	AllowedOrigins            []string
+	RedirectHTTPS             bool
+	ExternalURL               string
 	FileSizeLimit             int64
+	SizeLimitByType           map[string]int64
+	KeyLimits                 map[string]*KeyLimit
 	FileExpireAfterDefault    time.Duration
 	FileExpireAfterNonTextMax time.Duration
 	FileExpireAfterTextMax    time.Duration
+	FileExpireAfterByMode     map[string]time.Duration // Default and max. TTL by file mode, replacing FileExpireAfter
+	AllowNeverExpire          bool
 	FileModesAllowed          []string
+	DefaultFileMode           string // Empty means the first of FileModesAllowed
+	ReservedIDs               []string
+	IDMaxLength               int
+	IDPattern                 string
+	VerifyOnRead              string
+	CompressFiles             bool
+	CompressResponses         bool
+	EncryptAtRest             bool
+	AtRestKey                 []byte // Empty means the key is derived from Key, see crypto.DeriveAtRestKey
+	ForceDownloadForBrowsers  bool
+	CustomIndexFile           string
+	CurlBanner                string // Empty means the built-in description, see server's curl.tmpl
+	StaticDir                 string
+	RedactIDsInLogs           bool
+	AuthFailureDelay          time.Duration
+	AuthFailureThreshold      int // Zero means no blocking, see DefaultAuthFailureThreshold
+	AuthFailureWindow         time.Duration
+	RequireAuthNonce          bool
+	EnableMetrics             bool
+	EnableSearch              bool
+	EnableAdmin               bool
+	LogFile                   string
+	LogMaxSizeMB              int
+	LogMaxBackups             int
+	LogCompress               bool
+	LogFormat                 string
+	SMTPAddr                  string
+	SMTPUser                  string
+	SMTPPass                  string
+	SMTPFrom                  string
+	WebhookURL                string
+	WebhookSecret             string
 	ProgressFunc              util.ProgressFunc
 	ManagerInterval           time.Duration
 	LimitGET                  rate.Limit
 	LimitGETBurst             int
-	LimitPUT                  rate.Limit
-	LimitPUTBurst             int
+}
+
+// KeyLimit defines quotas for files copied with a specific key (see Config.KeyLimits). Zero values disable
+// the respective limit for the key.
+type KeyLimit struct {
+	FileCountLimit int           // Maximum number of files owned by the key
+	SizeLimit      int64         // Maximum total size of all files owned by the key
+	MaxTTL         time.Duration // Maximum TTL, replaces the FileExpireAfter max values; zero means they apply
 }
 
 // New returns the default config
@@ -137,24 +277,50 @@ func New() *Config {
 		ListenTCP:                 "",
 		ServerAddr:                "",
 		Key:                       nil,
+		AuthParamMethods:          strings.Split(DefaultAuthParamMethods, " "),
+		AuthReadRequired:          true,
+		AuthWriteRequired:         true,
+		AuthRealm:                 DefaultAuthRealm,
 		KeyFile:                   "",
 		CertFile:                  "",
+		AutoCertDomains:           make([]string, 0),
+		AutoCertCacheDir:          DefaultAutoCertCacheDir,
+		TLSMinVersion:             "",
+		TLSCipherSuites:           make([]string, 0),
 		DefaultID:                 DefaultID,
 		ClipboardName:             DefaultClipboardName,
 		ClipboardDir:              DefaultClipboardDir,
+		FileMode:                  DefaultStorageFileMode,
+		DirMode:                   DefaultStorageDirMode,
 		ClipboardSizeLimit:        DefaultClipboardSizeLimit,
 		ClipboardCountLimit:       DefaultClipboardCountLimit,
+		PutRateLimitPerMinute:     DefaultPutRateLimitPerMinute,
+		PutRateBurst:              DefaultPutRateBurst,
+		AuthFailureThreshold:      DefaultAuthFailureThreshold,
+		AuthFailureWindow:         DefaultAuthFailureWindow,
+		TrustedProxies:            make([]string, 0),
+		AllowedOrigins:            make([]string, 0),
+		RedirectHTTPS:             true,
 		FileSizeLimit:             DefaultFileSizeLimit,
+		SizeLimitByType:           make(map[string]int64),
+		KeyLimits:                 make(map[string]*KeyLimit),
 		FileExpireAfterDefault:    DefaultFileExpireAfter,
 		FileExpireAfterNonTextMax: DefaultFileExpireAfter,
 		FileExpireAfterTextMax:    DefaultFileExpireAfter,
+		FileExpireAfterByMode:     make(map[string]time.Duration),
 		FileModesAllowed:          strings.Split(DefaultFileModesAllowed, " "),
+		ReservedIDs:               make([]string, 0),
+		IDMaxLength:               DefaultIDMaxLength,
+		VerifyOnRead:              VerifyOnReadDisabled,
+		LogMaxSizeMB:              DefaultLogMaxSizeMB,
+		LogMaxBackups:             DefaultLogMaxBackups,
+		LogCompress:               true,
+		CompressResponses:         true,
+		LogFormat:                 LogFormatText,
 		ProgressFunc:              nil,
 		ManagerInterval:           defaultManagerInterval,
 		LimitGET:                  defaultLimitGET,
 		LimitGETBurst:             defaultLimitGETBurst,
-		LimitPUT:                  defaultLimitPUT,
-		LimitPUTBurst:             defaultLimitPUTBurst,
 	}
 }
 
@@ -189,6 +355,9 @@ func LoadFromFile(filename string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(config.AutoCertDomains) > 0 {
+		return config, nil // Certificates are obtained via ACME, default key/cert files must not be picked up
+	}
 	if config.KeyFile == "" {
 		config.KeyFile = DefaultKeyFile(filename, true)
 	}
@@ -274,6 +443,25 @@ func loadConfig(reader io.Reader) (*Config, error) {
 		}
 	}
 
+	keys, ok := raw["Keys"]
+	if ok {
+		for _, encodedKey := range strings.Fields(keys) {
+			k, err := crypto.DecodeKey(encodedKey)
+			if err != nil {
+				return nil, fmt.Errorf("invalid config value for 'Keys': %w", err)
+			}
+			config.Keys = append(config.Keys, k)
+		}
+	}
+
+	namespaceByKey, ok := raw["NamespaceByKey"]
+	if ok {
+		config.NamespaceByKey, err = strconv.ParseBool(namespaceByKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'NamespaceByKey': %w", err)
+		}
+	}
+
 	keyFile, ok := raw["KeyFile"]
 	if ok {
 		if _, err := os.Stat(keyFile); err != nil {
@@ -290,6 +478,32 @@ func loadConfig(reader io.Reader) (*Config, error) {
 		config.CertFile = certFile
 	}
 
+	autoCertDomains, ok := raw["AutoCertDomains"]
+	if ok {
+		config.AutoCertDomains = strings.Fields(autoCertDomains)
+	}
+
+	autoCertCacheDir, ok := raw["AutoCertCacheDir"]
+	if ok {
+		config.AutoCertCacheDir = util.ExpandHome(autoCertCacheDir)
+	}
+
+	tlsMinVersion, ok := raw["TLSMinVersion"]
+	if ok {
+		if _, err := ParseTLSVersion(tlsMinVersion); err != nil {
+			return nil, fmt.Errorf("invalid config value for 'TLSMinVersion': %w", err)
+		}
+		config.TLSMinVersion = tlsMinVersion
+	}
+
+	tlsCipherSuites, ok := raw["TLSCipherSuites"]
+	if ok {
+		config.TLSCipherSuites = strings.Fields(tlsCipherSuites)
+		if _, err := ParseTLSCipherSuites(config.TLSCipherSuites); err != nil {
+			return nil, fmt.Errorf("invalid config value for 'TLSCipherSuites': %w", err)
+		}
+	}
+
 	clipboardName, ok := raw["ClipboardName"]
 	if ok {
 		config.ClipboardName = clipboardName
@@ -300,6 +514,30 @@ func loadConfig(reader io.Reader) (*Config, error) {
 		config.ClipboardDir = util.ExpandHome(clipboardDir)
 	}
 
+	shardDir, ok := raw["ShardDir"]
+	if ok {
+		config.ShardDir, err = strconv.ParseBool(shardDir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'ShardDir': %w", err)
+		}
+	}
+
+	fileMode, ok := raw["FileMode"]
+	if ok {
+		config.FileMode, err = parsePermissions(fileMode, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'FileMode': %w", err)
+		}
+	}
+
+	dirMode, ok := raw["DirMode"]
+	if ok {
+		config.DirMode, err = parsePermissions(dirMode, 0700)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'DirMode': %w", err)
+		}
+	}
+
 	clipboardSizeLimit, ok := raw["ClipboardSizeLimit"]
 	if ok {
 		config.ClipboardSizeLimit, err = util.ParseSize(clipboardSizeLimit)
@@ -308,6 +546,22 @@ func loadConfig(reader io.Reader) (*Config, error) {
 		}
 	}
 
+	minFreeDiskBytes, ok := raw["MinFreeDiskBytes"]
+	if ok {
+		config.MinFreeDiskBytes, err = util.ParseSize(minFreeDiskBytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'MinFreeDiskBytes': %w", err)
+		}
+	}
+
+	sizePerVisitorLimit, ok := raw["SizePerVisitorLimit"]
+	if ok {
+		config.SizePerVisitorLimit, err = util.ParseSize(sizePerVisitorLimit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'SizePerVisitorLimit': %w", err)
+		}
+	}
+
 	clipboardCountLimit, ok := raw["ClipboardCountLimit"]
 	if ok {
 		config.ClipboardCountLimit, err = strconv.Atoi(clipboardCountLimit)
@@ -316,6 +570,125 @@ func loadConfig(reader io.Reader) (*Config, error) {
 		}
 	}
 
+	maxConcurrentUploads, ok := raw["MaxConcurrentUploads"]
+	if ok {
+		config.MaxConcurrentUploads, err = strconv.Atoi(maxConcurrentUploads)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'MaxConcurrentUploads': %w", err)
+		}
+	}
+
+	maxConcurrentStreams, ok := raw["MaxConcurrentStreams"]
+	if ok {
+		config.MaxConcurrentStreams, err = strconv.Atoi(maxConcurrentStreams)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'MaxConcurrentStreams': %w", err)
+		}
+	}
+
+	readTimeout, ok := raw["ReadTimeout"]
+	if ok {
+		config.ReadTimeout, err = util.ParseDuration(readTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'ReadTimeout': %w", err)
+		} else if config.ReadTimeout < 0 {
+			return nil, fmt.Errorf("invalid config value for 'ReadTimeout': duration cannot be negative")
+		}
+	}
+
+	writeTimeout, ok := raw["WriteTimeout"]
+	if ok {
+		config.WriteTimeout, err = util.ParseDuration(writeTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'WriteTimeout': %w", err)
+		} else if config.WriteTimeout < 0 {
+			return nil, fmt.Errorf("invalid config value for 'WriteTimeout': duration cannot be negative")
+		}
+	}
+
+	maxUploadDuration, ok := raw["MaxUploadDuration"]
+	if ok {
+		config.MaxUploadDuration, err = util.ParseDuration(maxUploadDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'MaxUploadDuration': %w", err)
+		} else if config.MaxUploadDuration < 0 {
+			return nil, fmt.Errorf("invalid config value for 'MaxUploadDuration': duration cannot be negative")
+		}
+	}
+
+	streamWaitTimeout, ok := raw["StreamWaitTimeout"]
+	if ok {
+		config.StreamWaitTimeout, err = util.ParseDuration(streamWaitTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'StreamWaitTimeout': %w", err)
+		} else if config.StreamWaitTimeout < 0 {
+			return nil, fmt.Errorf("invalid config value for 'StreamWaitTimeout': duration cannot be negative")
+		}
+	}
+
+	putRateLimitPerMinute, ok := raw["PutRateLimitPerMinute"]
+	if ok {
+		config.PutRateLimitPerMinute, err = strconv.Atoi(putRateLimitPerMinute)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'PutRateLimitPerMinute': %w", err)
+		} else if config.PutRateLimitPerMinute < 0 {
+			return nil, fmt.Errorf("invalid config value for 'PutRateLimitPerMinute': must not be negative")
+		}
+	}
+
+	putRateBurst, ok := raw["PutRateBurst"]
+	if ok {
+		config.PutRateBurst, err = strconv.Atoi(putRateBurst)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'PutRateBurst': %w", err)
+		} else if config.PutRateBurst < 1 {
+			return nil, fmt.Errorf("invalid config value for 'PutRateBurst': must be at least 1")
+		}
+	}
+
+	trustedProxies, ok := raw["TrustedProxies"]
+	if ok {
+		config.TrustedProxies = strings.Fields(trustedProxies)
+		for _, proxy := range config.TrustedProxies {
+			if _, err := util.ParseIPNet(proxy); err != nil {
+				return nil, fmt.Errorf("invalid config value for 'TrustedProxies': %w", err)
+			}
+		}
+	}
+
+	allowedOrigins, ok := raw["AllowedOrigins"]
+	if ok {
+		config.AllowedOrigins = strings.Fields(allowedOrigins)
+		for _, origin := range config.AllowedOrigins {
+			if origin == "*" {
+				continue
+			}
+			u, err := url.Parse(origin)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+				return nil, fmt.Errorf("invalid config value for 'AllowedOrigins': %s is not an origin", origin)
+			}
+		}
+	}
+
+	redirectHTTPS, ok := raw["RedirectHTTPS"]
+	if ok {
+		config.RedirectHTTPS, err = strconv.ParseBool(redirectHTTPS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'RedirectHTTPS': %w", err)
+		}
+	}
+
+	externalURL, ok := raw["ExternalURL"]
+	if ok {
+		u, err := url.Parse(externalURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'ExternalURL': %w", err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid config value for 'ExternalURL': must be http(s)://HOST[:PORT]")
+		}
+		config.ExternalURL = externalURL
+	}
+
 	fileSizeLimit, ok := raw["FileSizeLimit"]
 	if ok {
 		config.FileSizeLimit, err = util.ParseSize(fileSizeLimit)
@@ -324,6 +697,52 @@ func loadConfig(reader io.Reader) (*Config, error) {
 		}
 	}
 
+	sizeLimitByType, ok := raw["SizeLimitByType"]
+	if ok {
+		for _, rule := range strings.Fields(sizeLimitByType) {
+			parts := strings.Split(rule, ":")
+			if len(parts) != 2 || !strings.Contains(parts[0], "/") {
+				return nil, fmt.Errorf("invalid config value for 'SizeLimitByType': expected format type:size, got %s", rule)
+			}
+			limit, err := util.ParseSize(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid config value for 'SizeLimitByType': %w", err)
+			}
+			config.SizeLimitByType[strings.ToLower(parts[0])] = limit
+		}
+	}
+
+	keyLimits, ok := raw["KeyLimits"]
+	if ok {
+		for _, rule := range strings.Fields(keyLimits) {
+			parts := strings.Split(rule, ":")
+			if len(parts) != 4 || parts[0] == "" {
+				return nil, fmt.Errorf("invalid config value for 'KeyLimits': expected format keyid:count:size:maxttl, got %s", rule)
+			}
+			count, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid config value for 'KeyLimits': %w", err)
+			}
+			size, err := util.ParseSize(parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid config value for 'KeyLimits': %w", err)
+			}
+			maxTTL, err := util.ParseDuration(parts[3])
+			if err != nil {
+				return nil, fmt.Errorf("invalid config value for 'KeyLimits': %w", err)
+			}
+			config.KeyLimits[strings.ToLower(parts[0])] = &KeyLimit{FileCountLimit: count, SizeLimit: size, MaxTTL: maxTTL}
+		}
+	}
+
+	allowNeverExpire, ok := raw["AllowNeverExpire"]
+	if ok {
+		config.AllowNeverExpire, err = strconv.ParseBool(allowNeverExpire)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'AllowNeverExpire': %w", err)
+		}
+	}
+
 	fileExpireAfter, ok := raw["FileExpireAfter"]
 	if ok {
 		parts := strings.Split(fileExpireAfter, " ")
@@ -353,6 +772,10 @@ func loadConfig(reader io.Reader) (*Config, error) {
 		if config.FileExpireAfterTextMax > 0 && config.FileExpireAfterDefault > config.FileExpireAfterTextMax {
 			return nil, fmt.Errorf("invalid config value for 'FileExpireAfter': default value cannot be larger than text-max")
 		}
+		hasMax := config.FileExpireAfterNonTextMax > 0 || config.FileExpireAfterTextMax > 0
+		if config.FileExpireAfterDefault == 0 && hasMax && !config.AllowNeverExpire {
+			return nil, fmt.Errorf("invalid config value for 'FileExpireAfter': default value 0 (never expire) requires AllowNeverExpire if a max value is set")
+		}
 	}
 
 	fileModesAllowed, ok := raw["FileModesAllowed"]
@@ -369,9 +792,327 @@ func loadConfig(reader io.Reader) (*Config, error) {
 		config.FileModesAllowed = modes
 	}
 
+	defaultFileMode, ok := raw["DefaultFileMode"]
+	if ok {
+		if !IsFileModeAllowed(config.FileModesAllowed, defaultFileMode) {
+			return nil, fmt.Errorf("invalid config value for 'DefaultFileMode': %s is not in 'FileModesAllowed'", defaultFileMode)
+		}
+		config.DefaultFileMode = defaultFileMode
+	}
+
+	fileExpireAfterByMode, ok := raw["FileExpireAfterByMode"]
+	if ok {
+		for _, rule := range strings.Fields(fileExpireAfterByMode) {
+			parts := strings.Split(rule, ":")
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid config value for 'FileExpireAfterByMode': expected format mode:duration, got %s", rule)
+			} else if !IsFileModeAllowed(config.FileModesAllowed, parts[0]) {
+				return nil, fmt.Errorf("invalid config value for 'FileExpireAfterByMode': %s is not in 'FileModesAllowed'", parts[0])
+			}
+			ttl, err := util.ParseDuration(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid config value for 'FileExpireAfterByMode': %w", err)
+			} else if ttl <= 0 {
+				return nil, fmt.Errorf("invalid config value for 'FileExpireAfterByMode': duration for %s must be positive", parts[0])
+			}
+			config.FileExpireAfterByMode[parts[0]] = ttl
+		}
+	}
+
+	reservedIDs, ok := raw["ReservedIDs"]
+	if ok {
+		config.ReservedIDs = strings.Fields(reservedIDs)
+	}
+
+	idMaxLength, ok := raw["IDMaxLength"]
+	if ok {
+		config.IDMaxLength, err = strconv.Atoi(idMaxLength)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'IDMaxLength': %w", err)
+		} else if config.IDMaxLength < 2 {
+			return nil, fmt.Errorf("invalid config value for 'IDMaxLength': must be at least 2")
+		}
+	}
+
+	idPattern, ok := raw["IDPattern"]
+	if ok {
+		if _, err := regexp.Compile(idPattern); err != nil {
+			return nil, fmt.Errorf("invalid config value for 'IDPattern': %w", err)
+		}
+		config.IDPattern = idPattern
+	}
+
+	verifyOnRead, ok := raw["VerifyOnRead"]
+	if ok {
+		if verifyOnRead != VerifyOnReadDisabled && verifyOnRead != VerifyOnReadFail && verifyOnRead != VerifyOnReadDelete {
+			return nil, fmt.Errorf("invalid config value for 'VerifyOnRead': %s", verifyOnRead)
+		}
+		config.VerifyOnRead = verifyOnRead
+	}
+
+	compressFiles, ok := raw["CompressFiles"]
+	if ok {
+		config.CompressFiles, err = strconv.ParseBool(compressFiles)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'CompressFiles': %w", err)
+		}
+	}
+
+	compressResponses, ok := raw["CompressResponses"]
+	if ok {
+		config.CompressResponses, err = strconv.ParseBool(compressResponses)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'CompressResponses': %w", err)
+		}
+	}
+
+	encryptAtRest, ok := raw["EncryptAtRest"]
+	if ok {
+		config.EncryptAtRest, err = strconv.ParseBool(encryptAtRest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'EncryptAtRest': %w", err)
+		}
+	}
+
+	atRestKey, ok := raw["AtRestKey"]
+	if ok {
+		config.AtRestKey, err = base64.StdEncoding.DecodeString(atRestKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'AtRestKey': %w", err)
+		} else if len(config.AtRestKey) != crypto.KeyLenBytes {
+			return nil, fmt.Errorf("invalid config value for 'AtRestKey': key must be %d bytes", crypto.KeyLenBytes)
+		}
+	}
+
+	customIndexFile, ok := raw["CustomIndexFile"]
+	if ok {
+		config.CustomIndexFile = util.ExpandHome(customIndexFile)
+	}
+
+	curlBanner, ok := raw["CurlBanner"]
+	if ok {
+		config.CurlBanner = strings.ReplaceAll(curlBanner, `\n`, "\n")
+	}
+
+	staticDir, ok := raw["StaticDir"]
+	if ok {
+		config.StaticDir = util.ExpandHome(staticDir)
+	}
+
+	forceDownloadForBrowsers, ok := raw["ForceDownloadForBrowsers"]
+	if ok {
+		config.ForceDownloadForBrowsers, err = strconv.ParseBool(forceDownloadForBrowsers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'ForceDownloadForBrowsers': %w", err)
+		}
+	}
+
+	redactIDsInLogs, ok := raw["RedactIDsInLogs"]
+	if ok {
+		config.RedactIDsInLogs, err = strconv.ParseBool(redactIDsInLogs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'RedactIDsInLogs': %w", err)
+		}
+	}
+
+	authFailureDelay, ok := raw["AuthFailureDelay"]
+	if ok {
+		config.AuthFailureDelay, err = util.ParseDuration(authFailureDelay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'AuthFailureDelay': %w", err)
+		}
+	}
+
+	authFailureThreshold, ok := raw["AuthFailureThreshold"]
+	if ok {
+		config.AuthFailureThreshold, err = strconv.Atoi(authFailureThreshold)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'AuthFailureThreshold': %w", err)
+		} else if config.AuthFailureThreshold < 0 {
+			return nil, fmt.Errorf("invalid config value for 'AuthFailureThreshold': must not be negative")
+		}
+	}
+
+	authFailureWindow, ok := raw["AuthFailureWindow"]
+	if ok {
+		config.AuthFailureWindow, err = util.ParseDuration(authFailureWindow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'AuthFailureWindow': %w", err)
+		} else if config.AuthFailureWindow <= 0 {
+			return nil, fmt.Errorf("invalid config value for 'AuthFailureWindow': duration must be positive")
+		}
+	}
+
+	requireAuthNonce, ok := raw["RequireAuthNonce"]
+	if ok {
+		config.RequireAuthNonce, err = strconv.ParseBool(requireAuthNonce)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'RequireAuthNonce': %w", err)
+		}
+	}
+
+	logFile, ok := raw["LogFile"]
+	if ok {
+		config.LogFile = logFile
+	}
+
+	enableMetrics, ok := raw["EnableMetrics"]
+	if ok {
+		config.EnableMetrics, err = strconv.ParseBool(enableMetrics)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'EnableMetrics': %w", err)
+		}
+	}
+
+	enableSearch, ok := raw["EnableSearch"]
+	if ok {
+		config.EnableSearch, err = strconv.ParseBool(enableSearch)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'EnableSearch': %w", err)
+		}
+	}
+
+	enableAdmin, ok := raw["EnableAdmin"]
+	if ok {
+		config.EnableAdmin, err = strconv.ParseBool(enableAdmin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'EnableAdmin': %w", err)
+		}
+	}
+
+	logMaxSizeMB, ok := raw["LogMaxSizeMB"]
+	if ok {
+		config.LogMaxSizeMB, err = strconv.Atoi(logMaxSizeMB)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'LogMaxSizeMB': %w", err)
+		} else if config.LogMaxSizeMB < 0 {
+			return nil, fmt.Errorf("invalid config value for 'LogMaxSizeMB': must not be negative")
+		}
+	}
+
+	logMaxBackups, ok := raw["LogMaxBackups"]
+	if ok {
+		config.LogMaxBackups, err = strconv.Atoi(logMaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'LogMaxBackups': %w", err)
+		} else if config.LogMaxBackups < 0 {
+			return nil, fmt.Errorf("invalid config value for 'LogMaxBackups': must not be negative")
+		}
+	}
+
+	logCompress, ok := raw["LogCompress"]
+	if ok {
+		config.LogCompress, err = strconv.ParseBool(logCompress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'LogCompress': %w", err)
+		}
+	}
+
+	logFormat, ok := raw["LogFormat"]
+	if ok {
+		if logFormat != LogFormatText && logFormat != LogFormatJSON {
+			return nil, fmt.Errorf("invalid config value for 'LogFormat': %s", logFormat)
+		}
+		config.LogFormat = logFormat
+	}
+
+	smtpAddr, ok := raw["SMTPAddr"]
+	if ok {
+		if _, _, err := net.SplitHostPort(smtpAddr); err != nil {
+			return nil, fmt.Errorf("invalid config value for 'SMTPAddr': %w", err)
+		}
+		config.SMTPAddr = smtpAddr
+	}
+
+	smtpUser, ok := raw["SMTPUser"]
+	if ok {
+		config.SMTPUser = smtpUser
+	}
+
+	smtpPass, ok := raw["SMTPPass"]
+	if ok {
+		config.SMTPPass = smtpPass
+	}
+
+	smtpFrom, ok := raw["SMTPFrom"]
+	if ok {
+		if _, err := mail.ParseAddress(smtpFrom); err != nil {
+			return nil, fmt.Errorf("invalid config value for 'SMTPFrom': %w", err)
+		}
+		config.SMTPFrom = smtpFrom
+	}
+	if config.SMTPAddr != "" && config.SMTPFrom == "" {
+		return nil, fmt.Errorf("invalid config value for 'SMTPFrom': must be set if 'SMTPAddr' is set")
+	}
+
+	webhookURL, ok := raw["WebhookURL"]
+	if ok {
+		u, err := url.ParseRequestURI(webhookURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'WebhookURL': %w", err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid config value for 'WebhookURL': scheme must be http or https")
+		}
+		config.WebhookURL = webhookURL
+	}
+
+	webhookSecret, ok := raw["WebhookSecret"]
+	if ok {
+		config.WebhookSecret = webhookSecret
+	}
+
+	authParamMethods, ok := raw["AuthParamMethods"]
+	if ok {
+		methods := strings.Fields(strings.ToUpper(authParamMethods))
+		for _, m := range methods {
+			if m != http.MethodGet && m != http.MethodHead && m != http.MethodPut && m != http.MethodPost {
+				return nil, fmt.Errorf("invalid config value for 'AuthParamMethods': %s", m)
+			}
+		}
+		config.AuthParamMethods = methods
+	}
+
+	authReadRequired, ok := raw["AuthReadRequired"]
+	if ok {
+		config.AuthReadRequired, err = strconv.ParseBool(authReadRequired)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'AuthReadRequired': %w", err)
+		}
+	}
+
+	authWriteRequired, ok := raw["AuthWriteRequired"]
+	if ok {
+		config.AuthWriteRequired, err = strconv.ParseBool(authWriteRequired)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config value for 'AuthWriteRequired': %w", err)
+		}
+	}
+
+	authRealm, ok := raw["AuthRealm"]
+	if ok {
+		if authRealm == "" || strings.ContainsAny(authRealm, "\"\\") {
+			return nil, fmt.Errorf("invalid config value for 'AuthRealm': %s", authRealm)
+		}
+		config.AuthRealm = authRealm
+	}
+
 	return config, nil
 }
 
+// parsePermissions parses octal permission bits (e.g. 0640), and makes sure that the owner has at least the
+// required permissions, since the server could not work with its own files otherwise
+func parsePermissions(value string, required os.FileMode) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return 0, err
+	} else if perm&^0777 != 0 {
+		return 0, fmt.Errorf("%s is not a valid permission, must be between 0000 and 0777", value)
+	} else if os.FileMode(perm)&required != required {
+		return 0, fmt.Errorf("%s does not grant the owner the required permissions %04o", value, required)
+	}
+	return os.FileMode(perm), nil
+}
+
 func loadRawConfig(reader io.Reader) (map[string]string, error) {
 	config := make(map[string]string)
 	scanner := bufio.NewScanner(reader)
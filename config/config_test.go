@@ -1,6 +1,7 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
 	"heckel.io/pcopy/crypto"
 	"heckel.io/pcopy/test"
@@ -110,11 +111,73 @@ KeyFile %s
 CertFile %s
 ClipboardName Phil's Clipboard
 ClipboardDir %s
+ShardDir true
+FileMode 0640
+DirMode 750
 ClipboardSizeLimit 10M
+MinFreeDiskBytes 1G
+SizePerVisitorLimit 2M
 ClipboardCountLimit 101
+MaxConcurrentUploads 7
+MaxConcurrentStreams 3
+ReadTimeout 1m
+WriteTimeout 2h
+MaxUploadDuration 30m
+StreamWaitTimeout 5m
 FileSizeLimit 123k
 FileExpireAfter 10d 12d 13d
 FileModesAllowed ro rw
+DefaultFileMode rw
+FileExpireAfterByMode ro:7d rw:1h
+AutoCertDomains pcopy.example.com www.pcopy.example.com
+AutoCertCacheDir /tmp/autocert
+TLSMinVersion 1.3
+TLSCipherSuites TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256
+ReservedIDs health admin
+IDMaxLength 200
+IDPattern [a-z0-9]+
+AuthParamMethods get head put
+AuthReadRequired false
+AuthWriteRequired true
+AuthRealm My Clipboard
+SizeLimitByType text/plain:10k image/*:2M
+KeyLimits 3f1a9c0b:0:0:1y 7D2E4B11:10:10M:1h
+VerifyOnRead delete
+CompressFiles true
+CompressResponses false
+EncryptAtRest true
+AtRestKey hoaGhoaGhoaGhoaGhoaGhoaGhoaGhoaGhoaGhoaGhoY=
+ForceDownloadForBrowsers true
+CustomIndexFile /etc/pcopy/index.html
+CurlBanner Welcome to our clipboard!\nDocs: https://wiki.example.com/pcopy
+StaticDir /etc/pcopy/static
+RedactIDsInLogs true
+AuthFailureDelay 500ms
+AuthFailureThreshold 5
+AuthFailureWindow 1h
+RequireAuthNonce true
+EnableMetrics true
+EnableSearch true
+EnableAdmin true
+NamespaceByKey true
+LogFile /var/log/pcopy.log
+LogMaxSizeMB 10
+PutRateLimitPerMinute 30
+PutRateBurst 5
+TrustedProxies 127.0.0.1 10.0.0.0/8
+AllowedOrigins https://app.example.com http://localhost:3000
+RedirectHTTPS false
+ExternalURL https://pcopy.example.com
+LogMaxBackups 3
+LogCompress false
+LogFormat json
+SMTPAddr mail.example.com:587
+SMTPFrom pcopy <pcopy@example.com>
+SMTPUser pcopy
+SMTPPass secret
+WebhookURL https://chat.example.com/hooks/pcopy
+WebhookSecret hooksecret
+Keys Osz6osE1fRRirA==:XEBZJjB/7w4eCugzQSkwGMe8QW4nbsPvPMlle1wvW4I=
 `, keyFile, certFile, dir)))
 	if err != nil {
 		t.Fatal(err)
@@ -128,14 +191,84 @@ FileModesAllowed ro rw
 	test.StrEquals(t, certFile, config.CertFile)
 	test.StrEquals(t, "Phil's Clipboard", config.ClipboardName)
 	test.StrEquals(t, dir, config.ClipboardDir)
+	test.BoolEquals(t, true, config.ShardDir)
+	test.Int64Equals(t, 0640, int64(config.FileMode))
+	test.Int64Equals(t, 0750, int64(config.DirMode))
 	test.Int64Equals(t, 10*1024*1024, config.ClipboardSizeLimit)
+	test.Int64Equals(t, 1024*1024*1024, config.MinFreeDiskBytes)
+	test.Int64Equals(t, 2*1024*1024, config.SizePerVisitorLimit)
 	test.Int64Equals(t, 101, int64(config.ClipboardCountLimit))
+	test.Int64Equals(t, 7, int64(config.MaxConcurrentUploads))
+	test.Int64Equals(t, 3, int64(config.MaxConcurrentStreams))
+	test.DurationEquals(t, time.Minute, config.ReadTimeout)
+	test.DurationEquals(t, 2*time.Hour, config.WriteTimeout)
+	test.DurationEquals(t, 30*time.Minute, config.MaxUploadDuration)
+	test.DurationEquals(t, 5*time.Minute, config.StreamWaitTimeout)
 	test.Int64Equals(t, 123*1024, config.FileSizeLimit)
 	test.Int64Equals(t, 10*24, int64(config.FileExpireAfterDefault.Hours()))
 	test.Int64Equals(t, 12*24, int64(config.FileExpireAfterNonTextMax.Hours()))
 	test.Int64Equals(t, 13*24, int64(config.FileExpireAfterTextMax.Hours()))
+	test.DurationEquals(t, 7*24*time.Hour, config.FileExpireAfterByMode["ro"])
+	test.DurationEquals(t, time.Hour, config.FileExpireAfterByMode["rw"])
 	test.StrEquals(t, "ro", config.FileModesAllowed[0])
 	test.StrEquals(t, "rw", config.FileModesAllowed[1])
+	test.StrEquals(t, "rw", config.DefaultFileMode)
+	test.StrEquals(t, "health admin", strings.Join(config.ReservedIDs, " "))
+	test.Int64Equals(t, 200, int64(config.IDMaxLength))
+	test.StrEquals(t, "[a-z0-9]+", config.IDPattern)
+	test.StrEquals(t, "pcopy.example.com www.pcopy.example.com", strings.Join(config.AutoCertDomains, " "))
+	test.StrEquals(t, "/tmp/autocert", config.AutoCertCacheDir)
+	test.StrEquals(t, "1.3", config.TLSMinVersion)
+	test.StrEquals(t, "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256", strings.Join(config.TLSCipherSuites, " "))
+	test.StrEquals(t, "GET HEAD PUT", strings.Join(config.AuthParamMethods, " "))
+	test.BoolEquals(t, false, config.AuthReadRequired)
+	test.BoolEquals(t, true, config.AuthWriteRequired)
+	test.StrEquals(t, "My Clipboard", config.AuthRealm)
+	test.Int64Equals(t, 10*1024, config.SizeLimitByType["text/plain"])
+	test.Int64Equals(t, 2, int64(len(config.KeyLimits)))
+	test.Int64Equals(t, 0, int64(config.KeyLimits["3f1a9c0b"].FileCountLimit))
+	test.DurationEquals(t, 365*24*time.Hour, config.KeyLimits["3f1a9c0b"].MaxTTL)
+	test.Int64Equals(t, 10, int64(config.KeyLimits["7d2e4b11"].FileCountLimit))
+	test.Int64Equals(t, 10*1024*1024, config.KeyLimits["7d2e4b11"].SizeLimit)
+	test.DurationEquals(t, time.Hour, config.KeyLimits["7d2e4b11"].MaxTTL)
+	test.Int64Equals(t, 2*1024*1024, config.SizeLimitByType["image/*"])
+	test.StrEquals(t, VerifyOnReadDelete, config.VerifyOnRead)
+	test.BoolEquals(t, true, config.CompressFiles)
+	test.BoolEquals(t, false, config.CompressResponses)
+	test.BoolEquals(t, true, config.EncryptAtRest)
+	test.BytesEquals(t, bytes.Repeat([]byte{0x86}, 32), config.AtRestKey)
+	test.BoolEquals(t, true, config.ForceDownloadForBrowsers)
+	test.StrEquals(t, "/etc/pcopy/index.html", config.CustomIndexFile)
+	test.StrEquals(t, "Welcome to our clipboard!\nDocs: https://wiki.example.com/pcopy", config.CurlBanner)
+	test.StrEquals(t, "/etc/pcopy/static", config.StaticDir)
+	test.BoolEquals(t, true, config.RedactIDsInLogs)
+	test.DurationEquals(t, 500*time.Millisecond, config.AuthFailureDelay)
+	test.Int64Equals(t, 5, int64(config.AuthFailureThreshold))
+	test.DurationEquals(t, time.Hour, config.AuthFailureWindow)
+	test.BoolEquals(t, true, config.RequireAuthNonce)
+	test.BoolEquals(t, true, config.EnableMetrics)
+	test.BoolEquals(t, true, config.EnableSearch)
+	test.BoolEquals(t, true, config.EnableAdmin)
+	test.BoolEquals(t, true, config.NamespaceByKey)
+	test.StrEquals(t, "/var/log/pcopy.log", config.LogFile)
+	test.Int64Equals(t, 10, int64(config.LogMaxSizeMB))
+	test.Int64Equals(t, 30, int64(config.PutRateLimitPerMinute))
+	test.Int64Equals(t, 5, int64(config.PutRateBurst))
+	test.StrEquals(t, "127.0.0.1 10.0.0.0/8", strings.Join(config.TrustedProxies, " "))
+	test.StrEquals(t, "https://app.example.com http://localhost:3000", strings.Join(config.AllowedOrigins, " "))
+	test.BoolEquals(t, false, config.RedirectHTTPS)
+	test.StrEquals(t, "https://pcopy.example.com", config.ExternalURL)
+	test.Int64Equals(t, 3, int64(config.LogMaxBackups))
+	test.BoolEquals(t, false, config.LogCompress)
+	test.StrEquals(t, LogFormatJSON, config.LogFormat)
+	test.StrEquals(t, "mail.example.com:587", config.SMTPAddr)
+	test.StrEquals(t, "pcopy <pcopy@example.com>", config.SMTPFrom)
+	test.StrEquals(t, "pcopy", config.SMTPUser)
+	test.StrEquals(t, "secret", config.SMTPPass)
+	test.StrEquals(t, "https://chat.example.com/hooks/pcopy", config.WebhookURL)
+	test.StrEquals(t, "hooksecret", config.WebhookSecret)
+	test.Int64Equals(t, 1, int64(len(config.Keys)))
+	test.BytesEquals(t, test.FromBase64(t, "Osz6osE1fRRirA=="), config.Keys[0].Salt)
 }
 
 func TestConfig_WriteFileAllTheThings(t *testing.T) {
@@ -149,13 +282,69 @@ func TestConfig_WriteFileAllTheThings(t *testing.T) {
 	config.KeyFile = "some key file"
 	config.ClipboardName = "Phil's Clipboard"
 	config.ClipboardDir = "/tmp/clipboarddir"
+	config.ShardDir = true
+	config.FileMode = 0660
 	config.ClipboardCountLimit = 1234
+	config.MaxConcurrentUploads = 12
+	config.MaxConcurrentStreams = 4
+	config.ReadTimeout = time.Minute
+	config.WriteTimeout = 2 * time.Hour
+	config.MaxUploadDuration = 30 * time.Minute
+	config.StreamWaitTimeout = 5 * time.Second
 	config.ClipboardSizeLimit = 9876
+	config.MinFreeDiskBytes = 5000
+	config.SizePerVisitorLimit = 5432
 	config.FileSizeLimit = 777
 	config.FileExpireAfterDefault = time.Hour
 	config.FileExpireAfterNonTextMax = 7 * time.Hour
 	config.FileExpireAfterTextMax = 0
+	config.FileExpireAfterByMode = map[string]time.Duration{"ro": 7 * 24 * time.Hour, "rw": time.Hour}
+	config.AllowNeverExpire = true
 	config.FileModesAllowed = []string{"ro", "rw"}
+	config.DefaultFileMode = "rw"
+	config.ReservedIDs = []string{"health"}
+	config.IDMaxLength = 50
+	config.IDPattern = "[a-z]+"
+	config.AutoCertDomains = []string{"pcopy.example.com"}
+	config.TLSMinVersion = "1.3"
+	config.AuthParamMethods = []string{"GET"}
+	config.AuthWriteRequired = false
+	config.AuthRealm = "Secret Stuff"
+	config.SizeLimitByType = map[string]int64{"text/plain": 100, "image/*": 2000}
+	config.KeyLimits = map[string]*KeyLimit{"3f1a9c0b": {FileCountLimit: 5, SizeLimit: 1000, MaxTTL: time.Hour}}
+	config.VerifyOnRead = VerifyOnReadFail
+	config.CompressFiles = true
+	config.CompressResponses = false
+	config.EncryptAtRest = true
+	config.AtRestKey = bytes.Repeat([]byte{0x86}, 32)
+	config.ForceDownloadForBrowsers = true
+	config.CustomIndexFile = "/etc/pcopy/index.html"
+	config.CurlBanner = "Welcome!\nSee https://wiki.example.com"
+	config.StaticDir = "/etc/pcopy/static"
+	config.RedactIDsInLogs = true
+	config.AuthFailureDelay = time.Second
+	config.AuthFailureThreshold = 3
+	config.AuthFailureWindow = 30 * time.Minute
+	config.RequireAuthNonce = true
+	config.EnableMetrics = true
+	config.EnableSearch = true
+	config.EnableAdmin = true
+	config.NamespaceByKey = true
+	config.LogFile = "/var/log/pcopy.log"
+	config.LogMaxSizeMB = 20
+	config.PutRateLimitPerMinute = 0
+	config.PutRateBurst = 10
+	config.TrustedProxies = []string{"::1", "192.168.0.0/16"}
+	config.AllowedOrigins = []string{"*"}
+	config.RedirectHTTPS = false
+	config.ExternalURL = "https://pcopy.example.com:8443"
+	config.LogMaxBackups = 0
+	config.LogCompress = false
+	config.LogFormat = LogFormatJSON
+	config.SMTPAddr = "mail.example.com:25"
+	config.SMTPFrom = "pcopy@example.com"
+	config.WebhookURL = "http://localhost:8080/hook"
+	config.Keys = []*crypto.Key{{Salt: []byte("old salt"), Bytes: []byte("16 bytes exactly")}}
 
 	filename := filepath.Join(t.TempDir(), "some.conf")
 	if err := config.WriteFile(filename); err != nil {
@@ -175,11 +364,73 @@ func TestConfig_WriteFileAllTheThings(t *testing.T) {
 	test.StrContains(t, contents, "KeyFile some key file")
 	test.StrContains(t, contents, "ClipboardName Phil's Clipboard")
 	test.StrContains(t, contents, "ClipboardDir /tmp/clipboarddir")
+	test.StrContains(t, contents, "ShardDir true")
+	test.StrContains(t, contents, "FileMode 0660")
+	test.StrContains(t, contents, "# DirMode 0700")
 	test.StrContains(t, contents, "ClipboardCountLimit 1234")
+	test.StrContains(t, contents, "MaxConcurrentUploads 12")
+	test.StrContains(t, contents, "MaxConcurrentStreams 4")
+	test.StrContains(t, contents, "ReadTimeout 1m")
+	test.StrContains(t, contents, "WriteTimeout 2h")
+	test.StrContains(t, contents, "MaxUploadDuration 30m")
+	test.StrContains(t, contents, "StreamWaitTimeout 5s")
 	test.StrContains(t, contents, "ClipboardSizeLimit 9876")
+	test.StrContains(t, contents, "MinFreeDiskBytes 5000")
+	test.StrContains(t, contents, "SizePerVisitorLimit 5432")
 	test.StrContains(t, contents, "FileSizeLimit 777")
 	test.StrContains(t, contents, "FileExpireAfter 1h 7h 0")
+	test.StrContains(t, contents, "FileExpireAfterByMode ro:7d rw:1h")
+	test.StrContains(t, contents, "AllowNeverExpire true")
 	test.StrContains(t, contents, "FileModesAllowed ro rw")
+	test.StrContains(t, contents, "DefaultFileMode rw")
+	test.StrContains(t, contents, "ReservedIDs health")
+	test.StrContains(t, contents, "IDMaxLength 50")
+	test.StrContains(t, contents, "IDPattern [a-z]+")
+	test.StrContains(t, contents, "AutoCertDomains pcopy.example.com")
+	test.StrContains(t, contents, "# AutoCertCacheDir /var/lib/pcopy/autocert")
+	test.StrContains(t, contents, "TLSMinVersion 1.3")
+	test.StrContains(t, contents, "# TLSCipherSuites")
+	test.StrContains(t, contents, "AuthParamMethods GET")
+	test.StrContains(t, contents, "# AuthReadRequired true")
+	test.StrContains(t, contents, "AuthWriteRequired false")
+	test.StrContains(t, contents, "AuthRealm Secret Stuff")
+	test.StrContains(t, contents, "SizeLimitByType image/*:2000 text/plain:100")
+	test.StrContains(t, contents, "KeyLimits 3f1a9c0b:5:1000:1h0m0s")
+	test.StrContains(t, contents, "VerifyOnRead fail")
+	test.StrContains(t, contents, "CompressFiles true")
+	test.StrContains(t, contents, "CompressResponses false")
+	test.StrContains(t, contents, "EncryptAtRest true")
+	test.StrContains(t, contents, "AtRestKey hoaGhoaGhoaGhoaGhoaGhoaGhoaGhoaGhoaGhoaGhoY=")
+	test.StrContains(t, contents, "ForceDownloadForBrowsers true")
+	test.StrContains(t, contents, "CustomIndexFile /etc/pcopy/index.html")
+	test.StrContains(t, contents, `CurlBanner Welcome!\nSee https://wiki.example.com`)
+	test.StrContains(t, contents, "StaticDir /etc/pcopy/static")
+	test.StrContains(t, contents, "RedactIDsInLogs true")
+	test.StrContains(t, contents, "AuthFailureDelay 1s")
+	test.StrContains(t, contents, "AuthFailureThreshold 3")
+	test.StrContains(t, contents, "AuthFailureWindow 30m")
+	test.StrContains(t, contents, "RequireAuthNonce true")
+	test.StrContains(t, contents, "EnableMetrics true")
+	test.StrContains(t, contents, "EnableSearch true")
+	test.StrContains(t, contents, "EnableAdmin true")
+	test.StrContains(t, contents, "NamespaceByKey true")
+	test.StrContains(t, contents, "LogFile /var/log/pcopy.log")
+	test.StrContains(t, contents, "LogMaxSizeMB 20")
+	test.StrContains(t, contents, "PutRateLimitPerMinute 0")
+	test.StrContains(t, contents, "PutRateBurst 10")
+	test.StrContains(t, contents, "TrustedProxies ::1 192.168.0.0/16")
+	test.StrContains(t, contents, "AllowedOrigins *")
+	test.StrContains(t, contents, "\nRedirectHTTPS false")
+	test.StrContains(t, contents, "ExternalURL https://pcopy.example.com:8443")
+	test.StrContains(t, contents, "LogMaxBackups 0")
+	test.StrContains(t, contents, "LogCompress false")
+	test.StrContains(t, contents, "LogFormat json")
+	test.StrContains(t, contents, "SMTPAddr mail.example.com:25")
+	test.StrContains(t, contents, "SMTPFrom pcopy@example.com")
+	test.StrContains(t, contents, "WebhookURL http://localhost:8080/hook")
+	test.StrContains(t, contents, "# WebhookSecret")
+	test.StrContains(t, contents, "# SMTPUser")
+	test.StrContains(t, contents, "Keys b2xkIHNhbHQ=:MTYgYnl0ZXMgZXhhY3RseQ==")
 }
 
 func TestConfig_WriteFileNoneOfTheThings(t *testing.T) {
@@ -203,11 +454,69 @@ func TestConfig_WriteFileNoneOfTheThings(t *testing.T) {
 	test.StrContains(t, contents, "# KeyFile")
 	test.StrContains(t, contents, "# ClipboardName pcopy")
 	test.StrContains(t, contents, "# ClipboardDir /var/cache/pcopy")
+	test.StrContains(t, contents, "# ShardDir false")
+	test.StrContains(t, contents, "# FileMode 0600")
+	test.StrContains(t, contents, "# DirMode 0700")
 	test.StrContains(t, contents, "# ClipboardCountLimit")
+	test.StrContains(t, contents, "# MaxConcurrentUploads")
+	test.StrContains(t, contents, "# MaxConcurrentStreams 0")
+	test.StrContains(t, contents, "# ReadTimeout 0")
+	test.StrContains(t, contents, "# WriteTimeout 0")
+	test.StrContains(t, contents, "# MaxUploadDuration 0")
+	test.StrContains(t, contents, "# StreamWaitTimeout 0")
 	test.StrContains(t, contents, "# ClipboardSizeLimit")
+	test.StrContains(t, contents, "# MinFreeDiskBytes 0")
+	test.StrContains(t, contents, "# SizePerVisitorLimit 0")
 	test.StrContains(t, contents, "# FileSizeLimit")
 	test.StrContains(t, contents, "# FileExpireAfter 7d")
+	test.StrContains(t, contents, "# FileExpireAfterByMode")
+	test.StrContains(t, contents, "# AllowNeverExpire false")
 	test.StrContains(t, contents, "# FileModesAllowed rw ro")
+	test.StrContains(t, contents, "# DefaultFileMode rw")
+	test.StrContains(t, contents, "# ReservedIDs")
+	test.StrContains(t, contents, "# IDMaxLength 100")
+	test.StrContains(t, contents, "# IDPattern")
+	test.StrContains(t, contents, "# AutoCertDomains")
+	test.StrContains(t, contents, "# TLSMinVersion 1.2")
+	test.StrContains(t, contents, "# AuthParamMethods GET HEAD")
+	test.StrContains(t, contents, "# AuthReadRequired true")
+	test.StrContains(t, contents, "# AuthWriteRequired true")
+	test.StrContains(t, contents, "# AuthRealm pcopy")
+	test.StrContains(t, contents, "# SizeLimitByType")
+	test.StrContains(t, contents, "# KeyLimits")
+	test.StrContains(t, contents, "# VerifyOnRead off")
+	test.StrContains(t, contents, "# CompressFiles false")
+	test.StrContains(t, contents, "# CompressResponses true")
+	test.StrContains(t, contents, "# EncryptAtRest false")
+	test.StrContains(t, contents, "# AtRestKey\n")
+	test.StrContains(t, contents, "# ForceDownloadForBrowsers false")
+	test.StrContains(t, contents, "# CustomIndexFile")
+	test.StrContains(t, contents, "# CurlBanner")
+	test.StrContains(t, contents, "# StaticDir")
+	test.StrContains(t, contents, "# RedactIDsInLogs false")
+	test.StrContains(t, contents, "# AuthFailureDelay 0")
+	test.StrContains(t, contents, "# AuthFailureThreshold 10")
+	test.StrContains(t, contents, "# AuthFailureWindow 10m")
+	test.StrContains(t, contents, "# RequireAuthNonce false")
+	test.StrContains(t, contents, "# EnableMetrics false")
+	test.StrContains(t, contents, "# EnableSearch false")
+	test.StrContains(t, contents, "# EnableAdmin false")
+	test.StrContains(t, contents, "# NamespaceByKey false")
+	test.StrContains(t, contents, "# LogFile")
+	test.StrContains(t, contents, "# LogMaxSizeMB 100")
+	test.StrContains(t, contents, "# PutRateLimitPerMinute 1")
+	test.StrContains(t, contents, "# PutRateBurst 50")
+	test.StrContains(t, contents, "# TrustedProxies")
+	test.StrContains(t, contents, "# AllowedOrigins")
+	test.StrContains(t, contents, "# RedirectHTTPS true")
+	test.StrContains(t, contents, "# ExternalURL")
+	test.StrContains(t, contents, "# LogMaxBackups 5")
+	test.StrContains(t, contents, "# LogCompress true")
+	test.StrContains(t, contents, "# LogFormat text")
+	test.StrContains(t, contents, "# SMTPAddr")
+	test.StrContains(t, contents, "# SMTPFrom")
+	test.StrContains(t, contents, "# WebhookURL")
+	test.StrContains(t, contents, "# Keys")
 }
 
 func TestConfig_LoadConfigFileExpireAfterNoValue(t *testing.T) {
@@ -250,6 +559,28 @@ func TestConfig_LoadConfigFileExpireAfterThreeValues(t *testing.T) {
 	test.DurationEquals(t, 7*24*time.Hour, config.FileExpireAfterTextMax)
 }
 
+func TestConfig_LoadConfigFileExpireAfterNeverDefault(t *testing.T) {
+	config, err := loadConfig(strings.NewReader("FileExpireAfter 0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.DurationEquals(t, 0, config.FileExpireAfterDefault)
+	test.DurationEquals(t, 0, config.FileExpireAfterNonTextMax)
+	test.DurationEquals(t, 0, config.FileExpireAfterTextMax)
+
+	// With a max value, a default of "never expire" has to be allowed explicitly
+	if _, err := loadConfig(strings.NewReader("FileExpireAfter 0 10d")); err == nil {
+		t.Fatalf("expected error due to default value 0 without AllowNeverExpire, got none")
+	}
+	config, err = loadConfig(strings.NewReader("AllowNeverExpire true\nFileExpireAfter 0 10d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.BoolEquals(t, true, config.AllowNeverExpire)
+	test.DurationEquals(t, 0, config.FileExpireAfterDefault)
+	test.DurationEquals(t, 10*24*time.Hour, config.FileExpireAfterNonTextMax)
+}
+
 func TestConfig_LoadConfigFileExpireAfterThreeValuesInfiniteText(t *testing.T) {
 	config, err := loadConfig(strings.NewReader(`FileExpireAfter 6d 10d 0`))
 	if err != nil {
@@ -282,6 +613,18 @@ func TestConfig_LoadConfigFromFileFailedDueToMissingKey(t *testing.T) {
 	}
 }
 
+func TestConfig_LoadConfigFromFileFailedDueToInvalidFileMode(t *testing.T) {
+	for _, contents := range []string{"FileMode 0400", "FileMode 0999", "FileMode 10600", "DirMode 0600"} {
+		filename := filepath.Join(t.TempDir(), "some.conf")
+		ioutil.WriteFile(filename, []byte(contents), 0700)
+
+		_, err := LoadFromFile(filename)
+		if err == nil {
+			t.Fatalf("expected error due to invalid permissions '%s', got none", contents)
+		}
+	}
+}
+
 func TestConfig_LoadConfigFromFileFailedDueToInvalidClipboardSizeLimit(t *testing.T) {
 	filename := filepath.Join(t.TempDir(), "some.conf")
 	contents := "ClipboardSizeLimit invalid-value"
@@ -315,6 +658,28 @@ func TestConfig_LoadConfigFromFileFailedDueToInvalidFileMode1(t *testing.T) {
 	}
 }
 
+func TestConfig_LoadConfigFromFileFailedDueToDefaultFileModeNotAllowed(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.conf")
+	contents := "FileModesAllowed ro\nDefaultFileMode rw"
+	ioutil.WriteFile(filename, []byte(contents), 0700)
+
+	_, err := LoadFromFile(filename)
+	if err == nil {
+		t.Fatalf("expected error due to DefaultFileMode not in FileModesAllowed, got none")
+	}
+}
+
+func TestConfig_LoadConfigFromFileFailedDueToInvalidIDPattern(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.conf")
+	contents := "IDPattern [a-z"
+	ioutil.WriteFile(filename, []byte(contents), 0700)
+
+	_, err := LoadFromFile(filename)
+	if err == nil {
+		t.Fatalf("expected error due to invalid IDPattern, got none")
+	}
+}
+
 func TestConfig_LoadConfigFromFileFailedDueToInvalidFileMode2(t *testing.T) {
 	filename := filepath.Join(t.TempDir(), "some.conf")
 	contents := "FileModesAllowed rw ro123"
@@ -326,6 +691,182 @@ func TestConfig_LoadConfigFromFileFailedDueToInvalidFileMode2(t *testing.T) {
 	}
 }
 
+func TestConfig_LoadConfigFromFileFailedDueToInvalidAuthRealm(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.conf")
+	contents := `AuthRealm "quoted"`
+	ioutil.WriteFile(filename, []byte(contents), 0700)
+
+	_, err := LoadFromFile(filename)
+	if err == nil {
+		t.Fatalf("expected error due to invalid auth realm, got none")
+	}
+}
+
+func TestConfig_LoadConfigFromFileFailedDueToInvalidAuthParamMethod(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.conf")
+	contents := "AuthParamMethods GET DELETEALL"
+	ioutil.WriteFile(filename, []byte(contents), 0700)
+
+	_, err := LoadFromFile(filename)
+	if err == nil {
+		t.Fatalf("expected error due to invalid auth param method, got none")
+	}
+}
+
+func TestConfig_LoadConfigFromFileFailedDueToInvalidSizeLimitByType(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.conf")
+	contents := "SizeLimitByType text/plain=10k"
+	ioutil.WriteFile(filename, []byte(contents), 0700)
+
+	_, err := LoadFromFile(filename)
+	if err == nil {
+		t.Fatalf("expected error due to invalid size limit by type, got none")
+	}
+}
+
+func TestConfig_LoadConfigFileExpireAfterByModeNotAllowed(t *testing.T) {
+	_, err := loadConfig(strings.NewReader("FileModesAllowed rw\nFileExpireAfterByMode ro:7d"))
+	if err == nil {
+		t.Fatalf("expected error due to mode not in FileModesAllowed, got none")
+	}
+	_, err = loadConfig(strings.NewReader("FileExpireAfterByMode rw=1h"))
+	if err == nil {
+		t.Fatalf("expected error due to invalid format, got none")
+	}
+}
+
+func TestConfig_LoadConfigFromFileFailedDueToInvalidKeyLimits(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.conf")
+	contents := "KeyLimits 3f1a9c0b:10:10M"
+	ioutil.WriteFile(filename, []byte(contents), 0700)
+
+	_, err := LoadFromFile(filename)
+	if err == nil {
+		t.Fatalf("expected error due to invalid key limits, got none")
+	}
+}
+
+func TestConfig_LoadConfigFromFileFailedDueToNegativeLogMaxSizeMB(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.conf")
+	contents := "LogMaxSizeMB -1"
+	ioutil.WriteFile(filename, []byte(contents), 0700)
+
+	_, err := LoadFromFile(filename)
+	if err == nil {
+		t.Fatalf("expected error due to negative log max size, got none")
+	}
+}
+
+func TestConfig_LoadConfigFromFileFailedDueToInvalidPutRateBurst(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.conf")
+	contents := "PutRateBurst 0"
+	ioutil.WriteFile(filename, []byte(contents), 0700)
+
+	_, err := LoadFromFile(filename)
+	if err == nil {
+		t.Fatalf("expected error due to invalid put rate burst, got none")
+	}
+}
+
+func TestConfig_LoadConfigFromFileFailedDueToInvalidExternalURL(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.conf")
+	contents := "ExternalURL pcopy.example.com"
+	ioutil.WriteFile(filename, []byte(contents), 0700)
+
+	_, err := LoadFromFile(filename)
+	if err == nil {
+		t.Fatalf("expected error due to invalid external URL, got none")
+	}
+}
+
+func TestConfig_LoadConfigFromFileFailedDueToInvalidTrustedProxies(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.conf")
+	contents := "TrustedProxies 127.0.0.1 nginx"
+	ioutil.WriteFile(filename, []byte(contents), 0700)
+
+	_, err := LoadFromFile(filename)
+	if err == nil {
+		t.Fatalf("expected error due to invalid trusted proxies, got none")
+	}
+}
+
+func TestConfig_LoadConfigFromFileFailedDueToInvalidAllowedOrigins(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.conf")
+	contents := "AllowedOrigins https://app.example.com/some/path"
+	ioutil.WriteFile(filename, []byte(contents), 0700)
+
+	_, err := LoadFromFile(filename)
+	if err == nil {
+		t.Fatalf("expected error due to invalid allowed origins, got none")
+	}
+}
+
+func TestConfig_LoadConfigFromFileFailedDueToMissingSMTPFrom(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.conf")
+	contents := "SMTPAddr mail.example.com:25"
+	ioutil.WriteFile(filename, []byte(contents), 0700)
+
+	_, err := LoadFromFile(filename)
+	if err == nil {
+		t.Fatalf("expected error due to missing SMTPFrom, got none")
+	}
+}
+
+func TestConfig_LoadConfigFromFileFailedDueToInvalidSMTPAddr(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.conf")
+	contents := "SMTPAddr mail.example.com\nSMTPFrom pcopy@example.com"
+	ioutil.WriteFile(filename, []byte(contents), 0700)
+
+	_, err := LoadFromFile(filename)
+	if err == nil {
+		t.Fatalf("expected error due to invalid SMTPAddr, got none")
+	}
+}
+
+func TestConfig_LoadConfigFromFileFailedDueToInvalidWebhookURL(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.conf")
+	contents := "WebhookURL ftp://example.com/hook"
+	ioutil.WriteFile(filename, []byte(contents), 0700)
+
+	_, err := LoadFromFile(filename)
+	if err == nil {
+		t.Fatalf("expected error due to invalid WebhookURL, got none")
+	}
+}
+
+func TestConfig_LoadConfigFromFileFailedDueToInvalidTLSMinVersion(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.conf")
+	contents := "TLSMinVersion 1.4"
+	ioutil.WriteFile(filename, []byte(contents), 0700)
+
+	_, err := LoadFromFile(filename)
+	if err == nil {
+		t.Fatalf("expected error due to invalid TLSMinVersion, got none")
+	}
+}
+
+func TestConfig_LoadConfigFromFileFailedDueToInsecureTLSCipherSuite(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.conf")
+	contents := "TLSCipherSuites TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 TLS_RSA_WITH_RC4_128_SHA"
+	ioutil.WriteFile(filename, []byte(contents), 0700)
+
+	_, err := LoadFromFile(filename)
+	if err == nil {
+		t.Fatalf("expected error due to insecure TLSCipherSuites, got none")
+	}
+}
+
+func TestConfig_LoadConfigFromFileFailedDueToInvalidLogFormat(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "some.conf")
+	contents := "LogFormat xml"
+	ioutil.WriteFile(filename, []byte(contents), 0700)
+
+	_, err := LoadFromFile(filename)
+	if err == nil {
+		t.Fatalf("expected error due to invalid LogFormat, got none")
+	}
+}
+
 func TestConfigStore_FileFromName(t *testing.T) {
 	dir := t.TempDir()
 	store := newStoreWithDir(dir)
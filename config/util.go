@@ -1,6 +1,7 @@
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net/url"
 	"os"
@@ -83,3 +84,51 @@ func defaultFileWithNewExt(newExtension string, configFile string, mustExist boo
 	}
 	return file
 }
+
+// ParseTLSVersion converts a TLS version string, e.g. "1.2" or "1.3", to the matching tls.VersionTLS* constant.
+// An empty string returns 0, which means the Go default.
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %s, expected 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// ParseTLSCipherSuites converts cipher suite names as defined in crypto/tls, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+// to their IDs. Cipher suites that crypto/tls considers insecure are rejected.
+func ParseTLSCipherSuites(names []string) ([]uint16, error) {
+	ids := make([]uint16, 0)
+	for _, name := range names {
+		id, ok := uint16(0), false
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				id, ok = suite.ID, true
+				break
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// IsFileModeAllowed returns true if the given file mode is in the list of allowed modes, see Config.FileModesAllowed
+func IsFileModeAllowed(allowed []string, mode string) bool {
+	for _, m := range allowed {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
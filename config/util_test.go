@@ -1,6 +1,7 @@
 package config
 
 import (
+	"crypto/tls"
 	"heckel.io/pcopy/test"
 	"testing"
 )
@@ -48,3 +49,28 @@ func TestCollapseServerAddr_FullHTTPSURL(t *testing.T) {
 func TestCollapseServerAddr_FullHTTPSURL443(t *testing.T) {
 	test.StrEquals(t, "myhost:443", CollapseServerAddr("https://myhost"))
 }
+
+func TestParseTLSVersion(t *testing.T) {
+	version, err := ParseTLSVersion("1.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, tls.VersionTLS13, int64(version))
+	version, _ = ParseTLSVersion("")
+	test.Int64Equals(t, 0, int64(version))
+	if _, err := ParseTLSVersion("TLS1.2"); err == nil {
+		t.Fatalf("expected error, got none")
+	}
+}
+
+func TestParseTLSCipherSuites(t *testing.T) {
+	ids, err := ParseTLSCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, int64(tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384), int64(ids[0]))
+	test.Int64Equals(t, int64(tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256), int64(ids[1]))
+	if _, err := ParseTLSCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"}); err == nil {
+		t.Fatalf("expected error for insecure cipher suite, got none")
+	}
+}
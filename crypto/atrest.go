@@ -0,0 +1,184 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// AtRestNonceLenBytes is the length of the random nonce that is generated for each encrypted file. The file
+	// is encrypted with a key derived from the at-rest key and this nonce, see NewEncryptWriter.
+	AtRestNonceLenBytes = 16
+
+	atRestKeyInfo       = "pcopy at-rest encryption"
+	atRestChunkLenBytes = 64 * 1024 // Max. plaintext length of a single chunk
+	atRestHeaderLen     = 4         // Chunk header: plaintext length, highest bit marks the last chunk
+	atRestLastChunkFlag = 1 << 31
+)
+
+// ErrDecryptFailed is returned by the reader created with NewDecryptReader if the content was modified,
+// truncated, or encrypted with a different key
+var ErrDecryptFailed = errors.New("decryption failed")
+
+// DeriveAtRestKey derives the key used to encrypt files at rest from the given (server) key, so that the
+// key itself is never used for more than one purpose
+func DeriveAtRestKey(key *Key) []byte {
+	hash := hmac.New(sha256.New, key.Bytes)
+	hash.Write([]byte(atRestKeyInfo))
+	return hash.Sum(nil)
+}
+
+// GenerateAtRestNonce generates a random nonce for NewEncryptWriter
+func GenerateAtRestNonce() ([]byte, error) {
+	nonce := make([]byte, AtRestNonceLenBytes)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// NewEncryptWriter returns a writer that encrypts everything written to it with AES-GCM, and writes it to w.
+// The content is split into chunks that are authenticated individually, so that it can be written and read
+// as a stream (e.g. through a pipe). Each Write is sent on immediately. Close must be called to mark the end
+// of the content; it does not close w. The same nonce must be passed to NewDecryptReader.
+func NewEncryptWriter(w io.Writer, key []byte, nonce []byte) (io.WriteCloser, error) {
+	aead, err := newAtRestCipher(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead}, nil
+}
+
+// NewDecryptReader returns a reader that decrypts the content written by a writer created with NewEncryptWriter.
+// If the content was modified, reordered or truncated, or if the key or nonce is wrong, ErrDecryptFailed is returned.
+func NewDecryptReader(r io.Reader, key []byte, nonce []byte) (io.Reader, error) {
+	aead, err := newAtRestCipher(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: r, aead: aead}, nil
+}
+
+// newAtRestCipher creates the AES-GCM cipher for a single file, using a key derived from the at-rest key and
+// the file's nonce. Since every file has its own key, the GCM nonces only need to be unique within a file.
+func newAtRestCipher(key []byte, nonce []byte) (cipher.AEAD, error) {
+	hash := hmac.New(sha256.New, key)
+	hash.Write(nonce)
+	block, err := aes.NewCipher(hash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the GCM nonce for the chunk with the given index. The last chunk uses a different nonce,
+// so that a truncated file cannot be passed off as complete.
+func chunkNonce(aead cipher.AEAD, index uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	index  uint64
+	closed bool
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > atRestChunkLenBytes {
+			n = atRestChunkLenBytes
+		}
+		if err := e.writeChunk(p[:n], false); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.writeChunk(nil, true)
+}
+
+func (e *encryptWriter) writeChunk(plaintext []byte, last bool) error {
+	chunk := make([]byte, atRestHeaderLen, atRestHeaderLen+len(plaintext)+e.aead.Overhead())
+	header := uint32(len(plaintext))
+	if last {
+		header |= atRestLastChunkFlag
+	}
+	binary.BigEndian.PutUint32(chunk, header)
+	chunk = e.aead.Seal(chunk, chunkNonce(e.aead, e.index, last), plaintext, chunk[:atRestHeaderLen])
+	e.index++
+	_, err := e.w.Write(chunk)
+	return err
+}
+
+type decryptReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	index uint64
+	buf   []byte // Decrypted bytes of the current chunk that have not been read yet
+	done  bool   // Last chunk was read
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptReader) readChunk() error {
+	header := make([]byte, atRestHeaderLen)
+	if _, err := io.ReadFull(d.r, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return io.ErrUnexpectedEOF // The last chunk is missing, i.e. the content is incomplete
+	} else if err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(header)
+	last := length&atRestLastChunkFlag != 0
+	length &^= atRestLastChunkFlag
+	if length > atRestChunkLenBytes {
+		return ErrDecryptFailed
+	}
+	chunk := make([]byte, int(length)+d.aead.Overhead())
+	if _, err := io.ReadFull(d.r, chunk); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	plaintext, err := d.aead.Open(chunk[:0], chunkNonce(d.aead, d.index, last), chunk, header)
+	if err != nil {
+		return ErrDecryptFailed
+	}
+	d.index++
+	d.buf = plaintext
+	d.done = last
+	return nil
+}
@@ -9,20 +9,26 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"golang.org/x/crypto/pbkdf2"
 	"io/ioutil"
 	"math/big"
+	"net"
 	"regexp"
 	"time"
 )
 
 const (
+	// DefaultCertValidity is the validity of the certificates generated by GenerateKeyAndCert (~ 3 years)
+	DefaultCertValidity = time.Hour * 24 * 365 * 3
+
 	// KeyLenBytes is a constant that defines the length of the key that is derived from the password (128-bit)
 	KeyLenBytes = 32
 
@@ -30,11 +36,12 @@ const (
 	KeyDerivIter = 10000
 
 	keySaltLenBytes  = 10
-	certNotBeforeAge = -time.Hour * 24 * 7      // ~ 1 week
-	certNotAfterAge  = time.Hour * 24 * 365 * 3 // ~ 3 years
+	certNotBeforeAge = -time.Hour * 24 * 7 // ~ 1 week
 
 	// TODO move hmac validation in this package as well
-	authHmacFormat = "HMAC %d %d %s" // timestamp ttl b64-hmac
+	authHmacFormat      = "HMAC %d %d %s"    // timestamp ttl b64-hmac
+	authHmacNonceFormat = "HMAC %d %d %s %s" // timestamp ttl nonce b64-hmac
+	authNonceLenBytes   = 12
 )
 
 // Key defines the symmetric key that is derived from the user password. It consists of the raw key bytes
@@ -64,6 +71,13 @@ func DeriveKey(password []byte, salt []byte) *Key {
 	}
 }
 
+// KeyID returns a short identifier for the given key, derived from its salt. Since the salt is not secret, the
+// ID can be shared publicly. It is used to let clients pick the right salt if a server accepts multiple keys.
+func KeyID(key *Key) string {
+	hash := sha256.Sum256(key.Salt)
+	return hex.EncodeToString(hash[:4])
+}
+
 // EncodeKey encodes the raw key and salt into a string in the format SALT:KEY, with both parts
 // being base64 encoded.
 func EncodeKey(key *Key) string {
@@ -154,45 +168,118 @@ func EncodeCurlPinnedPublicKeyHash(hash []byte) string {
 	return fmt.Sprintf("sha256//%s", base64.StdEncoding.EncodeToString(hash))
 }
 
-// ReadCurlPinnedPublicKeyFromFile reads a cert from the given filename and calculates the public key for curl
+// CalculatePublicKeyPin calculates the pin of the public key contained in the given certificate, in the format that
+// curl's --pinnedpubkey option expects, i.e. "sha256//<base64-hash>". If the public key cannot be encoded, an empty
+// string is returned.
+func CalculatePublicKeyPin(cert *x509.Certificate) string {
+	hash, err := CalculatePublicKeyHash(cert)
+	if err != nil {
+		return ""
+	}
+	return EncodeCurlPinnedPublicKeyHash(hash)
+}
+
+// NewTLSConfigWithPinnedPublicKey returns a TLS config that only accepts servers whose certificate matches the given
+// public key pin (see CalculatePublicKeyPin). Like with curl's --pinnedpubkey option, the certificate is not verified
+// against the system's CAs, so self-signed certificates are accepted as long as the pin matches.
+func NewTLSConfigWithPinnedPublicKey(pin string) *tls.Config {
+	verifyPinFn := func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errPinnedPublicKeyMismatch
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if actual := CalculatePublicKeyPin(cert); pin == "" || actual != pin {
+			return errPinnedPublicKeyMismatch
+		}
+		return nil
+	}
+	return &tls.Config{
+		InsecureSkipVerify:    true, // The pin is checked manually
+		VerifyPeerCertificate: verifyPinFn,
+	}
+}
+
+// ReadCurlPinnedPublicKeyFromFile reads a cert from the given filename and calculates the public key pin for curl
+// (see CalculatePublicKeyPin). If the certificate is not self-signed, no pin is needed, and an empty string is returned.
 func ReadCurlPinnedPublicKeyFromFile(filename string) (string, error) {
 	cert, err := LoadCertFromFile(filename)
 	if err != nil {
 		return "", err
 	}
 	if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
-		hash, err := CalculatePublicKeyHash(cert)
-		if err != nil {
-			return "", err
+		pin := CalculatePublicKeyPin(cert)
+		if pin == "" {
+			return "", errInvalidPublicKey
 		}
-		return EncodeCurlPinnedPublicKeyHash(hash), nil
+		return pin, nil
 	}
 	return "", nil
 }
 
 // GenerateAuthHMAC generates the HMAC auth header used to authorize uthenticate against the server.
 // The result can be used in the HTTP "Authorization" header. If the TTL is non-zero, the authorization
-// header will only be valid for the given duration.
+// header will only be valid for the given duration. The header contains a random nonce, so that servers
+// can reject replayed headers (see config.RequireAuthNonce).
 func GenerateAuthHMAC(key []byte, method string, path string, ttl time.Duration) (string, error) {
-	return generateAuthHMAC(time.Now().Unix(), key, method, path, ttl)
+	nonce := make([]byte, authNonceLenBytes)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return generateAuthHMAC(time.Now().Unix(), hex.EncodeToString(nonce), key, method, path, ttl)
 }
 
-func generateAuthHMAC(timestamp int64, key []byte, method string, path string, ttl time.Duration) (string, error) {
+// GenerateReusableAuthHMAC generates an HMAC auth header like GenerateAuthHMAC, but without a nonce, so that it
+// can be used more than once until it expires, e.g. in a shared link. Servers that require a nonce (see
+// config.RequireAuthNonce) reject it.
+func GenerateReusableAuthHMAC(key []byte, method string, path string, ttl time.Duration) (string, error) {
+	return generateAuthHMAC(time.Now().Unix(), "", key, method, path, ttl)
+}
+
+// generateAuthHMAC generates the HMAC auth header. If the nonce is empty, the old format without nonce is used.
+func generateAuthHMAC(timestamp int64, nonce string, key []byte, method string, path string, ttl time.Duration) (string, error) {
 	ttlSecs := int(ttl.Seconds())
-	data := []byte(fmt.Sprintf("%d:%d:%s:%s", timestamp, ttlSecs, method, path))
 	hash := hmac.New(sha256.New, key)
-	if _, err := hash.Write(data); err != nil {
+	if _, err := hash.Write(AuthHMACData(timestamp, ttlSecs, nonce, method, path)); err != nil {
 		return "", err
 	}
 
 	hashBase64 := base64.StdEncoding.EncodeToString(hash.Sum(nil))
-	return fmt.Sprintf(authHmacFormat, timestamp, ttlSecs, hashBase64), nil
+	if nonce == "" {
+		return fmt.Sprintf(authHmacFormat, timestamp, ttlSecs, hashBase64), nil
+	}
+	return fmt.Sprintf(authHmacNonceFormat, timestamp, ttlSecs, nonce, hashBase64), nil
 }
 
-// GenerateKeyAndCert generates a ECDSA P-256 key, and a self-signed certificate.
-// It returns both as PEM-encoded values.
+// AuthHMACData returns the data that is signed in the HMAC auth header. The nonce is optional, since older
+// clients do not send it.
+func AuthHMACData(timestamp int64, ttlSecs int, nonce string, method string, path string) []byte {
+	if nonce == "" {
+		return []byte(fmt.Sprintf("%d:%d:%s:%s", timestamp, ttlSecs, method, path))
+	}
+	return []byte(fmt.Sprintf("%d:%d:%s:%s:%s", timestamp, ttlSecs, nonce, method, path))
+}
+
+// GenerateKeyAndCert generates a ECDSA P-256 key, and a self-signed certificate for the given hostname that is valid
+// for DefaultCertValidity. It returns both as PEM-encoded values. See GenerateKeyAndCertForNames for multiple names.
 func GenerateKeyAndCert(hostname string) (string, string, error) {
-	key, cert, err := generateKeyAndCertRaw(hostname)
+	return GenerateKeyAndCertForNames([]string{hostname}, DefaultCertValidity)
+}
+
+// GenerateKeyAndCertForNames generates a ECDSA P-256 key, and a self-signed certificate for the given names, which
+// may be DNS names or IP addresses. The first name is used as common name. The certificate is valid for the given
+// duration; zero means DefaultCertValidity. It returns both as PEM-encoded values.
+func GenerateKeyAndCertForNames(names []string, validFor time.Duration) (string, string, error) {
+	if len(names) == 0 {
+		return "", "", errCertNamesMissing
+	} else if validFor < 0 {
+		return "", "", errCertValidityInvalid
+	} else if validFor == 0 {
+		validFor = DefaultCertValidity
+	}
+	key, cert, err := generateKeyAndCertRaw(names, validFor)
 	if err != nil {
 		return "", "", err
 	}
@@ -207,7 +294,7 @@ func GenerateKeyAndCert(hostname string) (string, string, error) {
 	return string(pemKey), string(pemCert), nil
 }
 
-func generateKeyAndCertRaw(hostname string) (*ecdsa.PrivateKey, *x509.Certificate, error) {
+func generateKeyAndCertRaw(names []string, validFor time.Duration) (*ecdsa.PrivateKey, *x509.Certificate, error) {
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return nil, nil, err
@@ -220,10 +307,16 @@ func generateKeyAndCertRaw(hostname string) (*ecdsa.PrivateKey, *x509.Certificat
 	}
 	template := x509.Certificate{
 		SerialNumber: serial,
-		Subject:      pkix.Name{CommonName: hostname},
-		DNSNames:     []string{hostname},
+		Subject:      pkix.Name{CommonName: names[0]},
 		NotBefore:    time.Now().Add(certNotBeforeAge),
-		NotAfter:     time.Now().Add(certNotAfterAge),
+		NotAfter:     time.Now().Add(validFor),
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
 	}
 	derCert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
 	if err != nil {
@@ -250,3 +343,7 @@ func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
 
 var errInvalidKeyFormat = errors.New("invalid key format")
 var errNoCertFound = errors.New("no cert found in file")
+var errCertNamesMissing = errors.New("at least one name required for certificate")
+var errCertValidityInvalid = errors.New("certificate validity cannot be negative")
+var errInvalidPublicKey = errors.New("cannot encode public key")
+var errPinnedPublicKeyMismatch = errors.New("server public key does not match pin")
@@ -2,12 +2,16 @@ package crypto
 
 import (
 	"bytes"
+	"encoding/base64"
 	"heckel.io/pcopy/test"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 )
@@ -54,6 +58,11 @@ func TestDeriveKey_2(t *testing.T) {
 	}
 }
 
+func TestKeyID(t *testing.T) {
+	key := DeriveKey([]byte("some password"), []byte("some salt"))
+	test.StrEquals(t, "b38245f1", KeyID(key))
+}
+
 func TestEncodeKey_NonNil(t *testing.T) {
 	key := &Key{
 		Salt:  test.FromBase64(t, "Osz6osE1fRRirA=="),
@@ -198,6 +207,32 @@ func TestGenerateKeyAndCert(t *testing.T) {
 	test.StrEquals(t, "thiscert.com", crt.DNSNames[0])
 }
 
+func TestGenerateKeyAndCertForNames(t *testing.T) {
+	dir := t.TempDir()
+	_, cert, err := GenerateKeyAndCertForNames([]string{"thiscert.com", "www.thiscert.com", "10.0.1.2", "::1"}, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certfile := filepath.Join(dir, "cert")
+	ioutil.WriteFile(certfile, []byte(cert), 0600)
+
+	crt, _ := LoadCertFromFile(certfile)
+	test.StrEquals(t, "thiscert.com", crt.Subject.CommonName)
+	test.StrEquals(t, "thiscert.com www.thiscert.com", strings.Join(crt.DNSNames, " "))
+	test.Int64Equals(t, 2, int64(len(crt.IPAddresses)))
+	test.StrEquals(t, "10.0.1.2", crt.IPAddresses[0].String())
+	test.StrEquals(t, "::1", crt.IPAddresses[1].String())
+	test.BoolEquals(t, true, time.Until(crt.NotAfter) > 23*time.Hour && time.Until(crt.NotAfter) <= 24*time.Hour)
+	if err := crt.VerifyHostname("10.0.1.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := GenerateKeyAndCertForNames([]string{}, time.Hour); err != errCertNamesMissing {
+		t.Fatalf("expected errCertNamesMissing, got %v", err)
+	}
+}
+
 func TestEncodeCertAndReadCurlPinnedPublicKeyFromFileSuccess(t *testing.T) {
 	dir := t.TempDir()
 	serv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -226,6 +261,46 @@ func TestEncodeCertAndReadCurlPinnedPublicKeyFromFileSuccess(t *testing.T) {
 	test.StrEquals(t, "hi there what's up", stdout.String())
 }
 
+func TestCalculatePublicKeyPin(t *testing.T) {
+	_, pemCert, err := GenerateKeyAndCert("thiscert.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certfile := filepath.Join(t.TempDir(), "cert")
+	ioutil.WriteFile(certfile, []byte(pemCert), 0600)
+	cert, _ := LoadCertFromFile(certfile)
+
+	// The pin is the one that is advertised to curl (see X-Curl header)
+	pin := CalculatePublicKeyPin(cert)
+	curlPin, _ := ReadCurlPinnedPublicKeyFromFile(certfile)
+	test.StrEquals(t, curlPin, pin)
+	hash, _ := CalculatePublicKeyHash(cert)
+	test.StrEquals(t, "sha256//"+base64.StdEncoding.EncodeToString(hash), pin)
+}
+
+func TestNewTLSConfigWithPinnedPublicKey(t *testing.T) {
+	serv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi there what's up"))
+	}))
+	defer serv.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: NewTLSConfigWithPinnedPublicKey(CalculatePublicKeyPin(serv.Certificate()))}}
+	resp, err := client.Get(serv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.StrEquals(t, "hi there what's up", string(body))
+
+	for _, pin := range []string{"", "sha256//Z0tCCalbcr2Y9+UXq9p72cwGhodTUaptkHUfuy1fvCs="} {
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: NewTLSConfigWithPinnedPublicKey(pin)}}
+		if _, err := client.Get(serv.URL); err == nil {
+			t.Fatalf("expected pin mismatch for pin %q", pin)
+		}
+	}
+}
+
 func TestReadCurlPinnedPublicKeyFromFileFileNotExist(t *testing.T) {
 	_, err := ReadCurlPinnedPublicKeyFromFile("this is not a file")
 	if err == nil {
@@ -279,6 +354,89 @@ eTzmbC8o65uD4keYyszxUIk8bBPGM74=
 func TestGenerateAuthHMAC(t *testing.T) {
 	timestamp := int64(1626482338)
 	key := bytes.Repeat([]byte{0x86}, 32)
-	hmacAuth, _ := generateAuthHMAC(timestamp, key, "GET", "/abcdef", time.Hour)
+	hmacAuth, _ := generateAuthHMAC(timestamp, "", key, "GET", "/abcdef", time.Hour)
 	test.StrEquals(t, "HMAC 1626482338 3600 Z4Z5hOFyX2i+GHBUEV5Ft8CVnuQuts+3lC0yz8uDj8U=", hmacAuth)
 }
+
+func TestGenerateAuthHMAC_WithNonce(t *testing.T) {
+	timestamp := int64(1626482338)
+	key := bytes.Repeat([]byte{0x86}, 32)
+	hmacAuth, _ := generateAuthHMAC(timestamp, "0123456789abcdef01234567", key, "GET", "/abcdef", time.Hour)
+	test.StrEquals(t, "HMAC 1626482338 3600 0123456789abcdef01234567 7bk94yIOwm2I3rEZdjuHc27l+Bjs4hF4b2/sXbAg9LM=", hmacAuth)
+
+	auth1, _ := GenerateAuthHMAC(key, "GET", "/abcdef", time.Hour)
+	auth2, _ := GenerateAuthHMAC(key, "GET", "/abcdef", time.Hour)
+	if auth1 == auth2 {
+		t.Fatalf("expected different nonces, got identical headers %s", auth1)
+	}
+}
+
+func TestGenerateReusableAuthHMAC(t *testing.T) {
+	key := bytes.Repeat([]byte{0x86}, 32)
+	hmacAuth, _ := GenerateReusableAuthHMAC(key, "GET", "/abcdef", time.Hour)
+	test.BoolEquals(t, true, regexp.MustCompile(`^HMAC \d+ 3600 \S+$`).MatchString(hmacAuth))
+}
+
+func TestEncryptWriterDecryptReader(t *testing.T) {
+	key := DeriveAtRestKey(&Key{Bytes: bytes.Repeat([]byte{0x86}, 32)})
+	nonce, _ := GenerateAtRestNonce()
+	plaintext := bytes.Repeat([]byte("pcopy is awesome "), 10000) // Multiple chunks
+
+	var encrypted bytes.Buffer
+	w, err := NewEncryptWriter(&encrypted, key, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(plaintext[:100])
+	w.Write(plaintext[100:])
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted.Bytes(), []byte("pcopy is awesome")) {
+		t.Fatalf("expected content to be encrypted")
+	}
+
+	r, _ := NewDecryptReader(bytes.NewReader(encrypted.Bytes()), key, nonce)
+	decrypted, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.BytesEquals(t, plaintext, decrypted)
+}
+
+func TestDecryptReader_Failures(t *testing.T) {
+	key := bytes.Repeat([]byte{0x86}, 32)
+	nonce, _ := GenerateAtRestNonce()
+	var encrypted bytes.Buffer
+	w, _ := NewEncryptWriter(&encrypted, key, nonce)
+	w.Write([]byte("some secret content"))
+	w.Write([]byte("and some more"))
+	w.Close()
+	content := encrypted.Bytes()
+
+	// Modified content
+	modified := append([]byte{}, content...)
+	modified[10] ^= 0x01
+	r, _ := NewDecryptReader(bytes.NewReader(modified), key, nonce)
+	if _, err := ioutil.ReadAll(r); err != ErrDecryptFailed {
+		t.Fatalf("expected ErrDecryptFailed, got %v", err)
+	}
+
+	// Wrong key or nonce
+	otherNonce, _ := GenerateAtRestNonce()
+	r, _ = NewDecryptReader(bytes.NewReader(content), key, otherNonce)
+	if _, err := ioutil.ReadAll(r); err != ErrDecryptFailed {
+		t.Fatalf("expected ErrDecryptFailed, got %v", err)
+	}
+	r, _ = NewDecryptReader(bytes.NewReader(content), bytes.Repeat([]byte{0x87}, 32), nonce)
+	if _, err := ioutil.ReadAll(r); err != ErrDecryptFailed {
+		t.Fatalf("expected ErrDecryptFailed, got %v", err)
+	}
+
+	// Truncated content, i.e. the last chunk is missing
+	truncated := content[:len(content)-4-16]
+	r, _ = NewDecryptReader(bytes.NewReader(truncated), key, nonce)
+	if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
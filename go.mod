@@ -5,6 +5,7 @@ go 1.16
 require (
 	github.com/urfave/cli/v2 v2.25.0
 	golang.org/x/crypto v0.7.0
+	golang.org/x/net v0.8.0 // indirect
 	golang.org/x/sys v0.6.0
 	golang.org/x/term v0.6.0
 	golang.org/x/time v0.3.0
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"heckel.io/pcopy/config"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	authResultOK     = "ok"
+	authResultFailed = "failed"
+	authResultNone   = "none" // The server has no key, so every request is authorized
+)
+
+type accessLogCtx struct{}
+
+// accessLogEntry is the structured log line written for every request if LogFormat is "json". Since the
+// handlers only see copies of the request, the middleware fills in its results via the request context.
+type accessLogEntry struct {
+	Time       string  `json:"time"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	Visitor    string  `json:"visitor"`
+	DurationMs float64 `json:"durationMs"`
+	Auth       string  `json:"auth,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// statusWriter is a http.ResponseWriter that records the status code and the number of bytes written,
+// so that they can be logged once the request is handled
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes through to the underlying writer, so that streaming responses are not buffered
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// handleWithAccessLog handles the request, and then writes the JSON access log line for it
+func (s *Server) handleWithAccessLog(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	entry := &accessLogEntry{}
+	sw := &statusWriter{ResponseWriter: w}
+	s.handle(sw, r.WithContext(context.WithValue(r.Context(), accessLogCtx{}, entry)))
+	entry.Time = start.UTC().Format(time.RFC3339Nano)
+	entry.Method = r.Method
+	entry.Path = s.logURI(r)
+	entry.Status = sw.status
+	if entry.Status == 0 {
+		entry.Status = http.StatusOK // Nothing was written, so net/http sends a 200
+	}
+	entry.Bytes = sw.bytes
+	entry.Visitor = s.visitorIP(r)
+	entry.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	log.Writer().Write(append(line, '\n'))
+}
+
+// logRequest logs the request as a text line, unless the JSON access log is enabled (see handleWithAccessLog)
+func (s *Server) logRequest(r *http.Request) {
+	if s.config.LogFormat != config.LogFormatJSON {
+		log.Printf("[%s] %s - %s %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, s.logURI(r))
+	}
+}
+
+// logRequestError logs the error of a failed request as a text line, or records it in the JSON access log entry
+func (s *Server) logRequestError(r *http.Request, err error) {
+	if entry, ok := r.Context().Value(accessLogCtx{}).(*accessLogEntry); ok {
+		entry.Error = err.Error()
+		return
+	}
+	log.Printf("[%s] %s - %s %s - %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, s.logURI(r), err.Error())
+}
+
+// recordAuthResult records the result of the request's authorization in the JSON access log entry, if any
+func (s *Server) recordAuthResult(r *http.Request, err error) {
+	entry, ok := r.Context().Value(accessLogCtx{}).(*accessLogEntry)
+	if !ok {
+		return
+	}
+	if err != nil {
+		entry.Auth = authResultFailed
+	} else if s.config.Key == nil {
+		entry.Auth = authResultNone
+	} else {
+		entry.Auth = authResultOK
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"heckel.io/pcopy/clipboard"
+	"net/http"
+	"sort"
+)
+
+// AdminStats is the response of the /admin/stats endpoint. Unlike /stats, it does not list the entries, but
+// includes hidden entries in all values, and reports the disk usage and the configured limits.
+type AdminStats struct {
+	Count     int                  `json:"count"`
+	Size      int64                `json:"size"`      // Original size of all entries, as counted towards the limits
+	DiskUsage int64                `json:"diskUsage"` // Size on disk, including metadata and pending uploads
+	Oldest    *AdminStatsEntry     `json:"oldest,omitempty"`
+	Newest    *AdminStatsEntry     `json:"newest,omitempty"`
+	Visitors  []*AdminStatsVisitor `json:"visitors"`
+	Limits    *AdminStatsLimits    `json:"limits"`
+}
+
+// AdminStatsEntry identifies the oldest or newest clipboard entry in AdminStats
+type AdminStatsEntry struct {
+	ID       string `json:"id"`
+	Modified int64  `json:"modified"`
+}
+
+// AdminStatsVisitor describes the entries uploaded by a single visitor. Entries are only attributed to visitors
+// if config.SizePerVisitorLimit is set.
+type AdminStatsVisitor struct {
+	Addr  string `json:"addr"`
+	Count int    `json:"count"`
+	Size  int64  `json:"size"`
+}
+
+// AdminStatsLimits contains the configured limits in AdminStats. Zero means no limit; durations are in seconds.
+type AdminStatsLimits struct {
+	CountLimit           int   `json:"countLimit"`
+	SizeLimit            int64 `json:"sizeLimit"`
+	FileSizeLimit        int64 `json:"fileSizeLimit"`
+	SizePerVisitorLimit  int64 `json:"sizePerVisitorLimit"`
+	FileExpireDefault    int64 `json:"fileExpireDefault"`
+	FileExpireNonTextMax int64 `json:"fileExpireNonTextMax"`
+	FileExpireTextMax    int64 `json:"fileExpireTextMax"`
+}
+
+// PurgeResult is the response of the /admin/purge endpoint
+type PurgeResult struct {
+	Purged []string `json:"purged"`
+}
+
+// handleAdminStats returns an overview of the clipboard for operators, see AdminStats and config.EnableAdmin
+func (s *Server) handleAdminStats(w http.ResponseWriter, r *http.Request) error {
+	if !s.config.EnableAdmin {
+		return ErrHTTPNotFound
+	}
+	files := make([]*clipboard.File, 0)
+	for _, clip := range s.clipboards() {
+		clipFiles, err := clip.List()
+		if err != nil {
+			return err
+		}
+		files = append(files, clipFiles...)
+	}
+	diskUsage, err := s.clipboard.DiskUsage() // Includes the namespaces, see config.NamespaceByKey
+	if err != nil {
+		return err
+	}
+	response := &AdminStats{
+		DiskUsage: diskUsage,
+		Visitors:  make([]*AdminStatsVisitor, 0),
+		Limits: &AdminStatsLimits{
+			CountLimit:           s.config.ClipboardCountLimit,
+			SizeLimit:            s.config.ClipboardSizeLimit,
+			FileSizeLimit:        s.config.FileSizeLimit,
+			SizePerVisitorLimit:  s.config.SizePerVisitorLimit,
+			FileExpireDefault:    int64(s.config.FileExpireAfterDefault.Seconds()),
+			FileExpireNonTextMax: int64(s.config.FileExpireAfterNonTextMax.Seconds()),
+			FileExpireTextMax:    int64(s.config.FileExpireAfterTextMax.Seconds()),
+		},
+	}
+	visitors := make(map[string]*AdminStatsVisitor)
+	for _, f := range files {
+		response.Count++
+		response.Size += f.Size
+		modified := f.ModTime.Unix()
+		if response.Oldest == nil || modified < response.Oldest.Modified {
+			response.Oldest = &AdminStatsEntry{ID: f.ID, Modified: modified}
+		}
+		if response.Newest == nil || modified > response.Newest.Modified {
+			response.Newest = &AdminStatsEntry{ID: f.ID, Modified: modified}
+		}
+		if f.Visitor == "" {
+			continue
+		}
+		if _, ok := visitors[f.Visitor]; !ok {
+			visitors[f.Visitor] = &AdminStatsVisitor{Addr: f.Visitor}
+			response.Visitors = append(response.Visitors, visitors[f.Visitor])
+		}
+		visitors[f.Visitor].Count++
+		visitors[f.Visitor].Size += f.Size
+	}
+	sort.Slice(response.Visitors, func(i, j int) bool {
+		return response.Visitors[i].Size > response.Visitors[j].Size
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(response)
+}
+
+// handleAdminPurge removes orphaned files from the clipboard directory (see clipboard.PurgeOrphans), and then
+// runs the regular expiry sweep, so that the limiters reflect the remaining files
+func (s *Server) handleAdminPurge(w http.ResponseWriter, r *http.Request) error {
+	if !s.config.EnableAdmin {
+		return ErrHTTPNotFound
+	}
+	purged := make([]string, 0)
+	for _, clip := range s.clipboards() {
+		clipPurged, err := clip.PurgeOrphans()
+		if err != nil {
+			return err
+		}
+		purged = append(purged, clipPurged...)
+	}
+	s.updateStatsAndExpire()
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&PurgeResult{Purged: purged})
+}
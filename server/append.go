@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"heckel.io/pcopy/clipboard"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/util"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+const (
+	queryParamAppend = "append"
+	queryParamFollow = "follow"
+
+	appendOpen  = "1"
+	appendClose = "close"
+)
+
+// handleClipboardAppend appends the request body to an entry (PUT /<id>?append=1), and creates the entry if it does
+// not exist. While more content may be appended, the entry can be followed (GET /<id>?follow=1, see followFile);
+// ?append=close appends the body (which may be empty) and marks the entry as complete, which ends all followers.
+// Appended entries are stored uncompressed, since they are read while they are written. Entries that cannot be
+// served to anyone but the first reader (streams, reservations, burn-after-reading files, files with a download
+// limit or a password) cannot be appended to, and neither can aliases. Existing entries keep their TTL and mode;
+// read-only entries are rejected before this is called, see checkMutable.
+func (s *Server) handleClipboardAppend(w http.ResponseWriter, r *http.Request, id string) error {
+	closeEntry := false
+	switch r.URL.Query().Get(queryParamAppend) {
+	case appendOpen:
+	case appendClose:
+		closeEntry = true
+	default:
+		return ErrHTTPBadRequest
+	}
+	if s.config.EncryptAtRest {
+		return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (appending not supported with at-rest encryption)", http.StatusText(http.StatusBadRequest))}
+	} else if s.isBurn(r) {
+		return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (burn-after-reading not supported for appends)", http.StatusText(http.StatusBadRequest))}
+	}
+	downloadLimit, err := s.getDownloadLimit(r)
+	if err != nil {
+		return err
+	} else if downloadLimit > 0 {
+		return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (download limit not supported for appends)", http.StatusText(http.StatusBadRequest))}
+	}
+	if err := s.checkContentLength(r); err != nil {
+		return err
+	}
+
+	var meta *clipboard.File
+	var ttl time.Duration
+	var clamped bool
+	status := http.StatusOK
+	stat, _ := s.clipboardFor(r).Stat(id)
+	if stat == nil {
+		if err := s.checkPUT(r, id); err != nil {
+			return err
+		} else if err := s.checkPublic(r); err != nil {
+			return err
+		}
+		if meta, ttl, clamped, err = s.newAppendMeta(r); err != nil {
+			return err
+		}
+		status = http.StatusCreated
+	} else if stat.Pipe || stat.Reserved || stat.Pending || stat.Link != "" || stat.Mode == config.FileModeBurn ||
+		stat.DownloadLimit > 0 || stat.PasswordKey != "" || stat.Compressed || stat.Encrypted {
+		return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (%s cannot be appended to)", http.StatusText(http.StatusBadRequest), id)}
+	} else {
+		meta = stat
+		if stat.Expires > 0 {
+			ttl = time.Until(time.Unix(stat.Expires, 0))
+		}
+	}
+
+	// The entry as a whole is subject to the per-file limit. Since its content type is not known in advance,
+	// the largest of the per-file limits applies, same as for resumable uploads.
+	fileSizeLimit := s.maxFileSizeLimit()
+	quota, err := s.checkKeyLimit(r, id)
+	if err != nil {
+		return err
+	}
+	limitedByQuota := quota > 0 && (fileSizeLimit == 0 || quota < fileSizeLimit)
+	if limitedByQuota {
+		fileSizeLimit = quota
+	}
+	visitorQuota, err := s.checkVisitorLimit(r, id)
+	if err != nil {
+		return err
+	}
+	limitedByVisitorQuota := visitorQuota > 0 && (fileSizeLimit == 0 || visitorQuota < fileSizeLimit)
+	if limitedByVisitorQuota {
+		fileSizeLimit = visitorQuota
+	}
+
+	// Ensure that we update the limiters and such!
+	defer s.updateStatsAndExpire()
+
+	s.limitBody(w, r, 0)
+	defer s.limitUploadDuration(r)()
+	err = s.clipboardFor(r).AppendFile(id, meta, r.Body, fileSizeLimit, closeEntry)
+	if status == http.StatusCreated && err != clipboard.ErrNotAppendable {
+		if !meta.Hidden {
+			s.recordEvent(r, "copy", id)
+		}
+		s.recordChange(id, meta.Hidden)
+	}
+	if err == clipboard.ErrNotAppendable {
+		return &ErrHTTP{http.StatusConflict, fmt.Sprintf("%s (%s is being written)", http.StatusText(http.StatusConflict), id)}
+	} else if err == util.ErrLimitReached && limitedByVisitorQuota {
+		return errVisitorQuotaExceeded
+	} else if err == util.ErrLimitReached && limitedByQuota {
+		return &ErrHTTP{http.StatusRequestEntityTooLarge, fmt.Sprintf("%s (quota for key %s exceeded)",
+			http.StatusText(http.StatusRequestEntityTooLarge), meta.KeyID)}
+	} else if err == util.ErrLimitReached {
+		return ErrHTTPPayloadTooLarge
+	} else if err == context.DeadlineExceeded {
+		return errUploadTimeout
+	} else if err == clipboard.ErrStorageFull {
+		return errInsufficientStorage
+	} else if err == clipboard.ErrStorageNotWritable {
+		return errStorageNotWritable
+	} else if err != nil {
+		return err
+	}
+	return s.writeFileInfoOutput(w, r, status, id, meta.Expires, ttl, clamped, s.getOutputFormat(r), meta.Secret)
+}
+
+// newAppendMeta returns the metadata of an entry that is created by appending to it, see handleClipboardAppend
+func (s *Server) newAppendMeta(r *http.Request) (meta *clipboard.File, ttl time.Duration, clamped bool, err error) {
+	fileMode, err := s.getFileMode(r)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	userMeta, err := s.getUserMeta(r)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	// The content is not known in advance, and may grow well beyond a short text, so the non-text max. TTL applies
+	ttl, clamped, err = s.getTTL(r, fileMode, &util.PeakedReadCloser{LimitReached: true})
+	if err != nil {
+		return nil, 0, false, err
+	}
+	expires := int64(0)
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).Unix()
+	}
+	secret := ""
+	if s.config.Key != nil {
+		secret = randomSecret()
+	}
+	keyID := ""
+	if key := requestKey(r); key != nil {
+		keyID = crypto.KeyID(key)
+	}
+	visitor := ""
+	if s.config.SizePerVisitorLimit > 0 {
+		visitor = s.visitorIP(r)
+	}
+
+	// Unless the client sets an explicit content type, it is detected from the content when it is read
+	contentType := ""
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && !isGenericContentType(mediaType) {
+		contentType = r.Header.Get("Content-Type")
+	}
+	meta = &clipboard.File{
+		Mode:     fileMode,
+		Expires:  expires,
+		Secret:   secret,
+		KeyID:    keyID,
+		Visitor:  visitor,
+		Type:     contentType,
+		Hidden:   s.isHidden(r),
+		Public:   s.isPublic(r),
+		Filename: s.getFilename(r),
+		UserMeta: userMeta,
+	}
+	return meta, ttl, clamped, nil
+}
+
+// followFile streams the content of an entry that is being appended to (see handleClipboardAppend), and keeps
+// the response open until the entry is closed, deleted or expires, or until the client disconnects
+func (s *Server) followFile(w http.ResponseWriter, r *http.Request, writer io.Writer, id string) error {
+	w.Header().Set("Accept-Ranges", "none")
+	w.Header().Del("Length") // The final length is not known yet
+	disableCompression(w)
+	flusher, _ := w.(http.Flusher)
+	return s.clipboardFor(r).FollowFile(r.Context(), id, &flushWriter{writer, flusher})
+}
+
+// flushWriter flushes the response after every write, so that followers receive appended content right away
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher // May be nil
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+	return n, err
+}
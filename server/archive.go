@@ -0,0 +1,273 @@
+package server
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"heckel.io/pcopy/clipboard"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/util"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	queryParamArchive = "archive"
+	queryParamIDs     = "ids"
+	archiveFormatTar  = "tar"
+	archiveFilename   = "pcopy.tar"
+)
+
+// ArchiveResult is the response of an archive upload (PUT /?archive=tar), listing the clipboard entries that
+// were created from the archive members, in the order of the archive
+type ArchiveResult struct {
+	Files []*ArchiveFile `json:"files"`
+}
+
+// ArchiveFile is a single clipboard entry created from an archive member
+type ArchiveFile struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+}
+
+// archiveEntry is a clipboard entry written during an archive upload, see handleArchivePut
+type archiveEntry struct {
+	id   string
+	meta *clipboard.File
+	size int64
+}
+
+// handleArchivePut unpacks a tar archive into one clipboard entry per file, named after the base name of the
+// member. The TTL, file mode, password, hidden and public flags of the request apply to all files. If any file is
+// rejected (invalid name, size or count limits, ...), all files of the archive written so far are removed again,
+// so that an archive is either stored completely or not at all.
+func (s *Server) handleArchivePut(w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Query().Get(queryParamArchive) != archiveFormatTar {
+		return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (unsupported archive format)", http.StatusText(http.StatusBadRequest))}
+	}
+	if s.uploads != nil {
+		select {
+		case s.uploads <- struct{}{}:
+			defer func() { <-s.uploads }()
+		default:
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(uploadRetryAfter.Seconds())))
+			return ErrHTTPServiceUnavailable
+		}
+	}
+	fileMode, err := s.getFileMode(r)
+	if err != nil {
+		return err
+	}
+	passwordKey, err := s.getPasswordKey(r)
+	if err != nil {
+		return err
+	}
+	hidden := s.isHidden(r)
+	keyID := ""
+	if key := requestKey(r); key != nil {
+		keyID = crypto.KeyID(key)
+	}
+	visitor := ""
+	if s.config.SizePerVisitorLimit > 0 {
+		visitor = s.visitorIP(r)
+	}
+
+	// Ensure that we update the limiters and such!
+	defer s.updateStatsAndExpire()
+
+	entries := make([]*archiveEntry, 0)
+	seen := make(map[string]bool)
+	tr := tar.NewReader(r.Body)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			s.deleteArchiveEntries(r, entries)
+			return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (invalid tar archive)", http.StatusText(http.StatusBadRequest))}
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		} else if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			s.deleteArchiveEntries(r, entries)
+			return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (%s is not a regular file)", http.StatusText(http.StatusBadRequest), header.Name)}
+		}
+		id := path.Base(header.Name)
+		if seen[id] {
+			s.deleteArchiveEntries(r, entries)
+			return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (duplicate file name %s)", http.StatusText(http.StatusBadRequest), id)}
+		} else if !s.clipboardFor(r).IsValidID(id) {
+			s.deleteArchiveEntries(r, entries)
+			return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (invalid file name %s)", http.StatusText(http.StatusBadRequest), id)}
+		}
+		seen[id] = true
+		entry, err := s.writeArchiveEntry(r, id, tr, fileMode, passwordKey, hidden, keyID, visitor)
+		if err != nil {
+			s.deleteArchiveEntries(r, entries)
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (archive contains no files)", http.StatusText(http.StatusBadRequest))}
+	}
+
+	response := &ArchiveResult{Files: make([]*ArchiveFile, 0)}
+	for _, entry := range entries {
+		url, err := generateURL(s.config, fmt.Sprintf(clipboardPathFormat, entry.id), entry.meta.Secret)
+		if err != nil {
+			return err
+		}
+		response.Files = append(response.Files, &ArchiveFile{ID: entry.id, URL: url})
+		s.recordPut(entry.size)
+		if !hidden {
+			s.recordEvent(r, "copy", entry.id)
+		}
+		s.recordChange(entry.id, hidden)
+		if s.config.WebhookURL != "" && !hidden {
+			go s.sendWebhook(webhookEventCreated, entry.id, entry.meta, entry.size)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(response)
+}
+
+// writeArchiveEntry writes a single archive member to the clipboard, applying the same checks and limits as
+// a regular upload (see handleClipboardPut)
+func (s *Server) writeArchiveEntry(r *http.Request, id string, content io.Reader, fileMode string, passwordKey string,
+	hidden bool, keyID string, visitor string) (*archiveEntry, error) {
+	if err := s.checkPUT(r, id); err != nil {
+		return nil, err
+	}
+	body, err := util.Peak(ioutil.NopCloser(content), peakLimitBytes)
+	if err != nil {
+		return nil, err
+	}
+	ttl, _, err := s.getTTL(r, fileMode, body)
+	if err != nil {
+		return nil, err
+	}
+	expires := int64(0)
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).Unix()
+	}
+	secret := ""
+	if s.config.Key != nil {
+		secret = randomSecret()
+	}
+	limitType, fileSizeLimit := s.getFileSizeLimit(body)
+	quota, err := s.checkKeyLimit(r, id)
+	if err != nil {
+		return nil, err
+	}
+	visitorQuota, err := s.checkVisitorLimit(r, id)
+	if err != nil {
+		return nil, err
+	}
+	limitedByQuota := quota > 0 && (fileSizeLimit == 0 || quota < fileSizeLimit)
+	if limitedByQuota {
+		fileSizeLimit = quota
+	}
+	limitedByVisitorQuota := visitorQuota > 0 && (fileSizeLimit == 0 || visitorQuota < fileSizeLimit)
+	if limitedByVisitorQuota {
+		fileSizeLimit = visitorQuota
+	}
+	meta := &clipboard.File{
+		Mode:        fileMode,
+		Expires:     expires,
+		Secret:      secret,
+		KeyID:       keyID,
+		Visitor:     visitor,
+		Type:        http.DetectContentType(body.PeakedBytes), // The Content-Type of the request is the archive's
+		Hidden:      hidden,
+		Public:      s.isPublic(r),
+		PasswordKey: passwordKey,
+	}
+	s.clipboardFor(r).DeleteFile(id)
+	if err := s.clipboardFor(r).WriteFileWithLimit(id, meta, body, fileSizeLimit); err == util.ErrLimitReached && limitedByVisitorQuota {
+		return nil, errVisitorQuotaExceeded
+	} else if err == util.ErrLimitReached && limitedByQuota {
+		return nil, &ErrHTTP{http.StatusRequestEntityTooLarge, fmt.Sprintf("%s (quota for key %s exceeded)",
+			http.StatusText(http.StatusRequestEntityTooLarge), keyID)}
+	} else if err == util.ErrLimitReached && fileSizeLimit > 0 {
+		return nil, &ErrHTTP{http.StatusRequestEntityTooLarge, fmt.Sprintf("%s (%s: limit for %s is %s)",
+			http.StatusText(http.StatusRequestEntityTooLarge), id, limitType, util.BytesToHuman(fileSizeLimit))}
+	} else if err == util.ErrLimitReached {
+		return nil, ErrHTTPPayloadTooLarge
+	} else if err != nil {
+		return nil, err
+	}
+	size := int64(0)
+	if stat, err := s.clipboardFor(r).Stat(id); err == nil {
+		size = stat.Size
+	}
+	return &archiveEntry{id: id, meta: meta, size: size}, nil
+}
+
+// deleteArchiveEntries removes the entries of a rejected archive upload
+func (s *Server) deleteArchiveEntries(r *http.Request, entries []*archiveEntry) {
+	for _, entry := range entries {
+		if err := s.clipboardFor(r).DeleteFile(entry.id); err != nil {
+			log.Printf("[%s] failed to remove entry %s of rejected archive: %s", config.CollapseServerAddr(s.config.ServerAddr), s.logID(entry.id), err.Error())
+		}
+	}
+}
+
+// handleArchiveGet streams the clipboard entries passed via "ids" (comma-separated) as a tar archive. Entries that
+// cannot be served as a whole (aliases, streams, reservations, burn-after-reading files, files with a download limit or a
+// password) are rejected, as are missing ones, before anything is sent.
+func (s *Server) handleArchiveGet(w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Query().Get(queryParamArchive) != archiveFormatTar {
+		return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (unsupported archive format)", http.StatusText(http.StatusBadRequest))}
+	}
+	files := make([]*clipboard.File, 0)
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(r.URL.Query().Get(queryParamIDs), ",") {
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		stat, err := s.clipboardFor(r).Stat(id)
+		if err != nil {
+			return &ErrHTTP{http.StatusNotFound, fmt.Sprintf("%s (%s)", http.StatusText(http.StatusNotFound), id)}
+		} else if stat.Link != "" || stat.Pipe || stat.Reserved || stat.Pending || stat.Mode == config.FileModeBurn || stat.DownloadLimit > 0 || stat.PasswordKey != "" {
+			return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (%s cannot be archived)", http.StatusText(http.StatusBadRequest), id)}
+		} else if err := s.verifyFile(r, stat); err != nil {
+			return err
+		}
+		files = append(files, stat)
+	}
+	if len(files) == 0 {
+		return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (no file IDs)", http.StatusText(http.StatusBadRequest))}
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", archiveFilename))
+	tw := tar.NewWriter(w)
+	for _, stat := range files {
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     stat.ID,
+			Size:     stat.Size,
+			Mode:     0600,
+			ModTime:  stat.ModTime,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if err := s.clipboardFor(r).ReadFile(stat.ID, tw); err != nil {
+			return err
+		}
+		s.recordGet()
+		if !stat.Hidden {
+			s.recordEvent(r, "paste", stat.ID)
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// checkAuthBlocked returns ErrHTTPTooManyRequests (and sets the "Retry-After:" header) if the visitor has failed to
+// authenticate too often, see config.AuthFailureThreshold. Requests that neither require authentication nor carry
+// credentials are never blocked, since there is nothing to guess.
+func (s *Server) checkAuthBlocked(w http.ResponseWriter, r *http.Request) error {
+	if s.config.AuthFailureThreshold == 0 || (!s.authRequired(r) && !hasCredentials(r)) {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.visitors[s.visitorIP(r)]
+	if !ok {
+		return nil
+	}
+	if remaining := time.Until(v.authBlockedUntil); remaining > 0 {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(remaining.Seconds()))))
+		return ErrHTTPTooManyRequests
+	}
+	return nil
+}
+
+// countAuthFailure counts a failed authentication attempt of the visitor within the current window, and blocks the
+// visitor for config.AuthFailureWindow once config.AuthFailureThreshold is reached, see checkAuthBlocked
+func (s *Server) countAuthFailure(r *http.Request) {
+	if s.config.AuthFailureThreshold == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.visitors[s.visitorIP(r)]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if now.Sub(v.authWindowStart) > s.config.AuthFailureWindow {
+		v.authWindowStart = now
+		v.authWindowFailures = 0
+	}
+	v.authWindowFailures++
+	if v.authWindowFailures >= s.config.AuthFailureThreshold {
+		v.authBlockedUntil = now.Add(s.config.AuthFailureWindow)
+	}
+}
+
+// expireAuthFailures resets the failure counter of a visitor once its window has passed and it is no longer
+// blocked. It is called from the manager loop with the lock held.
+func (s *Server) expireAuthFailures(v *visitor) {
+	now := time.Now()
+	if v.authWindowFailures > 0 && now.Sub(v.authWindowStart) > s.config.AuthFailureWindow && now.After(v.authBlockedUntil) {
+		v.authWindowFailures = 0
+	}
+}
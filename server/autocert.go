@@ -0,0 +1,68 @@
+package server
+
+import (
+	"crypto/tls"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"heckel.io/pcopy/config"
+	"net/http"
+	"strings"
+)
+
+// newCertManager returns an ACME certificate manager for the domains in AutoCertDomains, or nil if the
+// option is not set. Certificates are obtained on the first TLS handshake, and renewed automatically.
+func newCertManager(conf *config.Config) *autocert.Manager {
+	if len(conf.AutoCertDomains) == 0 {
+		return nil
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(conf.AutoCertDomains...),
+		Cache:      autocert.DirCache(conf.AutoCertCacheDir),
+	}
+}
+
+// acmeHTTPHandler returns the handler for the HTTP listen address if AutoCertDomains is set: it answers
+// ACME "http-01" challenges, and redirects everything else to HTTPS. Since only GET and HEAD requests can
+// be safely redirected, all other requests fail. If RedirectHTTPS is disabled, everything else is served normally.
+func (s *Server) acmeHTTPHandler() http.Handler {
+	if !s.config.RedirectHTTPS {
+		return s.certManager.HTTPHandler(http.HandlerFunc(s.Handle))
+	}
+	return s.certManager.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Use HTTPS", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, s.httpsURL(r), http.StatusFound)
+	}))
+}
+
+// certManagerFor returns the certificate manager responsible for the given TLS server name, or nil
+// if the name is not in any server's AutoCertDomains
+func (r *Router) certManagerFor(serverName string) *autocert.Manager {
+	for _, s := range r.servers {
+		if s.certManager == nil {
+			continue
+		}
+		for _, domain := range s.config.AutoCertDomains {
+			if strings.EqualFold(domain, serverName) {
+				return s.certManager
+			}
+		}
+	}
+	return nil
+}
+
+// getCertificate selects the certificate for a TLS handshake. Certificates for AutoCertDomains are obtained via
+// ACME (including "tls-alpn-01" challenges). For all other names, the certificates loaded from CertFile are used.
+func (r *Router) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if m := r.certManagerFor(hello.ServerName); m != nil {
+		return m.GetCertificate(hello)
+	}
+	return nil, nil // Fall back to tls.Config.Certificates
+}
+
+// acmeNextProtos are the ALPN protocols announced if any server uses ACME; "acme-tls/1" is required for
+// the "tls-alpn-01" challenge
+var acmeNextProtos = []string{"http/1.1", acme.ALPNProto}
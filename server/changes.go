@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	queryParamSince = "since"
+	changesMax      = 1000 // Number of changes kept in memory; older changes are forgotten
+)
+
+var (
+	// changesTimeout is the time a /changes request blocks if there are no changes. This is a variable so it can be
+	// shortened in tests.
+	changesTimeout = 30 * time.Second
+)
+
+// Changes is the response of the /changes endpoint: the IDs of the clipboard entries that were created, updated,
+// deleted or expired after the requested timestamp, and the timestamp (unix nanoseconds) to pass as "since" in
+// the next request
+type Changes struct {
+	IDs  []string `json:"ids"`
+	Time int64    `json:"time"`
+}
+
+// change is a single clipboard change, at unix nanoseconds time
+type change struct {
+	time int64
+	id   string
+}
+
+// changes is a bounded log of recent clipboard changes. Waiters are notified of new changes by closing the
+// notify channel, which is then replaced by a new one (i.e. a broadcast). It has its own lock, since changes
+// are also recorded while the server lock is held (e.g. in updateStatsAndExpire).
+type changes struct {
+	log    []*change
+	notify chan struct{}
+	mu     sync.Mutex
+}
+
+func newChanges() *changes {
+	return &changes{
+		log:    make([]*change, 0),
+		notify: make(chan struct{}),
+	}
+}
+
+// record adds a change for the given IDs, and wakes up all waiting /changes requests
+func (c *changes) record(ids ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now().UnixNano()
+	if len(c.log) > 0 && now <= c.log[len(c.log)-1].time {
+		now = c.log[len(c.log)-1].time + 1 // Timestamps must be strictly increasing, or "since" would skip changes
+	}
+	for _, id := range ids {
+		c.log = append(c.log, &change{time: now, id: id})
+	}
+	if len(c.log) > changesMax {
+		c.log = c.log[len(c.log)-changesMax:]
+	}
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+// since returns the (unique) IDs changed after the given timestamp, the timestamp of the last change (or now,
+// if there are none), and a channel that is closed on the next change
+func (c *changes) since(since int64) ([]string, int64, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]string, 0)
+	seen := make(map[string]bool)
+	last := time.Now().UnixNano()
+	if len(c.log) > 0 && c.log[len(c.log)-1].time > last {
+		last = c.log[len(c.log)-1].time
+	}
+	for _, ch := range c.log {
+		if ch.time > since && !seen[ch.id] {
+			ids = append(ids, ch.id)
+			seen[ch.id] = true
+		}
+	}
+	return ids, last, c.notify
+}
+
+// handleChanges blocks until a clipboard entry was changed after the "since" timestamp (unix nanoseconds), and
+// returns the changed IDs. If nothing changes within changesTimeout, an empty list is returned, so clients can
+// simply loop. Without "since", only changes after the request are returned.
+func (s *Server) handleChanges(w http.ResponseWriter, r *http.Request) error {
+	since := time.Now().UnixNano()
+	if value := r.URL.Query().Get(queryParamSince); value != "" {
+		var err error
+		if since, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return ErrHTTPBadRequest
+		}
+	}
+	timeout := time.NewTimer(changesTimeout)
+	defer timeout.Stop()
+	for {
+		ids, last, notify := s.changes.since(since)
+		if len(ids) > 0 {
+			return writeChanges(w, ids, last)
+		}
+		select {
+		case <-notify:
+		case <-timeout.C:
+			return writeChanges(w, ids, last)
+		case <-r.Context().Done():
+			return nil
+		}
+	}
+}
+
+func writeChanges(w http.ResponseWriter, ids []string, last int64) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&Changes{IDs: ids, Time: last})
+}
+
+// recordChange records that the given entry was created, updated, deleted or expired, unless it is hidden
+func (s *Server) recordChange(id string, hidden bool) {
+	if !hidden {
+		s.changes.record(id)
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"heckel.io/pcopy/clipboard"
+	"heckel.io/pcopy/util"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// getChecksum returns the SHA-256 checksum of the content as passed via the X-SHA256 header, or nil if there is
+// none. Reservations and resumable uploads have no content (or not all of it) in the request, so they are rejected.
+func (s *Server) getChecksum(r *http.Request) ([]byte, error) {
+	value := r.Header.Get(HeaderSHA256)
+	if value == "" {
+		return nil, nil
+	}
+	checksum, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(checksum) != 32 {
+		return nil, &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (invalid checksum)", http.StatusText(http.StatusBadRequest))}
+	} else if s.isReserve(r) || r.URL.Query().Get(queryParamUpload) != "" {
+		return nil, &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (checksum not supported for reservations and resumable uploads)", http.StatusText(http.StatusBadRequest))}
+	}
+	return checksum, nil
+}
+
+// verifyChecksum wraps the body so that it is checked against the given checksum while it is read, see
+// util.ChecksumReadCloser. If there is no checksum, the body is returned as is.
+func verifyChecksum(body io.ReadCloser, checksum []byte) io.ReadCloser {
+	if checksum == nil {
+		return body
+	}
+	return util.NewChecksumReadCloser(body, checksum)
+}
+
+// writeChecksumHeader sets the X-SHA256 header to the checksum of the stored content. Streams and entries that
+// are being appended to have no (final) checksum, so the header is omitted for them.
+func writeChecksumHeader(w http.ResponseWriter, stat *clipboard.File) {
+	if stat.Checksum != "" && !stat.Pipe && !stat.Appending {
+		w.Header().Set(HeaderSHA256, stat.Checksum)
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"heckel.io/pcopy/clipboard"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+
+	// compressMinBytes is the minimum response size for compression, if the size is known in advance; compressing
+	// tiny responses does not save anything
+	compressMinBytes = 1024
+)
+
+// compressWriter is a http.ResponseWriter that compresses the response with gzip or deflate (i.e. zlib, as defined
+// for HTTP), if the content type is text (see config.CompressResponses and clipboard.IsText). Since the compressed
+// response is a different representation of the content, its ETag is marked as weak. Whether the response is compressed is decided when the headers
+// are written, so handlers must set the Content-Type (and Content-Encoding, if the content is already compressed)
+// before they write the body. Handlers that stream responses must opt out via disableCompression.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	w        compressor // nil if the response is not compressed
+	decided  bool
+	disabled bool
+}
+
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressResponse wraps the response writer in a compressWriter if the client accepts gzip or deflate. The
+// returned function must be called once the request is handled, to write the remainder of the compressed response.
+func (s *Server) compressResponse(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if !s.config.CompressResponses || r.Method == http.MethodHead {
+		return w, func() {}
+	}
+	var encoding string
+	if acceptsEncoding(r, encodingGzip) {
+		encoding = encodingGzip
+	} else if acceptsEncoding(r, encodingDeflate) {
+		encoding = encodingDeflate
+	} else {
+		return w, func() {}
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+	return cw, cw.close
+}
+
+// disableCompression makes sure that the response is not compressed, e.g. because it is streamed and compressing
+// it would buffer the content. This must be called before the headers are written.
+func disableCompression(w http.ResponseWriter) {
+	if cw, ok := w.(*compressWriter); ok {
+		cw.disabled = true
+	}
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	w.decide(code, nil)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	w.decide(http.StatusOK, p)
+	if w.w != nil {
+		return w.w.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush flushes the compressed content written so far, and passes through to the underlying writer
+func (w *compressWriter) Flush() {
+	if w.w != nil {
+		w.w.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// decide determines whether the response is compressed, based on its status code and headers. If no Content-Type
+// is set, it is detected from the first write, the same way net/http would do it.
+func (w *compressWriter) decide(code int, p []byte) {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	header := w.Header()
+	if header.Get("Content-Type") == "" && p != nil {
+		header.Set("Content-Type", http.DetectContentType(p))
+	}
+	if w.disabled || code < http.StatusOK || code == http.StatusNoContent || code == http.StatusPartialContent ||
+		code == http.StatusNotModified || header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" ||
+		!clipboard.IsText(header.Get("Content-Type")) {
+		return
+	}
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && length < compressMinBytes {
+		return
+	}
+	header.Del("Content-Length") // Refers to the uncompressed content
+	header.Set("Content-Encoding", w.encoding)
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+	if w.encoding == encodingGzip {
+		w.w = gzip.NewWriter(w.ResponseWriter)
+	} else {
+		w.w = zlib.NewWriter(w.ResponseWriter)
+	}
+}
+
+func (w *compressWriter) close() {
+	if w.w != nil {
+		w.w.Close()
+	}
+}
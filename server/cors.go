@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	corsAllowAllOrigins = "*"
+	corsMaxAgeSeconds   = 600 // How long browsers may cache the result of a preflight request
+)
+
+var (
+	// corsAllowedHeaders are the request headers that cross-origin requests may send
+	corsAllowedHeaders = []string{
+		"Authorization", "Content-Type", "Range", "If-None-Match", "X-Requested-With", HeaderStream, HeaderReserve,
+		HeaderBurn, HeaderDownloads, HeaderPassword, HeaderHidden, HeaderNoRedirect, HeaderFormat, HeaderFileMode,
+		HeaderTTL, HeaderExpires, HeaderNotify, HeaderSize, HeaderFilename, HeaderIdempotencyKey,
+		HeaderSHA256,
+	}
+
+	// corsExposedHeaders are the response headers that cross-origin requests may read, in addition to the ones
+	// browsers always expose (Content-Type, Content-Length, ...)
+	corsExposedHeaders = []string{
+		"Length", "Content-Disposition", "Content-Range", "Accept-Ranges", "ETag", "Retry-After", HeaderFile, HeaderURL,
+		HeaderTTL, HeaderTTLClamped, HeaderExpires, HeaderCurl, HeaderStreaming, HeaderAvailable, HeaderDownloadsRemaining,
+		HeaderQuotaRemaining, HeaderExpectedSize, HeaderUploadToken, HeaderUploadOffset, HeaderTotal, HeaderIdempotentReplayed,
+		HeaderSHA256, HeaderStreamReadyURL, HeaderLines, HeaderBinary,
+	}
+)
+
+// handleCORS sets the CORS response headers if the request comes from an allowed origin (see config.AllowedOrigins),
+// and answers preflight requests. It returns true if the request was a preflight request, i.e. if it was handled.
+// Preflight requests are answered without auth (browsers never send credentials with them), but this does not
+// bypass the auth of the actual request that follows.
+func (s *Server) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	if len(s.config.AllowedOrigins) == 0 {
+		return false
+	}
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	allowOrigin := s.corsAllowOrigin(origin)
+	if allowOrigin == "" {
+		if preflight {
+			s.fail(w, r, http.StatusForbidden, errCORSOriginNotAllowed)
+			return true
+		}
+		return false // The browser blocks the response, since the CORS headers are missing
+	}
+	w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+	if !preflight {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		return false
+	}
+	methods := s.routeMethods(r.URL.Path)
+	if len(methods) == 0 {
+		s.fail(w, r, http.StatusNotFound, errNoMatchingRoute)
+		return true
+	}
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(append(corsAllowedHeaders, corsAllowedUserMetaHeaders(r)...), ", "))
+	w.Header().Set("Access-Control-Max-Age", fmt.Sprintf("%d", corsMaxAgeSeconds))
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// corsAllowOrigin returns the value of the "Access-Control-Allow-Origin" header for the given origin, or an empty
+// string if the origin is not allowed. The origin is echoed back, unless all origins are allowed explicitly.
+func (s *Server) corsAllowOrigin(origin string) string {
+	for _, allowed := range s.config.AllowedOrigins {
+		if allowed == corsAllowAllOrigins {
+			return corsAllowAllOrigins
+		} else if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
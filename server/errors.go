@@ -16,6 +16,12 @@ func (e ErrHTTP) Error() string {
 	return fmt.Sprintf("http: %s", e.Status)
 }
 
+// ErrorResponse is the body of error responses if the client asked for JSON, see Server.wantsJSONError
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
 // ErrHTTPPartialContent is returned when the client interrupts a stream and only partial content was sent
 var ErrHTTPPartialContent = &ErrHTTP{http.StatusPartialContent, http.StatusText(http.StatusPartialContent)}
 
@@ -28,17 +34,82 @@ var ErrHTTPMethodNotAllowed = &ErrHTTP{http.StatusMethodNotAllowed, http.StatusT
 // ErrHTTPNotFound is returned when a resource is not found on the server
 var ErrHTTPNotFound = &ErrHTTP{http.StatusNotFound, http.StatusText(http.StatusNotFound)}
 
+// ErrHTTPGone is returned when a resource was deleted, e.g. because it was found to be corrupt
+var ErrHTTPGone = &ErrHTTP{http.StatusGone, http.StatusText(http.StatusGone)}
+
 // ErrHTTPTooManyRequests is returned when a server-side rate limit has been reached
 var ErrHTTPTooManyRequests = &ErrHTTP{http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests)}
 
+// errStreamNotStarted is returned when reading a reserved file (see HeaderReserve) before the stream has started
+var errStreamNotStarted = &ErrHTTP{http.StatusTooEarly, fmt.Sprintf("%s (file is reserved, but the stream has not started yet)",
+	http.StatusText(http.StatusTooEarly))}
+
+// errTooManyStreams is returned when a stream or reservation exceeds MaxConcurrentStreams
+var errTooManyStreams = &ErrHTTP{http.StatusTooManyRequests, fmt.Sprintf("%s (too many concurrent streams)",
+	http.StatusText(http.StatusTooManyRequests))}
+
+// errUploadTimeout is returned when an upload takes longer than MaxUploadDuration
+var errUploadTimeout = &ErrHTTP{http.StatusRequestTimeout, fmt.Sprintf("%s (upload took too long)",
+	http.StatusText(http.StatusRequestTimeout))}
+
+// errChecksumMismatch is returned when the content of an upload does not match its X-SHA256 header
+var errChecksumMismatch = &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (checksum mismatch)",
+	http.StatusText(http.StatusBadRequest))}
+
+// errUserMetaTooManyEntries is returned when an upload has more than userMetaMaxEntries X-Meta-* headers
+var errUserMetaTooManyEntries = &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (too many metadata headers)",
+	http.StatusText(http.StatusBadRequest))}
+
+// errUserMetaTooLarge is returned when the X-Meta-* headers of an upload exceed userMetaMaxSize
+var errUserMetaTooLarge = &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (metadata headers too large)",
+	http.StatusText(http.StatusBadRequest))}
+
+// errStreamWaitTimeout is returned when nobody reads a stream within StreamWaitTimeout
+var errStreamWaitTimeout = &ErrHTTP{http.StatusRequestTimeout, fmt.Sprintf("%s (nobody started reading the stream)",
+	http.StatusText(http.StatusRequestTimeout))}
+
+// errInsufficientStorage is returned when the clipboard directory is full, or the free disk space is below
+// MinFreeDiskBytes
+var errInsufficientStorage = &ErrHTTP{http.StatusInsufficientStorage, fmt.Sprintf("%s (not enough disk space)",
+	http.StatusText(http.StatusInsufficientStorage))}
+
+// errStorageNotWritable is returned when the clipboard directory is not writable
+var errStorageNotWritable = &ErrHTTP{http.StatusServiceUnavailable, fmt.Sprintf("%s (clipboard directory not writable)",
+	http.StatusText(http.StatusServiceUnavailable))}
+
 // ErrHTTPPayloadTooLarge is returned when the clipboard/file-size limit has been reached
 var ErrHTTPPayloadTooLarge = &ErrHTTP{http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge)}
 
+// ErrHTTPServiceUnavailable is returned when the server is too busy to handle the request, e.g. too many uploads
+var ErrHTTPServiceUnavailable = &ErrHTTP{http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable)}
+
 // ErrHTTPUnauthorized is returned when the client has not sent proper credentials
 var ErrHTTPUnauthorized = &ErrHTTP{http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized)}
 
+// ErrHTTPPasswordRequired is returned when a password-protected file is read without the correct password. Unlike
+// ErrHTTPUnauthorized, a "WWW-Authenticate" header is sent along with it, so that browsers and curl ask for the password.
+var ErrHTTPPasswordRequired = &ErrHTTP{http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized)}
+
+// errVisitorQuotaExceeded is returned when an upload exceeds the visitor's SizePerVisitorLimit
+var errVisitorQuotaExceeded = &ErrHTTP{http.StatusRequestEntityTooLarge, fmt.Sprintf("%s (quota for visitor exceeded)",
+	http.StatusText(http.StatusRequestEntityTooLarge))}
+
+// errCheckNotSupported is returned when a dry run (?check=1) is requested for anything but a regular upload
+var errCheckNotSupported = &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (check is only supported for regular uploads)",
+	http.StatusText(http.StatusBadRequest))}
+
 var errListenAddrMissing = errors.New("listen address missing, add 'ListenHTTPS' or 'ListenHTTP' to config or pass --listen-http(s)")
 var errKeyFileMissing = errors.New("private key file missing, add 'KeyFile' to config or pass --keyfile")
 var errCertFileMissing = errors.New("certificate file missing, add 'CertFile' to config or pass --certfile")
+var errAutoCertWithCertFiles = errors.New("'AutoCertDomains' cannot be combined with 'KeyFile'/'CertFile', remove one or the other")
+var errAutoCertListenMissing = errors.New("'AutoCertDomains' requires an HTTPS listen address, add 'ListenAddr :443/https' to config")
+var errDefaultFileModeNotAllowed = errors.New("'DefaultFileMode' must be one of 'FileModesAllowed'")
+var errFileExpireAfterByModeNotAllowed = errors.New("'FileExpireAfterByMode' must only contain modes from 'FileModesAllowed'")
+var errManagerIntervalInvalid = errors.New("'ManagerInterval' must be positive")
+var errAtRestKeyMissing = errors.New("'EncryptAtRest' requires 'Key' or 'AtRestKey' to be set")
 var errInvalidStreamMode = errors.New("invalid stream mode")
+var errExpiresInPast = errors.New("expiry time is in the past")
 var errNoMatchingRoute = errors.New("no matching route")
+var errMethodNotAllowed = errors.New("method not allowed for this route")
+var errTTLNegative = errors.New("TTL cannot be negative")
+var errCORSOriginNotAllowed = errors.New("origin not allowed")
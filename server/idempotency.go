@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// idempotencyKeyExpireAfter is the time after which a completed request can no longer be replayed with its
+	// idempotency key, see HeaderIdempotencyKey
+	idempotencyKeyExpireAfter = 10 * time.Minute
+	idempotencyKeyMaxLength   = 255
+)
+
+type idempotencyCtx struct{}
+
+// idempotencyRecord is the result of a PUT/POST request with an Idempotency-Key header. Since the handlers do not
+// return their result, writeFileInfoOutput fills it in via the request context. All fields are guarded by Server.mu.
+type idempotencyRecord struct {
+	path    string // Path of the original request; the key cannot be reused for another path
+	created time.Time
+	done    bool // True once the result is known; until then, retries are rejected
+	status  int
+	id      string
+	expires int64
+	ttl     time.Duration
+	clamped bool
+	secret  string
+}
+
+// idempotent makes uploads safe to retry: if a PUT/POST carries an Idempotency-Key header (see HeaderIdempotencyKey)
+// that was already used for a successful upload, the original result is returned again (same file ID, status, TTL),
+// without uploading the body, and without counting towards any limits (see also isIdempotentReplay). Keys are scoped by visitor, and are forgotten
+// after idempotencyKeyExpireAfter. Failed requests are not recorded, so they can be retried with the same key.
+// Requests that do not return file info (e.g. archives) are not recorded either.
+func (s *Server) idempotent(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		key := r.Header.Get(HeaderIdempotencyKey)
+		if key == "" {
+			return next(w, r)
+		} else if len(key) > idempotencyKeyMaxLength {
+			return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (idempotency key too long)", http.StatusText(http.StatusBadRequest))}
+		}
+		key = idempotencyKey(s.visitorIP(r), key)
+		s.mu.Lock()
+		record, ok := s.idempotency[key]
+		if !ok {
+			record = &idempotencyRecord{path: r.URL.Path, created: time.Now()}
+			s.idempotency[key] = record
+		}
+		replay := *record
+		s.mu.Unlock()
+		if ok {
+			if replay.path != r.URL.Path {
+				return &ErrHTTP{http.StatusUnprocessableEntity, fmt.Sprintf("%s (idempotency key was used for another request)", http.StatusText(http.StatusUnprocessableEntity))}
+			} else if !replay.done {
+				return &ErrHTTP{http.StatusConflict, fmt.Sprintf("%s (request with this idempotency key is in progress)", http.StatusText(http.StatusConflict))}
+			}
+			w.Header().Set(HeaderIdempotentReplayed, HeaderIdempotentReplayedYes)
+			return s.writeFileInfoOutput(w, r, replay.status, replay.id, replay.expires, replay.ttl, replay.clamped, s.getOutputFormat(r), replay.secret)
+		}
+		err := next(w, r.WithContext(context.WithValue(r.Context(), idempotencyCtx{}, record)))
+		s.mu.Lock()
+		if err != nil || !record.done {
+			delete(s.idempotency, key)
+		}
+		s.mu.Unlock()
+		return err
+	}
+}
+
+// isIdempotentReplay returns true if the request will be answered by replaying the result of a previous upload (see
+// idempotent). It is used by limit to not use up an upload rate limiter token for replays.
+func (s *Server) isIdempotentReplay(r *http.Request) bool {
+	key := r.Header.Get(HeaderIdempotencyKey)
+	if key == "" || len(key) > idempotencyKeyMaxLength {
+		return false
+	}
+	key = idempotencyKey(s.visitorIP(r), key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.idempotency[key]
+	return ok && record.done && record.path == r.URL.Path
+}
+
+// idempotencyKey returns the key of the idempotency record, which is scoped by visitor
+func idempotencyKey(visitorIP string, key string) string {
+	return visitorIP + " " + key
+}
+
+// recordIdempotentResult records the result of an upload for the request's idempotency key (if any), see idempotent
+func (s *Server) recordIdempotentResult(r *http.Request, status int, id string, expires int64, ttl time.Duration, clamped bool, secret string) {
+	record, ok := r.Context().Value(idempotencyCtx{}).(*idempotencyRecord)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record.done = true
+	record.status = status
+	record.id = id
+	record.expires = expires
+	record.ttl = ttl
+	record.clamped = clamped
+	record.secret = secret
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"heckel.io/pcopy/util"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	queryParamIDLength = "idlen"
+	queryParamIDStyle  = "idstyle"
+
+	idStyleChars = "chars" // Random letters and digits, e.g. "aZ3kq9XbT1" (default)
+	idStyleWords = "words" // Random words, e.g. "brave-amber-otter"
+
+	// randomFileIDAttempts is the number of random IDs that are tried before giving up, if the generated
+	// IDs are taken or not allowed (see config.IDPattern)
+	randomFileIDAttempts = 10
+)
+
+// idGenerator generates random file IDs of one style, see idGenerators. If the length of the IDs cannot be chosen
+// (e.g. for word-based IDs), hasLength is false, and the generate function is passed 0.
+type idGenerator struct {
+	generate  func(length int) string
+	hasLength bool
+}
+
+var idGenerators = map[string]*idGenerator{
+	idStyleChars: {
+		generate:  func(length int) string { return util.RandomStringWithCharset(length, randomFileIDCharset) },
+		hasLength: true,
+	},
+	idStyleWords: {
+		generate: func(int) string {
+			return strings.Join([]string{util.RandomElement(idAdjectives), util.RandomElement(idColors), util.RandomElement(idAnimals)}, "-")
+		},
+	},
+}
+
+// Word lists for idStyleWords; the longest possible ID is 21 characters
+var (
+	idAdjectives = []string{
+		"brave", "calm", "clever", "cosy", "eager", "fancy", "gentle", "giant", "happy", "honest", "jolly", "keen",
+		"kind", "lively", "lucky", "mighty", "modest", "noble", "polite", "proud", "quick", "quiet", "rapid", "sharp",
+		"shiny", "silly", "smart", "snowy", "sunny", "swift", "tidy", "witty",
+	}
+	idColors = []string{
+		"amber", "azure", "beige", "black", "blue", "bronze", "coral", "cyan", "golden", "gray", "green", "indigo",
+		"ivory", "lilac", "olive", "orange", "pink", "purple", "red", "ruby", "silver", "teal", "violet", "white",
+	}
+	idAnimals = []string{
+		"badger", "beaver", "bison", "camel", "crane", "dingo", "dolphin", "eagle", "falcon", "ferret", "gecko",
+		"heron", "hippo", "koala", "lemur", "lynx", "marmot", "moose", "otter", "owl", "panda", "parrot", "puffin",
+		"rabbit", "raven", "salmon", "seal", "sloth", "tiger", "toucan", "walrus", "zebra",
+	}
+)
+
+// generateFileID generates a random file ID for a PUT/POST without ID, using the style and length requested
+// via the "idstyle" and "idlen" query parameters (default: 10 random letters and digits, or fewer if IDMaxLength
+// is shorter). IDs that are taken or not allowed by the config are skipped, so existing files are never replaced.
+func (s *Server) generateFileID(r *http.Request) (string, error) {
+	style := r.URL.Query().Get(queryParamIDStyle)
+	if style == "" {
+		style = idStyleChars
+	}
+	generator, ok := idGenerators[style]
+	if !ok {
+		return "", &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (invalid ID style)", http.StatusText(http.StatusBadRequest))}
+	}
+	length := 0
+	if generator.hasLength {
+		length = randomFileIDLength
+		if s.config.IDMaxLength > 0 && s.config.IDMaxLength < length {
+			length = s.config.IDMaxLength
+		}
+	}
+	if value := r.URL.Query().Get(queryParamIDLength); value != "" {
+		var err error
+		if !generator.hasLength {
+			return "", &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (ID length not supported for ID style %s)", http.StatusText(http.StatusBadRequest), style)}
+		} else if length, err = strconv.Atoi(value); err != nil || length < 2 || (s.config.IDMaxLength > 0 && length > s.config.IDMaxLength) {
+			return "", &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (ID length must be between 2 and %d)", http.StatusText(http.StatusBadRequest), s.config.IDMaxLength)}
+		}
+	}
+	for i := 0; i < randomFileIDAttempts; i++ {
+		id := generator.generate(length)
+		if !s.clipboardFor(r).IsValidID(id) {
+			continue
+		}
+		if _, err := s.clipboardFor(r).Stat(id); err != nil {
+			return id, nil
+		}
+	}
+	return "", &ErrHTTP{http.StatusConflict, fmt.Sprintf("%s (cannot find a free random ID, try a longer ID or another ID style)", http.StatusText(http.StatusConflict))}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"heckel.io/pcopy/clipboard"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/crypto"
+	"heckel.io/pcopy/util"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	queryParamLink = "link"
+)
+
+// handleClipboardLink creates an alias of an existing entry (PUT /<alias>?link=<id>), so that the same content
+// can be shared under another ID without copying it. The alias has its own TTL, mode and secret, but no content:
+// a GET resolves it to the linked entry (see linkTarget). Entries that cannot be served to anyone but the first
+// reader (streams, reservations, burn-after-reading files, files with a download limit or a password) cannot be
+// linked, and neither can aliases, so that links are only ever one level deep.
+func (s *Server) handleClipboardLink(w http.ResponseWriter, r *http.Request, id string, target string) error {
+	if err := s.checkPUT(r, id); err != nil {
+		return err
+	}
+	stat, err := s.clipboardFor(r).Stat(target)
+	if err != nil {
+		return &ErrHTTP{http.StatusNotFound, fmt.Sprintf("%s (link target %s not found)", http.StatusText(http.StatusNotFound), target)}
+	} else if stat.Link != "" || target == id {
+		return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (link target %s is an alias)", http.StatusText(http.StatusBadRequest), target)}
+	} else if stat.Pipe || stat.Reserved || stat.Pending || stat.Mode == config.FileModeBurn || stat.DownloadLimit > 0 || stat.PasswordKey != "" {
+		return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (%s cannot be linked)", http.StatusText(http.StatusBadRequest), target)}
+	}
+	fileMode, err := s.getFileMode(r)
+	if err != nil {
+		return err
+	}
+
+	// The max. TTL depends on the linked content, same as when touching a file
+	content, err := s.clipboardFor(r).OpenFile(target)
+	if err != nil {
+		return err
+	}
+	peaked, err := util.Peak(content, peakLimitBytes)
+	content.Close()
+	if err != nil {
+		return err
+	}
+	ttl, clamped, err := s.getTTL(r, fileMode, peaked)
+	if err != nil {
+		return err
+	}
+	expires := int64(0)
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).Unix()
+	}
+	secret := ""
+	if s.config.Key != nil {
+		secret = randomSecret()
+	}
+	keyID := ""
+	if key := requestKey(r); key != nil {
+		keyID = crypto.KeyID(key)
+	}
+	hidden := s.isHidden(r)
+	if err := s.checkPublic(r); err != nil {
+		return err
+	}
+	meta := &clipboard.File{
+		Mode:    fileMode,
+		Expires: expires,
+		Secret:  secret,
+		KeyID:   keyID,
+		Type:    stat.Type,
+		Hidden:  hidden,
+		Public:  s.isPublic(r),
+	}
+
+	// Ensure that we update the limiters and such!
+	defer s.updateStatsAndExpire()
+
+	s.clipboardFor(r).DeleteFile(id)
+	if err := s.clipboardFor(r).WriteLink(id, target, meta); err == clipboard.ErrLinkChain {
+		return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (link target %s is an alias)", http.StatusText(http.StatusBadRequest), target)}
+	} else if os.IsNotExist(err) {
+		return &ErrHTTP{http.StatusNotFound, fmt.Sprintf("%s (link target %s not found)", http.StatusText(http.StatusNotFound), target)}
+	} else if err != nil {
+		return err
+	}
+	if !hidden {
+		s.recordEvent(r, "copy", id)
+	}
+	s.recordChange(id, hidden)
+	return s.writeFileInfoOutput(w, r, http.StatusCreated, id, expires, ttl, clamped, s.getOutputFormat(r), secret)
+}
+
+// linkTarget returns the entry whose content is served for the given file: the linked entry if the file is an
+// alias (see handleClipboardLink), or the file itself otherwise. If the linked entry expired or was deleted,
+// ErrHTTPGone is returned. The same is true if it was replaced by an entry that cannot be linked in the meantime.
+func (s *Server) linkTarget(stat *clipboard.File) (*clipboard.File, error) {
+	if stat.Link == "" {
+		return stat, nil
+	}
+	target := stat.Target
+	if target == nil || target.Pipe || target.Reserved || target.Pending || target.Mode == config.FileModeBurn ||
+		target.DownloadLimit > 0 || target.PasswordKey != "" {
+		return nil, ErrHTTPGone
+	}
+	return target, nil
+}
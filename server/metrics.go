@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// rejectedCodes are the HTTP status codes that count as "rejected due to a limit" in the metrics
+var rejectedCodes = []int{http.StatusRequestEntityTooLarge, http.StatusTooManyRequests, http.StatusServiceUnavailable}
+
+// metrics holds the counters and gauges exposed by the /metrics endpoint. Counters are updated by the handlers,
+// gauges are updated by updateStatsAndExpire, so they are fresh even if there is no traffic. All fields are
+// guarded by the server lock.
+type metrics struct {
+	puts     int64
+	gets     int64
+	stored   int64         // Bytes stored, accumulated over all uploads
+	expired  int64         // Files removed after their TTL was reached
+	rejected map[int]int64 // Rejected requests by HTTP status code, see rejectedCodes
+	files    int
+	size     int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		rejected: make(map[int]int64),
+	}
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) error {
+	if !s.config.EnableMetrics {
+		return ErrHTTPNotFound
+	}
+	s.mu.Lock()
+	m := *s.metrics
+	m.rejected = make(map[int]int64)
+	for code, count := range s.metrics.rejected {
+		m.rejected[code] = count
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	return writeMetrics(w, &m)
+}
+
+// recordPut counts a successful upload. Streams have no known size, so they only count towards the uploads.
+func (s *Server) recordPut(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics.puts++
+	s.metrics.stored += size
+}
+
+func (s *Server) recordGet() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics.gets++
+}
+
+// recordRejected counts requests that failed because a size, count or rate limit was reached
+func (s *Server) recordRejected(err error) {
+	e, ok := err.(*ErrHTTP)
+	if !ok {
+		return
+	}
+	for _, code := range rejectedCodes {
+		if e.Code == code {
+			s.mu.Lock()
+			s.metrics.rejected[code]++
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// writeMetrics renders the metrics in the Prometheus text exposition format
+func writeMetrics(w io.Writer, m *metrics) error {
+	codes := make([]int, 0)
+	for code := range m.rejected {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	rejected := ""
+	for _, code := range codes {
+		rejected += fmt.Sprintf("pcopy_rejected_requests_total{code=\"%d\"} %d\n", code, m.rejected[code])
+	}
+	_, err := fmt.Fprintf(w, `# HELP pcopy_puts_total Number of successful uploads.
+# TYPE pcopy_puts_total counter
+pcopy_puts_total %d
+# HELP pcopy_gets_total Number of successful downloads.
+# TYPE pcopy_gets_total counter
+pcopy_gets_total %d
+# HELP pcopy_stored_bytes_total Number of bytes stored, excluding streams.
+# TYPE pcopy_stored_bytes_total counter
+pcopy_stored_bytes_total %d
+# HELP pcopy_expired_files_total Number of files removed after their time-to-live was reached.
+# TYPE pcopy_expired_files_total counter
+pcopy_expired_files_total %d
+# HELP pcopy_rejected_requests_total Number of requests rejected due to a size, count or rate limit.
+# TYPE pcopy_rejected_requests_total counter
+%s# HELP pcopy_files Number of files currently in the clipboard.
+# TYPE pcopy_files gauge
+pcopy_files %d
+# HELP pcopy_clipboard_size_bytes Total size of the files currently in the clipboard.
+# TYPE pcopy_clipboard_size_bytes gauge
+pcopy_clipboard_size_bytes %d
+`, m.puts, m.gets, m.stored, m.expired, rejected, m.files, m.size)
+	return err
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"heckel.io/pcopy/clipboard"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/crypto"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// namespacesDir is the directory within the clipboard dir that contains one clipboard dir per key, see
+// config.NamespaceByKey. The default namespace is the clipboard dir itself.
+const namespacesDir = ".namespaces"
+
+// namespaceCtx is a marker struct used to find the namespace of the request, if it is not the one of the key that
+// authorized the request (see requestNamespace)
+type namespaceCtx struct{}
+
+// newNamespaces creates a clipboard for each of the given keys, keyed by key ID, with its own directory (and hence
+// its own limits) within the clipboard dir. If config.NamespaceByKey is disabled, or if the server has no key,
+// it returns an empty map.
+func newNamespaces(conf *config.Config, keys []*crypto.Key) (map[string]*clipboard.Clipboard, error) {
+	namespaces := make(map[string]*clipboard.Clipboard)
+	if !conf.NamespaceByKey || conf.Key == nil {
+		return namespaces, nil
+	}
+	for _, key := range keys {
+		keyID := crypto.KeyID(key)
+		if _, ok := namespaces[keyID]; ok {
+			continue
+		}
+		namespaceConf := *conf
+		namespaceConf.ClipboardDir = filepath.Join(conf.ClipboardDir, namespacesDir, keyID)
+		clip, err := clipboard.New(&namespaceConf)
+		if err != nil {
+			return nil, err
+		}
+		namespaces[keyID] = clip
+	}
+	return namespaces, nil
+}
+
+// withNamespace returns a copy of the request with the given namespace attached to its context, see requestNamespace
+func withNamespace(r *http.Request, namespace string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), namespaceCtx{}, namespace))
+}
+
+// requestNamespace returns the namespace of the request: the namespace of the key that authorized the request,
+// unless the file was found in another namespace (see authorizeNamespacedFile). An empty string is the default
+// namespace, which is used for requests that were not authorized using a key.
+func (s *Server) requestNamespace(r *http.Request) string {
+	if namespace, ok := r.Context().Value(namespaceCtx{}).(string); ok {
+		return namespace
+	}
+	return s.keyNamespace(requestKey(r))
+}
+
+// keyNamespace returns the namespace of the given key, or the default namespace if there is none
+func (s *Server) keyNamespace(key *crypto.Key) string {
+	if key == nil {
+		return ""
+	}
+	keyID := crypto.KeyID(key)
+	if _, ok := s.namespaces[keyID]; !ok {
+		return ""
+	}
+	return keyID
+}
+
+// clipboardFor returns the clipboard of the request's namespace
+func (s *Server) clipboardFor(r *http.Request) *clipboard.Clipboard {
+	return s.namespaceClipboard(s.requestNamespace(r))
+}
+
+func (s *Server) namespaceClipboard(namespace string) *clipboard.Clipboard {
+	if clip, ok := s.namespaces[namespace]; ok {
+		return clip
+	}
+	return s.clipboard
+}
+
+// namespaceIDs returns all namespaces, starting with the default namespace, followed by the namespaces of the
+// server's keys in the order of the keys
+func (s *Server) namespaceIDs() []string {
+	namespaces := []string{""}
+	seen := make(map[string]bool)
+	for _, key := range s.keys() {
+		keyID := crypto.KeyID(key)
+		if _, ok := s.namespaces[keyID]; ok && !seen[keyID] {
+			namespaces = append(namespaces, keyID)
+			seen[keyID] = true
+		}
+	}
+	return namespaces
+}
+
+// clipboards returns the clipboards of all namespaces, see namespaceIDs
+func (s *Server) clipboards() []*clipboard.Clipboard {
+	clips := make([]*clipboard.Clipboard, 0)
+	for _, namespace := range s.namespaceIDs() {
+		clips = append(clips, s.namespaceClipboard(namespace))
+	}
+	return clips
+}
+
+// entryKey returns a key that identifies the given file ID across namespaces, e.g. for the reservations map.
+// Entries of the default namespace are identified by their ID only. File IDs cannot contain a slash.
+func (s *Server) entryKey(r *http.Request, id string) string {
+	if namespace := s.requestNamespace(r); namespace != "" {
+		return namespace + "/" + id
+	}
+	return id
+}
+
+// entryClipboard returns the clipboard and the file ID for the given entry key, see entryKey
+func (s *Server) entryClipboard(key string) (*clipboard.Clipboard, string) {
+	if i := strings.Index(key, "/"); i >= 0 {
+		return s.namespaceClipboard(key[:i]), key[i+1:]
+	}
+	return s.clipboard, key
+}
+
+// authorizeNamespacedFile is like authorizeFileWithFallback, but for servers with config.NamespaceByKey. It returns
+// the key and the namespace of the request: the file is looked up in the namespace of the key that authorized the
+// request. Reading a file that does not exist there falls back to the default namespace and to the public files of
+// other namespaces. Files with a matching file secret, as well as public and password-protected files, are found
+// in any namespace (starting with the default namespace), so that they can be read without a key.
+func (s *Server) authorizeNamespacedFile(r *http.Request, id string) (*crypto.Key, string, error) {
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	if secret, ok := r.URL.Query()[queryParamAuth]; ok && s.authParamAllowed(r) {
+		for _, namespace := range s.namespaceIDs() {
+			stat, err := s.namespaceClipboard(namespace).Stat(id)
+			if err != nil || stat.Secret == "" || subtle.ConstantTimeCompare([]byte(stat.Secret), []byte(secret[0])) != 1 {
+				continue
+			} else if stat.PasswordKey != "" && read {
+				return nil, namespace, s.authorizeFilePassword(r, stat)
+			}
+			return nil, namespace, nil
+		}
+	}
+	if hasCredentials(r) {
+		key, err := s.authenticate(r, s.keys())
+		if err == nil {
+			namespace := s.keyNamespace(key)
+			stat, err := s.namespaceClipboard(namespace).Stat(id)
+			if err != nil && read {
+				if shared, sharedStat := s.sharedFile(id, true); sharedStat != nil {
+					namespace, stat = shared, sharedStat
+				}
+			}
+			if stat != nil && stat.PasswordKey != "" && read {
+				return nil, namespace, s.authorizeFilePassword(r, stat) // The key does not grant access to such files
+			}
+			s.resetAuthFailures(r)
+			return key, namespace, nil
+		} else if !read {
+			if err == ErrHTTPUnauthorized {
+				s.countAuthFailure(r)
+				s.delayAuthFailure(r)
+			}
+			return nil, "", err
+		}
+	}
+	if read {
+		if namespace, stat := s.sharedFile(id, false); stat != nil {
+			if stat.PasswordKey != "" {
+				return nil, namespace, s.authorizeFilePassword(r, stat)
+			}
+			return nil, namespace, nil
+		}
+	}
+	key, err := s.authorizeKey(r)
+	return key, "", err
+}
+
+// sharedFile returns the first public or password-protected file with the given ID (and its namespace), starting
+// with the default namespace, or nil if there is none. If includeDefault is true, any file of the default
+// namespace is returned, since it is shared by all keys.
+func (s *Server) sharedFile(id string, includeDefault bool) (string, *clipboard.File) {
+	for _, namespace := range s.namespaceIDs() {
+		stat, err := s.namespaceClipboard(namespace).Stat(id)
+		if err == nil && ((namespace == "" && includeDefault) || stat.Public || stat.PasswordKey != "") {
+			return namespace, stat
+		}
+	}
+	return "", nil
+}
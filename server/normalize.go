@@ -0,0 +1,44 @@
+package server
+
+import (
+	"fmt"
+	"heckel.io/pcopy/clipboard"
+	"heckel.io/pcopy/util"
+	"io"
+	"net/http"
+)
+
+const (
+	queryParamNormalize = "normalize"
+
+	normalizeLF   = "lf"
+	normalizeCRLF = "crlf"
+)
+
+// getNormalize returns the line ending normalization requested via ?normalize=lf|crlf, or an empty string if none
+// was requested. Normalization changes the content while it is stored, so it is not supported for streams,
+// reservations and resumable uploads.
+func (s *Server) getNormalize(r *http.Request) (string, error) {
+	normalize := r.URL.Query().Get(queryParamNormalize)
+	if normalize == "" {
+		return "", nil
+	} else if normalize != normalizeLF && normalize != normalizeCRLF {
+		return "", ErrHTTPBadRequest
+	}
+	streamMode, err := s.getStreamMode(r)
+	if err != nil {
+		return "", err
+	} else if s.isReserve(r) || streamMode != HeaderStreamDisabled || r.URL.Query().Get(queryParamUpload) != "" {
+		return "", &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (normalization not supported for streams and resumable uploads)", http.StatusText(http.StatusBadRequest))}
+	}
+	return normalize, nil
+}
+
+// normalizeLineEndings converts the line endings of the body as requested (see getNormalize), if the content is
+// text. Binary content is returned as is, and the returned normalization is empty.
+func normalizeLineEndings(body io.ReadCloser, normalize string, contentType string) (io.ReadCloser, string) {
+	if normalize == "" || !clipboard.IsText(contentType) {
+		return body, ""
+	}
+	return util.NewLineEndingReadCloser(body, normalize == normalizeCRLF), normalize
+}
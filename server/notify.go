@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"heckel.io/pcopy/clipboard"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/util"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+const (
+	notifyReminderFraction = 10 // Remind when 1/10th (10%) of the TTL is left
+)
+
+// sendMailFunc has the same signature as smtp.SendMail, so it can be replaced in tests
+type sendMailFunc func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+
+// notifyCreated emails the link to a newly created file to the address in its metadata. This is meant to be
+// called asynchronously; errors are only logged.
+func (s *Server) notifyCreated(id string, meta *clipboard.File) {
+	url, err := generateURL(s.config, fmt.Sprintf(clipboardPathFormat, id), meta.Secret)
+	if err != nil {
+		log.Printf("[%s] cannot send notification for %s: %s", config.CollapseServerAddr(s.config.ServerAddr), s.logID(id), err.Error())
+		return
+	}
+	expires := "never"
+	if meta.Expires > 0 {
+		expires = time.Unix(meta.Expires, 0).Format(time.RFC1123)
+	}
+	subject := fmt.Sprintf("pcopy: %s was copied", id)
+	body := fmt.Sprintf("The file %s was copied to %s.\n\nLink: %s\nExpires: %s\n",
+		id, config.CollapseServerAddr(s.config.ServerAddr), url, expires)
+	s.notify(id, meta.Notify, subject, body)
+}
+
+// sendExpiryReminders emails a reminder for all files with a notification address that have less than
+// 1/notifyReminderFraction of their time-to-live left. Each file is reminded only once. The emails are
+// sent asynchronously.
+func (s *Server) sendExpiryReminders() {
+	for _, clip := range s.clipboards() {
+		s.sendClipboardExpiryReminders(clip)
+	}
+}
+
+func (s *Server) sendClipboardExpiryReminders(clip *clipboard.Clipboard) {
+	files, err := clip.List()
+	if err != nil {
+		log.Printf("[%s] cannot list clipboard entries for reminders: %s", config.CollapseServerAddr(s.config.ServerAddr), err.Error())
+		return
+	}
+	for _, f := range files {
+		if f.Notify == "" || f.Notified || f.Pipe || f.Expires == 0 {
+			continue
+		}
+		expires := time.Unix(f.Expires, 0)
+		left := time.Until(expires)
+		if left <= 0 || left > expires.Sub(f.ModTime)/notifyReminderFraction {
+			continue
+		}
+		f.Notified = true
+		if err := clip.WriteMeta(f.ID, f); err != nil {
+			log.Printf("[%s] cannot update metadata for %s: %s", config.CollapseServerAddr(s.config.ServerAddr), s.logID(f.ID), err.Error())
+			continue
+		}
+		url, err := generateURL(s.config, fmt.Sprintf(clipboardPathFormat, f.ID), f.Secret)
+		if err != nil {
+			continue
+		}
+		subject := fmt.Sprintf("pcopy: %s expires in %s", f.ID, util.DurationToHuman(left))
+		body := fmt.Sprintf("The file %s on %s expires in %s (%s). Download it before it is deleted.\n\nLink: %s\n",
+			f.ID, config.CollapseServerAddr(s.config.ServerAddr), util.DurationToHuman(left), expires.Format(time.RFC1123), url)
+		go s.notify(f.ID, f.Notify, subject, body)
+	}
+}
+
+func (s *Server) notify(id string, to string, subject string, body string) {
+	var auth smtp.Auth
+	if s.config.SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(s.config.SMTPAddr)
+		auth = smtp.PlainAuth("", s.config.SMTPUser, s.config.SMTPPass, host)
+	}
+	headers := []string{
+		fmt.Sprintf("From: %s", s.config.SMTPFrom),
+		fmt.Sprintf("To: %s", to),
+		fmt.Sprintf("Subject: %s", subject),
+		fmt.Sprintf("Date: %s", time.Now().Format(time.RFC1123Z)),
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	msg := strings.Join(headers, "\r\n") + "\r\n\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+	from := s.config.SMTPFrom
+	if addr, err := mail.ParseAddress(from); err == nil {
+		from = addr.Address // Envelope sender must not contain the display name
+	}
+	if err := s.sendMail(s.config.SMTPAddr, auth, from, []string{to}, []byte(msg)); err != nil {
+		log.Printf("[%s] cannot send notification for %s: %s", config.CollapseServerAddr(s.config.ServerAddr), s.logID(id), err.Error())
+	}
+}
@@ -0,0 +1,397 @@
+package server
+
+import (
+	"fmt"
+	"heckel.io/pcopy/config"
+	"heckel.io/pcopy/util"
+	"strings"
+	"time"
+)
+
+const (
+	openAPIVersion = "3.0.3"
+)
+
+// openAPISpec generates an OpenAPI description of the clipboard API. Allowed values, defaults and limits
+// are taken from the server config, so the spec reflects what this particular server accepts.
+func (s *Server) openAPISpec() map[string]interface{} {
+	fileParam := map[string]interface{}{
+		"name":        "id",
+		"in":          "path",
+		"required":    true,
+		"description": "Clipboard file identifier",
+		"schema":      map[string]interface{}{"type": "string", "pattern": fmt.Sprintf("^[a-zA-Z0-9][-_.a-zA-Z0-9]{1,%d}$", s.config.IDMaxLength-1)},
+	}
+	putParams := []interface{}{
+		openAPIQueryParam(queryParamTTL, fmt.Sprintf("Time-to-live after which the file will be deleted, e.g. 30m or 2d, or never (default: %s)",
+			durationOrNever(s.config.FileExpireAfterDefault)), map[string]interface{}{"type": "string"}),
+		openAPIQueryParam(queryParamExpires, "Absolute expiry time as unix timestamp or RFC3339, alternative to the time-to-live; the same max. values apply",
+			map[string]interface{}{"type": "string"}),
+		openAPIQueryParam(queryParamFileMode, "Defines whether the file is read-write or read-only",
+			map[string]interface{}{"type": "string", "enum": s.config.FileModesAllowed, "default": s.defaultFileMode()}),
+		openAPIQueryParam(queryParamStream, "Stream data without storing it on the server; the upload blocks until the download begins",
+			map[string]interface{}{"type": "string", "enum": []string{HeaderStreamDisabled, HeaderStreamImmediateHeaders, HeaderStreamDelayHeaders}}),
+		openAPIQueryParam(queryParamStreamReserve, "Reserve the file name for a short period of time, so it can be streamed to later",
+			map[string]interface{}{"type": "string", "enum": []string{HeaderReserveEnabled}}),
+		openAPIQueryParam(queryParamBurn, "Burn after reading: delete the file after it has been downloaded once",
+			map[string]interface{}{"type": "string", "enum": []string{HeaderBurnEnabled}}),
+		openAPIQueryParam(queryParamDownloads, "Delete the file after it has been downloaded this many times; further downloads fail with 410",
+			map[string]interface{}{"type": "integer", "minimum": 1}),
+		openAPIQueryParam(queryParamPassword, "Protect the file with a password; reading it then requires the password via basic auth or HMAC",
+			map[string]interface{}{"type": "string", "format": "password"}),
+		openAPIQueryParam(queryParamHidden, "Hide the file from the statistics endpoint; it can still be retrieved by its ID",
+			map[string]interface{}{"type": "string", "enum": []string{HeaderHiddenEnabled}}),
+		openAPIQueryParam(queryParamPublic, "Make the file readable without the server password; creating a public file requires the server password",
+			map[string]interface{}{"type": "string", "enum": []string{HeaderPublicEnabled}}),
+		openAPIQueryParam(queryParamNormalize, "Convert the line endings of text content to LF or CRLF before storing it; binary content is stored as is",
+			map[string]interface{}{"type": "string", "enum": []string{normalizeLF, normalizeCRLF}}),
+		openAPIQueryParam(queryParamFormat, "Output format of the response",
+			map[string]interface{}{"type": "string", "enum": []string{HeaderFormatText, HeaderFormatJSON, HeaderFormatNone}, "default": HeaderFormatText}),
+		openAPIQueryParam(queryParamCheck, "Dry run: validate the upload (including the size announced via X-Size) against the limits and respond with 200 or the error, without storing anything; not supported for archives, aliases, appends, touches and resumable uploads",
+			map[string]interface{}{"type": "string", "enum": []string{"1"}}),
+	}
+	if s.config.SMTPAddr != "" {
+		putParams = append(putParams, openAPIQueryParam(queryParamNotify, "Email address to send the link to, and to remind shortly before the file expires",
+			map[string]interface{}{"type": "string", "format": "email"}))
+	}
+	touchParam := openAPIQueryParam(queryParamTouch, "Only reset the time-to-live of an existing read-write file, without uploading it again; the request body is ignored",
+		map[string]interface{}{"type": "string", "enum": []string{"1"}})
+	uploadParam := openAPIQueryParam(queryParamUpload, "Start a resumable upload (returns the token in X-Upload-Token), or commit it after all chunks were sent via PATCH; the request body is ignored",
+		map[string]interface{}{"type": "string", "enum": []string{uploadStart, uploadFinish}})
+	linkParam := openAPIQueryParam(queryParamLink, "Create an alias of the given existing file instead of uploading; the alias serves the file's content, but has its own time-to-live; the request body is ignored",
+		map[string]interface{}{"type": "string"})
+	appendParam := openAPIQueryParam(queryParamAppend, "Append the body to the file instead of replacing it, and create it if it does not exist; \"close\" appends and marks the file as complete, which ends all followers",
+		map[string]interface{}{"type": "string", "enum": []string{appendOpen, appendClose}})
+	idStyleParam := openAPIQueryParam(queryParamIDStyle, "Style of the random file name, e.g. \"aZ3kq9XbT1\" or \"brave-amber-otter\"",
+		map[string]interface{}{"type": "string", "enum": []string{idStyleChars, idStyleWords}, "default": idStyleChars})
+	idLengthParam := openAPIQueryParam(queryParamIDLength, "Length of the random file name (only for ID style \"chars\")",
+		map[string]interface{}{"type": "integer", "minimum": 2, "maximum": s.config.IDMaxLength, "default": randomFileIDLength})
+	archiveParam := openAPIQueryParam(queryParamArchive, "Unpack the body as archive, one file per member (named after its base name); the created files are returned as JSON, and if one is rejected, none are stored",
+		map[string]interface{}{"type": "string", "enum": []string{archiveFormatTar}})
+	getParams := []interface{}{
+		openAPIQueryParam(queryParamFilename, "File name used in the Content-Disposition header", map[string]interface{}{"type": "string"}),
+		openAPIQueryParam(queryParamDownload, "Force download (Content-Disposition: attachment)", map[string]interface{}{"type": "string", "enum": []string{"1"}}),
+		openAPIQueryParam(queryParamFollow, "If content is being appended to the file (see ?append=1), keep the response open and stream new content until the file is complete or expires",
+			map[string]interface{}{"type": "string", "enum": []string{"1"}}),
+		openAPIQueryParam(queryParamWait, fmt.Sprintf("If the file is reserved (see ?r=1) and the stream has not started yet, wait this long for it, e.g. 5s (max. %s)", reserveTTL),
+			map[string]interface{}{"type": "string"}),
+		openAPIQueryParam(queryParamToken, fmt.Sprintf("Token of a reservation, as part of the %s header: wait for the stream to that reservation to start (see ?timeout=)", HeaderStreamReadyURL),
+			map[string]interface{}{"type": "string"}),
+		openAPIQueryParam(queryParamTimeout, fmt.Sprintf("Alias for ?wait=; with ?token=, the default is to wait as long as the reservation lasts (%s)", reserveTTL),
+			map[string]interface{}{"type": "string"}),
+	}
+	putOperation := func(summary string, params ...interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"summary":     summary,
+			"parameters":  append(params, putParams...),
+			"requestBody": map[string]interface{}{"content": map[string]interface{}{"*/*": map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}}},
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{"description": "Upload would be accepted (?check=1)", "headers": openAPIFileInfoHeaders()},
+				"201": map[string]interface{}{"description": "File created", "headers": openAPIFileInfoHeaders()},
+				"400": map[string]interface{}{"description": "Invalid file ID or parameters"},
+				"405": map[string]interface{}{"description": "File exists and is read-only"},
+				"413": map[string]interface{}{"description": fmt.Sprintf("File or clipboard limit reached (%s)", s.openAPILimits())},
+				"429": map[string]interface{}{"description": "Rate limit or max. number of concurrent streams exceeded"},
+			},
+		}
+	}
+
+	putByIDOperation := func() map[string]interface{} {
+		op := putOperation("Copy to the given file", fileParam, touchParam, uploadParam, linkParam, appendParam)
+		responses := op["responses"].(map[string]interface{})
+		responses["200"] = map[string]interface{}{"description": "Upload would be accepted (?check=1), time-to-live reset (?touch=1), or content appended to an existing file (?append=1)", "headers": openAPIFileInfoHeaders()}
+		responses["409"] = map[string]interface{}{"description": "File is being written and cannot be appended to (?append=1)"}
+		responses["412"] = map[string]interface{}{"description": "If-Match or If-None-Match does not match the current file (\"If-None-Match: *\" creates the file only if it does not exist)"}
+		responses["404"] = map[string]interface{}{"description": "File not found (?touch=1), no pending upload (?upload=finish), or link target not found (?link=)"}
+		return op
+	}
+
+	paths := map[string]interface{}{
+		"/": map[string]interface{}{
+			"put":  putOperation("Copy to a random file name, or multiple files as archive", idStyleParam, idLengthParam, archiveParam),
+			"post": putOperation("Copy to a random file name, or multiple files as archive", idStyleParam, idLengthParam, archiveParam),
+			"options": map[string]interface{}{
+				"summary":   "Discover the features and limits of the server (streaming, burn mode, passwords, compression, ...)",
+				"security":  []interface{}{},
+				"responses": map[string]interface{}{"200": map[string]interface{}{"description": "Supported features, allowed methods in the Allow header", "content": openAPIJSONContent()}},
+			},
+			"get": map[string]interface{}{
+				"summary": "Paste multiple files as archive (without ?archive=, this is the web UI)",
+				"parameters": []interface{}{
+					openAPIQueryParam(queryParamArchive, "Archive format", map[string]interface{}{"type": "string", "enum": []string{archiveFormatTar}}),
+					openAPIQueryParam(queryParamIDs, "Comma-separated list of file identifiers", map[string]interface{}{"type": "string"}),
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Archive", "content": map[string]interface{}{"application/x-tar": map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}}},
+					"400": map[string]interface{}{"description": "No file identifiers, or a file cannot be archived (e.g. streams, burn-after-reading or password-protected files)"},
+					"404": map[string]interface{}{"description": "File not found"},
+				},
+			},
+		},
+		"/{id}": map[string]interface{}{
+			"put":  putByIDOperation(),
+			"post": putByIDOperation(),
+			"patch": map[string]interface{}{
+				"summary": "Append a chunk to a resumable upload",
+				"parameters": []interface{}{
+					fileParam,
+					openAPIQueryParam(queryParamUpload, "Upload token, as returned by ?upload=start", map[string]interface{}{"type": "string"}),
+					openAPIQueryParam(queryParamOffset, "Number of bytes uploaded so far, i.e. the offset of this chunk", map[string]interface{}{"type": "integer", "minimum": 0}),
+				},
+				"requestBody": map[string]interface{}{"content": map[string]interface{}{"*/*": map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}}},
+				"responses": map[string]interface{}{
+					"204": map[string]interface{}{"description": "Chunk appended, the new offset is in X-Upload-Offset"},
+					"404": map[string]interface{}{"description": "No pending upload for this file and token"},
+					"405": map[string]interface{}{"description": "File exists and is read-only"},
+					"409": map[string]interface{}{"description": "Offset mismatch, the expected offset is in X-Upload-Offset"},
+					"413": map[string]interface{}{"description": fmt.Sprintf("File limit reached (%s)", s.openAPILimits())},
+				},
+			},
+			"get": map[string]interface{}{
+				"summary":    "Paste the given file",
+				"parameters": append([]interface{}{fileParam}, getParams...),
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "File contents", "content": map[string]interface{}{"*/*": map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}}},
+					"206": map[string]interface{}{"description": "Partial file contents (Range request)"},
+					"304": map[string]interface{}{"description": "File unchanged since the ETag in If-None-Match; does not count as a download"},
+					"401": map[string]interface{}{"description": "File is password-protected, and the password is missing or wrong"},
+					"404": map[string]interface{}{"description": "File not found"},
+					"410": map[string]interface{}{"description": "Download limit reached, or the file is an alias and the linked file is gone"},
+					"425": map[string]interface{}{"description": "File is reserved, but the stream has not started yet (see ?wait=)"},
+				},
+			},
+			"delete": map[string]interface{}{
+				"summary":    "Delete the given file before it expires",
+				"parameters": []interface{}{fileParam},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "File deleted", "headers": map[string]interface{}{HeaderFile: map[string]interface{}{"description": "File identifier", "schema": map[string]interface{}{"type": "string"}}}},
+					"404": map[string]interface{}{"description": "File not found"},
+					"405": map[string]interface{}{"description": "File is read-only"},
+				},
+			},
+			"head": map[string]interface{}{
+				"summary":    "Retrieve file metadata",
+				"parameters": []interface{}{fileParam},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "File metadata", "headers": openAPIFileInfoHeaders()},
+					"304": map[string]interface{}{"description": "File unchanged since the ETag in If-None-Match"},
+					"404": map[string]interface{}{"description": "File not found"},
+					"410": map[string]interface{}{"description": "Download limit reached, or the file is an alias and the linked file is gone"},
+				},
+			},
+		},
+		"/{id}:meta": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary":    "Retrieve the full file metadata as JSON",
+				"parameters": []interface{}{fileParam},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "File metadata", "content": openAPIJSONContent()},
+					"404": map[string]interface{}{"description": "File not found"},
+				},
+			},
+		},
+		"/info": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary":  "Retrieve server information required to join the clipboard",
+				"security": []interface{}{},
+				"parameters": []interface{}{
+					openAPIQueryParam(queryParamFormat, "Include the server limits (file size, TTL, file modes, ...) in the response",
+						map[string]interface{}{"type": "string", "enum": []string{infoFormatFull}}),
+				},
+				"responses": map[string]interface{}{"200": map[string]interface{}{"description": "Server information", "content": openAPIJSONContent()}},
+			},
+		},
+		"/verify": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Verify the password",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Password is correct"},
+					"401": map[string]interface{}{"description": "Password is incorrect"},
+				},
+			},
+		},
+		"/list": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "List the clipboard entries, newest first",
+				"parameters": []interface{}{
+					openAPIQueryParam(queryParamOffset, "Number of entries to skip", map[string]interface{}{"type": "integer", "minimum": 0, "default": 0}),
+					openAPIQueryParam(queryParamLimit, "Max. number of entries to return",
+						map[string]interface{}{"type": "integer", "minimum": 1, "maximum": listLimitMax, "default": listLimitDefault}),
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "Clipboard entries",
+						"headers":     map[string]interface{}{HeaderTotal: map[string]interface{}{"description": "Total number of entries", "schema": map[string]interface{}{"type": "integer"}}},
+						"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}}}},
+					},
+					"400": map[string]interface{}{"description": "Invalid offset or limit"},
+				},
+			},
+		},
+		"/stats": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary":   "Retrieve clipboard statistics and recent activity",
+				"responses": map[string]interface{}{"200": map[string]interface{}{"description": "Clipboard statistics", "content": openAPIJSONContent()}},
+			},
+		},
+		"/changes": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": fmt.Sprintf("Wait up to %s for entries to be created, updated, deleted or expired, and return their IDs", util.DurationToHuman(changesTimeout)),
+				"parameters": []interface{}{
+					openAPIQueryParam(queryParamSince, "Unix timestamp in nanoseconds, as returned in the \"time\" field of the previous response (default: now)",
+						map[string]interface{}{"type": "integer"}),
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Changed IDs (empty on timeout), and the timestamp to pass as \"since\" next", "content": openAPIJSONContent()},
+					"400": map[string]interface{}{"description": "Invalid timestamp"},
+				},
+			},
+		},
+		"/admin/expire": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Delete expired entries now, instead of waiting for the next periodic sweep",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Number of expired entries", "content": openAPIJSONContent()},
+				},
+			},
+		},
+	}
+
+	if s.config.EnableSearch {
+		paths["/search"] = map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Search the text entries for the given string",
+				"parameters": []interface{}{
+					openAPIQueryParam(queryParamQuery, fmt.Sprintf("String to search for (case-sensitive); only the first %s of each entry are searched",
+						util.BytesToHuman(searchFileSizeMax)), map[string]interface{}{"type": "string", "maxLength": searchQueryLengthMax}),
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Matching entries with a snippet; \"complete\" is false if the search timed out", "content": openAPIJSONContent()},
+					"400": map[string]interface{}{"description": "Missing or too long query"},
+				},
+			},
+		}
+	}
+
+	if s.config.EnableAdmin {
+		paths["/admin/stats"] = map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Retrieve the number and size of all entries, the disk usage, the entries per visitor and the configured limits",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Clipboard stats", "content": openAPIJSONContent()},
+				},
+			},
+		}
+		paths["/admin/purge"] = map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "Remove orphaned files, i.e. clipboard files without metadata and metadata without a clipboard file",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "IDs of the purged files", "content": openAPIJSONContent()},
+				},
+			},
+		}
+	}
+
+	if s.config.EnableMetrics {
+		paths["/metrics"] = map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary":   "Retrieve server metrics in the Prometheus text format",
+				"responses": map[string]interface{}{"200": map[string]interface{}{"description": "Metrics", "content": map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}}},
+			},
+		}
+	}
+
+	spec := map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":       "pcopy",
+			"description": fmt.Sprintf("Copy/paste across machines. Limits: %s.", s.openAPILimits()),
+			"version":     "1",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": config.ExpandServerAddr(s.config.ServerAddr)}},
+		"paths":   paths,
+	}
+	if s.config.Key != nil {
+		spec["components"] = map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"basic": map[string]interface{}{"type": "http", "scheme": "basic", "description": "Password as basic auth password (any user)"},
+				"hmac":  map[string]interface{}{"type": "apiKey", "in": "header", "name": "Authorization", "description": "HMAC <timestamp> <ttl> <base64-hmac>"},
+				"param": map[string]interface{}{"type": "apiKey", "in": "query", "name": queryParamAuth,
+					"description": fmt.Sprintf("Password or HMAC as query parameter (allowed for: %s)", strings.Join(s.config.AuthParamMethods, ", "))},
+			},
+		}
+		spec["security"] = []interface{}{
+			map[string]interface{}{"basic": []string{}},
+			map[string]interface{}{"hmac": []string{}},
+			map[string]interface{}{"param": []string{}},
+		}
+	}
+	return spec
+}
+
+func (s *Server) openAPILimits() string {
+	limits := []string{
+		fmt.Sprintf("per-file size %s", bytesOrNoLimit(s.config.FileSizeLimit)),
+		fmt.Sprintf("total size %s", bytesOrNoLimit(s.config.ClipboardSizeLimit)),
+	}
+	if s.config.ClipboardCountLimit > 0 {
+		limits = append(limits, fmt.Sprintf("max. %d files", s.config.ClipboardCountLimit))
+	}
+	if s.config.SizePerVisitorLimit > 0 {
+		limits = append(limits, fmt.Sprintf("per-visitor size %s", util.BytesToHuman(s.config.SizePerVisitorLimit)))
+	}
+	return strings.Join(limits, ", ")
+}
+
+func openAPIQueryParam(name string, description string, schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        name,
+		"in":          "query",
+		"description": description,
+		"schema":      schema,
+	}
+}
+
+func openAPIFileInfoHeaders() map[string]interface{} {
+	headers := map[string]interface{}{}
+	for name, description := range map[string]string{
+		HeaderFile:               "File identifier",
+		HeaderURL:                "Full URL (including auth) to access the file",
+		HeaderTTL:                "Remaining time-to-live in seconds",
+		HeaderExpires:            "Expiration unix timestamp (0 = never)",
+		HeaderCurl:               "curl command to retrieve the file",
+		HeaderAvailable:          "Whether the file is ready to be read (HEAD only)",
+		HeaderStreaming:          "Set to true if the file is a stream (HEAD only)",
+		HeaderExpectedSize:       "Size announced by the uploader of a stream via X-Size; not enforced (GET/HEAD only)",
+		HeaderSHA256:             "SHA-256 checksum of the stored content, not sent for streams (GET/HEAD only)",
+		HeaderDownloadsRemaining: "Number of downloads left, if the file has a download limit (HEAD only)",
+		HeaderLines:              "Number of lines, if the file is text (HEAD only, not for streams)",
+		HeaderBinary:             "Set to true if the file is not text, based on its detected content type (HEAD only, not for streams)",
+		"Cache-Control":          "max-age until the file expires, or no-store for one-time content and streams (GET/HEAD only)",
+		"Expires":                "HTTP date when the file expires, not sent for one-time content and streams (GET/HEAD only)",
+		"ETag":                   "Strong entity tag of the file content, for use with If-None-Match, or If-Match on PUT (HEAD and PUT only, not for streams)",
+		HeaderQuotaRemaining:     "Number of bytes the visitor can still upload, if there is a per-visitor quota (PUT/POST only)",
+		HeaderStreamReadyURL:     "URL to read the stream once it starts, see ?token= (reservations only)",
+	} {
+		headers[name] = map[string]interface{}{"description": description, "schema": map[string]interface{}{"type": "string"}}
+	}
+	return headers
+}
+
+func openAPIJSONContent() map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{"type": "object"}}}
+}
+
+func bytesOrNoLimit(limit int64) string {
+	if limit == 0 {
+		return "no limit"
+	}
+	return util.BytesToHuman(limit)
+}
+
+func durationOrNever(d time.Duration) string {
+	if d == 0 {
+		return "never"
+	}
+	return util.DurationToHuman(d)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"heckel.io/pcopy/clipboard"
+	"net/http"
+	"strings"
+)
+
+// errPreconditionFailed is returned if the If-Match or If-None-Match header of a PUT request does not match the
+// current state of the entry, see checkPrecondition
+var errPreconditionFailed = &ErrHTTP{http.StatusPreconditionFailed, http.StatusText(http.StatusPreconditionFailed)}
+
+// checkPrecondition evaluates the If-Match and If-None-Match headers of a PUT request against the current entry,
+// to allow optimistic concurrency: "If-None-Match: *" only creates the entry if it does not exist, and
+// "If-Match: <etag>" only overwrites it if its content has not changed since it was read. Since the check is
+// only meaningful if the entry does not change until it is written, concurrent conditional requests for the same
+// entry are rejected. It returns true if the request was conditional, in which case releasePrecondition must be
+// called once the entry is written.
+func (s *Server) checkPrecondition(r *http.Request, id string) (bool, error) {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return false, nil
+	}
+	if !s.claimPrecondition(s.entryKey(r, id)) {
+		return false, errPreconditionFailed // Another conditional request is about to change the entry
+	}
+	var etags []string
+	stat, err := s.clipboardFor(r).Stat(id)
+	exists := err == nil
+	if exists {
+		if content, err := s.linkTarget(stat); err == nil {
+			etags = entityTags(content)
+		}
+	}
+	if (ifMatch != "" && !ifMatchMatches(ifMatch, exists, etags)) || (ifNoneMatch != "" && ifNoneMatchMatches(ifNoneMatch, exists, etags)) {
+		s.releasePrecondition(s.entryKey(r, id))
+		return false, errPreconditionFailed
+	}
+	return true, nil
+}
+
+func (s *Server) claimPrecondition(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.preconditions[id] {
+		return false
+	}
+	s.preconditions[id] = true
+	return true
+}
+
+func (s *Server) releasePrecondition(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.preconditions, id)
+}
+
+// entityTags returns all ETags that a client may have received for the entry, i.e. with and without the gzip
+// suffix, see fileETag. Streams have none.
+func entityTags(stat *clipboard.File) []string {
+	identity := fileETag(&http.Request{Header: http.Header{}}, stat)
+	if identity == "" {
+		return nil
+	} else if !stat.Compressed {
+		return []string{identity}
+	}
+	return []string{identity, strings.TrimSuffix(identity, `"`) + `-gzip"`}
+}
+
+// ifMatchMatches returns true if the If-Match header matches the entry: "*" matches any existing entry, otherwise
+// one of the listed ETags must be the entry's. As required for If-Match, weak ETags ("W/...") never match.
+func ifMatchMatches(ifMatch string, exists bool, etags []string) bool {
+	if !exists {
+		return false
+	}
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		for _, etag := range etags {
+			if candidate == etag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ifNoneMatchMatches returns true if the If-None-Match header matches the entry, i.e. if the PUT must be rejected,
+// see etagMatches
+func ifNoneMatchMatches(ifNoneMatch string, exists bool, etags []string) bool {
+	if !exists {
+		return false
+	}
+	for _, etag := range etags {
+		if etagMatches(ifNoneMatch, etag) {
+			return true
+		}
+	}
+	return strings.TrimSpace(ifNoneMatch) == "*"
+}
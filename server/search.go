@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	queryParamQuery      = "q"
+	searchFileSizeMax    = 1024 * 1024 // Only the first 1 MB of each file is searched
+	searchQueryLengthMax = 256
+)
+
+var (
+	// searchTimeout bounds the time spent searching, so that a large clipboard cannot keep the server busy.
+	// This is a variable so it can be shortened in tests.
+	searchTimeout = 5 * time.Second
+)
+
+// SearchResult is the response of the /search endpoint. If the search timed out, Complete is false and
+// Matches only contains the matches found until then.
+type SearchResult struct {
+	Matches  []*SearchMatch `json:"matches"`
+	Complete bool           `json:"complete"`
+}
+
+// SearchMatch is a single clipboard entry containing the search query
+type SearchMatch struct {
+	ID      string `json:"id"`
+	Snippet string `json:"snippet"`
+}
+
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) error {
+	if !s.config.EnableSearch {
+		return ErrHTTPNotFound
+	}
+	query := r.URL.Query().Get(queryParamQuery)
+	if query == "" || len(query) > searchQueryLengthMax {
+		return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (query must be between 1 and %d bytes)", http.StatusText(http.StatusBadRequest), searchQueryLengthMax)}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), searchTimeout)
+	defer cancel()
+	matches, err := s.clipboardFor(r).Search(ctx, query, searchFileSizeMax)
+	if err != nil && err != context.DeadlineExceeded && err != context.Canceled {
+		return err
+	}
+	response := &SearchResult{
+		Matches:  make([]*SearchMatch, 0),
+		Complete: err == nil,
+	}
+	for _, m := range matches {
+		if !m.File.Hidden { // Hidden files must not show up here, same as in the stats and the list
+			response.Matches = append(response.Matches, &SearchMatch{ID: m.File.ID, Snippet: m.Snippet})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(response)
+}
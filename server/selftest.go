@@ -0,0 +1,191 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"heckel.io/pcopy/config"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// SelfTestError is returned by SelfTest if the config has one or more problems. Unlike New, which fails
+// on the first problem, it lists all of them.
+type SelfTestError struct {
+	Problems []string
+}
+
+func (e *SelfTestError) Error() string {
+	return fmt.Sprintf("self-test found %d problem(s):\n- %s", len(e.Problems), strings.Join(e.Problems, "\n- "))
+}
+
+// SelfTest validates the server config end-to-end without serving anything: it checks that the listen
+// addresses are valid, that the TLS certificate and key can be loaded and match, that the clipboard
+// directory is writable, that the limits are sane, and that the web templates render with this config.
+// If any of these checks fail, a *SelfTestError listing all problems is returned.
+func (s *Server) SelfTest() error {
+	return SelfTest(s.config)
+}
+
+// SelfTest runs the same checks as Server.SelfTest, but does not require a Server. This is useful to check
+// a config that New would reject, since New fails on the first problem.
+func SelfTest(conf *config.Config) error {
+	problems := make([]string, 0)
+	problems = append(problems, selfTestListen(conf)...)
+	problems = append(problems, selfTestTLS(conf)...)
+	problems = append(problems, selfTestClipboardDir(conf)...)
+	problems = append(problems, selfTestLimits(conf)...)
+	problems = append(problems, selfTestTemplates(conf)...)
+	if len(problems) > 0 {
+		return &SelfTestError{Problems: problems}
+	}
+	return nil
+}
+
+func selfTestListen(conf *config.Config) []string {
+	problems := make([]string, 0)
+	if conf.ListenHTTPS == "" && conf.ListenHTTP == "" {
+		problems = append(problems, errListenAddrMissing.Error())
+	}
+	names := []string{"ListenHTTPS", "ListenHTTP", "ListenTCP"}
+	for i, addr := range []string{conf.ListenHTTPS, conf.ListenHTTP, conf.ListenTCP} {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid %s %s: %s", names[i], addr, err.Error()))
+		}
+	}
+	if _, err := url.ParseRequestURI(config.ExpandServerAddr(conf.ServerAddr)); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid ServerAddr %s: %s", conf.ServerAddr, err.Error()))
+	}
+	return problems
+}
+
+func selfTestTLS(conf *config.Config) []string {
+	if len(conf.AutoCertDomains) > 0 {
+		return selfTestAutoCert(conf)
+	} else if conf.ListenHTTPS == "" {
+		return nil
+	}
+	problems := make([]string, 0)
+	if conf.KeyFile == "" {
+		problems = append(problems, errKeyFileMissing.Error())
+	}
+	if conf.CertFile == "" {
+		problems = append(problems, errCertFileMissing.Error())
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return []string{fmt.Sprintf("cannot load certificate %s and key %s: %s", conf.CertFile, conf.KeyFile, err.Error())}
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return []string{fmt.Sprintf("cannot parse certificate %s: %s", conf.CertFile, err.Error())}
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return []string{fmt.Sprintf("certificate %s expired on %s", conf.CertFile, leaf.NotAfter.Format(time.RFC3339))}
+	}
+	return nil
+}
+
+func selfTestAutoCert(conf *config.Config) []string {
+	problems := make([]string, 0)
+	if conf.KeyFile != "" || conf.CertFile != "" {
+		problems = append(problems, errAutoCertWithCertFiles.Error())
+	}
+	if conf.ListenHTTPS == "" {
+		problems = append(problems, errAutoCertListenMissing.Error())
+	}
+	if err := os.MkdirAll(conf.AutoCertCacheDir, 0700); err != nil {
+		problems = append(problems, fmt.Sprintf("cannot create AutoCertCacheDir %s: %s", conf.AutoCertCacheDir, err.Error()))
+	}
+	return problems
+}
+
+func selfTestClipboardDir(conf *config.Config) []string {
+	if err := os.MkdirAll(conf.ClipboardDir, conf.DirMode); err != nil {
+		return []string{fmt.Sprintf("cannot create clipboard dir %s: %s", conf.ClipboardDir, err.Error())}
+	}
+	if err := unix.Access(conf.ClipboardDir, unix.W_OK); err != nil {
+		return []string{fmt.Sprintf("clipboard dir %s not writable by user: %s", conf.ClipboardDir, err.Error())}
+	}
+	f, err := ioutil.TempFile(conf.ClipboardDir, ".selftest")
+	if err != nil {
+		return []string{fmt.Sprintf("cannot write to clipboard dir %s: %s", conf.ClipboardDir, err.Error())}
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+func selfTestLimits(conf *config.Config) []string {
+	problems := make([]string, 0)
+	if conf.ClipboardSizeLimit < 0 {
+		problems = append(problems, "ClipboardSizeLimit must not be negative")
+	}
+	if conf.ClipboardCountLimit < 0 {
+		problems = append(problems, "ClipboardCountLimit must not be negative")
+	}
+	if conf.SizePerVisitorLimit < 0 {
+		problems = append(problems, "SizePerVisitorLimit must not be negative")
+	}
+	if conf.FileSizeLimit < 0 {
+		problems = append(problems, "FileSizeLimit must not be negative")
+	}
+	if conf.MaxConcurrentUploads < 0 {
+		problems = append(problems, "MaxConcurrentUploads must not be negative")
+	}
+	if conf.MaxConcurrentStreams < 0 {
+		problems = append(problems, "MaxConcurrentStreams must not be negative")
+	}
+	if conf.ClipboardSizeLimit > 0 && conf.FileSizeLimit > conf.ClipboardSizeLimit {
+		problems = append(problems, "FileSizeLimit is larger than ClipboardSizeLimit, files of that size can never be stored")
+	}
+	contentTypes := make([]string, 0)
+	for contentType := range conf.SizeLimitByType {
+		contentTypes = append(contentTypes, contentType)
+	}
+	sort.Strings(contentTypes)
+	for _, contentType := range contentTypes {
+		if conf.ClipboardSizeLimit > 0 && conf.SizeLimitByType[contentType] > conf.ClipboardSizeLimit {
+			problems = append(problems, fmt.Sprintf("SizeLimitByType for %s is larger than ClipboardSizeLimit", contentType))
+		}
+	}
+	if len(conf.FileModesAllowed) == 0 {
+		problems = append(problems, "FileModesAllowed must allow at least one file mode")
+	} else if conf.DefaultFileMode != "" && !config.IsFileModeAllowed(conf.FileModesAllowed, conf.DefaultFileMode) {
+		problems = append(problems, errDefaultFileModeNotAllowed.Error())
+	}
+	if conf.ManagerInterval <= 0 {
+		problems = append(problems, errManagerIntervalInvalid.Error())
+	}
+	if conf.EncryptAtRest && conf.Key == nil && len(conf.AtRestKey) == 0 {
+		problems = append(problems, errAtRestKeyMissing.Error())
+	}
+	if conf.FileExpireAfterDefault == 0 && (conf.FileExpireAfterTextMax > 0 || conf.FileExpireAfterNonTextMax > 0) {
+		problems = append(problems, "FileExpireAfter default is 0 (never), so files without a TTL never expire, despite the max. values")
+	}
+	return problems
+}
+
+func selfTestTemplates(conf *config.Config) []string {
+	problems := make([]string, 0)
+	s := &Server{config: conf}
+	for _, tmpl := range []*template.Template{webTemplate, curlTemplate, ncTemplate} {
+		if err := tmpl.Execute(ioutil.Discard, s.webTemplateConfig()); err != nil {
+			problems = append(problems, fmt.Sprintf("cannot render %s template: %s", tmpl.Name(), err.Error()))
+		}
+	}
+	return problems
+}
@@ -15,6 +15,7 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
@@ -24,6 +25,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/time/rate"
 	"heckel.io/pcopy/clipboard"
 	"heckel.io/pcopy/config"
@@ -32,15 +34,25 @@ import (
 	htmltemplate "html/template"
 	"io"
 	"log"
+	"math"
+	"math/rand"
+	"mime"
 	"net"
 	"net/http"
+	"net/mail"
+	"net/smtp"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"text/template"
 	"time"
+	"unicode"
 	"unicode/utf8"
 )
 
@@ -67,6 +79,34 @@ const (
 	// HeaderReserveEnabled is a value for X-Reserve that enabled reservation mode; no other values are possible
 	HeaderReserveEnabled = "1"
 
+	// HeaderBurn can be sent in PUT requests to delete the file after it has been read once (see config.FileModeBurn)
+	HeaderBurn = "X-Burn"
+
+	// HeaderBurnEnabled is a value for X-Burn that enables burn-after-reading; no other values are possible
+	HeaderBurnEnabled = "1"
+
+	// HeaderDownloads can be sent in PUT requests to limit how many times a file can be downloaded before it is
+	// deleted. Once the limit is reached, further downloads fail with 410 Gone.
+	HeaderDownloads = "X-Downloads"
+
+	// HeaderPassword can be sent in PUT requests to protect the file with a password. The file can then only be
+	// read by presenting the password via basic auth or HMAC, regardless of the server key.
+	HeaderPassword = "X-Password"
+
+	// HeaderHidden can be sent in PUT requests to hide the file from the /stats endpoint. Hidden files can still
+	// be retrieved by their ID.
+	HeaderHidden = "X-Hidden"
+
+	// HeaderHiddenEnabled is a value for X-Hidden that hides the file; no other values are possible
+	HeaderHiddenEnabled = "1"
+
+	// HeaderPublic can be sent in PUT requests to make the file readable without authorization on a password-protected
+	// server, e.g. to share a single file externally. Creating a public file requires the server password (or key).
+	HeaderPublic = "X-Public"
+
+	// HeaderPublicEnabled is a value for X-Public that makes the file public; no other values are possible
+	HeaderPublicEnabled = "1"
+
 	// HeaderNoRedirect prevents the redirect handler from redirecting to HTTPS
 	HeaderNoRedirect = "X-No-Redirect"
 
@@ -94,35 +134,170 @@ const (
 	// HeaderTTL is a response header containing the remaining time-to-live (TTL) for the clipboard file
 	HeaderTTL = "X-TTL"
 
+	// HeaderTTLClamped is a response header that is set to HeaderTTLClampedYes if the requested TTL was larger than
+	// the max. allowed TTL, and was therefore reduced to the max. value (see config.FileExpireAfterTextMax, ...)
+	HeaderTTLClamped = "X-TTL-Clamped"
+
+	// HeaderTTLClampedYes is a value for X-TTL-Clamped indicating that the TTL was reduced to the max. value
+	HeaderTTLClampedYes = "true"
+
 	// HeaderURL is a response header containing the full URL (including auth) to access the clipboard file
 	HeaderURL = "X-URL"
 
-	// HeaderExpires is a response header containing the file expiration unix timestamp for the clipboard file
+	// HeaderStreamReadyURL is a response header for reservations (see HeaderReserve) containing the URL to read the
+	// stream once it starts: a GET against it waits until the stream is attached, see waitForStream
+	HeaderStreamReadyURL = "X-Stream-Ready-URL"
+
+	// HeaderExpires is a response header containing the file expiration unix timestamp for the clipboard file. As a
+	// request header, it sets an absolute expiry time (unix timestamp or RFC3339), as an alternative to X-TTL.
 	HeaderExpires = "X-Expires"
 
 	// HeaderCurl is a response header containing the curl command that can be used to retrieve the clipboard file
 	HeaderCurl = "X-Curl"
 
+	// HeaderNotify can be set in PUT requests to an email address that is notified when the file is created, and
+	// shortly before it expires (only if SMTP is configured)
+	HeaderNotify = "X-Notify"
+
+	// HeaderStreaming is a response header for HEAD requests that is set to HeaderStreamingYes if the clipboard file
+	// is a stream. Streams have no known size, so no "Length:" header is sent (but possibly HeaderExpectedSize). The
+	// stream can be read with a GET request.
+	HeaderStreaming = "X-Streaming"
+
+	// HeaderStreamingYes is a value for X-Streaming indicating that the clipboard file is a stream
+	HeaderStreamingYes = "true"
+
+	// HeaderAvailable is a response header for HEAD requests that is set to HeaderAvailableNo if the clipboard file
+	// exists, but cannot be read yet, e.g. because it is only reserved or still being uploaded
+	HeaderAvailable = "X-Available"
+
+	// HeaderAvailableYes is a value for X-Available indicating that the clipboard file is ready to be read
+	HeaderAvailableYes = "1"
+
+	// HeaderAvailableNo is a value for X-Available indicating that the clipboard file is not ready to be read yet
+	HeaderAvailableNo = "0"
+
+	// HeaderDownloadsRemaining is a response header for HEAD requests containing the number of downloads left before
+	// the clipboard file is deleted. It is only sent for files with a download limit (see HeaderDownloads).
+	HeaderDownloadsRemaining = "X-Downloads-Remaining"
+
+	// HeaderQuotaRemaining is a response header for PUT/POST requests containing the number of bytes the visitor
+	// can still upload. It is only sent if SizePerVisitorLimit is set.
+	HeaderQuotaRemaining = "X-Quota-Remaining"
+
+	// HeaderSize can be sent in PUT requests for streams and reservations to announce the size of the content, if
+	// the request has no Content-Length (or for reservations, where the content follows in a later request)
+	HeaderSize = "X-Size"
+
+	// HeaderFilename can be sent in PUT requests to store the original name of the file. When the file is retrieved,
+	// it is sent as an attachment with that name (Content-Disposition), so that browsers save it under that name.
+	HeaderFilename = "X-Filename"
+
+	// HeaderLines is a response header for HEAD requests containing the number of lines of text content. It is
+	// not sent for binary content (see HeaderBinary), streams, and entries that are being appended to.
+	HeaderLines = "X-Lines"
+
+	// HeaderBinary is a response header for HEAD requests that is set to HeaderBinaryYes if the content is not
+	// text, based on the content type detected when it was stored
+	HeaderBinary = "X-Binary"
+
+	// HeaderBinaryYes and HeaderBinaryNo are the values for HeaderBinary
+	HeaderBinaryYes = "true"
+	HeaderBinaryNo  = "false"
+
+	// HeaderSHA256 can be sent in PUT requests with the hex-encoded SHA-256 checksum of the content, which is then
+	// verified while it is stored. In GET/HEAD responses, it contains the checksum of the stored content.
+	HeaderSHA256 = "X-SHA256"
+
+	// HeaderMetaPrefix is the prefix of headers that can be sent in PUT requests to attach arbitrary metadata to a
+	// file (e.g. "X-Meta-Author: phil"). The headers are stored with the file and sent back in GET/HEAD responses.
+	HeaderMetaPrefix = "X-Meta-"
+
+	// HeaderExpectedSize is a response header for GET/HEAD requests of streams containing the size announced by the
+	// uploader (see HeaderSize). Unlike Content-Length, it is not enforced, so the stream may be shorter or longer.
+	HeaderExpectedSize = "X-Expected-Size"
+
+	// HeaderUploadToken is a response header for ?upload=start containing the token of the resumable upload,
+	// which must be passed to every PATCH request as ?upload=<token>
+	HeaderUploadToken = "X-Upload-Token"
+
+	// HeaderUploadOffset is a response header for PATCH requests containing the number of bytes of a resumable
+	// upload received so far, i.e. the offset of the next chunk
+	HeaderUploadOffset = "X-Upload-Offset"
+
+	// HeaderIdempotencyKey can be sent in PUT/POST requests to make them safe to retry: a repeated request with the
+	// same key returns the result of the original request instead of uploading again, see idempotent
+	HeaderIdempotencyKey = "Idempotency-Key"
+
+	// HeaderIdempotentReplayed is a response header that is set if the response is the replayed result of an
+	// earlier request with the same HeaderIdempotencyKey
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+
+	// HeaderIdempotentReplayedYes is the value for HeaderIdempotentReplayed
+	HeaderIdempotentReplayedYes = "true"
+
+	// HeaderTotal is a response header for the /list endpoint containing the total number of entries, regardless
+	// of the requested page
+	HeaderTotal = "X-Total"
+
 	queryParamAuth          = "a"
 	queryParamStreamReserve = "r"
 	queryParamStream        = "s"
 	queryParamFormat        = "f"
 	queryParamFileMode      = "m"
 	queryParamTTL           = "t"
+	ttlNever                = "never"
+	queryParamExpires       = "expires"
 	queryParamDownload      = "d"
 	queryParamFilename      = "f" // Same as format, but that's ok, since this is for GETs
-
-	defaultMaxAuthAge   = time.Minute
-	visitorExpungeAfter = 30 * time.Minute
-	reserveTTL          = 10 * time.Second
-	peakLimitBytes      = 512 * 1024
+	filenameMaxLength       = 255 // Max. length of the original file name in bytes, see HeaderFilename
+	queryParamNotify        = "notify"
+	queryParamHidden        = "hidden"
+	queryParamPublic        = "public"
+	queryParamBurn          = "b"
+	queryParamDownloads     = "dl"
+	queryParamLimit         = "limit"
+	queryParamPassword      = "p"
+	queryParamOffset        = "offset"
+	queryParamTouch         = "touch"
+	queryParamUpload        = "upload"
+	queryParamCheck         = "check"
+	queryParamWait          = "wait"
+	queryParamToken         = "token"
+	queryParamTimeout       = "timeout"
+	queryParamAuthPrompt    = "auth"
+
+	uploadStart  = "start"
+	uploadFinish = "finish"
+
+	infoFormatFull = "full" // Value for ?f= on /info to include the server limits
+
+	defaultMaxAuthAge     = time.Minute
+	authNoncesMax         = 100000 // Max. number of remembered HMAC nonces, see config.RequireAuthNonce
+	visitorExpungeAfter   = 30 * time.Minute
+	reserveTTL            = 10 * time.Second
+	reserveWaitInterval   = 100 * time.Millisecond // Interval in which waitForStream checks if the stream has started
+	peakLimitBytes        = 512 * 1024
+	statsEventsMax        = 50
+	listLimitDefault      = 100
+	listLimitMax          = 1000
+	uploadRetryAfter      = 5 * time.Second
+	uploadExpireAfter     = time.Hour // Pending resumable uploads are deleted after this long without a new chunk
+	authFailureDelayMax   = 30 * time.Second
+	sniffContentTypeBytes = 512 // Max. bytes considered by http.DetectContentType
 )
 
 var (
-	authHmacRegex       = regexp.MustCompile(`^HMAC (\d+) (\d+) (.+)$`)
+	authHmacRegex       = regexp.MustCompile(`^HMAC (\d+) (\d+)(?: ([a-zA-Z0-9]{16,64}))? (\S+)$`) // timestamp ttl [nonce] b64-hmac
 	authBasicRegex      = regexp.MustCompile(`^Basic (\S+)$`)
 	clipboardPathFormat = "/%s"
-	templateFnMap       = template.FuncMap{
+	clipboardMetaSuffix = ":meta"
+
+	// authAlwaysRequiredPaths are the endpoints that reveal the clipboard contents or its visitors, and therefore
+	// always require authorization, regardless of config.AuthReadRequired, see authRequired
+	authAlwaysRequiredPaths = []string{"/list", "/stats", "/search", "/changes", "/metrics"}
+
+	templateFnMap = template.FuncMap{
 		"expandServerAddr":   config.ExpandServerAddr,
 		"collapseServerAddr": config.CollapseServerAddr,
 		"encodeBase64":       base64.StdEncoding.EncodeToString,
@@ -130,6 +305,7 @@ var (
 		"durationToHuman":    util.DurationToHuman,
 		"stringsJoin":        strings.Join,
 		"htmlEscape":         htmltemplate.HTMLEscapeString,
+		"indent":             indentLines,
 	}
 
 	//go:embed "index.gohtml"
@@ -150,28 +326,56 @@ var (
 
 // Server is the main HTTP server struct. It's the one with all the good stuff.
 type Server struct {
-	config      *config.Config
-	clipboard   *clipboard.Clipboard
-	visitors    map[string]*visitor
-	routes      []route
-	managerChan chan bool
-	mu          sync.Mutex
+	config          *config.Config
+	clipboard       *clipboard.Clipboard
+	namespaces      map[string]*clipboard.Clipboard // Clipboards by key ID, see config.NamespaceByKey; the default namespace is clipboard
+	visitors        map[string]*visitor
+	events          []*StatsEvent
+	uploads         chan struct{}                 // Semaphore limiting concurrent uploads, nil if unlimited
+	streams         int                           // Number of streams in progress, see acquireStream; guarded by mu
+	reservations    map[string]bool               // Reservations that count towards MaxConcurrentStreams; guarded by mu
+	burning         map[string]bool               // Burn-after-reading files that are currently being read
+	preconditions   map[string]bool               // Files with a conditional PUT in progress, see checkPrecondition; guarded by mu
+	exhausted       map[string]int64              // Files deleted after reaching their download limit, mapped to their original expiry
+	authNonces      map[string]int64              // HMAC nonces that were used, mapped to the expiry of their HMAC; guarded by mu
+	authNonceOrder  []string                      // Nonces in authNonces, oldest first, see useAuthNonce; guarded by mu
+	idempotency     map[string]*idempotencyRecord // Results of uploads by visitor and idempotency key; guarded by mu
+	trustedProxies  []*net.IPNet                  // Reverse proxies whose X-Forwarded-For header is trusted, see visitorIP
+	certManager     *autocert.Manager             // Obtains TLS certificates via ACME, nil unless AutoCertDomains is set
+	tlsMinVersion   uint16                        // See config.TLSMinVersion, 0 means Go default
+	tlsCipherSuites []uint16                      // See config.TLSCipherSuites, empty means Go default
+	metrics         *metrics                      // Counters and gauges for the /metrics endpoint, guarded by mu
+	changes         *changes                      // Recent changes for the /changes endpoint, has its own lock
+	sendMail        sendMailFunc                  // Allow injecting mail sender for testing
+	routes          []route
+	lowDiskSpace    bool // Free disk space is below MinFreeDiskBytes, see checkDiskSpace; guarded by mu
+	managerChan     chan bool
+	mu              sync.Mutex
 }
 
 // File contains information about an uploaded file
 type File struct {
-	URL     string
-	File    string
-	TTL     time.Duration
-	Expires time.Time
-	Curl    string
+	URL        string
+	File       string
+	TTL        time.Duration
+	TTLClamped bool // The requested TTL was reduced to the server's max. TTL
+	Expires    time.Time
+	Curl       string
+	Available  bool
+	Streaming  bool
+	ReadyURL   string // URL to read the stream once it starts, only set for reservations, see HeaderStreamReadyURL
 }
 
 // visitor represents an API user, and its associated rate.Limiter used for rate limiting
 type visitor struct {
-	limiterGET *rate.Limiter
-	limiterPUT *rate.Limiter
-	lastSeen   time.Time
+	limiterGET         *rate.Limiter
+	limiterPUT         *rate.Limiter
+	lastSeen           time.Time
+	requests           int
+	authFailures       int       // Consecutive failures, see delayAuthFailure
+	authWindowStart    time.Time // Start of the current window of config.AuthFailureWindow, see countAuthFailure
+	authWindowFailures int       // Failures within the current window, see countAuthFailure
+	authBlockedUntil   time.Time // Requests requiring authentication are rejected until then, see checkAuthBlocked
 }
 
 // Info contains information about the server needed o join a server.
@@ -179,16 +383,128 @@ type Info struct {
 	ServerAddr string            `json:"serverAddr"`
 	DefaultID  string            `json:"defaultID"`
 	Salt       []byte            `json:"salt"`
+	Salts      []*InfoSalt       `json:"salts,omitempty"`
+	Limits     *InfoLimits       `json:"limits,omitempty"`
 	Cert       *x509.Certificate `json:"-"`
 }
 
+// InfoLimits describes the limits and options of the server, so that clients can check a file before uploading it.
+// It is only part of Info if requested with "?f=full". Zero values mean no limit, durations are in seconds.
+type InfoLimits struct {
+	FileSizeLimit             int64            `json:"fileSizeLimit"`
+	SizeLimitByType           map[string]int64 `json:"sizeLimitByType,omitempty"`
+	ClipboardSizeLimit        int64            `json:"clipboardSizeLimit"`
+	ClipboardCountLimit       int              `json:"clipboardCountLimit"`
+	SizePerVisitorLimit       int64            `json:"sizePerVisitorLimit"`
+	FileExpireAfterDefault    int64            `json:"fileExpireAfterDefault"`
+	FileExpireAfterNonTextMax int64            `json:"fileExpireAfterNonTextMax"`
+	FileExpireAfterTextMax    int64            `json:"fileExpireAfterTextMax"`
+	FileModesAllowed          []string         `json:"fileModesAllowed"`
+	KeyRequired               bool             `json:"keyRequired"`
+}
+
+// Features describes the capabilities of the server, so that clients can enable or disable features accordingly.
+// It is returned by "OPTIONS /" without authentication, and therefore only contains capability flags and limits.
+type Features struct {
+	Stream            bool        `json:"stream"`
+	Reserve           bool        `json:"reserve"`
+	Burn              bool        `json:"burn"`
+	Password          bool        `json:"password"`
+	CompressFiles     bool        `json:"compressFiles"`
+	CompressResponses bool        `json:"compressResponses"`
+	AuthReadRequired  bool        `json:"authReadRequired"`
+	AuthWriteRequired bool        `json:"authWriteRequired"`
+	Limits            *InfoLimits `json:"limits"`
+}
+
+// InfoSalt identifies one of the salts in Info. Salts are only advertised if the server accepts more than
+// one key (e.g. during key rotation). The first salt is always the primary salt, i.e. the one in Info.Salt.
+type InfoSalt struct {
+	ID   string `json:"id"`
+	Salt []byte `json:"salt"`
+}
+
+// Stats contains live statistics about the clipboard contents, its visitors and recent copy/paste actions.
+// It is returned by the /stats endpoint and rendered by "pcopy top".
+type Stats struct {
+	Count      int             `json:"count"`
+	Size       int64           `json:"size"`
+	CountLimit int             `json:"countLimit"`
+	SizeLimit  int64           `json:"sizeLimit"`
+	Streams    int             `json:"streams"`
+	Entries    []*StatsEntry   `json:"entries"`
+	Visitors   []*StatsVisitor `json:"visitors"`
+	Events     []*StatsEvent   `json:"events"`
+}
+
+// ExpireResult is the response of the /admin/expire endpoint
+type ExpireResult struct {
+	Expired int `json:"expired"`
+}
+
+// FileMetadata contains the full metadata of a single clipboard file, as returned by the meta endpoint
+type FileMetadata struct {
+	ID            string            `json:"id"`
+	Mode          string            `json:"mode"`
+	Size          int64             `json:"size"`
+	ContentType   string            `json:"contentType,omitempty"`
+	Checksum      string            `json:"checksum,omitempty"`
+	Created       int64             `json:"created"`
+	Expires       int64             `json:"expires"`
+	Stream        bool              `json:"stream"`
+	Reserved      bool              `json:"reserved"`
+	DownloadLimit int               `json:"downloadLimit,omitempty"`
+	Downloads     int               `json:"downloads,omitempty"`
+	Link          string            `json:"link,omitempty"`
+	Public        bool              `json:"public,omitempty"`
+	Normalized    string            `json:"normalized,omitempty"`
+	Meta          map[string]string `json:"meta,omitempty"`
+	Binary        bool              `json:"binary"`
+	Lines         int64             `json:"lines,omitempty"` // Not set for binary content, see HeaderLines
+}
+
+// StatsEntry describes a single clipboard entry in Stats
+type StatsEntry struct {
+	ID      string `json:"id"`
+	Size    int64  `json:"size"`
+	Mode    string `json:"mode"`
+	Expires int64  `json:"expires"`
+	Stream  bool   `json:"stream"`
+}
+
+// ListEntry describes a single clipboard entry, as returned by the /list endpoint
+type ListEntry struct {
+	ID        string `json:"id"`
+	Size      int64  `json:"size"`
+	Mode      string `json:"mode"`
+	TTL       int64  `json:"ttl"`
+	Expires   int64  `json:"expires"`
+	Streaming bool   `json:"streaming"`
+}
+
+// StatsVisitor describes the usage of a single visitor (by IP address) in Stats
+type StatsVisitor struct {
+	Addr     string `json:"addr"`
+	Requests int    `json:"requests"`
+	LastSeen int64  `json:"lastSeen"`
+}
+
+// StatsEvent describes a recent copy/paste action in Stats
+type StatsEvent struct {
+	Time   int64  `json:"time"`
+	Addr   string `json:"addr"`
+	Action string `json:"action"`
+	ID     string `json:"id"`
+}
+
 // httpResponseFileInfo is the response returned when uploading a file
 type httpResponseFileInfo struct {
-	URL     string `json:"url"`
-	File    string `json:"file"`
-	TTL     int    `json:"ttl"`
-	Expires int64  `json:"expires"`
-	Curl    string `json:"curl"`
+	URL        string `json:"url"`
+	File       string `json:"file"`
+	TTL        int    `json:"ttl"`
+	TTLClamped bool   `json:"ttlClamped,omitempty"`
+	Expires    int64  `json:"expires"`
+	Curl       string `json:"curl"`
 }
 
 // handleFunc extends the normal http.HandlerFunc to be able to easily return errors
@@ -205,17 +521,43 @@ func newRoute(method, pattern string, handler handleFunc) route {
 	return route{method, regexp.MustCompile("^" + pattern + "$"), handler}
 }
 
+// reservedRouteIDs returns the file IDs that would clash with the given routes, i.e. the first path segment of all
+// routes that start with a literal segment, e.g. "info" for "/info", or "static" for "/static/.+". Routes that start
+// with a pattern, like the clipboard file routes, are skipped.
+func reservedRouteIDs(routes []route) []string {
+	ids := make([]string, 0)
+	for _, r := range routes {
+		prefix, complete := r.regex.LiteralPrefix()
+		segment := strings.TrimPrefix(prefix, "/")
+		if i := strings.Index(segment, "/"); i != -1 {
+			segment = segment[:i]
+		} else if !complete {
+			continue // Segment continues with a pattern, e.g. "/(random)?"
+		}
+		if segment != "" {
+			ids = append(ids, segment)
+		}
+	}
+	return ids
+}
+
 // routeCtx is a marker struct used to find fields in route matches
 type routeCtx struct{}
 
+// keyCtx is a marker struct used to find the key that authorized the request
+type keyCtx struct{}
+
 // webTemplateConfig is a struct defining all the things required to render the web root
 type webTemplateConfig struct {
-	KeyDerivIter int
-	KeyLenBytes  int
-	DefaultPort  int
-	TCPHost      string
-	TCPPort      string
-	Config       *config.Config
+	KeyDerivIter    int
+	KeyLenBytes     int
+	DefaultPort     int
+	TCPHost         string
+	TCPPort         string
+	DefaultFileMode string
+	ServerAddr      string // Full server URL, see config.ExpandServerAddr
+	Salt            string // Base64-encoded key salt, or empty if the clipboard is not password-protected
+	Config          *config.Config
 }
 
 // New creates a new instance of a Server using the given config. It does a few sanity checks to ensure
@@ -224,7 +566,14 @@ func New(conf *config.Config) (*Server, error) {
 	if conf.ListenHTTPS == "" && conf.ListenHTTP == "" {
 		return nil, errListenAddrMissing
 	}
-	if conf.ListenHTTPS != "" {
+	if len(conf.AutoCertDomains) > 0 {
+		if conf.KeyFile != "" || conf.CertFile != "" {
+			return nil, errAutoCertWithCertFiles
+		}
+		if conf.ListenHTTPS == "" {
+			return nil, errAutoCertListenMissing
+		}
+	} else if conf.ListenHTTPS != "" {
 		if conf.KeyFile == "" {
 			return nil, errKeyFileMissing
 		}
@@ -232,27 +581,105 @@ func New(conf *config.Config) (*Server, error) {
 			return nil, errCertFileMissing
 		}
 	}
+	if conf.DefaultFileMode != "" && !config.IsFileModeAllowed(conf.FileModesAllowed, conf.DefaultFileMode) {
+		return nil, errDefaultFileModeNotAllowed
+	}
+	for mode := range conf.FileExpireAfterByMode {
+		if !config.IsFileModeAllowed(conf.FileModesAllowed, mode) {
+			return nil, errFileExpireAfterByModeNotAllowed
+		}
+	}
+	if conf.ManagerInterval <= 0 {
+		return nil, errManagerIntervalInvalid // time.NewTicker panics otherwise
+	}
+	if conf.EncryptAtRest && conf.Key == nil && len(conf.AtRestKey) == 0 {
+		return nil, errAtRestKeyMissing
+	}
 	clip, err := clipboard.New(conf)
 	if err != nil {
 		return nil, err
 	}
-	return &Server{
-		config:    conf,
-		clipboard: clip,
-		visitors:  make(map[string]*visitor),
-		routes:    nil,
-	}, nil
+	namespaces, err := newNamespaces(conf, append([]*crypto.Key{conf.Key}, conf.Keys...))
+	if err != nil {
+		return nil, err
+	}
+	var uploads chan struct{}
+	if conf.MaxConcurrentUploads > 0 {
+		uploads = make(chan struct{}, conf.MaxConcurrentUploads)
+	}
+	tlsMinVersion, err := config.ParseTLSVersion(conf.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	tlsCipherSuites, err := config.ParseTLSCipherSuites(conf.TLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies := make([]*net.IPNet, 0)
+	for _, proxy := range conf.TrustedProxies {
+		ipNet, err := util.ParseIPNet(proxy)
+		if err != nil {
+			return nil, err
+		}
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+	server := &Server{
+		config:          conf,
+		clipboard:       clip,
+		namespaces:      namespaces,
+		visitors:        make(map[string]*visitor),
+		uploads:         uploads,
+		reservations:    make(map[string]bool),
+		burning:         make(map[string]bool),
+		preconditions:   make(map[string]bool),
+		exhausted:       make(map[string]int64),
+		authNonces:      make(map[string]int64),
+		idempotency:     make(map[string]*idempotencyRecord),
+		trustedProxies:  trustedProxies,
+		certManager:     newCertManager(conf),
+		tlsMinVersion:   tlsMinVersion,
+		tlsCipherSuites: tlsCipherSuites,
+		metrics:         newMetrics(),
+		changes:         newChanges(),
+		sendMail:        smtp.SendMail,
+		routes:          nil,
+	}
+	for _, c := range server.clipboards() {
+		c.Reserve(reservedRouteIDs(server.routeList())...)
+	}
+	return server, nil
 }
 
 // Handle is the delegating handler function for a clipboard's server. It uses the routeList to find a matching route
-// and delegates to it.
+// and delegates to it. If LogFormat is "json", a structured access log line is written for every request.
 func (s *Server) Handle(w http.ResponseWriter, r *http.Request) {
+	if s.config.LogFormat == config.LogFormatJSON {
+		s.handleWithAccessLog(w, r)
+		return
+	}
+	s.handle(w, r)
+}
+
+// SignedURL returns a download URL for the given file ID that can be used without the key until it expires after
+// the given duration, see GenerateSignedURL
+func (s *Server) SignedURL(id string, validFor time.Duration) string {
+	u, _ := GenerateSignedURL(s.config, id, validFor) // Only fails if the HMAC cannot be computed
+	return u
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if s.handleCORS(w, r) {
+		return // Preflight request, see config.AllowedOrigins
+	}
+	w, done := s.compressResponse(w, r)
+	defer done()
 	for _, route := range s.routeList() {
 		matches := route.regex.FindStringSubmatch(r.URL.Path)
 		if len(matches) > 0 && r.Method == route.method {
-			log.Printf("[%s] %s - %s %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
+			s.logRequest(r)
 			ctx := context.WithValue(r.Context(), routeCtx{}, matches[1:])
 			if err := route.handler(w, r.WithContext(ctx)); err != nil {
+				s.recordRejected(err)
 				if err == clipboard.ErrInvalidFileID {
 					s.fail(w, r, http.StatusBadRequest, err)
 				} else if e, ok := err.(*ErrHTTP); ok {
@@ -264,13 +691,30 @@ func (s *Server) Handle(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	if r.Method == http.MethodGet {
+	if methods := s.routeMethods(r.URL.Path); len(methods) > 0 {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		s.fail(w, r, http.StatusMethodNotAllowed, errMethodNotAllowed)
+	} else if r.Method == http.MethodGet {
 		s.fail(w, r, http.StatusNotFound, errNoMatchingRoute)
 	} else {
 		s.fail(w, r, http.StatusBadRequest, errNoMatchingRoute)
 	}
 }
 
+// routeMethods returns the methods of all routes matching the given path, i.e. the methods that are allowed for it.
+// It is used for the "Allow" header of 405 responses, and to answer CORS preflight requests.
+func (s *Server) routeMethods(path string) []string {
+	methods := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, route := range s.routeList() {
+		if !seen[route.method] && route.regex.MatchString(path) {
+			methods = append(methods, route.method)
+			seen[route.method] = true
+		}
+	}
+	return methods
+}
+
 func (s *Server) routeList() []route {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -279,50 +723,265 @@ func (s *Server) routeList() []route {
 	}
 
 	fileRoute := "/" + clipboard.FileRegexPart
+	metaRoute := fileRoute + clipboardMetaSuffix
 	s.routes = []route{
 		newRoute("GET", "/", s.limit(s.handleRoot)),
+		newRoute("OPTIONS", "/", s.limit(s.handleFeatures)),
 		newRoute("GET", "/curl", s.limit(s.handleCurlRoot)),
 		newRoute("GET", "/nc", s.limit(s.handleNcRoot)),
-		newRoute("PUT", "/(random)?", s.limit(s.auth(s.handleClipboardPutRandom))),
-		newRoute("POST", "/(random)?", s.limit(s.auth(s.handleClipboardPutRandom))),
+		newRoute("PUT", "/", s.limit(s.auth(s.idempotent(s.handleClipboardPutRandom)))),
+		newRoute("POST", "/", s.limit(s.auth(s.idempotent(s.handleClipboardPutRandom)))),
+		newRoute("PUT", "/random", s.limit(s.auth(s.idempotent(s.handleClipboardPutRandom)))),
+		newRoute("POST", "/random", s.limit(s.auth(s.idempotent(s.handleClipboardPutRandom)))),
 		newRoute("GET", "/static/.+", s.limit(s.handleStatic)),
-		newRoute("GET", "/favicon.ico", s.limit(s.handleFavicon)),
+		newRoute("GET", `/favicon\.ico`, s.limit(s.handleFavicon)),
 		newRoute("GET", "/info", s.limit(s.handleInfo)),
 		newRoute("GET", "/verify", s.limit(s.auth(s.handleVerify))),
-		newRoute("PUT", fileRoute, s.limit(s.authFile(s.handleClipboardPut))),
-		newRoute("POST", fileRoute, s.limit(s.authFile(s.handleClipboardPut))),
+		newRoute("GET", "/stats", s.limit(s.auth(s.handleStats))),
+		newRoute("GET", "/list", s.limit(s.auth(s.handleList))),
+		newRoute("GET", "/metrics", s.limit(s.auth(s.handleMetrics))),
+		newRoute("GET", "/changes", s.limit(s.auth(s.handleChanges))),
+		newRoute("GET", "/search", s.limit(s.auth(s.handleSearch))),
+		newRoute("GET", `/openapi\.json`, s.limit(s.handleOpenAPI)),
+		newRoute("POST", "/admin/expire", s.limit(s.auth(s.handleAdminExpire))),
+		newRoute("GET", "/admin/stats", s.limit(s.auth(s.handleAdminStats))),
+		newRoute("POST", "/admin/purge", s.limit(s.auth(s.handleAdminPurge))),
+		newRoute("PUT", fileRoute, s.limit(s.authFile(s.idempotent(s.handleClipboardPut)))),
+		newRoute("POST", fileRoute, s.limit(s.authFile(s.idempotent(s.handleClipboardPut)))),
+		newRoute("PATCH", fileRoute, s.limit(s.authFile(s.handleClipboardPatch))),
 		newRoute("GET", fileRoute, s.limit(s.authFile(s.handleClipboardGet))),
 		newRoute("HEAD", fileRoute, s.limit(s.authFile(s.handleClipboardHead))),
+		newRoute("DELETE", fileRoute, s.limit(s.auth(s.handleClipboardDelete))),
+		newRoute("GET", metaRoute, s.limit(s.authFile(s.handleClipboardMeta))),
 	}
 	return s.routes
 }
 
 func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request) error {
-	log.Printf("[%s] %s - %s %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
+	s.logRequest(r)
 
 	var salt []byte
 	if s.config.Key != nil {
 		salt = s.config.Key.Salt
 	}
 
+	var salts []*InfoSalt
+	if keys := s.keys(); len(keys) > 1 {
+		for _, key := range keys {
+			salts = append(salts, &InfoSalt{ID: crypto.KeyID(key), Salt: key.Salt})
+		}
+	}
+
 	response := &Info{
 		ServerAddr: s.config.ServerAddr,
 		DefaultID:  s.config.DefaultID,
 		Salt:       salt,
+		Salts:      salts,
+	}
+	if r.URL.Query().Get(queryParamFormat) == infoFormatFull {
+		response.Limits = s.infoLimits()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	return json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) infoLimits() *InfoLimits {
+	return &InfoLimits{
+		FileSizeLimit:             s.config.FileSizeLimit,
+		SizeLimitByType:           s.config.SizeLimitByType,
+		ClipboardSizeLimit:        s.config.ClipboardSizeLimit,
+		ClipboardCountLimit:       s.config.ClipboardCountLimit,
+		SizePerVisitorLimit:       s.config.SizePerVisitorLimit,
+		FileExpireAfterDefault:    int64(s.config.FileExpireAfterDefault.Seconds()),
+		FileExpireAfterNonTextMax: int64(s.config.FileExpireAfterNonTextMax.Seconds()),
+		FileExpireAfterTextMax:    int64(s.config.FileExpireAfterTextMax.Seconds()),
+		FileModesAllowed:          s.config.FileModesAllowed,
+		KeyRequired:               s.config.Key != nil,
 	}
+}
 
+// handleFeatures answers "OPTIONS /" with the features the server supports (see Features), as well as the
+// allowed methods in the "Allow" header. Like /info, it does not require authentication.
+func (s *Server) handleFeatures(w http.ResponseWriter, r *http.Request) error {
+	keyRequired := s.config.Key != nil
+	response := &Features{
+		Stream:            true,
+		Reserve:           true,
+		Burn:              true,
+		Password:          true,
+		CompressFiles:     s.config.CompressFiles,
+		CompressResponses: s.config.CompressResponses,
+		AuthReadRequired:  keyRequired && s.config.AuthReadRequired,
+		AuthWriteRequired: keyRequired && s.config.AuthWriteRequired,
+		Limits:            s.infoLimits(),
+	}
+
+	w.Header().Set("Allow", strings.Join(s.routeMethods("/"), ", "))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
 	return json.NewEncoder(w).Encode(response)
 }
 
+// handleVerify lets clients check their credentials before uploading anything (e.g. when joining): like all
+// protected endpoints it is wrapped in auth, so it returns 401 if the credentials are invalid. On servers without
+// a key, it always succeeds. Plain connectivity checks do not need credentials; /info serves that purpose.
 func (s *Server) handleVerify(w http.ResponseWriter, r *http.Request) error {
-	log.Printf("[%s] %s - %s %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
+	s.logRequest(r)
 	return nil
 }
 
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(s.openAPISpec())
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) error {
+	files, err := s.clipboardFor(r).List()
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime.After(files[j].ModTime)
+	})
+
+	response := &Stats{
+		CountLimit: s.config.ClipboardCountLimit,
+		SizeLimit:  s.config.ClipboardSizeLimit,
+		Entries:    make([]*StatsEntry, 0),
+		Visitors:   make([]*StatsVisitor, 0),
+		Events:     make([]*StatsEvent, 0),
+	}
+	for _, f := range files {
+		response.Count++
+		response.Size += f.Size
+		if f.Pipe {
+			response.Streams++
+		}
+		if f.Hidden {
+			continue // Counted towards the totals, but not listed
+		}
+		response.Entries = append(response.Entries, &StatsEntry{
+			ID:      f.ID,
+			Size:    f.Size,
+			Mode:    f.Mode,
+			Expires: f.Expires,
+			Stream:  f.Pipe,
+		})
+	}
+
+	s.mu.Lock()
+	for ip, v := range s.visitors {
+		response.Visitors = append(response.Visitors, &StatsVisitor{
+			Addr:     ip,
+			Requests: v.requests,
+			LastSeen: v.lastSeen.Unix(),
+		})
+	}
+	response.Events = append(response.Events, s.events...)
+	s.mu.Unlock()
+	sort.Slice(response.Visitors, func(i, j int) bool {
+		return response.Visitors[i].LastSeen > response.Visitors[j].LastSeen
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	return json.NewEncoder(w).Encode(response)
+}
+
+// handleList returns the clipboard entries as a JSON array, newest first. Streams and reservations are included,
+// but marked as streaming, since they have no real content yet. Hidden files are not listed. The response is
+// paginated using the "offset" and "limit" query parameters; the total number of entries is sent in X-Total.
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) error {
+	offset, limit, err := s.getListPage(r)
+	if err != nil {
+		return err
+	}
+	files, err := s.clipboardFor(r).List()
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime.After(files[j].ModTime)
+	})
+
+	entries := make([]*ListEntry, 0)
+	for _, f := range files {
+		if f.Hidden {
+			continue
+		}
+		ttl := int64(0)
+		if f.Expires > 0 {
+			ttl = int64(time.Until(time.Unix(f.Expires, 0)).Seconds())
+		}
+		entries = append(entries, &ListEntry{
+			ID:        f.ID,
+			Size:      f.Size,
+			Mode:      f.Mode,
+			TTL:       ttl,
+			Expires:   f.Expires,
+			Streaming: f.Pipe || f.Reserved,
+		})
+	}
+	total := len(entries)
+	if offset > total {
+		offset = total
+	}
+	if offset+limit < total {
+		entries = entries[offset : offset+limit]
+	} else {
+		entries = entries[offset:]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(HeaderTotal, strconv.Itoa(total))
+	w.WriteHeader(http.StatusOK)
+
+	return json.NewEncoder(w).Encode(entries)
+}
+
+func (s *Server) getListPage(r *http.Request) (offset int, limit int, err error) {
+	offset, limit = 0, listLimitDefault
+	if r.URL.Query().Get(queryParamOffset) != "" {
+		offset, err = strconv.Atoi(r.URL.Query().Get(queryParamOffset))
+		if err != nil || offset < 0 {
+			return 0, 0, &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (invalid offset)", http.StatusText(http.StatusBadRequest))}
+		}
+	}
+	if r.URL.Query().Get(queryParamLimit) != "" {
+		limit, err = strconv.Atoi(r.URL.Query().Get(queryParamLimit))
+		if err != nil || limit < 1 || limit > listLimitMax {
+			return 0, 0, &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (limit must be between 1 and %d)", http.StatusText(http.StatusBadRequest), listLimitMax)}
+		}
+	}
+	return offset, limit, nil
+}
+
+// recordEvent adds a copy/paste action to the list of recent events shown in the /stats endpoint.
+// Only the last statsEventsMax events are kept.
+func (s *Server) recordEvent(r *http.Request, action string, id string) {
+	ip := s.visitorIP(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, &StatsEvent{
+		Time:   time.Now().Unix(),
+		Addr:   ip,
+		Action: action,
+		ID:     id,
+	})
+	if len(s.events) > statsEventsMax {
+		s.events = s.events[len(s.events)-statsEventsMax:]
+	}
+}
+
 func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Query().Get(queryParamArchive) != "" {
+		return s.auth(s.handleArchiveGet)(w, r)
+	}
 	if strings.HasPrefix(r.Header.Get("User-Agent"), "curl/") {
 		return s.handleCurlRoot(w, r)
 	}
@@ -330,9 +989,37 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) error {
 }
 
 func (s *Server) handleWebRoot(w http.ResponseWriter, r *http.Request) error {
+	if s.config.CustomIndexFile != "" && isBrowser(r) {
+		page, err := s.renderCustomIndex()
+		if err == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, err = w.Write(page)
+			return err
+		}
+		log.Printf("[%s] warning: cannot render custom index file %s, serving built-in page instead: %s",
+			config.CollapseServerAddr(s.config.ServerAddr), s.config.CustomIndexFile, err.Error())
+	}
 	return webTemplate.Execute(w, s.webTemplateConfig())
 }
 
+// renderCustomIndex renders the CustomIndexFile as HTML template. Since the file is read on every request, changes
+// take effect without a restart. The page is rendered to a buffer, so that errors do not result in a partial page.
+func (s *Server) renderCustomIndex() ([]byte, error) {
+	source, err := os.ReadFile(s.config.CustomIndexFile)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := htmltemplate.New("custom").Funcs(htmltemplate.FuncMap(templateFnMap)).Parse(string(source))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, s.webTemplateConfig()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func (s *Server) handleCurlRoot(w http.ResponseWriter, r *http.Request) error {
 	return curlTemplate.Execute(w, s.webTemplateConfig())
 }
@@ -349,13 +1036,20 @@ func (s *Server) webTemplateConfig() *webTemplateConfig {
 	if _, port, err := net.SplitHostPort(s.config.ListenTCP); err == nil {
 		tcpPort = port
 	}
+	salt := ""
+	if s.config.Key != nil {
+		salt = base64.StdEncoding.EncodeToString(s.config.Key.Salt)
+	}
 	return &webTemplateConfig{
-		KeyDerivIter: crypto.KeyDerivIter,
-		KeyLenBytes:  crypto.KeyLenBytes,
-		DefaultPort:  config.DefaultPort,
-		TCPHost:      tcpHost,
-		TCPPort:      tcpPort,
-		Config:       s.config,
+		KeyDerivIter:    crypto.KeyDerivIter,
+		KeyLenBytes:     crypto.KeyLenBytes,
+		DefaultPort:     config.DefaultPort,
+		TCPHost:         tcpHost,
+		TCPPort:         tcpPort,
+		DefaultFileMode: s.defaultFileMode(),
+		ServerAddr:      config.ExpandServerAddr(s.config.ServerAddr),
+		Salt:            salt,
+		Config:          s.config,
 	}
 }
 
@@ -364,11 +1058,36 @@ func (s *Server) handleFavicon(w http.ResponseWriter, r *http.Request) error {
 	return s.handleStatic(w, r)
 }
 
+// handleStatic serves the static assets of the web UI. Files in StaticDir take precedence over the built-in
+// ones, so the web UI can be customized without rebuilding; anything that is not there is served from the built-in assets.
 func (s *Server) handleStatic(w http.ResponseWriter, r *http.Request) error {
+	if s.config.StaticDir != "" {
+		if f, stat, err := s.openStaticFile(r.URL.Path); err == nil {
+			defer f.Close()
+			http.ServeContent(w, r, stat.Name(), stat.ModTime(), f)
+			return nil
+		}
+	}
 	http.FileServer(http.FS(webStaticFs)).ServeHTTP(w, r)
 	return nil
 }
 
+// openStaticFile opens the file in StaticDir for the given /static/ path. The path is cleaned as if it were
+// absolute before it is joined with StaticDir, so ".." segments cannot escape it. Only regular files are served.
+func (s *Server) openStaticFile(urlPath string) (*os.File, os.FileInfo, error) {
+	name := path.Clean("/" + strings.TrimPrefix(urlPath, "/static/"))
+	f, err := os.Open(filepath.Join(s.config.StaticDir, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, os.ErrNotExist
+	}
+	return f, stat, nil
+}
+
 func (s *Server) handleClipboardGet(w http.ResponseWriter, r *http.Request) error {
 	fields := r.Context().Value(routeCtx{}).([]string)
 	id := fields[0]
@@ -380,143 +1099,819 @@ func (s *Server) handleClipboardGet(w http.ResponseWriter, r *http.Request) erro
 	if r.URL.Query().Get(queryParamDownload) == "1" {
 		download = true
 	}
-	stat, err := s.clipboard.Stat(id)
-	if err != nil {
+	token := r.URL.Query().Get(queryParamToken)
+	stat, err := s.clipboardFor(r).Stat(id)
+	if err != nil && token == "" { // With a token, the file may briefly not exist while the stream is attached
+		if s.isExhausted(s.entryKey(r, id)) {
+			return ErrHTTPGone
+		}
 		return ErrHTTPNotFound
 	}
+	if token != "" || stat.Reserved {
+		if stat, err = s.waitForStream(r, id, token); err != nil {
+			return err
+		}
+	}
+	content, err := s.linkTarget(stat) // Aliases serve the content of the linked entry, but have their own TTL
+	if err != nil {
+		return err
+	}
+	if content.Filename != "" && r.URL.Query().Get(queryParamFilename) == "" {
+		filename = content.Filename
+		download = true // Save under the original name, see HeaderFilename
+	}
+	if notModified(w, r, content) {
+		return nil // Unchanged since the client last downloaded it; this does not count as a download
+	}
+	if err := s.verifyFile(r, content); err != nil {
+		return err
+	}
+	if stat.DownloadLimit > 0 {
+		last, err := s.countDownload(r, id)
+		if err != nil {
+			return err
+		}
+		if last {
+			defer s.deleteExhausted(r, id, stat)
+		}
+	}
+	burn := stat.Mode == config.FileModeBurn
+	if burn {
+		if !s.claimBurn(s.entryKey(r, id)) {
+			return ErrHTTPNotFound // Someone else is reading it right now, so it'll be gone in a moment
+		}
+		defer s.releaseBurn(s.entryKey(r, id))
+		if _, err := s.clipboardFor(r).Stat(id); err != nil {
+			return ErrHTTPNotFound // Burned by another reader since we last checked
+		}
+	}
 	if !stat.Pipe {
-		w.Header().Set("Length", fmt.Sprintf("%d", stat.Size))
+		w.Header().Set("Length", fmt.Sprintf("%d", content.Size))
+	} else if stat.ExpectedSize > 0 && stat.ExpectedExact {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", stat.ExpectedSize))
+	} else if stat.ExpectedSize > 0 {
+		w.Header().Set(HeaderExpectedSize, fmt.Sprintf("%d", stat.ExpectedSize))
+	}
+	w.Header().Set(HeaderFile, id)
+	w.Header().Set(HeaderExpires, fmt.Sprintf("%d", stat.Expires))
+	s.writeCacheHeaders(w, stat)
+	writeUserMetaHeaders(w, content)
+	writeChecksumHeader(w, content)
+	if !stat.Hidden {
+		s.recordEvent(r, "paste", id)
 	}
 	defer func() {
 		if stat.Pipe {
-			s.clipboard.DeleteFile(id)
+			s.clipboardFor(r).DeleteFile(id)
+			s.recordChange(id, stat.Hidden)
 		}
 	}()
-	return s.clipboard.ReadFile(id, util.NewContentTypeWriter(w, filename, download))
-}
-
-func (s *Server) handleClipboardHead(w http.ResponseWriter, r *http.Request) error {
-	fields := r.Context().Value(routeCtx{}).([]string)
-	id := fields[0]
-	stat, err := s.clipboard.Stat(id)
-	if err != nil {
-		return ErrHTTPNotFound
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	browser := isBrowser(r)
+	if browser && s.config.ForceDownloadForBrowsers {
+		download = true
 	}
-	if !stat.Pipe {
-		w.Header().Set("Length", fmt.Sprintf("%d", stat.Size))
+	writer := s.contentTypeWriter(w, r, content, filename, download)
+	if content.Compressed {
+		w.Header().Set("Vary", "Accept-Encoding")
 	}
-	ttl := time.Until(time.Unix(stat.Expires, 0))
-	if ttl < -1 {
-		ttl = 0
+	if stat.Pipe {
+		disableCompression(w) // Compressing would buffer the stream
 	}
-	return s.writeFileInfoOutput(w, http.StatusOK, id, stat.Expires, ttl, HeaderFormatNone, stat.Secret)
-}
-
-func (s *Server) handleClipboardPutRandom(w http.ResponseWriter, r *http.Request) error {
-	ctx := context.WithValue(r.Context(), routeCtx{}, []string{randomFileID()})
-	return s.handleClipboardPut(w, r.WithContext(ctx))
-}
-
-func (s *Server) handleClipboardPut(w http.ResponseWriter, r *http.Request) error {
-	// Parse request: file ID, stream
-	fields := r.Context().Value(routeCtx{}).([]string)
-	id := fields[0]
-
-	// Check if file exists
-	if err := s.checkPUT(id, r.RemoteAddr); err != nil {
-		return err
+	if content.Appending && r.URL.Query().Get(queryParamFollow) == "1" {
+		err = s.followFile(w, r, writer, content.ID)
+	} else if !stat.Pipe && !content.Compressed && !burn {
+		err = s.serveContent(w, r, writer, content)
+	} else if content.Compressed && acceptsGzip(r) {
+		w.Header().Set("Accept-Ranges", "none")
+		err = s.writeCompressed(w, r, writer, content.ID)
+	} else {
+		w.Header().Set("Accept-Ranges", "none")
+		if !stat.Pipe {
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", content.Size)) // Size of the decompressed content
+		}
+		err = s.clipboardFor(r).ReadFile(content.ID, writer)
+	}
+	if err == clipboard.ErrStreamAborted {
+		// The headers (and most of the content) were already sent, so the only way to tell the client that the
+		// content is incomplete is to break the connection, instead of properly ending the response
+		log.Printf("[%s] stream %s aborted by sender, aborting response", config.CollapseServerAddr(s.config.ServerAddr), s.logID(id))
+		panic(http.ErrAbortHandler)
+	} else if err != nil {
+		return err // Burn-after-reading files are only deleted if they were fully written to the client
+	}
+	s.recordGet()
+	if burn {
+		if err := s.clipboardFor(r).DeleteFile(id); err != nil {
+			log.Printf("[%s] failed to burn entry %s: %s", config.CollapseServerAddr(s.config.ServerAddr), s.logID(id), err.Error())
+			return nil // Response was already sent
+		}
+		log.Printf("[%s] burned entry after reading: %s", config.CollapseServerAddr(s.config.ServerAddr), s.logID(id))
+		s.recordChange(id, stat.Hidden)
+		s.updateStatsAndExpire()
 	}
+	return nil
+}
 
-	// Peak body, i.e. read up to 512 KB of the body into memory. This is needed two things:
-	//
-	// 1. Text-only TTL: to be able to determine if the body is UTF-8, we need to read it all. I have not figured
-	//    out how to do this in a stream, so we only support long TTLs for short texts.
-	// 2. Immediate headers (HeaderStreamImmediateHeaders): For very short POST payloads, "curl -d.." will
-	//    (obviously) not send the "Expect: 100-continue" header, so the body is immediately consumed and closed
-	//    by Go's HTTP server, yielding a http.ErrBodyReadAfterClose error. To counter this behavior in streaming mode,
-	//    we consume the entire request body if it is short enough. In practice, curl will send "Expect: 100-continue"
-	//    for anything > ~1400 bytes.
-	body, err := util.Peak(r.Body, peakLimitBytes)
+// serveContent serves a regular file via http.ServeContent, so that Range and conditional requests are supported,
+// e.g. to resume an interrupted download. Streams, compressed and burn-after-reading files cannot be served this way,
+// since they either cannot seek, or must be sent in full.
+func (s *Server) serveContent(w http.ResponseWriter, r *http.Request, writer *util.ContentTypeWriter, stat *clipboard.File) error {
+	rc, err := s.clipboardFor(r).OpenFile(stat.ID)
 	if err != nil {
 		return err
 	}
-
-	// Read query params & peak body
-	format := s.getOutputFormat(r)
-	reserve := s.isReserve(r)
-	streamMode, err := s.getStreamMode(r)
-	if err != nil {
+	defer rc.Close()
+	f, ok := rc.(io.ReadSeeker)
+	if !ok {
+		w.Header().Set("Accept-Ranges", "none")
+		_, err := io.Copy(writer, rc)
 		return err
 	}
-	fileMode, err := s.getFileMode(r)
-	if err != nil {
+
+	// Set Content-Type and Content-Disposition ourselves, since http.ServeContent would render active content
+	head := make([]byte, sniffContentTypeBytes)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return err
 	}
-	ttl, err := s.getTTL(r, body)
-	if err != nil {
+	writer.Sniff(head[:n])
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
-	expires := int64(0)
-	if ttl > 0 {
+	w.Header().Set("Accept-Ranges", "bytes") // The ETag header is already set, see notModified
+	http.ServeContent(w, r, "", stat.ModTime, f)
+	return nil
+}
+
+// contentTypeWriter returns a writer that sets the Content-Type (and Content-Disposition) headers for the given
+// file. The content type recorded during upload is used if there is one, otherwise it is detected from the content.
+func (s *Server) contentTypeWriter(w http.ResponseWriter, r *http.Request, stat *clipboard.File, filename string, download bool) *util.ContentTypeWriter {
+	var writer *util.ContentTypeWriter
+	if !isBrowser(r) && hasExplicitAccept(r) {
+		writer = util.NewUnfilteredContentTypeWriter(w, filename, download)
+	} else {
+		writer = util.NewContentTypeWriter(w, filename, download)
+	}
+	writer.SetContentType(stat.Type)
+	return writer
+}
+
+// claimBurn marks the given burn-after-reading file as being read, and returns false if it already is. This
+// ensures that a file is only ever served once, even if it is requested concurrently.
+func (s *Server) claimBurn(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.burning[id] {
+		return false
+	}
+	s.burning[id] = true
+	return true
+}
+
+func (s *Server) releaseBurn(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.burning, id)
+}
+
+// countDownload increments the download counter of a file with a download limit, and returns true if this is
+// the last allowed download. If the limit has already been reached, ErrHTTPGone is returned.
+func (s *Server) countDownload(r *http.Request, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stat, err := s.clipboardFor(r).Stat(id)
+	if err != nil {
+		if _, ok := s.exhausted[s.entryKey(r, id)]; ok {
+			return false, ErrHTTPGone
+		}
+		return false, ErrHTTPNotFound
+	}
+	if stat.Downloads >= stat.DownloadLimit {
+		return false, ErrHTTPGone
+	}
+	stat.Downloads++
+	if err := s.clipboardFor(r).WriteMeta(id, stat); err != nil {
+		return false, err
+	}
+	return stat.Downloads == stat.DownloadLimit, nil
+}
+
+// deleteExhausted deletes a file after its last allowed download, and remembers it until its original expiry,
+// so that further downloads fail with 410 Gone instead of 404 Not Found
+func (s *Server) deleteExhausted(r *http.Request, id string, stat *clipboard.File) {
+	if err := s.clipboardFor(r).DeleteFile(id); err != nil && !os.IsNotExist(err) {
+		log.Printf("[%s] failed to remove entry %s after reaching download limit: %s", config.CollapseServerAddr(s.config.ServerAddr), s.logID(id), err.Error())
+		return
+	}
+	log.Printf("[%s] removed entry after reaching download limit (%d): %s", config.CollapseServerAddr(s.config.ServerAddr), stat.DownloadLimit, s.logID(id))
+	s.mu.Lock()
+	s.exhausted[s.entryKey(r, id)] = stat.Expires
+	s.mu.Unlock()
+	s.recordChange(id, stat.Hidden)
+	s.updateStatsAndExpire()
+}
+
+func (s *Server) isExhausted(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.exhausted[id]
+	return ok
+}
+
+// writeCompressed sends the gzip-compressed file content as is, with "Content-Encoding: gzip". Since the
+// content type cannot be detected from the compressed bytes, it is detected from the decompressed beginning
+// of the file.
+func (s *Server) writeCompressed(w http.ResponseWriter, r *http.Request, writer *util.ContentTypeWriter, id string) error {
+	rc, err := s.clipboardFor(r).OpenFile(id)
+	if err != nil {
+		return err
+	}
+	head := make([]byte, sniffContentTypeBytes)
+	n, err := io.ReadFull(rc, head)
+	rc.Close()
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	writer.Sniff(head[:n])
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/octet-stream") // Don't let the ResponseWriter sniff gzip bytes
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	return s.clipboardFor(r).ReadFileRaw(id, writer)
+}
+
+// verifyFile checks the file against the length and checksum in its metadata (if VerifyOnRead is enabled).
+// Corrupt files result in a 500, or are deleted and result in a 410 if VerifyOnRead is set to "delete".
+func (s *Server) verifyFile(r *http.Request, stat *clipboard.File) error {
+	if s.config.VerifyOnRead != config.VerifyOnReadFail && s.config.VerifyOnRead != config.VerifyOnReadDelete {
+		return nil
+	}
+	if err := s.clipboardFor(r).Verify(stat); err == clipboard.ErrFileCorrupt && s.config.VerifyOnRead == config.VerifyOnReadDelete {
+		log.Printf("[%s] deleting corrupt entry: %s", config.CollapseServerAddr(s.config.ServerAddr), s.logID(stat.ID))
+		if err := s.clipboardFor(r).DeleteFile(stat.ID); err != nil {
+			return err
+		}
+		return ErrHTTPGone
+	} else if err != nil {
+		return fmt.Errorf("cannot verify entry %s: %w", s.logID(stat.ID), err)
+	}
+	return nil
+}
+
+func (s *Server) handleClipboardHead(w http.ResponseWriter, r *http.Request) error {
+	fields := r.Context().Value(routeCtx{}).([]string)
+	id := fields[0]
+	stat, err := s.clipboardFor(r).Stat(id)
+	if err != nil {
+		if s.isExhausted(s.entryKey(r, id)) {
+			return ErrHTTPGone
+		}
+		return ErrHTTPNotFound
+	}
+	content, err := s.linkTarget(stat)
+	if err != nil {
+		return err
+	}
+	if notModified(w, r, content) {
+		return nil
+	}
+	if stat.Pipe {
+		w.Header().Set(HeaderStreaming, HeaderStreamingYes)
+		if stat.ExpectedSize > 0 {
+			w.Header().Set(HeaderExpectedSize, fmt.Sprintf("%d", stat.ExpectedSize))
+		}
+	} else {
+		w.Header().Set("Length", fmt.Sprintf("%d", content.Size))
+	}
+	if stat.DownloadLimit > 0 {
+		w.Header().Set(HeaderDownloadsRemaining, fmt.Sprintf("%d", stat.DownloadLimit-stat.Downloads))
+	}
+	if !content.Pipe {
+		if content.Binary {
+			w.Header().Set(HeaderBinary, HeaderBinaryYes)
+		} else {
+			w.Header().Set(HeaderBinary, HeaderBinaryNo)
+		}
+		if content.Lines > 0 && !content.Appending {
+			w.Header().Set(HeaderLines, fmt.Sprintf("%d", content.Lines))
+		}
+	}
+	s.writeCacheHeaders(w, stat)
+	writeUserMetaHeaders(w, content)
+	writeChecksumHeader(w, content)
+	if content.Type != "" {
+		s.contentTypeWriter(w, r, content, id, false).Sniff(nil)
+	}
+	if stat.Reserved || (stat.Pending && !stat.Pipe) {
+		w.Header().Set(HeaderAvailable, HeaderAvailableNo)
+	} else {
+		w.Header().Set(HeaderAvailable, HeaderAvailableYes)
+	}
+	ttl := time.Until(time.Unix(stat.Expires, 0))
+	if ttl < -1 {
+		ttl = 0
+	}
+	return s.writeFileInfoOutput(w, r, http.StatusOK, id, stat.Expires, ttl, false, HeaderFormatNone, stat.Secret)
+}
+
+// writeCacheHeaders sets the "Expires" and "Cache-Control" headers according to the expiry of the entry, so that
+// browsers and caching proxies keep the content no longer than the entry exists. Entries that are gone (or change)
+// after reading them, i.e. burn-after-reading and download-limited entries, streams and entries that are being
+// appended to, must not be cached at all. Only private caches may keep entries that require authorization.
+func (s *Server) writeCacheHeaders(w http.ResponseWriter, stat *clipboard.File) {
+	if stat.Mode == config.FileModeBurn || stat.DownloadLimit > 0 || stat.Pipe || stat.Appending {
+		w.Header().Set("Cache-Control", "no-store")
+		return
+	} else if stat.Expires == 0 {
+		return // Never expires, but may be overwritten or deleted at any time
+	}
+	expires := time.Unix(stat.Expires, 0)
+	maxAge := int64(time.Until(expires).Seconds())
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	cacheControl := fmt.Sprintf("max-age=%d", maxAge)
+	if (s.config.Key != nil && !stat.Public) || stat.PasswordKey != "" {
+		cacheControl = "private, " + cacheControl
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("Expires", expires.UTC().Format(http.TimeFormat))
+}
+
+func (s *Server) handleClipboardMeta(w http.ResponseWriter, r *http.Request) error {
+	fields := r.Context().Value(routeCtx{}).([]string)
+	id := fields[0]
+	stat, err := s.clipboardFor(r).Stat(id)
+	if err != nil {
+		return ErrHTTPNotFound
+	}
+	response := &FileMetadata{
+		ID:            id,
+		Mode:          stat.Mode,
+		ContentType:   stat.Type,
+		Checksum:      stat.Checksum,
+		Created:       stat.ModTime.Unix(),
+		Expires:       stat.Expires,
+		Stream:        stat.Pipe,
+		Reserved:      stat.Reserved,
+		DownloadLimit: stat.DownloadLimit,
+		Downloads:     stat.Downloads,
+		Link:          stat.Link,
+		Public:        stat.Public,
+		Normalized:    stat.Normalized,
+		Meta:          stat.UserMeta,
+	}
+	content := stat
+	if stat.Target != nil {
+		content = stat.Target
+		response.Meta = stat.Target.UserMeta
+		response.Size = stat.Target.Size
+		response.Checksum = stat.Target.Checksum
+	} else if !stat.Pipe {
+		response.Size = stat.Size
+	}
+	if !content.Pipe {
+		response.Binary = content.Binary
+		if !content.Appending {
+			response.Lines = content.Lines
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleClipboardDelete(w http.ResponseWriter, r *http.Request) error {
+	fields := r.Context().Value(routeCtx{}).([]string)
+	id := fields[0]
+	stat, err := s.clipboardFor(r).Stat(id)
+	if err != nil {
+		return ErrHTTPNotFound
+	}
+	if err := s.checkMutable(r, id); err != nil {
+		return err
+	}
+	defer s.updateStatsAndExpire()
+	if err := s.clipboardFor(r).DeleteFile(id); err != nil && !os.IsNotExist(err) {
+		return err // A writer that was unblocked may have deleted the (pipe) file already
+	}
+	if !stat.Hidden {
+		s.recordEvent(r, "delete", id)
+	}
+	s.recordChange(id, stat.Hidden)
+	w.Header().Set(HeaderFile, id)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *Server) handleClipboardPutRandom(w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Query().Get(queryParamArchive) != "" && s.isCheck(r) {
+		return errCheckNotSupported
+	} else if r.URL.Query().Get(queryParamArchive) != "" {
+		return s.handleArchivePut(w, r)
+	}
+	id, err := s.generateFileID(r)
+	if err != nil {
+		return err
+	}
+	ctx := context.WithValue(r.Context(), routeCtx{}, []string{id})
+	return s.handleClipboardPut(w, r.WithContext(ctx))
+}
+
+func (s *Server) handleClipboardPut(w http.ResponseWriter, r *http.Request) error {
+	// Parse request: file ID, stream
+	fields := r.Context().Value(routeCtx{}).([]string)
+	id := fields[0]
+
+	// Read-only files are immutable, including their metadata, see checkMutable
+	if err := s.checkMutable(r, id); err != nil {
+		return err
+	}
+
+	// Conditional requests (If-Match/If-None-Match) only write if the entry is in the expected state
+	if conditional, err := s.checkPrecondition(r, id); err != nil {
+		return err
+	} else if conditional {
+		defer s.releasePrecondition(s.entryKey(r, id))
+	}
+
+	// A dry run (?check=1) validates a regular upload, see below; the other kinds of PUT requests cannot be checked
+	check := s.isCheck(r)
+	if check && (s.isTouch(r) || r.URL.Query().Get(queryParamLink) != "" || r.URL.Query().Get(queryParamAppend) != "" || r.URL.Query().Get(queryParamUpload) != "") {
+		return errCheckNotSupported
+	}
+
+	// Resetting the TTL does not upload anything, so it is not subject to the upload limits
+	if s.isTouch(r) {
+		return s.handleClipboardTouch(w, r, id)
+	}
+
+	// Aliases do not upload anything either, they point to an existing entry
+	if target := r.URL.Query().Get(queryParamLink); target != "" {
+		return s.handleClipboardLink(w, r, id, target)
+	}
+
+	// Appending to an entry does not replace it, so none of the regular upload logic applies
+	if r.URL.Query().Get(queryParamAppend) != "" {
+		return s.handleClipboardAppend(w, r, id)
+	}
+
+	// Resumable uploads: ?upload=start creates the upload, chunks are sent via PATCH (see handleClipboardPatch),
+	// and ?upload=finish commits it. Committing is handled like a regular upload, with the uploaded chunks as body.
+	finish := false
+	switch r.URL.Query().Get(queryParamUpload) {
+	case "":
+	case uploadStart:
+		return s.handleClipboardUploadStart(w, r, id)
+	case uploadFinish:
+		finish = true
+	default:
+		return ErrHTTPBadRequest
+	}
+
+	// Shed load if too many uploads are in progress
+	if s.uploads != nil && !check {
+		select {
+		case s.uploads <- struct{}{}:
+			defer func() { <-s.uploads }()
+		default:
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(uploadRetryAfter.Seconds())))
+			return ErrHTTPServiceUnavailable
+		}
+	}
+
+	// Check if file exists
+	if err := s.checkPUT(r, id); err != nil {
+		return err
+	}
+
+	// Reject oversized uploads before reading the body (if the client announced the size), and stop reading
+	// the body once it exceeds the limits (if it did not)
+	if err := s.checkContentLength(r); err != nil {
+		return err
+	}
+	if !finish {
+		s.limitBody(w, r, peakLimitBytes)
+		defer s.limitUploadDuration(r)()
+	}
+
+	// Peak body, i.e. read up to 512 KB of the body into memory. This is needed two things:
+	//
+	// 1. Text-only TTL: to be able to determine if the body is UTF-8, we need to read it all. I have not figured
+	//    out how to do this in a stream, so we only support long TTLs for short texts.
+	// 2. Immediate headers (HeaderStreamImmediateHeaders): For very short POST payloads, "curl -d.." will
+	//    (obviously) not send the "Expect: 100-continue" header, so the body is immediately consumed and closed
+	//    by Go's HTTP server, yielding a http.ErrBodyReadAfterClose error. To counter this behavior in streaming mode,
+	//    we consume the entire request body if it is short enough. In practice, curl will send "Expect: 100-continue"
+	//    for anything > ~1400 bytes.
+	content := r.Body
+	if finish {
+		upload, err := s.clipboardFor(r).OpenUpload(id)
+		if err != nil {
+			return ErrHTTPNotFound
+		}
+		defer upload.Close()
+		content = upload
+	}
+	body, err := util.Peak(content, peakLimitBytes)
+	if err == context.DeadlineExceeded {
+		return errUploadTimeout
+	} else if err != nil {
+		return err
+	}
+
+	// Read query params & peak body
+	format := s.getOutputFormat(r)
+	reserve := s.isReserve(r)
+	hidden := s.isHidden(r)
+	public := s.isPublic(r)
+	if err := s.checkPublic(r); err != nil {
+		return err
+	}
+	burn := s.isBurn(r)
+	streamMode, err := s.getStreamMode(r)
+	if err != nil {
+		return err
+	}
+	if finish && (reserve || streamMode != HeaderStreamDisabled) {
+		return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (resumable uploads cannot be streamed)", http.StatusText(http.StatusBadRequest))}
+	}
+	if burn && (reserve || streamMode != HeaderStreamDisabled) {
+		return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (burn-after-reading not supported for streams)", http.StatusText(http.StatusBadRequest))}
+	}
+	expectedSize, expectedExact, err := s.getExpectedSize(r, reserve)
+	if err != nil {
+		return err
+	}
+	filename := s.getFilename(r)
+	userMeta, err := s.getUserMeta(r)
+	if err != nil {
+		return err
+	}
+	checksum, err := s.getChecksum(r)
+	if err != nil {
+		return err
+	}
+	downloadLimit, err := s.getDownloadLimit(r)
+	if err != nil {
+		return err
+	}
+	if downloadLimit > 0 && (reserve || streamMode != HeaderStreamDisabled) {
+		return &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (download limit not supported for streams)", http.StatusText(http.StatusBadRequest))}
+	}
+	fileMode, err := s.getFileMode(r)
+	if err != nil {
+		return err
+	}
+	ttl, clamped, err := s.getTTL(r, fileMode, body)
+	if err != nil {
+		return err
+	}
+	expires := int64(0)
+	if ttl > 0 {
 		expires = time.Now().Add(ttl).Unix()
 	}
 	secret := ""
 	if s.config.Key != nil {
 		secret = randomSecret()
 	}
+	notify, err := s.getNotify(r)
+	if err != nil {
+		return err
+	}
+	passwordKey, err := s.getPasswordKey(r)
+	if err != nil {
+		return err
+	}
+	normalize, err := s.getNormalize(r)
+	if err != nil {
+		return err
+	}
+	contentType := s.getContentType(r, body)
+	limitType, fileSizeLimit := s.getFileSizeLimit(body)
+	quota, err := s.checkKeyLimit(r, id)
+	if err != nil {
+		return err
+	}
+	limitedByQuota := quota > 0 && (fileSizeLimit == 0 || quota < fileSizeLimit)
+	if limitedByQuota {
+		fileSizeLimit = quota
+	}
+	visitorQuota, err := s.checkVisitorLimit(r, id)
+	if err != nil {
+		return err
+	}
+	limitedByVisitorQuota := visitorQuota > 0 && (fileSizeLimit == 0 || visitorQuota < fileSizeLimit)
+	if limitedByVisitorQuota {
+		fileSizeLimit = visitorQuota
+	}
+	keyID := ""
+	if key := requestKey(r); key != nil {
+		keyID = crypto.KeyID(key)
+	}
+	visitor := ""
+	if s.config.SizePerVisitorLimit > 0 {
+		visitor = s.visitorIP(r)
+	}
+
+	// A dry run stops here, before anything is stored. The size of the file can be announced via X-Size (see
+	// getExpectedSize), so that it is checked against the limits and quotas, too. Since no file (and no secret)
+	// is created, the response has no body and no URL.
+	if check {
+		if err := s.checkUploadSize(expectedSize); err != nil {
+			return err
+		} else if visitorQuota > 0 && expectedSize > visitorQuota {
+			return errVisitorQuotaExceeded
+		} else if quota > 0 && expectedSize > quota {
+			return &ErrHTTP{http.StatusRequestEntityTooLarge, fmt.Sprintf("%s (quota for key %s exceeded)",
+				http.StatusText(http.StatusRequestEntityTooLarge), keyID)}
+		} else if !s.clipboardFor(r).Fits(0, expectedSize) {
+			return ErrHTTPPayloadTooLarge
+		}
+		if visitorQuota > 0 {
+			w.Header().Set(HeaderQuotaRemaining, strconv.FormatInt(visitorQuota-expectedSize, 10))
+		}
+		w.Header().Set(HeaderFile, id)
+		w.Header().Set(HeaderTTL, fmt.Sprintf("%d", int(ttl.Seconds())))
+		if clamped {
+			w.Header().Set(HeaderTTLClamped, HeaderTTLClampedYes)
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	// Streams block until they are read, so they (and reservations for them) are limited
+	if reserve || streamMode != HeaderStreamDisabled {
+		if !s.acquireStream(s.entryKey(r, id), reserve) {
+			return errTooManyStreams
+		}
+		if !reserve {
+			defer s.releaseStream()
+		}
+	}
+
+	streamToken := ""
+	if stat, err := s.clipboardFor(r).Stat(id); err == nil && stat.Reserved {
+		if stat.Hidden {
+			hidden = true // Streaming to a hidden reservation keeps the file hidden
+		}
+		if expectedSize == 0 {
+			expectedSize = stat.ExpectedSize // Size announced when reserving, not enforced
+		}
+		if filename == "" {
+			filename = stat.Filename
+		}
+		if userMeta == nil {
+			userMeta = stat.UserMeta
+		}
+		streamToken = stat.StreamToken
+	}
 
 	// Always delete file first to avoid awkward FIFO/regular-file behavior
-	s.clipboard.DeleteFile(id)
+	s.clipboardFor(r).DeleteFile(id)
+	s.mu.Lock()
+	delete(s.exhausted, s.entryKey(r, id))
+	s.mu.Unlock()
 
 	// Ensure that we update the limiters and such!
 	defer s.updateStatsAndExpire()
 
 	// For streaming mode a short-time reservation is necessary
 	var meta *clipboard.File
+	var reader io.ReadCloser = body
 	if reserve {
 		meta = &clipboard.File{
-			Mode:    config.FileModeReadWrite,
-			Expires: time.Now().Add(reserveTTL).Unix(),
-			Secret:  secret,
+			Mode:        config.FileModeReadWrite,
+			Expires:     time.Now().Add(reserveTTL).Unix(),
+			Secret:      secret,
+			Reserved:    true,
+			KeyID:       keyID,
+			Visitor:     visitor,
+			Hidden:      hidden,
+			StreamToken: randomStreamToken(),
 		}
 	} else {
 		meta = &clipboard.File{
-			Mode:    fileMode,
-			Expires: expires,
-			Secret:  secret,
+			Mode:          fileMode,
+			Expires:       expires,
+			Secret:        secret,
+			KeyID:         keyID,
+			Visitor:       visitor,
+			Type:          contentType,
+			Binary:        !clipboard.IsText(contentType),
+			Hidden:        hidden,
+			Public:        public,
+			DownloadLimit: downloadLimit,
+		}
+		reader, meta.Normalized = normalizeLineEndings(verifyChecksum(body, checksum), normalize, contentType)
+		if streamMode == HeaderStreamDisabled {
+			meta.Notify = notify
 		}
+		if burn {
+			meta.Mode = config.FileModeBurn
+		}
+	}
+	meta.PasswordKey = passwordKey
+	meta.Filename = filename
+	meta.UserMeta = userMeta
+	if reserve || streamMode != HeaderStreamDisabled {
+		meta.ExpectedSize = expectedSize
+		meta.ExpectedExact = expectedExact
+	}
+	if streamMode != HeaderStreamDisabled {
+		meta.StreamToken = streamToken // Readers of the reservation wait for this stream, see waitForStream
 	}
 
 	// If this is a stream, make fifo device instead of file if type is set to "fifo".
 	// Also, we want to immediately output instructions.
 	if streamMode != HeaderStreamDisabled {
-		if err := s.clipboard.MakePipe(id); err != nil {
+		if err := s.clipboardFor(r).MakePipe(id); err == clipboard.ErrStorageNotWritable {
+			return errStorageNotWritable
+		} else if err != nil {
 			return err
 		}
 		if streamMode == HeaderStreamImmediateHeaders {
 			// For this to work with curl, we have to have peaked the body for short payloads, since we're technically
 			// writing a response before fully reading the body. See above when we peak the body.
-			if err := s.writeFileInfoOutput(w, http.StatusCreated, id, expires, ttl, format, secret); err != nil {
+			if err := s.writeFileInfoOutput(w, r, http.StatusCreated, id, expires, ttl, clamped, format, secret); err != nil {
 				return err
 			}
 		}
 	}
 
 	// Copy file contents (with file limit & total limit)
-	if err := s.clipboard.WriteFile(id, meta, body); err != nil {
-		if err == util.ErrLimitReached {
+	if finish {
+		err = s.clipboardFor(r).CommitUpload(id, meta, fileSizeLimit)
+	} else {
+		err = s.clipboardFor(r).WriteFileWithLimit(id, meta, reader, fileSizeLimit)
+	}
+	if err != nil {
+		if err == util.ErrLimitReached && limitedByVisitorQuota {
+			return errVisitorQuotaExceeded
+		} else if err == util.ErrLimitReached && limitedByQuota {
+			return &ErrHTTP{http.StatusRequestEntityTooLarge, fmt.Sprintf("%s (quota for key %s exceeded)",
+				http.StatusText(http.StatusRequestEntityTooLarge), keyID)}
+		} else if err == util.ErrLimitReached && fileSizeLimit > 0 {
+			return &ErrHTTP{http.StatusRequestEntityTooLarge, fmt.Sprintf("%s (limit for %s is %s)",
+				http.StatusText(http.StatusRequestEntityTooLarge), limitType, util.BytesToHuman(fileSizeLimit))}
+		} else if err == util.ErrLimitReached {
 			return ErrHTTPPayloadTooLarge
 		} else if err == clipboard.ErrBrokenPipe {
 			// This happens when interrupting on receiver-side while streaming. We treat this as a success.
 			return ErrHTTPPartialContent
+		} else if err == context.DeadlineExceeded {
+			return errUploadTimeout
+		} else if err == clipboard.ErrStreamWaitTimeout {
+			return errStreamWaitTimeout
+		} else if err == util.ErrChecksumMismatch {
+			return errChecksumMismatch
+		} else if err == clipboard.ErrStorageFull {
+			return errInsufficientStorage
+		} else if err == clipboard.ErrStorageNotWritable {
+			return errStorageNotWritable
 		}
 		return err
 	}
 
+	size := int64(0)
+	if !reserve && streamMode == HeaderStreamDisabled {
+		if stat, err := s.clipboardFor(r).Stat(id); err == nil {
+			size = stat.Size
+			w.Header().Set("ETag", fileETag(r, stat)) // For the next conditional request, see checkPrecondition
+		}
+	}
+	s.recordPut(size)
+	if !hidden { // Hidden files must not show up in the recent events either
+		if reserve {
+			s.recordEvent(r, "reserve", id)
+		} else if streamMode != HeaderStreamDisabled {
+			s.recordEvent(r, "stream", id)
+		} else {
+			s.recordEvent(r, "copy", id)
+		}
+	}
+	s.recordChange(id, hidden)
+	if meta.Notify != "" {
+		go s.notifyCreated(id, meta)
+	}
+	if s.config.WebhookURL != "" && !reserve && !hidden {
+		go s.sendWebhook(webhookEventCreated, id, meta, size)
+	}
+
 	// Output URL, TTL, etc.
 	if streamMode == HeaderStreamDisabled || streamMode == HeaderStreamDelayHeaders {
-		if err := s.writeFileInfoOutput(w, http.StatusCreated, id, expires, ttl, format, secret); err != nil {
-			s.clipboard.DeleteFile(id)
+		if visitorQuota > 0 {
+			w.Header().Set(HeaderQuotaRemaining, strconv.FormatInt(visitorQuota-size, 10))
+		}
+		if reserve {
+			url, err := generateStreamReadyURL(s.config, id, secret, meta.StreamToken)
+			if err != nil {
+				return err
+			}
+			w.Header().Set(HeaderStreamReadyURL, url)
+		}
+		if err := s.writeFileInfoOutput(w, r, http.StatusCreated, id, expires, ttl, clamped, format, secret); err != nil {
+			s.clipboardFor(r).DeleteFile(id)
 			return err
 		}
 	}
@@ -524,18 +1919,326 @@ func (s *Server) handleClipboardPut(w http.ResponseWriter, r *http.Request) erro
 	return nil
 }
 
-// checkPUT verifies that the PUT against the given ID is allowed
-func (s *Server) checkPUT(id string, remoteAddr string) error {
-	stat, _ := s.clipboard.Stat(id)
+// checkContentLength rejects uploads whose Content-Length exceeds the per-file or total clipboard size limit
+// before any of the body is read. Since the content type is not known at this point, the largest of the
+// per-file limits (see maxFileSizeLimit) is used. Uploads without Content-Length are checked while streaming.
+func (s *Server) checkContentLength(r *http.Request) error {
+	return s.checkUploadSize(r.ContentLength)
+}
+
+// checkUploadSize rejects an upload of the given size if it exceeds the per-file or total clipboard size limit,
+// see checkContentLength. A size of zero or less means that the size is not known.
+func (s *Server) checkUploadSize(size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	fileSizeLimit := s.maxFileSizeLimit()
+	if fileSizeLimit > 0 && size > fileSizeLimit {
+		return &ErrHTTP{http.StatusRequestEntityTooLarge, fmt.Sprintf("%s (limit is %s)",
+			http.StatusText(http.StatusRequestEntityTooLarge), util.BytesToHuman(fileSizeLimit))}
+	} else if s.config.ClipboardSizeLimit > 0 && size > s.config.ClipboardSizeLimit {
+		return ErrHTTPPayloadTooLarge
+	}
+	return nil
+}
+
+// limitBody wraps the request body in a http.MaxBytesReader, so that the server stops reading an oversized body
+// (and closes the connection) instead of reading it until the end. The clipboard enforces the exact limits while
+// writing (see clipboard.WriteFileWithLimit), and removes the partially written file if one is exceeded. The reader
+// therefore allows one byte more than the largest limit, so that the clipboard's limit trips first and the usual
+// 413 error is returned. It also allows at least the given number of bytes, which are read before the limit is
+// known (see util.Peak).
+func (s *Server) limitBody(w http.ResponseWriter, r *http.Request, min int64) {
+	limit := s.maxFileSizeLimit()
+	if s.config.ClipboardSizeLimit > 0 && (limit == 0 || s.config.ClipboardSizeLimit < limit) {
+		limit = s.config.ClipboardSizeLimit
+	}
+	if limit == 0 || r.Body == nil {
+		return
+	} else if limit < min {
+		limit = min
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit+1)
+}
+
+// limitUploadDuration makes reading the request body fail with context.DeadlineExceeded once the upload takes
+// longer than MaxUploadDuration (if set). The returned function must be called once the upload is done.
+func (s *Server) limitUploadDuration(r *http.Request) context.CancelFunc {
+	if s.config.MaxUploadDuration == 0 || r.Body == nil {
+		return func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.config.MaxUploadDuration)
+	r.Body = util.NewContextReadCloser(ctx, r.Body)
+	return cancel
+}
+
+// maxFileSizeLimit returns the largest of the per-file size limits, i.e. FileSizeLimit and the limits in
+// SizeLimitByType, or 0 if any of them is unlimited. This is used if the content type is not known yet.
+func (s *Server) maxFileSizeLimit() int64 {
+	fileSizeLimit := s.config.FileSizeLimit
+	for _, limit := range s.config.SizeLimitByType {
+		if limit == 0 || fileSizeLimit == 0 {
+			return 0
+		} else if limit > fileSizeLimit {
+			fileSizeLimit = limit
+		}
+	}
+	return fileSizeLimit
+}
+
+// getFileSizeLimit detects the content type of the peaked body and returns it along with the effective per-file size
+// limit: an exact match in SizeLimitByType wins over a wildcard match ("image/*"), and FileSizeLimit is the fallback.
+func (s *Server) getFileSizeLimit(body *util.PeakedReadCloser) (string, int64) {
+	contentType, _, err := mime.ParseMediaType(http.DetectContentType(body.PeakedBytes))
+	if err != nil {
+		return "", s.config.FileSizeLimit
+	}
+	if limit, ok := s.config.SizeLimitByType[contentType]; ok {
+		return contentType, limit
+	}
+	if slash := strings.Index(contentType, "/"); slash > 0 {
+		if limit, ok := s.config.SizeLimitByType[contentType[:slash]+"/*"]; ok {
+			return contentType, limit
+		}
+	}
+	return contentType, s.config.FileSizeLimit
+}
+
+// getContentType returns the content type of the uploaded file: the Content-Type request header if the client
+// explicitly set one, or the type detected from the peaked body otherwise. Note that size limits are always
+// based on the detected type (see getFileSizeLimit), so they cannot be bypassed with a made-up Content-Type.
+func (s *Server) getContentType(r *http.Request, body *util.PeakedReadCloser) string {
+	contentType := r.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && !isGenericContentType(mediaType) {
+		return contentType
+	}
+	return http.DetectContentType(body.PeakedBytes)
+}
+
+// acquireStream takes a slot for a stream or reservation, and returns false if MaxConcurrentStreams is reached.
+// Streaming to a reserved ID takes over the slot of the reservation. A stream's slot must be given back with
+// releaseStream; a reservation's slot is freed in updateStatsAndExpire, once it is streamed to or has expired.
+// Reservations are identified by their entry key, see entryKey.
+func (s *Server) acquireStream(key string, reserve bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reserved := s.reservations[key]
+	if !reserved && s.config.MaxConcurrentStreams > 0 && s.streams+len(s.reservations) >= s.config.MaxConcurrentStreams {
+		return false
+	}
+	if reserve {
+		s.reservations[key] = true
+	} else {
+		delete(s.reservations, key)
+		s.streams++
+	}
+	return true
+}
+
+// waitForStream waits for the stream to a reserved file to start (see HeaderReserve), for as long as requested via
+// ?wait=, but no longer than the reservation lasts. Without ?wait=, or if the stream does not start in time,
+// errStreamNotStarted is returned, since the reserved file is empty, and reading it would be misleading. If a
+// token is given (see HeaderStreamReadyURL), only the stream that replaces the reservation with that token is
+// returned; anything else is reported as not found.
+func (s *Server) waitForStream(r *http.Request, id string, token string) (*clipboard.File, error) {
+	wait, err := s.getStreamWait(r, token)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.After(wait)
+	ticker := time.NewTicker(reserveWaitInterval)
+	defer ticker.Stop()
+	for {
+		// The file briefly does not exist while the reserved file is replaced by the stream, so a missing
+		// file only counts once the time is up
+		stat, err := s.clipboardFor(r).Stat(id)
+		if err == nil && token != "" && subtle.ConstantTimeCompare([]byte(stat.StreamToken), []byte(token)) != 1 {
+			return nil, ErrHTTPNotFound // Replaced by an unrelated upload or reservation
+		} else if err == nil && !stat.Reserved {
+			return stat, nil
+		}
+		gone := err != nil
+		select {
+		case <-timeout:
+			if gone {
+				return nil, ErrHTTPNotFound // Reservation expired, or the stream was read by someone else
+			}
+			return nil, errStreamNotStarted
+		case <-r.Context().Done():
+			return nil, errStreamNotStarted
+		case <-ticker.C:
+		}
+	}
+}
+
+// getStreamWait returns how long waitForStream waits for a stream to start, as requested via ?wait= (or its alias
+// ?timeout=). With a token (see HeaderStreamReadyURL), it waits as long as the reservation lasts by default.
+func (s *Server) getStreamWait(r *http.Request, token string) (time.Duration, error) {
+	value := r.URL.Query().Get(queryParamWait)
+	if value == "" {
+		value = r.URL.Query().Get(queryParamTimeout)
+	}
+	if value == "" && token != "" {
+		return reserveTTL, nil
+	} else if value == "" {
+		return 0, nil
+	}
+	wait, err := util.ParseDuration(value)
+	if err != nil || wait < 0 {
+		return 0, ErrHTTPBadRequest
+	} else if wait > reserveTTL {
+		wait = reserveTTL
+	}
+	return wait, nil
+}
+
+func (s *Server) releaseStream() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams--
+}
+
+// handleClipboardUploadStart starts a resumable upload (see ?upload=start) and returns its token. Since the file
+// is only created once the upload is committed, the same checks as for a regular upload apply then.
+func (s *Server) handleClipboardUploadStart(w http.ResponseWriter, r *http.Request, id string) error {
+	if err := s.checkPUT(r, id); err != nil {
+		return err
+	}
+	token := randomUploadToken()
+	if err := s.clipboardFor(r).StartUpload(id, token); err == clipboard.ErrInvalidFileID {
+		return ErrHTTPBadRequest
+	} else if err != nil {
+		return err
+	}
+	w.Header().Set(HeaderUploadToken, token)
+	w.Header().Set(HeaderUploadOffset, "0")
+	w.WriteHeader(http.StatusCreated)
+	_, err := io.WriteString(w, token+"\n")
+	return err
+}
+
+// handleClipboardPatch appends a chunk to a resumable upload (see ?upload=start). The chunk is only accepted
+// if ?offset= matches the number of bytes received so far; otherwise a 409 is returned, and X-Upload-Offset
+// tells the client where to resume. The per-file size limit is enforced as the chunks accumulate.
+func (s *Server) handleClipboardPatch(w http.ResponseWriter, r *http.Request) error {
+	fields := r.Context().Value(routeCtx{}).([]string)
+	id := fields[0]
+	token := r.URL.Query().Get(queryParamUpload)
+	offset, err := strconv.ParseInt(r.URL.Query().Get(queryParamOffset), 10, 64)
+	if err != nil || offset < 0 || token == "" {
+		return ErrHTTPBadRequest
+	}
+
+	// Shed load if too many uploads are in progress
+	if s.uploads != nil {
+		select {
+		case s.uploads <- struct{}{}:
+			defer func() { <-s.uploads }()
+		default:
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(uploadRetryAfter.Seconds())))
+			return ErrHTTPServiceUnavailable
+		}
+	}
+
+	// Read-only files are immutable, see checkMutable; the check when committing the upload would be too late
+	if err := s.checkMutable(r, id); err != nil {
+		return err
+	}
+
+	// The content type is not known until the upload is committed, so the largest of the per-file limits applies
+	fileSizeLimit := s.maxFileSizeLimit()
+	s.limitBody(w, r, 0)
+	offset, err = s.clipboardFor(r).AppendUpload(id, token, offset, r.Body, fileSizeLimit)
+	if err == clipboard.ErrUploadNotFound {
+		return ErrHTTPNotFound
+	} else if err == clipboard.ErrUploadOffsetMismatch {
+		w.Header().Set(HeaderUploadOffset, strconv.FormatInt(offset, 10))
+		return &ErrHTTP{http.StatusConflict, fmt.Sprintf("%s (expected offset %d)", http.StatusText(http.StatusConflict), offset)}
+	} else if err == util.ErrLimitReached {
+		return &ErrHTTP{http.StatusRequestEntityTooLarge, fmt.Sprintf("%s (limit is %s)",
+			http.StatusText(http.StatusRequestEntityTooLarge), util.BytesToHuman(fileSizeLimit))}
+	} else if err != nil {
+		return err
+	}
+	w.Header().Set(HeaderUploadOffset, strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleClipboardTouch resets the TTL of an existing read-write file (see ?touch=1) by rewriting only its
+// metadata file. The TTL is determined as for regular uploads, with the file's current content standing
+// in for the request body, so the text max. value still applies to short texts.
+func (s *Server) handleClipboardTouch(w http.ResponseWriter, r *http.Request, id string) error {
+	stat, err := s.clipboardFor(r).Stat(id)
+	if err != nil {
+		return ErrHTTPNotFound
+	} else if stat.Mode != config.FileModeReadWrite || stat.Reserved || stat.Pipe {
+		return ErrHTTPMethodNotAllowed // Read-only files are rejected before, see checkMutable
+	}
+	contentID := id
+	if stat.Target != nil {
+		contentID = stat.Target.ID // The max. TTL of an alias depends on the linked content
+	}
+	content, err := s.clipboardFor(r).OpenFile(contentID)
+	if err != nil {
+		return err
+	}
+	peaked, err := util.Peak(content, peakLimitBytes)
+	content.Close()
+	if err != nil {
+		return err
+	}
+	ttl, clamped, err := s.getTTL(r, stat.Mode, peaked)
+	if err != nil {
+		return err
+	}
+	stat.Expires = 0
+	if ttl > 0 {
+		stat.Expires = time.Now().Add(ttl).Unix()
+	}
+	stat.Notified = false // Remind again before the new expiry time
+	if err := s.clipboardFor(r).WriteMeta(id, stat); err != nil {
+		return err
+	}
+	s.recordChange(id, stat.Hidden)
+	return s.writeFileInfoOutput(w, r, http.StatusOK, id, stat.Expires, ttl, clamped, s.getOutputFormat(r), stat.Secret)
+}
+
+// checkMutable returns ErrHTTPMethodNotAllowed if the given file is read-only. Read-only files are immutable,
+// including their metadata: neither the content nor the TTL can be changed, so their life can never be extended.
+// Every route that modifies existing files must check this once, before doing anything else: PUT/POST (including
+// ?touch=1 and resumable uploads) in handleClipboardPut, PATCH, and DELETE.
+func (s *Server) checkMutable(r *http.Request, id string) error {
+	if stat, err := s.clipboardFor(r).Stat(id); err == nil && stat.Mode == config.FileModeReadOnly {
+		return ErrHTTPMethodNotAllowed
+	}
+	return nil
+}
+
+// checkPUT verifies that the PUT against the given ID is allowed. For a new file, it takes a slot of the clipboard's
+// file count limit, unless the request is a dry run (see isCheck).
+func (s *Server) checkPUT(r *http.Request, id string) error {
+	if !s.clipboardFor(r).IsValidID(id) {
+		return ErrHTTPBadRequest
+	}
+	s.mu.Lock()
+	lowDiskSpace := s.lowDiskSpace
+	s.mu.Unlock()
+	if lowDiskSpace {
+		return errInsufficientStorage
+	}
+	stat, _ := s.clipboardFor(r).Stat(id)
 	if stat == nil {
 		// TODO this should be in the WriteFile call
 		// File does not exist, check total file count limit
-		if !s.clipboard.Allow() {
+		if s.isCheck(r) && !s.clipboardFor(r).Fits(1, 0) {
+			return ErrHTTPTooManyRequests
+		} else if !s.isCheck(r) && !s.clipboardFor(r).Allow() {
 			return ErrHTTPTooManyRequests
 		}
 	} else {
 		// File exists, check if it can be overwritten
-		m, err := s.clipboard.Stat(id)
+		m, err := s.clipboardFor(r).Stat(id)
 		if err != nil {
 			return err
 		}
@@ -546,7 +2249,8 @@ func (s *Server) checkPUT(id string, remoteAddr string) error {
 	return nil
 }
 
-func (s *Server) writeFileInfoOutput(w http.ResponseWriter, statusCode int, id string, expires int64, ttl time.Duration, format string, secret string) error {
+func (s *Server) writeFileInfoOutput(w http.ResponseWriter, r *http.Request, statusCode int, id string, expires int64, ttl time.Duration, clamped bool, format string, secret string) error {
+	s.recordIdempotentResult(r, statusCode, id, expires, ttl, clamped, secret)
 	path := fmt.Sprintf(clipboardPathFormat, id)
 	url, err := generateURL(s.config, path, secret)
 	if err != nil {
@@ -560,88 +2264,244 @@ func (s *Server) writeFileInfoOutput(w http.ResponseWriter, statusCode int, id s
 	w.Header().Set(HeaderURL, url)
 	w.Header().Set(HeaderFile, id)
 	w.Header().Set(HeaderTTL, fmt.Sprintf("%d", int(ttl.Seconds())))
+	if clamped {
+		w.Header().Set(HeaderTTLClamped, HeaderTTLClampedYes)
+	}
 	w.Header().Set(HeaderExpires, fmt.Sprintf("%d", expires))
 	w.Header().Set(HeaderCurl, curl)
 	w.WriteHeader(statusCode)
 
 	if format == HeaderFormatJSON {
 		response := &httpResponseFileInfo{
-			URL:     url,
-			File:    id,
-			TTL:     int(ttl.Seconds()),
-			Expires: expires,
-			Curl:    curl,
+			URL:        url,
+			File:       id,
+			TTL:        int(ttl.Seconds()),
+			TTLClamped: clamped,
+			Expires:    expires,
+			Curl:       curl,
 		}
 		if err := json.NewEncoder(w).Encode(response); err != nil {
 			return err
 		}
 	} else if format == HeaderFormatText {
 		info := &File{
-			URL:     url,
-			File:    id,
-			TTL:     ttl,
-			Expires: time.Unix(expires, 0),
-			Curl:    curl,
+			URL:        url,
+			File:       id,
+			TTL:        ttl,
+			TTLClamped: clamped,
+			Expires:    time.Unix(expires, 0),
+			Curl:       curl,
 		}
 		if _, err := w.Write([]byte(FileInfoInstructions(info))); err != nil {
 			return err
 		}
 	}
 
-	// This is important for streaming with curl, so that the download instructions
-	// are immediately available before the request body is fully read.
-	if f, ok := w.(http.Flusher); ok {
-		f.Flush()
+	// This is important for streaming with curl, so that the download instructions
+	// are immediately available before the request body is fully read.
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	return nil
+}
+
+func (s *Server) getFileMode(r *http.Request) (string, error) {
+	mode := s.defaultFileMode()
+	if r.Header.Get(HeaderFileMode) != "" {
+		mode = r.Header.Get(HeaderFileMode)
+	} else if r.URL.Query().Get(queryParamFileMode) != "" {
+		mode = r.URL.Query().Get(queryParamFileMode)
+	}
+	if !config.IsFileModeAllowed(s.config.FileModesAllowed, mode) {
+		return "", ErrHTTPBadRequest
+	}
+	return mode, nil
+}
+
+// defaultFileMode returns the mode used if the client does not set one: DefaultFileMode if it is set,
+// and the first of FileModesAllowed otherwise
+func (s *Server) defaultFileMode() string {
+	if s.config.DefaultFileMode != "" {
+		return s.config.DefaultFileMode
+	} else if len(s.config.FileModesAllowed) == 0 {
+		return "" // Invalid config, see SelfTest
+	}
+	return s.config.FileModesAllowed[0]
+}
+
+func (s *Server) getNotify(r *http.Request) (string, error) {
+	notify := r.Header.Get(HeaderNotify)
+	if notify == "" {
+		notify = r.URL.Query().Get(queryParamNotify)
+	}
+	if notify == "" {
+		return "", nil
+	} else if s.config.SMTPAddr == "" {
+		return "", &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (notifications not enabled)", http.StatusText(http.StatusBadRequest))}
+	}
+	addr, err := mail.ParseAddress(notify)
+	if err != nil {
+		return "", ErrHTTPBadRequest
+	}
+	return addr.Address, nil
+}
+
+// keyLimit returns the quota for the key that authorized the request, or nil if there is none
+func (s *Server) keyLimit(r *http.Request) *config.KeyLimit {
+	key := requestKey(r)
+	if key == nil {
+		return nil
 	}
+	return s.config.KeyLimits[crypto.KeyID(key)]
+}
 
-	return nil
+// checkKeyLimit checks the file count quota of the key that authorized the request, and returns the remaining
+// size quota, or zero if the size is not limited. The file with the given ID is not counted, since it will be
+// overwritten.
+func (s *Server) checkKeyLimit(r *http.Request, id string) (int64, error) {
+	limit := s.keyLimit(r)
+	if limit == nil || (limit.FileCountLimit == 0 && limit.SizeLimit == 0) {
+		return 0, nil
+	}
+	files, err := s.clipboardFor(r).List()
+	if err != nil {
+		return 0, err
+	}
+	keyID := crypto.KeyID(requestKey(r))
+	count, size := 0, int64(0)
+	for _, f := range files {
+		if f.KeyID == keyID && f.ID != id {
+			count++
+			size += f.Size
+		}
+	}
+	if limit.FileCountLimit > 0 && count >= limit.FileCountLimit {
+		return 0, &ErrHTTP{http.StatusTooManyRequests, fmt.Sprintf("%s (quota for key %s is %d files)",
+			http.StatusText(http.StatusTooManyRequests), keyID, limit.FileCountLimit)}
+	} else if limit.SizeLimit > 0 && size >= limit.SizeLimit {
+		return 0, &ErrHTTP{http.StatusRequestEntityTooLarge, fmt.Sprintf("%s (quota for key %s exceeded)",
+			http.StatusText(http.StatusRequestEntityTooLarge), keyID)}
+	} else if limit.SizeLimit > 0 {
+		return limit.SizeLimit - size, nil
+	}
+	return 0, nil
 }
 
-func (s *Server) getFileMode(r *http.Request) (string, error) {
-	mode := s.config.FileModesAllowed[0]
-	if r.Header.Get(HeaderFileMode) != "" {
-		mode = r.Header.Get(HeaderFileMode)
-	} else if r.URL.Query().Get(queryParamFileMode) != "" {
-		mode = r.URL.Query().Get(queryParamFileMode)
+// checkVisitorLimit checks the size quota of the visitor (see SizePerVisitorLimit), and returns the remaining
+// number of bytes, or 0 if there is no quota. Since the usage is computed from the files in the clipboard, it
+// decreases as the visitor's files expire or are deleted. The file with the given ID is not counted, since it
+// is about to be overwritten.
+func (s *Server) checkVisitorLimit(r *http.Request, id string) (int64, error) {
+	if s.config.SizePerVisitorLimit == 0 {
+		return 0, nil
+	}
+	files, err := s.clipboardFor(r).List()
+	if err != nil {
+		return 0, err
 	}
-	for _, allowed := range s.config.FileModesAllowed {
-		if mode == allowed {
-			return mode, nil
+	visitor := s.visitorIP(r)
+	size := int64(0)
+	for _, f := range files {
+		if f.Visitor == visitor && f.ID != id {
+			size += f.Size
 		}
 	}
-	return "", ErrHTTPBadRequest
+	if size >= s.config.SizePerVisitorLimit {
+		return 0, errVisitorQuotaExceeded
+	}
+	return s.config.SizePerVisitorLimit - size, nil
 }
 
-func (s *Server) getTTL(r *http.Request, peakedBody *util.PeakedReadCloser) (time.Duration, error) {
-	var err error
-	var ttl time.Duration
+// getTTL returns the TTL for a new or touched file, and whether it was reduced to the max. allowed value. A TTL of
+// zero means that the file never expires. Clients can request this with "never" (or 0), but unless the operator
+// allows it (see config.AllowNeverExpire), such a request is treated like an infinitely long TTL, i.e. it is
+// reduced to the max. value if there is one. The default and max. values depend on the file mode, see
+// config.FileExpireAfterByMode.
+func (s *Server) getTTL(r *http.Request, fileMode string, peakedBody *util.PeakedReadCloser) (ttl time.Duration, clamped bool, err error) {
+	defaultTTL, nonTextMaxTTL, textMaxTTL := s.config.FileExpireAfterDefault, s.config.FileExpireAfterNonTextMax, s.config.FileExpireAfterTextMax
+	if modeTTL, ok := s.config.FileExpireAfterByMode[fileMode]; ok {
+		defaultTTL, nonTextMaxTTL, textMaxTTL = modeTTL, modeTTL, modeTTL
+	}
 
 	// Get the TTL
+	never := false
 	if r.URL.Query().Get(queryParamTTL) != "" {
-		ttl, err = util.ParseDuration(r.URL.Query().Get(queryParamTTL))
+		ttl, never, err = parseTTL(r.URL.Query().Get(queryParamTTL))
+	} else if r.URL.Query().Get(queryParamExpires) != "" {
+		ttl, err = parseExpires(r.URL.Query().Get(queryParamExpires))
 	} else if r.Header.Get(HeaderTTL) != "" {
-		ttl, err = util.ParseDuration(r.Header.Get(HeaderTTL))
-	} else if s.config.FileExpireAfterDefault > 0 {
-		ttl = s.config.FileExpireAfterDefault
+		ttl, never, err = parseTTL(r.Header.Get(HeaderTTL))
+	} else if r.Header.Get(HeaderExpires) != "" {
+		ttl, err = parseExpires(r.Header.Get(HeaderExpires))
+	} else if defaultTTL > 0 {
+		ttl = defaultTTL
+	} else {
+		never = true // No default expiry, only allowed with AllowNeverExpire or without max. values (see config)
 	}
-	if err != nil {
-		return 0, ErrHTTPBadRequest
+	if err == errExpiresInPast {
+		return 0, false, &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (expiry time is in the past)", http.StatusText(http.StatusBadRequest))}
+	} else if err != nil {
+		return 0, false, ErrHTTPBadRequest
+	}
+
+	// Keys with a max TTL have their own max value, replacing the global max values (see config.KeyLimits). Files
+	// that never expire are not allowed for them, not even with AllowNeverExpire.
+	if limit := s.keyLimit(r); limit != nil && limit.MaxTTL > 0 {
+		if never || ttl > limit.MaxTTL {
+			return limit.MaxTTL, true, nil
+		}
+		return ttl, false, nil
+	}
+	if never && s.config.AllowNeverExpire {
+		return 0, false, nil
 	}
 
 	// If the given TTL is larger than the max allowed value, set it to the max value.
 	// Special handling for text: if the body is a short text (as per our peaking), the text max value applies.
 	// It may be a little inefficient to always check for UTF-8, but I think it's fine.
-	if ttl > s.config.FileExpireAfterNonTextMax || ttl > s.config.FileExpireAfterTextMax {
-		maxTTL := s.config.FileExpireAfterNonTextMax
+	if never || ttl > nonTextMaxTTL || ttl > textMaxTTL {
+		maxTTL := nonTextMaxTTL
 		isShortText := !peakedBody.LimitReached && utf8.Valid(peakedBody.PeakedBytes)
 		if isShortText {
-			maxTTL = s.config.FileExpireAfterTextMax
+			maxTTL = textMaxTTL
 		}
-		if maxTTL > 0 && ttl > maxTTL {
-			ttl = maxTTL
+		if maxTTL > 0 && (never || ttl > maxTTL) {
+			return maxTTL, true, nil
 		}
 	}
 
+	return ttl, false, nil
+}
+
+// parseTTL parses a relative TTL, e.g. "30m" or "2d". "never" and zero request a file that never expires, in which
+// case never is true.
+func parseTTL(s string) (ttl time.Duration, never bool, err error) {
+	if s == ttlNever {
+		return 0, true, nil
+	}
+	ttl, err = util.ParseDuration(s)
+	if err != nil {
+		return 0, false, err
+	} else if ttl < 0 {
+		return 0, false, errTTLNegative
+	}
+	return ttl, ttl == 0, nil
+}
+
+// parseExpires parses an absolute expiry time, given as unix timestamp or in RFC3339 format, and returns the
+// time-to-live until then. Like relative TTLs, the result is then clamped to the max. values.
+func parseExpires(s string) (time.Duration, error) {
+	var expires time.Time
+	if timestamp, err := strconv.ParseInt(s, 10, 64); err == nil {
+		expires = time.Unix(timestamp, 0)
+	} else if expires, err = time.Parse(time.RFC3339, s); err != nil {
+		return 0, err
+	}
+	ttl := time.Until(expires)
+	if ttl <= 0 {
+		return 0, errExpiresInPast
+	}
 	return ttl, nil
 }
 
@@ -662,6 +2522,109 @@ func (s *Server) isReserve(r *http.Request) bool {
 	return r.Header.Get(HeaderReserve) == HeaderReserveEnabled || r.URL.Query().Get(queryParamStreamReserve) == HeaderReserveEnabled
 }
 
+func (s *Server) isBurn(r *http.Request) bool {
+	return r.Header.Get(HeaderBurn) == HeaderBurnEnabled || r.URL.Query().Get(queryParamBurn) == HeaderBurnEnabled
+}
+
+// getPasswordKey derives a key from the per-file password defined via X-Password or ?p=, and returns it
+// encoded (see crypto.EncodeKey), or an empty string if the file is not password-protected
+func (s *Server) getPasswordKey(r *http.Request) (string, error) {
+	password := r.Header.Get(HeaderPassword)
+	if r.URL.Query().Get(queryParamPassword) != "" {
+		password = r.URL.Query().Get(queryParamPassword)
+	}
+	if password == "" {
+		return "", nil
+	}
+	key, err := crypto.GenerateKey([]byte(password))
+	if err != nil {
+		return "", err
+	}
+	return crypto.EncodeKey(key), nil
+}
+
+// getDownloadLimit returns the max. number of downloads defined via X-Downloads or ?dl=, or 0 if there is no limit
+func (s *Server) getDownloadLimit(r *http.Request) (int, error) {
+	value := r.Header.Get(HeaderDownloads)
+	if r.URL.Query().Get(queryParamDownloads) != "" {
+		value = r.URL.Query().Get(queryParamDownloads)
+	}
+	if value == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 {
+		return 0, &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (invalid download limit)", http.StatusText(http.StatusBadRequest))}
+	}
+	return limit, nil
+}
+
+// getExpectedSize returns the size of a stream or reservation as announced by the uploader, and whether it is
+// enforced: the Content-Length of a stream is, since the body cannot be shorter or longer, an X-Size header is not.
+func (s *Server) getExpectedSize(r *http.Request, reserve bool) (int64, bool, error) {
+	if value := r.Header.Get(HeaderSize); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			return 0, false, &ErrHTTP{http.StatusBadRequest, fmt.Sprintf("%s (invalid size)", http.StatusText(http.StatusBadRequest))}
+		}
+		return size, false, nil
+	} else if !reserve && r.ContentLength > 0 {
+		return r.ContentLength, true, nil
+	}
+	return 0, false, nil
+}
+
+// getFilename returns the original file name passed via the X-Filename header, if any. Directories, quotes and
+// control characters are removed, and overly long names are cut off, so that it can safely be sent back in the
+// Content-Disposition header (see handleClipboardGet).
+func (s *Server) getFilename(r *http.Request) string {
+	filename := r.Header.Get(HeaderFilename)
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+	filename = strings.Map(func(c rune) rune {
+		if unicode.IsControl(c) || c == '"' {
+			return -1
+		}
+		return c
+	}, strings.ToValidUTF8(filename, ""))
+	if len(filename) > filenameMaxLength {
+		filename = strings.ToValidUTF8(filename[:filenameMaxLength], "") // Drop a partial rune at the end
+	}
+	filename = strings.TrimSpace(filename)
+	if filename == "." || filename == ".." {
+		return ""
+	}
+	return filename
+}
+
+func (s *Server) isTouch(r *http.Request) bool {
+	return r.URL.Query().Get(queryParamTouch) == "1"
+}
+
+// isCheck returns true if the PUT request is a dry run (?check=1), i.e. it is only validated, but nothing is stored
+func (s *Server) isCheck(r *http.Request) bool {
+	return r.URL.Query().Get(queryParamCheck) == "1"
+}
+
+func (s *Server) isHidden(r *http.Request) bool {
+	return r.Header.Get(HeaderHidden) == HeaderHiddenEnabled || r.URL.Query().Get(queryParamHidden) == HeaderHiddenEnabled
+}
+
+func (s *Server) isPublic(r *http.Request) bool {
+	return r.Header.Get(HeaderPublic) == HeaderPublicEnabled || r.URL.Query().Get(queryParamPublic) == HeaderPublicEnabled
+}
+
+// checkPublic verifies that public files (see HeaderPublic) are only created by requests that were authorized with
+// the server password (or key). The file secret is not enough, since it would let anyone who received a link to a
+// file make it public.
+func (s *Server) checkPublic(r *http.Request) error {
+	if s.isPublic(r) && s.config.Key != nil && requestKey(r) == nil {
+		return ErrHTTPUnauthorized
+	}
+	return nil
+}
+
 func (s *Server) getOutputFormat(r *http.Request) string {
 	if r.Header.Get(HeaderFormat) == HeaderFormatJSON || r.URL.Query().Get(queryParamFormat) == HeaderFormatJSON {
 		return HeaderFormatJSON
@@ -673,94 +2636,285 @@ func (s *Server) getOutputFormat(r *http.Request) string {
 
 func (s *Server) auth(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		if err := s.authorize(r); err != nil {
+		if err := s.checkAuthBlocked(w, r); err != nil {
 			return err
 		}
-		return next(w, r)
+		key, err := s.authorizeKey(r)
+		s.recordAuthResult(r, err)
+		if err == ErrHTTPUnauthorized && s.wantsAuthPrompt(r) {
+			s.setAuthenticateHeader(w)
+			return err
+		} else if err != nil {
+			return err
+		}
+		return next(w, withKey(r, key))
 	}
 }
 
 func (s *Server) authFile(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		if err := s.authorizeFileWithFallback(r); err != nil {
+		if err := s.checkAuthBlocked(w, r); err != nil {
 			return err
 		}
-		return next(w, r)
+		key, namespace, err := s.authorizeFileWithFallback(r)
+		s.recordAuthResult(r, err)
+		if err == ErrHTTPPasswordRequired || (err == ErrHTTPUnauthorized && s.wantsAuthPrompt(r)) {
+			s.setAuthenticateHeader(w)
+			return err
+		} else if err != nil {
+			return err
+		}
+		return next(w, withNamespace(withKey(r, key), namespace))
+	}
+}
+
+// wantsAuthPrompt returns true if a failed authentication should ask for credentials via "WWW-Authenticate", i.e.
+// for browsers (to show a login dialog), or if requested via "?auth=basic". curl and the pcopy client do not need it,
+// and neither do the web UI's own requests (marked with "X-Requested-With"), since it has its own password prompt.
+func (s *Server) wantsAuthPrompt(r *http.Request) bool {
+	if r.URL.Query().Get(queryParamAuthPrompt) == "basic" {
+		return true
+	}
+	return isBrowser(r) && r.Header.Get("X-Requested-With") == ""
+}
+
+func (s *Server) setAuthenticateHeader(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, s.config.AuthRealm))
+}
+
+// withKey returns a copy of the request with the given key attached to its context, see requestKey
+func withKey(r *http.Request, key *crypto.Key) *http.Request {
+	if key == nil {
+		return r
 	}
+	return r.WithContext(context.WithValue(r.Context(), keyCtx{}, key))
 }
 
-func (s *Server) authorizeFileWithFallback(r *http.Request) error {
+// requestKey returns the key that authorized the request, or nil if the request was not authorized using a key
+func requestKey(r *http.Request) *crypto.Key {
+	key, _ := r.Context().Value(keyCtx{}).(*crypto.Key)
+	return key
+}
+
+// authorizeFileWithFallback authorizes the request using the file secret (if any), and falls back to regular
+// authorization otherwise. Public files can be read without authorization. The returned key is nil if the file
+// secret was used, if the file is public, or if the server has no key. The returned namespace is the one the file
+// is looked up in, see authorizeNamespacedFile; it is always the default namespace unless config.NamespaceByKey is set.
+func (s *Server) authorizeFileWithFallback(r *http.Request) (*crypto.Key, string, error) {
 	fields := r.Context().Value(routeCtx{}).([]string)
 	id := fields[0]
+	if len(s.namespaces) > 0 {
+		return s.authorizeNamespacedFile(r, id)
+	}
 	stat, err := s.clipboard.Stat(id)
 	if err != nil {
-		return s.authorize(r)
+		key, err := s.authorizeKey(r)
+		return key, "", err
+	}
+	if stat.PasswordKey != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		return nil, "", s.authorizeFilePassword(r, stat)
+	} else if stat.Public && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		return nil, "", nil // Reading public files requires no authorization, but writing to them does
 	}
 	if stat.Secret == "" {
-		return s.authorize(r)
+		key, err := s.authorizeKey(r)
+		return key, "", err
 	}
 	secret, ok := r.URL.Query()[queryParamAuth]
-	if !ok || subtle.ConstantTimeCompare([]byte(stat.Secret), []byte(secret[0])) != 1 {
-		return s.authorize(r)
+	if !ok || !s.authParamAllowed(r) || subtle.ConstantTimeCompare([]byte(stat.Secret), []byte(secret[0])) != 1 {
+		key, err := s.authorizeKey(r)
+		return key, "", err
 	}
+	return nil, "", nil
+}
+
+// authorizeFilePassword authorizes reading a password-protected file against its per-file password. Neither
+// the server key nor the file secret grant access to such files. Failed attempts are delayed, see delayAuthFailure.
+func (s *Server) authorizeFilePassword(r *http.Request, stat *clipboard.File) error {
+	key, err := crypto.DecodeKey(stat.PasswordKey)
+	if err != nil {
+		return err
+	}
+	if _, err := s.authenticate(r, []*crypto.Key{key}); err != nil {
+		s.countAuthFailure(r)
+		s.delayAuthFailure(r)
+		return ErrHTTPPasswordRequired
+	}
+	s.resetAuthFailures(r)
 	return nil
 }
 
 func (s *Server) authorize(r *http.Request) error {
-	if s.config.Key == nil {
-		return nil
+	_, err := s.authorizeKey(r)
+	return err
+}
+
+// authorizeKey authorizes the request against all of the server's keys, and returns the key that matched.
+// If the server has no key, the request is always authorized and the returned key is nil. Failed attempts
+// are delayed, see delayAuthFailure.
+func (s *Server) authorizeKey(r *http.Request) (*crypto.Key, error) {
+	if s.config.Key == nil || (!s.authRequired(r) && !hasCredentials(r)) {
+		return nil, nil
+	}
+	key, err := s.authenticate(r, s.keys())
+	if err == ErrHTTPUnauthorized {
+		s.countAuthFailure(r)
+		s.delayAuthFailure(r)
+	} else if err == nil {
+		s.resetAuthFailures(r)
+	}
+	return key, err
+}
+
+// authRequired returns true if the request must be authorized, depending on whether it reads or writes, see
+// config.AuthReadRequired and config.AuthWriteRequired. The admin endpoints and the endpoints that list the
+// clipboard contents (see authAlwaysRequiredPaths) always require authorization, and so do deleting and modifying
+// existing entries: without a key, files can only be created, not replaced.
+func (s *Server) authRequired(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		return true
+	}
+	for _, path := range authAlwaysRequiredPaths {
+		if r.URL.Path == path {
+			return true
+		}
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return s.config.AuthReadRequired
+	} else if r.Method == http.MethodDelete {
+		return true
+	} else if fields, ok := r.Context().Value(routeCtx{}).([]string); ok && len(fields) > 0 {
+		if _, err := s.clipboardFor(r).Stat(fields[0]); err == nil {
+			return true
+		}
+	}
+	return s.config.AuthWriteRequired
+}
+
+// hasCredentials returns true if the request carries credentials, i.e. an "Authorization:" header or the "?a=..."
+// query param. Credentials are always checked, even if authorization is not required, see authRequired.
+func hasCredentials(r *http.Request) bool {
+	_, ok := r.URL.Query()[queryParamAuth]
+	return ok || r.Header.Get("Authorization") != ""
+}
+
+// delayAuthFailure blocks the current request for the configured AuthFailureDelay, doubling the delay for every
+// consecutive failure from the same IP address (up to authFailureDelayMax), plus a random jitter of up to 25%.
+// Only the current request's goroutine sleeps; the server lock is not held while waiting.
+func (s *Server) delayAuthFailure(r *http.Request) {
+	if s.config.AuthFailureDelay <= 0 {
+		return
+	}
+	failures := 1
+	s.mu.Lock()
+	if v, ok := s.visitors[s.visitorIP(r)]; ok {
+		v.authFailures++
+		failures = v.authFailures
+	}
+	s.mu.Unlock()
+	delay := s.config.AuthFailureDelay
+	for i := 1; i < failures && delay < authFailureDelayMax; i++ {
+		delay *= 2
+	}
+	if delay > authFailureDelayMax && s.config.AuthFailureDelay < authFailureDelayMax {
+		delay = authFailureDelayMax
+	}
+	delay += time.Duration(rand.Int63n(int64(delay)/4 + 1))
+	select {
+	case <-time.After(delay):
+	case <-r.Context().Done():
+	}
+}
+
+// resetAuthFailures resets the failure counters of the visitor after a successful authentication, see
+// delayAuthFailure and countAuthFailure
+func (s *Server) resetAuthFailures(r *http.Request) {
+	if s.config.AuthFailureDelay <= 0 && s.config.AuthFailureThreshold == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.visitors[s.visitorIP(r)]; ok {
+		v.authFailures = 0
+		v.authWindowFailures = 0
 	}
+}
+
+// authenticate checks the request's credentials (HMAC, basic auth, or plain password) against the given keys
+func (s *Server) authenticate(r *http.Request, keys []*crypto.Key) (*crypto.Key, error) {
 
 	auth := r.Header.Get("Authorization")
 	if authParams, ok := r.URL.Query()[queryParamAuth]; ok && len(authParams) > 0 {
+		if !s.authParamAllowed(r) {
+			log.Printf("[%s] %s - %s %s - auth param not allowed for method", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, s.logURI(r))
+			return nil, ErrHTTPUnauthorized
+		}
 		auth = authParams[0]
 	}
 
 	if m := authHmacRegex.FindStringSubmatch(auth); m != nil {
-		return s.authorizeHmac(r, m)
+		return s.authorizeHmac(r, m, keys)
 	} else if m := authBasicRegex.FindStringSubmatch(auth); m != nil {
-		return s.authorizeBasic(r, m)
+		return s.authorizeBasic(r, m, keys)
 	} else if auth != "" {
-		return s.authorizePlain(r, auth)
+		return s.authorizePlain(r, auth, keys)
 	} else {
-		log.Printf("[%s] %s - %s %s - invalid or missing auth", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
-		return ErrHTTPUnauthorized
+		log.Printf("[%s] %s - %s %s - invalid or missing auth", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, s.logURI(r))
+		return nil, ErrHTTPUnauthorized
+	}
+}
+
+// authParamAllowed returns true if the request method may be authorized via the "a" query param. Links containing
+// this param are shared, so by default only read-only methods are allowed (see config.AuthParamMethods).
+func (s *Server) authParamAllowed(r *http.Request) bool {
+	for _, method := range s.config.AuthParamMethods {
+		if strings.EqualFold(method, r.Method) {
+			return true
+		}
 	}
+	return false
 }
 
-func (s *Server) authorizeHmac(r *http.Request, matches []string) error {
+func (s *Server) authorizeHmac(r *http.Request, matches []string, keys []*crypto.Key) (*crypto.Key, error) {
 	timestamp, err := strconv.Atoi(matches[1])
 	if err != nil {
-		log.Printf("[%s] %s - %s %s - hmac timestamp conversion: %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI, err.Error())
-		return ErrHTTPUnauthorized
+		log.Printf("[%s] %s - %s %s - hmac timestamp conversion: %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, s.logURI(r), err.Error())
+		return nil, ErrHTTPUnauthorized
 	}
 
 	ttlSecs, err := strconv.Atoi(matches[2])
 	if err != nil {
-		log.Printf("[%s] %s - %s %s - hmac ttl conversion: %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI, err.Error())
-		return ErrHTTPUnauthorized
+		log.Printf("[%s] %s - %s %s - hmac ttl conversion: %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, s.logURI(r), err.Error())
+		return nil, ErrHTTPUnauthorized
 	}
 
-	hash, err := base64.StdEncoding.DecodeString(matches[3])
+	nonce := matches[3]
+	hash, err := base64.StdEncoding.DecodeString(matches[4])
 	if err != nil {
-		log.Printf("[%s] %s - %s %s - hmac base64 conversion: %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI, err.Error())
-		return ErrHTTPUnauthorized
+		log.Printf("[%s] %s - %s %s - hmac base64 conversion: %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, s.logURI(r), err.Error())
+		return nil, ErrHTTPUnauthorized
 	}
 
 	// Recalculate HMAC
 	// TODO this should include the query string
-	data := []byte(fmt.Sprintf("%d:%d:%s:%s", timestamp, ttlSecs, r.Method, r.URL.Path))
-	hm := hmac.New(sha256.New, s.config.Key.Bytes)
-	if _, err := hm.Write(data); err != nil {
-		log.Printf("[%s] %s - %s %s - hmac calculation: %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI, err.Error())
-		return ErrHTTPUnauthorized
-	}
-	rehash := hm.Sum(nil)
+	data := crypto.AuthHMACData(int64(timestamp), ttlSecs, nonce, r.Method, r.URL.Path)
+	var matched *crypto.Key
+	for _, key := range keys {
+		hm := hmac.New(sha256.New, key.Bytes)
+		if _, err := hm.Write(data); err != nil {
+			log.Printf("[%s] %s - %s %s - hmac calculation: %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, s.logURI(r), err.Error())
+			return nil, ErrHTTPUnauthorized
+		}
+		rehash := hm.Sum(nil)
 
-	// Compare HMAC in constant time (to prevent timing attacks)
-	if subtle.ConstantTimeCompare(hash, rehash) != 1 {
-		log.Printf("[%s] %s - %s %s - hmac invalid", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
-		return ErrHTTPUnauthorized
+		// Compare HMAC in constant time (to prevent timing attacks)
+		if subtle.ConstantTimeCompare(hash, rehash) == 1 {
+			matched = key
+		}
+	}
+	if matched == nil {
+		log.Printf("[%s] %s - %s %s - hmac invalid", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, s.logURI(r))
+		return nil, ErrHTTPUnauthorized
 	}
 
 	// Compare timestamp (to prevent replay attacks)
@@ -771,49 +2925,99 @@ func (s *Server) authorizeHmac(r *http.Request, matches []string) error {
 	if maxAge > 0 {
 		age := time.Since(time.Unix(int64(timestamp), 0))
 		if age > maxAge {
-			log.Printf("[%s] %s - %s %s - hmac request age mismatch", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
-			return ErrHTTPUnauthorized
+			log.Printf("[%s] %s - %s %s - hmac request age mismatch", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, s.logURI(r))
+			return nil, ErrHTTPUnauthorized
 		}
 	}
 
-	return nil
+	// Reject reused nonces (to prevent replay attacks within the max. age)
+	if s.config.RequireAuthNonce {
+		if nonce == "" {
+			log.Printf("[%s] %s - %s %s - hmac nonce missing", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, s.logURI(r))
+			return nil, ErrHTTPUnauthorized
+		} else if !s.useAuthNonce(nonce, time.Unix(int64(timestamp), 0).Add(maxAge)) {
+			log.Printf("[%s] %s - %s %s - hmac nonce reused", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, s.logURI(r))
+			return nil, ErrHTTPUnauthorized
+		}
+	}
+
+	return matched, nil
+}
+
+// useAuthNonce remembers the given nonce until the HMAC it belongs to expires, and returns false if it was
+// already used. If too many nonces are remembered, the oldest ones are forgotten to make room, so that a fresh
+// nonce is never rejected.
+func (s *Server) useAuthNonce(nonce string, expires time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.authNonces[nonce]; ok {
+		return false
+	}
+	for len(s.authNonces) >= authNoncesMax && len(s.authNonceOrder) > 0 {
+		delete(s.authNonces, s.authNonceOrder[0]) // May have been pruned already, see updateStatsAndExpire
+		s.authNonceOrder = s.authNonceOrder[1:]
+	}
+	s.authNonces[nonce] = expires.Unix()
+	s.authNonceOrder = append(s.authNonceOrder, nonce)
+	return true
 }
 
-func (s *Server) authorizeBasic(r *http.Request, matches []string) error {
+func (s *Server) authorizeBasic(r *http.Request, matches []string, keys []*crypto.Key) (*crypto.Key, error) {
 	userPassBytes, err := base64.StdEncoding.DecodeString(matches[1])
 	if err != nil {
-		log.Printf("[%s] %s - %s %s - basic base64 conversion: %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI, err.Error())
-		return ErrHTTPUnauthorized
+		log.Printf("[%s] %s - %s %s - basic base64 conversion: %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, s.logURI(r), err.Error())
+		return nil, ErrHTTPUnauthorized
 	}
 
 	userPassParts := strings.Split(string(userPassBytes), ":")
 	if len(userPassParts) != 2 {
-		log.Printf("[%s] %s - %s %s - basic invalid user/pass format", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
-		return ErrHTTPUnauthorized
+		log.Printf("[%s] %s - %s %s - basic invalid user/pass format", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, s.logURI(r))
+		return nil, ErrHTTPUnauthorized
 	}
 	passwordBytes := []byte(userPassParts[1])
 
-	// Compare HMAC in constant time (to prevent timing attacks)
-	key := crypto.DeriveKey(passwordBytes, s.config.Key.Salt)
-	if subtle.ConstantTimeCompare(key.Bytes, s.config.Key.Bytes) != 1 {
-		log.Printf("[%s] %s - %s %s - basic invalid", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
-		return ErrHTTPUnauthorized
+	key := matchingKey(passwordBytes, keys)
+	if key == nil {
+		log.Printf("[%s] %s - %s %s - basic invalid", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, s.logURI(r))
+		return nil, ErrHTTPUnauthorized
 	}
 
-	return nil
+	return key, nil
 }
 
-func (s *Server) authorizePlain(r *http.Request, auth string) error {
+func (s *Server) authorizePlain(r *http.Request, auth string, keys []*crypto.Key) (*crypto.Key, error) {
 	passwordBytes := []byte(auth)
 
-	// Compare HMAC in constant time (to prevent timing attacks)
-	key := crypto.DeriveKey(passwordBytes, s.config.Key.Salt)
-	if subtle.ConstantTimeCompare(key.Bytes, s.config.Key.Bytes) != 1 {
-		log.Printf("[%s] %s - %s %s - plain invalid", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI)
-		return ErrHTTPUnauthorized
+	key := matchingKey(passwordBytes, keys)
+	if key == nil {
+		log.Printf("[%s] %s - %s %s - plain invalid", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, s.logURI(r))
+		return nil, ErrHTTPUnauthorized
 	}
 
-	return nil
+	return key, nil
+}
+
+// matchingKey derives a key from the given password for each of the given keys (using the respective salt),
+// and returns the first key that matches, or nil if none does
+func matchingKey(password []byte, keys []*crypto.Key) *crypto.Key {
+	var matched *crypto.Key
+	for _, key := range keys {
+		// Compare in constant time, and check all keys (to prevent timing attacks)
+		derived := crypto.DeriveKey(password, key.Salt)
+		if subtle.ConstantTimeCompare(derived.Bytes, key.Bytes) == 1 && matched == nil {
+			matched = key
+		}
+	}
+	return matched
+}
+
+// keys returns all keys accepted by the server, starting with the primary key. All other keys are only accepted
+// to allow rotating keys without downtime. If the server is not protected by a key, nil is returned.
+func (s *Server) keys() []*crypto.Key {
+	if s.config.Key == nil {
+		return nil
+	}
+	return append([]*crypto.Key{s.config.Key}, s.config.Keys...)
 }
 
 // startManager will start the server manager background process that will update the stats and expire
@@ -852,28 +3056,139 @@ func (s *Server) stopManager() {
 	}
 }
 
-func (s *Server) updateStatsAndExpire() {
+// checkDiskSpace updates lowDiskSpace according to the free space in the clipboard directory, see
+// config.MinFreeDiskBytes. It must be called with mu held.
+func (s *Server) checkDiskSpace() {
+	free, err := s.clipboard.FreeSpace()
+	if err != nil {
+		log.Printf("[%s] cannot determine free disk space: %s", config.CollapseServerAddr(s.config.ServerAddr), err.Error())
+		return
+	}
+	lowDiskSpace := free < s.config.MinFreeDiskBytes
+	if lowDiskSpace && !s.lowDiskSpace {
+		log.Printf("[%s] free disk space is low (%s), refusing uploads", config.CollapseServerAddr(s.config.ServerAddr), util.BytesToHuman(free))
+	} else if !lowDiskSpace && s.lowDiskSpace {
+		log.Printf("[%s] free disk space is back to %s, accepting uploads again", config.CollapseServerAddr(s.config.ServerAddr), util.BytesToHuman(free))
+	}
+	s.lowDiskSpace = lowDiskSpace
+}
+
+// ExpireNow runs the same sweep as the manager does every ManagerInterval, i.e. it deletes expired entries and
+// updates the stats, and returns the number of expired entries. This is useful e.g. after deleting many files.
+func (s *Server) ExpireNow() int {
+	return s.updateStatsAndExpire()
+}
+
+// handleAdminExpire runs an immediate expiry sweep, see ExpireNow
+func (s *Server) handleAdminExpire(w http.ResponseWriter, r *http.Request) error {
+	expired := s.ExpireNow()
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&ExpireResult{Expired: expired})
+}
+
+// updateStatsAndExpire expires visitors, reservations, uploads and clipboard entries, and updates the stats.
+// It returns the number of expired clipboard entries.
+func (s *Server) updateStatsAndExpire() int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	// Expire visitors from rate visitors map
 	for ip, v := range s.visitors {
-		if time.Since(v.lastSeen) > visitorExpungeAfter {
+		if time.Since(v.lastSeen) > visitorExpungeAfter && time.Now().After(v.authBlockedUntil) {
 			delete(s.visitors, ip)
+		} else {
+			s.expireAuthFailures(v)
 		}
 	}
 
-	// Walk clipboard to update size/count limiters, and expire/delete files
-	if err := s.clipboard.Expire(); err != nil {
-		log.Printf("[%s] cannot expire clipboard entries: %s", config.CollapseServerAddr(s.config.ServerAddr), err.Error())
+	// Free the stream slots of reservations that have expired, or were replaced by a regular upload
+	for key := range s.reservations {
+		clip, id := s.entryClipboard(key)
+		if stat, err := clip.Stat(id); err != nil || !stat.Reserved {
+			delete(s.reservations, key)
+		}
 	}
 
-	stats, err := s.clipboard.Stats()
-	if err != nil {
-		log.Printf("[%s] cannot get stats from clipboard: %s", config.CollapseServerAddr(s.config.ServerAddr), err.Error())
-	} else {
-		s.printStats(stats)
+	// Forget HMAC nonces once the HMAC they belong to has expired, since it would be rejected anyway
+	for nonce, expires := range s.authNonces {
+		if time.Until(time.Unix(expires, 0)) < 0 {
+			delete(s.authNonces, nonce)
+		}
+	}
+	authNonceOrder := make([]string, 0, len(s.authNonces))
+	for _, nonce := range s.authNonceOrder {
+		if _, ok := s.authNonces[nonce]; ok {
+			authNonceOrder = append(authNonceOrder, nonce)
+		}
+	}
+	s.authNonceOrder = authNonceOrder
+
+	// Forget the results of uploads with an idempotency key after a while; requests in progress are kept
+	for key, record := range s.idempotency {
+		if record.done && time.Since(record.created) > idempotencyKeyExpireAfter {
+			delete(s.idempotency, key)
+		}
+	}
+
+	// Forget files that were removed after reaching their download limit, once they would have expired anyway
+	for id, expires := range s.exhausted {
+		if expires > 0 && time.Until(time.Unix(expires, 0)) <= 0 {
+			delete(s.exhausted, id)
+		}
+	}
+
+	// Remind users of files that are about to expire, before they are gone
+	if s.config.SMTPAddr != "" {
+		s.sendExpiryReminders()
+	}
+
+	// Refuse uploads while the disk is (almost) full
+	if s.config.MinFreeDiskBytes > 0 {
+		s.checkDiskSpace()
+	}
+
+	// Delete resumable uploads that were abandoned
+	for _, clip := range s.clipboards() {
+		if err := clip.ExpireUploads(uploadExpireAfter); err != nil {
+			log.Printf("[%s] cannot expire pending uploads: %s", config.CollapseServerAddr(s.config.ServerAddr), err.Error())
+		}
+	}
+
+	// Walk clipboard(s) to update size/count limiters, and expire/delete files
+	expired := make([]*clipboard.File, 0)
+	for _, clip := range s.clipboards() {
+		clipExpired, err := clip.Expire()
+		if err != nil {
+			log.Printf("[%s] cannot expire clipboard entries: %s", config.CollapseServerAddr(s.config.ServerAddr), err.Error())
+		}
+		expired = append(expired, clipExpired...)
+	}
+	s.metrics.expired += int64(len(expired))
+	for _, f := range expired {
+		s.recordChange(f.ID, f.Hidden)
 	}
+	if s.config.WebhookURL != "" {
+		for _, f := range expired {
+			if !f.Hidden {
+				go s.sendWebhook(webhookEventExpired, f.ID, f, f.Size)
+			}
+		}
+	}
+
+	stats := &clipboard.Stats{}
+	for _, clip := range s.clipboards() {
+		clipStats, err := clip.Stats()
+		if err != nil {
+			log.Printf("[%s] cannot get stats from clipboard: %s", config.CollapseServerAddr(s.config.ServerAddr), err.Error())
+			return len(expired)
+		}
+		stats.Count += clipStats.Count
+		stats.Size += clipStats.Size
+	}
+	s.metrics.files = stats.Count
+	s.metrics.size = stats.Size
+	s.printStats(stats)
+	return len(expired)
 }
 
 func (s *Server) printStats(stats *clipboard.Stats) {
@@ -894,35 +3209,52 @@ func (s *Server) printStats(stats *clipboard.Stats) {
 
 func (s *Server) redirectHTTPS(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		if r.Header.Get(HeaderNoRedirect) == "" && r.TLS == nil && s.config.ListenHTTPS != "" {
-			newURL := r.URL
-			newURL.Host = r.Host
-			newURL.Scheme = "https"
-			if strings.Contains(newURL.Host, ":") {
-				newURL.Host, _, _ = net.SplitHostPort(newURL.Host)
-			}
-			_, port, _ := net.SplitHostPort(s.config.ListenHTTPS)
-			if port != "443" {
-				newURL.Host = net.JoinHostPort(newURL.Host, port)
-			}
-			http.Redirect(w, r, newURL.String(), http.StatusFound)
+		if s.config.RedirectHTTPS && r.Header.Get(HeaderNoRedirect) == "" && r.TLS == nil && s.config.ListenHTTPS != "" {
+			http.Redirect(w, r, s.httpsURL(r), http.StatusFound)
 			return nil
 		}
 		return next(w, r)
 	}
 }
 
+// httpsURL returns the URL of the given request on the HTTPS listen address, or on ExternalURL if it is set
+func (s *Server) httpsURL(r *http.Request) string {
+	newURL := *r.URL
+	if externalURL, err := url.Parse(s.config.ExternalURL); err == nil && s.config.ExternalURL != "" {
+		newURL.Scheme = externalURL.Scheme
+		newURL.Host = externalURL.Host
+		return newURL.String()
+	}
+	newURL.Host = r.Host
+	newURL.Scheme = "https"
+	if strings.Contains(newURL.Host, ":") {
+		newURL.Host, _, _ = net.SplitHostPort(newURL.Host)
+	}
+	_, port, _ := net.SplitHostPort(s.config.ListenHTTPS)
+	if port != "443" {
+		newURL.Host = net.JoinHostPort(newURL.Host, port)
+	}
+	return newURL.String()
+}
+
 // limit wraps all HTTP endpoints and limits API use to a certain number of requests per second.
 // This function was taken from https://www.alexedwards.net/blog/how-to-rate-limit-http-requests (MIT).
 func (s *Server) limit(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		v := s.getVisitor(r.RemoteAddr)
-		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		v := s.getVisitor(s.visitorIP(r))
+		// Chunks of a resumable upload (PATCH) are subject to the GET limit; the upload itself is already
+		// subject to the PUT limit when it is started
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodPatch {
 			if !v.limiterGET.Allow() {
 				return ErrHTTPTooManyRequests
 			}
-		} else {
-			if !v.limiterPUT.Allow() {
+		} else if !s.isIdempotentReplay(r) { // Replays are free, see idempotent
+			reservation := v.limiterPUT.Reserve()
+			if !reservation.OK() {
+				return ErrHTTPTooManyRequests
+			} else if delay := reservation.Delay(); delay > 0 {
+				reservation.Cancel()
+				w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(delay.Seconds()))))
 				return ErrHTTPTooManyRequests
 			}
 		}
@@ -931,34 +3263,123 @@ func (s *Server) limit(next handleFunc) handleFunc {
 	}
 }
 
+// putRateLimit converts the per-minute upload limit to a rate.Limit; zero disables the limit
+func putRateLimit(perMinute int) rate.Limit {
+	if perMinute == 0 {
+		return rate.Inf
+	}
+	return rate.Limit(float64(perMinute) / 60)
+}
+
 // getVisitor creates or retrieves a rate.Limiter for the given visitor.
 // This function was taken from https://www.alexedwards.net/blog/how-to-rate-limit-http-requests (MIT).
-func (s *Server) getVisitor(remoteAddr string) *visitor {
+func (s *Server) getVisitor(ip string) *visitor {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	ip, _, err := net.SplitHostPort(remoteAddr)
-	if err != nil {
-		ip = remoteAddr // This should not happen in real life; only in tests.
-	}
-
 	v, exists := s.visitors[ip]
 	if !exists {
 		v = &visitor{
-			rate.NewLimiter(s.config.LimitGET, s.config.LimitGETBurst),
-			rate.NewLimiter(s.config.LimitPUT, s.config.LimitPUTBurst),
-			time.Now(),
+			limiterGET: rate.NewLimiter(s.config.LimitGET, s.config.LimitGETBurst),
+			limiterPUT: rate.NewLimiter(putRateLimit(s.config.PutRateLimitPerMinute), s.config.PutRateBurst),
+			lastSeen:   time.Now(),
+			requests:   1,
 		}
 		s.visitors[ip] = v
 		return v
 	}
 
 	v.lastSeen = time.Now()
+	v.requests++
 	return v
 }
 
+// visitorIP returns the IP address that is used to identify the visitor. This is the IP address part of the remote
+// address, unless the request comes from a trusted proxy (see config.TrustedProxies). In that case, the rightmost
+// address in X-Forwarded-For that is not a trusted proxy itself is used.
+func (s *Server) visitorIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr // This should not happen in real life; only in tests.
+	}
+	if !s.isTrustedProxy(ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break // Don't trust anything left of a garbled entry
+		}
+		ip = addr
+		if !s.isTrustedProxy(addr) {
+			break
+		}
+	}
+	return ip
+}
+
+func (s *Server) isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range s.trustedProxies {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// logURI returns the request URI as it should appear in the log. If RedactIDsInLogs is enabled, the query string is
+// dropped, and the first path segment is replaced by its hash (see clipboard.RedactID), unless it belongs to one of
+// the non-file routes (see reservedRouteIDs). Unknown paths are redacted as well, since they may contain a file ID.
+func (s *Server) logURI(r *http.Request) string {
+	if !s.config.RedactIDsInLogs {
+		return r.RequestURI
+	}
+	id, rest := strings.TrimPrefix(r.URL.Path, "/"), ""
+	if i := strings.Index(id, "/"); i != -1 {
+		id, rest = id[:i], id[i:]
+	}
+	if id == "" || s.clipboard.IsReserved(id) {
+		return r.URL.Path
+	} else if strings.HasSuffix(id, clipboardMetaSuffix) {
+		return "/" + clipboard.RedactID(strings.TrimSuffix(id, clipboardMetaSuffix)) + clipboardMetaSuffix + rest
+	}
+	return "/" + clipboard.RedactID(id) + rest
+}
+
+// logID returns the file ID as it should appear in the log, see logURI
+func (s *Server) logID(id string) string {
+	if s.config.RedactIDsInLogs {
+		return clipboard.RedactID(id)
+	}
+	return id
+}
+
 func (s *Server) fail(w http.ResponseWriter, r *http.Request, code int, err error) {
-	log.Printf("[%s] %s - %s %s - %s", config.CollapseServerAddr(s.config.ServerAddr), r.RemoteAddr, r.Method, r.RequestURI, err.Error())
+	s.logRequestError(r, err)
+	status := http.StatusText(code)
+	if e, ok := err.(*ErrHTTP); ok && e.Status != "" {
+		status = e.Status
+	}
+	if s.wantsJSONError(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(&ErrorResponse{Error: status, Code: code})
+		return
+	}
 	w.WriteHeader(code)
-	io.WriteString(w, fmt.Sprintf("%s\n", http.StatusText(code)))
+	io.WriteString(w, fmt.Sprintf("%s\n", status))
+}
+
+// wantsJSONError returns true if errors should be returned as JSON (see ErrorResponse), i.e. if the client asked for
+// JSON output via "?f=json" or "X-Format: json" (for uploads, since "?f=" is the filename for GETs), or via "Accept:"
+func (s *Server) wantsJSONError(r *http.Request) bool {
+	if strings.Contains(r.Header.Get("Accept"), "application/json") || r.Header.Get(HeaderFormat) == HeaderFormatJSON {
+		return true
+	}
+	return r.Method != http.MethodGet && r.Method != http.MethodHead && r.URL.Query().Get(queryParamFormat) == HeaderFormatJSON
 }
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Router is a simple vhost delegator to be able to run multiple clipboards on the same port.
@@ -161,22 +162,33 @@ func (r *Router) createHTTPServers() ([]*http.Server, error) {
 	servers := make(map[string]*http.Server)
 	for _, s := range r.servers {
 		if s.config.ListenHTTP != "" {
-			if _, err := r.createServerOrAddHandler(servers, serversPerPort, s, s.config.ListenHTTP); err != nil {
+			var handler http.Handler = http.HandlerFunc(s.Handle)
+			if s.certManager != nil {
+				handler = s.acmeHTTPHandler()
+			}
+			if _, err := r.createServerOrAddHandler(servers, serversPerPort, s, s.config.ListenHTTP, handler); err != nil {
 				return nil, err
 			}
 		}
 		if s.config.ListenHTTPS != "" {
-			server, err := r.createServerOrAddHandler(servers, serversPerPort, s, s.config.ListenHTTPS)
+			server, err := r.createServerOrAddHandler(servers, serversPerPort, s, s.config.ListenHTTPS, http.HandlerFunc(s.Handle))
 			if err != nil {
 				return nil, err
 			}
+			if server.TLSConfig == nil {
+				server.TLSConfig = newTLSConfig(s)
+			} else if !sameTLSPolicy(server.TLSConfig, s) {
+				return nil, errTLSPolicyMismatch
+			}
+			if s.certManager != nil {
+				server.TLSConfig.GetCertificate = r.getCertificate
+				server.TLSConfig.NextProtos = acmeNextProtos
+				continue
+			}
 			cert, err := tls.LoadX509KeyPair(s.config.CertFile, s.config.KeyFile)
 			if err != nil {
 				return nil, err
 			}
-			if server.TLSConfig == nil {
-				server.TLSConfig = &tls.Config{Certificates: make([]tls.Certificate, 0)}
-			}
 			server.TLSConfig.Certificates = append(server.TLSConfig.Certificates, cert)
 		}
 	}
@@ -187,11 +199,48 @@ func (r *Router) createHTTPServers() ([]*http.Server, error) {
 	return serversList, nil
 }
 
-func (r *Router) createServerOrAddHandler(servers map[string]*http.Server, serversPerPort map[string]int, s *Server, listen string) (*http.Server, error) {
+// newTLSConfig creates the TLS config for an HTTPS listen address, applying the server's minimum TLS version
+// and cipher suites (if any). Certificates are added by the caller.
+func newTLSConfig(s *Server) *tls.Config {
+	tlsConfig := &tls.Config{
+		Certificates: make([]tls.Certificate, 0),
+		MinVersion:   s.tlsMinVersion,
+	}
+	if len(s.tlsCipherSuites) > 0 {
+		tlsConfig.CipherSuites = s.tlsCipherSuites
+		tlsConfig.PreferServerCipherSuites = true
+	}
+	return tlsConfig
+}
+
+// sameTLSPolicy returns true if the server's minimum TLS version and cipher suites match the given TLS config,
+// which is shared by all servers on the same HTTPS listen address
+func sameTLSPolicy(tlsConfig *tls.Config, s *Server) bool {
+	if tlsConfig.MinVersion != s.tlsMinVersion || len(tlsConfig.CipherSuites) != len(s.tlsCipherSuites) {
+		return false
+	}
+	for i, id := range s.tlsCipherSuites {
+		if tlsConfig.CipherSuites[i] != id {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Router) createServerOrAddHandler(servers map[string]*http.Server, serversPerPort map[string]int, s *Server, listen string, h http.Handler) (*http.Server, error) {
 	server, ok := servers[listen]
 	if !ok {
-		server = &http.Server{Addr: listen, Handler: http.NewServeMux()}
+		server = &http.Server{
+			Addr:         listen,
+			Handler:      http.NewServeMux(),
+			ReadTimeout:  s.config.ReadTimeout,
+			WriteTimeout: s.config.WriteTimeout,
+		}
 		servers[listen] = server
+	} else {
+		// Clipboards on the same listen address share the timeouts, so the most lenient ones apply
+		server.ReadTimeout = longestTimeout(server.ReadTimeout, s.config.ReadTimeout)
+		server.WriteTimeout = longestTimeout(server.WriteTimeout, s.config.WriteTimeout)
 	}
 	serverURL, err := url.ParseRequestURI(config.ExpandServerAddr(s.config.ServerAddr))
 	if err != nil {
@@ -199,13 +248,23 @@ func (r *Router) createServerOrAddHandler(servers map[string]*http.Server, serve
 	}
 	handler := server.Handler.(*http.ServeMux)
 	if serversPerPort[listen] == 1 {
-		handler.HandleFunc("/", s.Handle)
+		handler.Handle("/", h)
 	} else {
-		handler.HandleFunc(fmt.Sprintf("%s/", serverURL.Hostname()), s.Handle)
+		handler.Handle(fmt.Sprintf("%s/", serverURL.Hostname()), h)
 	}
 	return server, nil
 }
 
+// longestTimeout returns the longer of the two timeouts, where zero means no timeout, i.e. infinitely long
+func longestTimeout(a, b time.Duration) time.Duration {
+	if a == 0 || b == 0 {
+		return 0
+	} else if a > b {
+		return a
+	}
+	return b
+}
+
 func (r *Router) createTCPForwarders() ([]*tcpForwarder, error) {
 	servers := make([]*tcpForwarder, 0)
 	for _, s := range r.servers {
@@ -218,3 +277,4 @@ func (r *Router) createTCPForwarders() ([]*tcpForwarder, error) {
 }
 
 var errInvalidNumberOfConfigs = errors.New("invalid number of configs, need at least one")
+var errTLSPolicyMismatch = errors.New("'TLSMinVersion' and 'TLSCipherSuites' must be identical for all clipboards on the same HTTPS listen address")
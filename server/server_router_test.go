@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"heckel.io/pcopy/clipboard/clipboardtest"
@@ -14,6 +15,7 @@ import (
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestServerRouter_InvalidConfigNoConfigs(t *testing.T) {
@@ -23,6 +25,87 @@ func TestServerRouter_InvalidConfigNoConfigs(t *testing.T) {
 	}
 }
 
+func TestServerRouter_AutoCertManagerForDomain(t *testing.T) {
+	_, conf1 := configtest.NewTestConfigWithHostname(t, "some-host-1")
+	conf1.AutoCertDomains = []string{"pcopy.example.com"}
+	conf1.AutoCertCacheDir = t.TempDir()
+	conf1.KeyFile = ""
+	conf1.CertFile = ""
+	_, conf2 := configtest.NewTestConfigWithHostname(t, "some-host-2")
+	router, err := NewRouter(conf1, conf2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.BoolEquals(t, true, router.certManagerFor("PCOPY.example.com") == router.servers[0].certManager)
+	test.BoolEquals(t, true, router.certManagerFor("some-host-2") == nil)
+
+	// Names without ACME fall back to the certificates loaded from CertFile
+	cert, err := router.getCertificate(&tls.ClientHelloInfo{ServerName: "some-host-2"})
+	test.BoolEquals(t, true, cert == nil && err == nil)
+}
+
+func TestServerRouter_TLSPolicy(t *testing.T) {
+	_, conf1 := configtest.NewTestConfigWithHostname(t, "some-host-1")
+	conf1.ListenHTTPS = ":11443"
+	conf1.TLSMinVersion = "1.2"
+	conf1.TLSCipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}
+	router, err := NewRouter(conf1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err := router.createHTTPServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := servers[0].TLSConfig
+	test.Int64Equals(t, tls.VersionTLS12, int64(tlsConfig.MinVersion))
+	test.Int64Equals(t, 2, int64(len(tlsConfig.CipherSuites)))
+	test.Int64Equals(t, int64(tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384), int64(tlsConfig.CipherSuites[1]))
+	test.BoolEquals(t, true, tlsConfig.PreferServerCipherSuites)
+
+	// Clipboards on the same port must agree on the policy
+	_, conf2 := configtest.NewTestConfigWithHostname(t, "some-host-2")
+	conf2.ListenHTTPS = ":11443"
+	conf2.TLSMinVersion = "1.3"
+	router, _ = NewRouter(conf1, conf2)
+	if _, err := router.createHTTPServers(); err != errTLSPolicyMismatch {
+		t.Fatalf("expected errTLSPolicyMismatch, got %v", err)
+	}
+}
+
+func TestServerRouter_Timeouts(t *testing.T) {
+	_, conf1 := configtest.NewTestConfigWithHostname(t, "some-host-1")
+	conf1.ListenHTTPS = ":11443"
+	conf1.ReadTimeout = time.Minute
+	conf1.WriteTimeout = time.Hour
+	_, conf2 := configtest.NewTestConfigWithHostname(t, "some-host-2")
+	conf2.ListenHTTPS = ":11443"
+	conf2.ReadTimeout = 2 * time.Minute
+	conf2.WriteTimeout = 0
+	router, err := NewRouter(conf1, conf2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err := router.createHTTPServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, server := range servers {
+		if server.Addr == ":11443" {
+			test.DurationEquals(t, 2*time.Minute, server.ReadTimeout) // Longest timeout wins
+			test.DurationEquals(t, 0, server.WriteTimeout)            // No timeout wins
+		}
+	}
+}
+
+func TestServerRouter_InvalidTLSMinVersion(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.TLSMinVersion = "2.0"
+	if _, err := NewRouter(conf); err == nil {
+		t.Fatalf("expected error, got none")
+	}
+}
+
 func TestServerRouter_StartStopSimple(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	conf.ServerAddr = "https://localhost:11443"
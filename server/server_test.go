@@ -1,10 +1,16 @@
 package server
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"golang.org/x/time/rate"
 	"heckel.io/pcopy/clipboard"
@@ -19,10 +25,15 @@ import (
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/smtp"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -41,6 +52,63 @@ func TestServer_NewServerInvalidListenAddr(t *testing.T) {
 	}
 }
 
+func TestServer_NewServerDefaultFileModeNotAllowed(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileModesAllowed = []string{config.FileModeReadWrite}
+	conf.DefaultFileMode = config.FileModeReadOnly
+	_, err := New(conf)
+	if err != errDefaultFileModeNotAllowed {
+		t.Fatalf("expected errDefaultFileModeNotAllowed, got %v", err)
+	}
+}
+
+func TestServer_NewServerFileExpireAfterByModeNotAllowed(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileModesAllowed = []string{config.FileModeReadWrite}
+	conf.FileExpireAfterByMode = map[string]time.Duration{config.FileModeReadOnly: time.Hour}
+	_, err := New(conf)
+	if err != errFileExpireAfterByModeNotAllowed {
+		t.Fatalf("expected errFileExpireAfterByModeNotAllowed, got %v", err)
+	}
+}
+
+func TestServer_NewServerInvalidManagerInterval(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ManagerInterval = 0
+	_, err := New(conf)
+	if err != errManagerIntervalInvalid {
+		t.Fatalf("expected errManagerIntervalInvalid, got %v", err)
+	}
+}
+
+func TestServer_HandleClipboardPutDefaultFileMode(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileModesAllowed = []string{config.FileModeReadWrite, config.FileModeReadOnly}
+	conf.DefaultFileMode = config.FileModeReadOnly
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/default-ro", strings.NewReader("read-only by default"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/default-ro", strings.NewReader("overwrite"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusMethodNotAllowed)
+
+	// Clients can still choose read-write explicitly
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/explicit-rw?m=rw", strings.NewReader("read-write"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/explicit-rw", strings.NewReader("overwrite"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+}
+
 func TestServer_NewServerInvalidKeyFile(t *testing.T) {
 	conf := config.New()
 	conf.KeyFile = ""
@@ -61,6 +129,58 @@ func TestServer_NewServerInvalidCertFile(t *testing.T) {
 	}
 }
 
+func TestServer_NewServerAutoCertWithCertFiles(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.AutoCertDomains = []string{"pcopy.example.com"}
+	_, err := New(conf)
+	if err != errAutoCertWithCertFiles {
+		t.Fatalf("expected errAutoCertWithCertFiles, got %v", err)
+	}
+}
+
+func TestServer_NewServerAutoCertWithoutHTTPS(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.AutoCertDomains = []string{"pcopy.example.com"}
+	conf.KeyFile = ""
+	conf.CertFile = ""
+	conf.ListenHTTPS = ""
+	conf.ListenHTTP = ":80"
+	_, err := New(conf)
+	if err != errAutoCertListenMissing {
+		t.Fatalf("expected errAutoCertListenMissing, got %v", err)
+	}
+}
+
+func TestServer_AutoCertHTTPHandler(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.AutoCertDomains = []string{"pcopy.example.com"}
+	conf.AutoCertCacheDir = t.TempDir()
+	conf.KeyFile = ""
+	conf.CertFile = ""
+	conf.ListenHTTPS = ":443"
+	conf.ListenHTTP = ":80"
+	server := newTestServer(t, conf)
+	handler := server.acmeHTTPHandler()
+
+	// Unknown challenge tokens are not redirected
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://pcopy.example.com/.well-known/acme-challenge/some-token", nil)
+	handler.ServeHTTP(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://pcopy.example.com/some-file?a=1", nil)
+	handler.ServeHTTP(rr, req)
+	test.Status(t, rr, http.StatusFound)
+	test.StrEquals(t, "https://pcopy.example.com/some-file?a=1", rr.Header().Get("Location"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "http://pcopy.example.com/some-file", strings.NewReader("not over http"))
+	handler.ServeHTTP(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+	clipboardtest.NotExist(t, conf, "some-file")
+}
+
 func TestServer_HandleInfoUnprotected(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	conf.DefaultID = ""
@@ -73,713 +193,5124 @@ func TestServer_HandleInfoUnprotected(t *testing.T) {
 	test.Response(t, rr, http.StatusOK, `{"serverAddr":"https://localhost:12345","defaultID":"","salt":null}`)
 }
 
-func TestServer_HandleVerify(t *testing.T) {
+func TestServer_HandleInfoFull(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
+	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	conf.FileSizeLimit = 1000
+	conf.ClipboardSizeLimit = 5000
+	conf.FileExpireAfterDefault = time.Hour
+	conf.FileModesAllowed = []string{"ro"}
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/verify", nil)
+	req, _ := http.NewRequest("GET", "/info?f=full", nil)
 	server.Handle(rr, req)
 	test.Status(t, rr, http.StatusOK)
+
+	var info Info
+	if err := json.NewDecoder(rr.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "some salt", string(info.Salt))
+	test.Int64Equals(t, 1000, info.Limits.FileSizeLimit)
+	test.Int64Equals(t, 5000, info.Limits.ClipboardSizeLimit)
+	test.Int64Equals(t, 3600, info.Limits.FileExpireAfterDefault)
+	test.StrEquals(t, "ro", strings.Join(info.Limits.FileModesAllowed, " "))
+	test.BoolEquals(t, true, info.Limits.KeyRequired)
+
+	// Default response does not include the limits
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/info", nil)
+	server.Handle(rr, req)
+	test.BoolEquals(t, false, strings.Contains(rr.Body.String(), "limits"))
 }
 
-func TestServer_HandleInfoProtected(t *testing.T) {
+func TestServer_HandleFeatures(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	conf.AuthReadRequired = false
+	conf.CompressFiles = true
+	conf.FileSizeLimit = 1000
+	conf.FileModesAllowed = []string{"ro"}
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/info", nil)
+	req, _ := http.NewRequest("OPTIONS", "/", nil) // No credentials required
 	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "GET, OPTIONS, PUT, POST", rr.Header().Get("Allow"))
+	test.BoolEquals(t, false, strings.Contains(rr.Body.String(), "salt"))
 
-	test.Response(t, rr, http.StatusOK, `{"serverAddr":"https://localhost:12345","defaultID":"default","salt":"c29tZSBzYWx0"}`)
+	var features Features
+	if err := json.NewDecoder(rr.Body).Decode(&features); err != nil {
+		t.Fatal(err)
+	}
+	test.BoolEquals(t, true, features.Stream)
+	test.BoolEquals(t, true, features.Burn)
+	test.BoolEquals(t, true, features.Password)
+	test.BoolEquals(t, true, features.CompressFiles)
+	test.BoolEquals(t, false, features.AuthReadRequired)
+	test.BoolEquals(t, true, features.AuthWriteRequired)
+	test.Int64Equals(t, 1000, features.Limits.FileSizeLimit)
+	test.StrEquals(t, "ro", strings.Join(features.Limits.FileModesAllowed, " "))
+	test.BoolEquals(t, true, features.Limits.KeyRequired)
 }
 
-func TestServer_HandleDoesNotExist(t *testing.T) {
+func TestServer_HandleVerify(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/some path that can't be a clipboard id", nil)
+	req, _ := http.NewRequest("GET", "/verify", nil)
 	server.Handle(rr, req)
-
-	test.Status(t, rr, http.StatusNotFound)
+	test.Status(t, rr, http.StatusOK)
 }
 
-func TestServer_HandleCurlRoot(t *testing.T) {
+func TestServer_HandleStats(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
+	conf.ClipboardCountLimit = 10
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/", nil)
-	req.Header.Set("User-Agent", "curl/1.2.3")
+	req, _ := http.NewRequest("PUT", "/some-file", strings.NewReader("hi there"))
+	req.RemoteAddr = "1.2.3.4:1234"
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/stats", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
 	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
 
-	test.StrContains(t, rr.Body.String(), "This is is the curl-endpoint for pcopy")
+	var stats Stats
+	if err := json.NewDecoder(rr.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 1, int64(stats.Count))
+	test.Int64Equals(t, 8, stats.Size)
+	test.Int64Equals(t, 10, int64(stats.CountLimit))
+	test.StrEquals(t, "some-file", stats.Entries[0].ID)
+	test.StrEquals(t, "1.2.3.4", stats.Visitors[0].Addr)
+	test.Int64Equals(t, 2, int64(stats.Visitors[0].Requests))
+	test.StrEquals(t, "copy", stats.Events[0].Action)
+	test.StrEquals(t, "some-file", stats.Events[0].ID)
 }
 
-func TestServer_HandleCurlRootFromEndpoint(t *testing.T) {
+func TestServer_HandleStatsHiddenEntries(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/curl", nil)
+	req, _ := http.NewRequest("PUT", "/visible", strings.NewReader("hi there"))
 	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
 
-	test.StrContains(t, rr.Body.String(), "This is is the curl-endpoint for pcopy")
-}
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/unlisted?hidden=1", strings.NewReader("secret stuff"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
 
-func TestServer_HandleWebRoot(t *testing.T) {
-	_, conf := configtest.NewTestConfig(t)
-	server := newTestServer(t, conf)
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/unlisted2", strings.NewReader("more secret stuff"))
+	req.Header.Set("X-Hidden", "1")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
 
-	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/", nil)
-	req.TLS = &tls.ConnectionState{} // Pretend that this is TLS, so we don't redirect
+	// Hidden files can still be retrieved directly
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/unlisted", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "secret stuff")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("HEAD", "/unlisted2", nil)
 	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
 
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/stats", nil)
+	server.Handle(rr, req)
 	test.Status(t, rr, http.StatusOK)
-	if !strings.Contains(rr.Body.String(), "</html>") { // Check for </html> to ensure rendering completed
-		t.Fatalf("expected html, got: %s", rr.Body.String())
+	if strings.Contains(rr.Body.String(), "unlisted") {
+		t.Fatalf("expected hidden files to be excluded from stats, got %s", rr.Body.String())
+	}
+
+	var stats Stats
+	if err := json.NewDecoder(rr.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
 	}
+	test.Int64Equals(t, 3, int64(stats.Count))
+	test.Int64Equals(t, 1, int64(len(stats.Entries)))
+	test.StrEquals(t, "visible", stats.Entries[0].ID)
+	test.Int64Equals(t, 1, int64(len(stats.Events)))
+	test.StrEquals(t, "visible", stats.Events[0].ID)
 }
 
-func TestServer_HandleWebRootRedirectHTTPS(t *testing.T) {
+func TestServer_HandleStatsHiddenReservation(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.ListenHTTP = ":9876"
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/", nil)
-	req.Host = "localhost"
+	req, _ := http.NewRequest("PUT", "/abc?r=1&hidden=1", nil)
 	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
 
-	test.Status(t, rr, http.StatusFound)
-	test.StrEquals(t, "https://localhost:12345/", rr.Header().Get("Location"))
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/abc", strings.NewReader("streamed later"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/stats", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	if strings.Contains(rr.Body.String(), "abc") {
+		t.Fatalf("expected hidden reservation to stay hidden, got %s", rr.Body.String())
+	}
 }
 
-func TestServer_HandleWebStaticResource(t *testing.T) {
+func TestServer_HandleStatsProtected(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
+	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/static/js/app.js", nil)
+	req, _ := http.NewRequest("GET", "/stats", nil)
 	server.Handle(rr, req)
-
-	test.Status(t, rr, http.StatusOK)
-	if !strings.Contains(rr.Body.String(), "getElementById") {
-		t.Fatalf("expected js, got: %s", rr.Body.String())
-	}
+	test.Status(t, rr, http.StatusUnauthorized)
 }
 
-func TestServer_HandleWebFavicon(t *testing.T) {
+func TestServer_HandleList(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/favicon.ico", nil)
+	req, _ := http.NewRequest("PUT", "/some-file?t=1h&m=ro", strings.NewReader("hi there"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/unlisted?hidden=1", strings.NewReader("secret stuff"))
 	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/reserved?r=1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
 
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/list", nil)
+	server.Handle(rr, req)
 	test.Status(t, rr, http.StatusOK)
-	test.BytesEquals(t, []byte{0x00, 0x00, 0x01, 0x00}, rr.Body.Bytes()[:4]) // .ico magic bytes
+	test.StrEquals(t, "2", rr.Header().Get("X-Total"))
+
+	var entries []*ListEntry
+	if err := json.NewDecoder(rr.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 2, int64(len(entries)))
+	byID := make(map[string]*ListEntry)
+	for _, e := range entries {
+		byID[e.ID] = e
+	}
+	test.Int64Equals(t, 8, byID["some-file"].Size)
+	test.StrEquals(t, "ro", byID["some-file"].Mode)
+	test.BoolEquals(t, false, byID["some-file"].Streaming)
+	test.BoolEquals(t, true, byID["some-file"].TTL > 3500 && byID["some-file"].TTL <= 3600)
+	test.BoolEquals(t, true, byID["reserved"].Streaming)
 }
 
-func TestServer_HandleClipboardGetExists(t *testing.T) {
+func TestServer_HandleListPagination(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	server := newTestServer(t, conf)
 
-	file := filepath.Join(conf.ClipboardDir, "this-exists")
-	metafile := filepath.Join(conf.ClipboardDir, "this-exists:meta")
-	ioutil.WriteFile(file, []byte("hi there"), 0700)
-	ioutil.WriteFile(metafile, []byte("{}"), 0700)
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("file%d", i)
+		file := filepath.Join(conf.ClipboardDir, id)
+		ioutil.WriteFile(file, []byte("hi"), 0700)
+		ioutil.WriteFile(file+":meta", []byte(`{"mode":"rw"}`), 0700)
+		modTime := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(file, modTime, modTime)
+	}
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/this-exists", nil)
+	req, _ := http.NewRequest("GET", "/list?offset=1&limit=2", nil)
 	server.Handle(rr, req)
-	test.Response(t, rr, http.StatusOK, "hi there")
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "5", rr.Header().Get("X-Total"))
+
+	var entries []*ListEntry
+	json.NewDecoder(rr.Body).Decode(&entries)
+	test.Int64Equals(t, 2, int64(len(entries)))
+	test.StrEquals(t, "file3", entries[0].ID) // Newest first
+	test.StrEquals(t, "file2", entries[1].ID)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/list?offset=10", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "[]\n")
+
+	for _, query := range []string{"offset=-1", "limit=0", "limit=1001", "limit=abc"} {
+		rr = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/list?"+query, nil)
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusBadRequest)
+	}
 }
 
-func TestServer_HandleClipboardGetExistsWithAuthParam(t *testing.T) {
+func TestServer_HandleListProtected(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
 	server := newTestServer(t, conf)
 
-	file := filepath.Join(conf.ClipboardDir, "this-exists-again")
-	metafile := filepath.Join(conf.ClipboardDir, "this-exists-again:meta")
-	ioutil.WriteFile(file, []byte("hi there again"), 0700)
-	ioutil.WriteFile(metafile, []byte(`{"secret":"abc"}`), 0700)
-
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/this-exists-again?a=abc", nil)
+	req, _ := http.NewRequest("GET", "/list", nil)
 	server.Handle(rr, req)
-	test.Response(t, rr, http.StatusOK, "hi there again")
+	test.Status(t, rr, http.StatusUnauthorized)
 }
 
-func TestServer_HandleClipboardGetExistsWithAuthParamFailure(t *testing.T) {
+func TestServer_AuthPromptForBrowsers(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	conf.AuthRealm = "My Clipboard"
 	server := newTestServer(t, conf)
 
-	file := filepath.Join(conf.ClipboardDir, "this-exists-again")
-	metafile := filepath.Join(conf.ClipboardDir, "this-exists-again:meta")
-	ioutil.WriteFile(file, []byte("hi there again"), 0700)
-	ioutil.WriteFile(metafile, []byte(`{"secret":"abc"}`), 0700)
-
+	// curl and the pcopy client don't get a prompt
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/this-exists-again?a=invalid", nil)
+	req, _ := http.NewRequest("GET", "/some-file", nil)
+	req.Header.Set("User-Agent", "curl/7.68.0")
 	server.Handle(rr, req)
 	test.Status(t, rr, http.StatusUnauthorized)
-}
+	test.StrEquals(t, "", rr.Header().Get("WWW-Authenticate"))
 
-func TestServer_HandleClipboardGetDoesntExist(t *testing.T) {
-	_, conf := configtest.NewTestConfig(t)
-	server := newTestServer(t, conf)
+	// Browsers do, unless it's a request from the web UI
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/some-file", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+	test.StrEquals(t, `Basic realm="My Clipboard"`, rr.Header().Get("WWW-Authenticate"))
 
-	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/this-does-not-exist", nil)
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/verify", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusNotFound)
+	test.Status(t, rr, http.StatusUnauthorized)
+	test.StrEquals(t, "", rr.Header().Get("WWW-Authenticate"))
+
+	// Anyone can ask for it
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/list?auth=basic", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+	test.StrEquals(t, `Basic realm="My Clipboard"`, rr.Header().Get("WWW-Authenticate"))
 }
 
-func TestServer_HandleClipboardPut(t *testing.T) {
+func TestServer_HandleChanges(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	server := newTestServer(t, conf)
 
-	content := "this is a new thing"
+	result := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/changes", nil)
+		server.Handle(rr, req)
+		result <- rr
+	}()
+	time.Sleep(100 * time.Millisecond)
+
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/new-thing", strings.NewReader(content))
+	req, _ := http.NewRequest("PUT", "/hidden-file?hidden=1", strings.NewReader("not announced"))
 	server.Handle(rr, req)
 	test.Status(t, rr, http.StatusCreated)
-	clipboardtest.Content(t, conf, "new-thing", content)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file1", strings.NewReader("hi there"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	var changes Changes
+	select {
+	case rr = <-result:
+		test.Status(t, rr, http.StatusOK)
+		json.NewDecoder(rr.Body).Decode(&changes)
+		test.StrEquals(t, "file1", strings.Join(changes.IDs, ","))
+	case <-time.After(time.Second):
+		t.Fatal("/changes did not return after a change")
+	}
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/file1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/changes?since=%d", changes.Time), nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	json.NewDecoder(rr.Body).Decode(&changes)
+	test.StrEquals(t, "file1", strings.Join(changes.IDs, ","))
 }
 
-func TestServer_HandleClipboardPutRandom(t *testing.T) {
+func TestServer_HandleChangesTimeout(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	server := newTestServer(t, conf)
+	changesTimeout = 100 * time.Millisecond
+	defer func() { changesTimeout = 30 * time.Second }()
 
+	before := time.Now().UnixNano()
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/", strings.NewReader("this is a thing"))
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/changes?since=%d", before), nil)
 	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
 
-	test.Status(t, rr, http.StatusCreated)
+	var changes Changes
+	json.NewDecoder(rr.Body).Decode(&changes)
+	test.Int64Equals(t, 0, int64(len(changes.IDs)))
+	test.BoolEquals(t, true, changes.Time > before)
 
-	test.Int64Equals(t, 10, int64(len(rr.Header().Get("X-File"))))
-	test.StrEquals(t, fmt.Sprintf("%d", 3600*24*7), rr.Header().Get("X-TTL"))
-	clipboardtest.Content(t, conf, rr.Header().Get("X-File"), "this is a thing")
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/changes?since=yesterday", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
 }
 
-func TestServer_HandleClipboardPutUntilLimitReached(t *testing.T) {
+func TestServer_HandleSearch(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.LimitPUTBurst = 2
+	conf.EnableSearch = true
 	server := newTestServer(t, conf)
 
+	for path, content := range map[string]string{
+		"/note":            "remember the milk",
+		"/secret?hidden=1": "the milk is hidden",
+		"/other":           "nothing to see here",
+	} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", path, strings.NewReader(content))
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusCreated)
+	}
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/", strings.NewReader("this is a thing"))
+	req, _ := http.NewRequest("PUT", "/image", bytes.NewReader([]byte("\x89PNG\r\n\x1a\n milk")))
 	server.Handle(rr, req)
 	test.Status(t, rr, http.StatusCreated)
 
 	rr = httptest.NewRecorder()
-	req, _ = http.NewRequest("PUT", "/", strings.NewReader("this is a another thing"))
+	req, _ = http.NewRequest("GET", "/search?q=milk", nil)
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusCreated)
+	test.Status(t, rr, http.StatusOK)
+
+	var result SearchResult
+	json.NewDecoder(rr.Body).Decode(&result)
+	test.BoolEquals(t, true, result.Complete)
+	test.Int64Equals(t, 1, int64(len(result.Matches)))
+	test.StrEquals(t, "note", result.Matches[0].ID)
+	test.StrEquals(t, "remember the milk", result.Matches[0].Snippet)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/search", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+}
+
+func TestServer_HandleSearchDisabled(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/search?q=milk", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+}
+
+func TestServer_HandleArchivePutAndGet(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	archive := newTestTar(t, map[string]string{"dir/": "", "dir/a.txt": "file a", "b.txt": "file b"})
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/?archive=tar", archive)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	var result ArchiveResult
+	json.NewDecoder(rr.Body).Decode(&result)
+	test.Int64Equals(t, 2, int64(len(result.Files)))
+	test.StrEquals(t, "b.txt", result.Files[0].ID)
+	test.StrEquals(t, "https://localhost:12345/b.txt", result.Files[0].URL)
+	test.StrEquals(t, "a.txt", result.Files[1].ID)
+	clipboardtest.Content(t, conf, "a.txt", "file a")
+	clipboardtest.Content(t, conf, "b.txt", "file b")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/?archive=tar&ids=b.txt,a.txt", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "application/x-tar", rr.Header().Get("Content-Type"))
+
+	tr := tar.NewReader(rr.Body)
+	for _, expected := range []string{"b.txt", "a.txt"} {
+		header, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.StrEquals(t, expected, header.Name)
+		content, _ := ioutil.ReadAll(tr)
+		test.StrEquals(t, "file "+expected[:1], string(content))
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Fatalf("expected end of archive, got %v", err)
+	}
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/?archive=tar&ids=a.txt,missing", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+}
+
+func TestServer_HandleArchivePutLimitRollsBack(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ClipboardCountLimit = 2
+	server := newTestServer(t, conf)
+
+	archive := newTestTar(t, map[string]string{"a.txt": "file a", "b.txt": "file b", "c.txt": "file c"})
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/?archive=tar", archive)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusTooManyRequests)
+	clipboardtest.NotExist(t, conf, "a.txt")
+	clipboardtest.NotExist(t, conf, "b.txt")
+	clipboardtest.NotExist(t, conf, "c.txt")
+
+	// The limit is not used up by the rejected archive
+	archive = newTestTar(t, map[string]string{"a.txt": "file a", "b.txt": "file b"})
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/?archive=tar", archive)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+}
+
+func TestServer_HandleArchivePutInvalid(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	for _, files := range []map[string]string{
+		{"ok.txt": "fine", "info": "reserved ID"},
+		{"ok.txt": "fine", "other/ok.txt": "duplicate"},
+		{},
+	} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/?archive=tar", newTestTar(t, files))
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusBadRequest)
+		clipboardtest.NotExist(t, conf, "ok.txt")
+	}
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/?archive=zip", strings.NewReader("not a zip"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+}
+
+func TestServer_HandleMetrics(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.EnableMetrics = true
+	conf.FileSizeLimit = 10
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/some-file", strings.NewReader("hi there"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/some-file", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/too-large", strings.NewReader("this is too large"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusRequestEntityTooLarge)
+
+	file := filepath.Join(conf.ClipboardDir, "expired")
+	ioutil.WriteFile(file, []byte("old"), 0700)
+	ioutil.WriteFile(file+":meta", []byte(fmt.Sprintf(`{"mode":"rw","expires":%d}`, time.Now().Add(-time.Minute).Unix())), 0700)
+	server.updateStatsAndExpire()
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	body := rr.Body.String()
+	test.StrContains(t, body, "# TYPE pcopy_puts_total counter\npcopy_puts_total 1\n")
+	test.StrContains(t, body, "\npcopy_gets_total 1\n")
+	test.StrContains(t, body, "\npcopy_stored_bytes_total 8\n")
+	test.StrContains(t, body, "\npcopy_expired_files_total 1\n")
+	test.StrContains(t, body, "\npcopy_rejected_requests_total{code=\"413\"} 1\n")
+	test.StrContains(t, body, "# TYPE pcopy_files gauge\npcopy_files 1\n")
+	test.StrContains(t, body, "\npcopy_clipboard_size_bytes 8\n")
+}
+
+func TestServer_HandleMetricsDisabled(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+}
+
+func TestServer_HandleMetricsProtected(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.EnableMetrics = true
+	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+}
+
+func TestServer_HandleOpenAPI(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileSizeLimit = 2 * 1024 * 1024
+	conf.FileModesAllowed = []string{"ro"}
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/openapi.json", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "application/json", rr.Header().Get("Content-Type"))
+
+	var spec struct {
+		OpenAPI string `json:"openapi"`
+		Info    struct {
+			Description string `json:"description"`
+		} `json:"info"`
+		Paths map[string]map[string]struct {
+			Parameters []struct {
+				Name   string `json:"name"`
+				Schema struct {
+					Enum []string `json:"enum"`
+				} `json:"schema"`
+			} `json:"parameters"`
+		} `json:"paths"`
+		Security []interface{} `json:"security"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&spec); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "3.0.3", spec.OpenAPI)
+	test.StrContains(t, spec.Info.Description, "per-file size 2.0 MB")
+	for _, path := range []string{"/", "/{id}", "/info", "/verify", "/stats"} {
+		if _, ok := spec.Paths[path]; !ok {
+			t.Fatalf("expected path %s in spec", path)
+		}
+	}
+	params := spec.Paths["/{id}"]["put"].Parameters
+	names := make([]string, 0)
+	for _, p := range params {
+		names = append(names, p.Name)
+		if p.Name == "m" {
+			test.StrEquals(t, "ro", strings.Join(p.Schema.Enum, " "))
+		}
+	}
+	test.StrEquals(t, "id touch upload link append t expires m s r b dl p hidden public normalize f check", strings.Join(names, " "))
+	test.Int64Equals(t, 0, int64(len(spec.Security)))
+}
+
+func TestServer_HandleOpenAPIProtected(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/openapi.json", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrContains(t, rr.Body.String(), `"securitySchemes"`)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/openapi.json", strings.NewReader("something"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+}
+
+func TestServer_HandleInfoProtected(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/info", nil)
+	server.Handle(rr, req)
+
+	test.Response(t, rr, http.StatusOK, `{"serverAddr":"https://localhost:12345","defaultID":"default","salt":"c29tZSBzYWx0"}`)
+}
+
+func TestServer_HandleInfoProtectedMultipleKeys(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	conf.Keys = []*crypto.Key{{Salt: []byte("old salt"), Bytes: []byte("16 bytes exactly")}}
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/info", nil)
+	server.Handle(rr, req)
+
+	test.Response(t, rr, http.StatusOK, `{"serverAddr":"https://localhost:12345","defaultID":"default","salt":"c29tZSBzYWx0",`+
+		`"salts":[{"id":"b38245f1","salt":"c29tZSBzYWx0"},{"id":"947ebfd2","salt":"b2xkIHNhbHQ="}]}`)
+}
+
+func TestServer_HandleDoesNotExist(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/some path that can't be a clipboard id", nil)
+	server.Handle(rr, req)
+
+	test.Status(t, rr, http.StatusNotFound)
+}
+
+func TestServer_HandleCurlRoot(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "curl/1.2.3")
+	server.Handle(rr, req)
+
+	test.StrContains(t, rr.Body.String(), "This is the curl-endpoint for pcopy")
+}
+
+func TestServer_HandleCurlRootFromEndpoint(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/curl", nil)
+	server.Handle(rr, req)
+
+	test.StrContains(t, rr.Body.String(), "This is the curl-endpoint for pcopy")
+}
+
+func TestServer_HandleCurlRootWithBanner(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.CurlBanner = "Welcome to our clipboard!\nDocs: https://wiki.example.com/pcopy"
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "curl/1.2.3")
+	server.Handle(rr, req)
+	test.StrContains(t, rr.Body.String(), "DESCRIPTION:\n  Welcome to our clipboard!\n  Docs: https://wiki.example.com/pcopy\n\n  You may use curl's -T option")
+	test.BoolEquals(t, false, strings.Contains(rr.Body.String(), "This is the curl-endpoint for pcopy"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{} // Pretend that this is TLS, so we don't redirect
+	server.Handle(rr, req)
+	test.BoolEquals(t, false, strings.Contains(rr.Body.String(), "Welcome to our clipboard!"))
+}
+
+func TestServer_HandleWebRoot(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{} // Pretend that this is TLS, so we don't redirect
+	server.Handle(rr, req)
+
+	test.Status(t, rr, http.StatusOK)
+	if !strings.Contains(rr.Body.String(), "</html>") { // Check for </html> to ensure rendering completed
+		t.Fatalf("expected html, got: %s", rr.Body.String())
+	}
+}
+
+func TestServer_HandleWebRootCustomIndex(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	conf.CustomIndexFile = filepath.Join(t.TempDir(), "index.html")
+	if err := ioutil.WriteFile(conf.CustomIndexFile, []byte("<h1>Welcome to {{.ServerAddr}}</h1><p>{{.Salt}}</p>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServer(t, conf)
+
+	get := func(userAgent string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.TLS = &tls.ConnectionState{} // Pretend that this is TLS, so we don't redirect
+		req.Header.Set("User-Agent", userAgent)
+		server.Handle(rr, req)
+		return rr
+	}
+
+	rr := get("Mozilla/5.0")
+	test.Response(t, rr, http.StatusOK, "<h1>Welcome to https://localhost:12345</h1><p>c29tZSBzYWx0</p>")
+	test.StrEquals(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+
+	rr = get("curl/7.68.0")
+	test.StrContains(t, rr.Body.String(), "curl-endpoint for pcopy")
+
+	// Missing file falls back to the built-in page
+	os.Remove(conf.CustomIndexFile)
+	rr = get("Mozilla/5.0")
+	test.Status(t, rr, http.StatusOK)
+	test.StrContains(t, rr.Body.String(), "</html>")
+}
+
+func TestServer_HandleStaticDir(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.StaticDir = t.TempDir()
+	os.MkdirAll(filepath.Join(conf.StaticDir, "js"), 0700)
+	if err := ioutil.WriteFile(filepath.Join(conf.StaticDir, "js", "app.js"), []byte("console.log('custom')"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(filepath.Dir(conf.StaticDir), "secret.txt"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServer(t, conf)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		server.Handle(rr, req)
+		return rr
+	}
+
+	// Overridden file
+	rr := get("/static/js/app.js")
+	test.Response(t, rr, http.StatusOK, "console.log('custom')")
+
+	// Missing files fall back to the built-in assets
+	rr = get("/static/css/app.css")
+	test.Status(t, rr, http.StatusOK)
+	test.StrContains(t, rr.Body.String(), "{")
+
+	// Files outside of the directory are not served
+	rr = get("/static/../secret.txt")
+	test.BoolEquals(t, false, strings.Contains(rr.Body.String(), "secret"))
+	rr = get("/static/%2e%2e/secret.txt")
+	test.BoolEquals(t, false, strings.Contains(rr.Body.String(), "secret"))
+}
+
+func TestServer_HandleWebRootRedirectHTTPS(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ListenHTTP = ":9876"
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Host = "localhost"
+	server.Handle(rr, req)
+
+	test.Status(t, rr, http.StatusFound)
+	test.StrEquals(t, "https://localhost:12345/", rr.Header().Get("Location"))
+}
+
+func TestServer_HandleWebRootRedirectHTTPSToExternalURL(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ListenHTTP = ":9876"
+	conf.ExternalURL = "https://pcopy.example.com"
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/?x=1", nil)
+	req.Host = "10.0.0.1:9876"
+	server.Handle(rr, req)
+
+	test.Status(t, rr, http.StatusFound)
+	test.StrEquals(t, "https://pcopy.example.com/?x=1", rr.Header().Get("Location"))
+}
+
+func TestServer_HandleWebRootRedirectHTTPSDisabled(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ListenHTTP = ":9876"
+	conf.RedirectHTTPS = false
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Host = "localhost"
+	server.Handle(rr, req)
+
+	test.Status(t, rr, http.StatusOK)
+	test.StrContains(t, rr.Body.String(), "<html")
+}
+
+func TestServer_HandleWebStaticResource(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/static/js/app.js", nil)
+	server.Handle(rr, req)
+
+	test.Status(t, rr, http.StatusOK)
+	if !strings.Contains(rr.Body.String(), "getElementById") {
+		t.Fatalf("expected js, got: %s", rr.Body.String())
+	}
+}
+
+func TestServer_HandleWebFavicon(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/favicon.ico", nil)
+	server.Handle(rr, req)
+
+	test.Status(t, rr, http.StatusOK)
+	test.BytesEquals(t, []byte{0x00, 0x00, 0x01, 0x00}, rr.Body.Bytes()[:4]) // .ico magic bytes
+}
+
+func TestServer_HandleClipboardGetExists(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	file := filepath.Join(conf.ClipboardDir, "this-exists")
+	metafile := filepath.Join(conf.ClipboardDir, "this-exists:meta")
+	ioutil.WriteFile(file, []byte("hi there"), 0700)
+	ioutil.WriteFile(metafile, []byte("{}"), 0700)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/this-exists", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "hi there")
+	test.StrEquals(t, "this-exists", rr.Header().Get(HeaderFile))
+}
+
+func TestServer_HandleClipboardGetExistsWithAuthParam(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	server := newTestServer(t, conf)
+
+	file := filepath.Join(conf.ClipboardDir, "this-exists-again")
+	metafile := filepath.Join(conf.ClipboardDir, "this-exists-again:meta")
+	ioutil.WriteFile(file, []byte("hi there again"), 0700)
+	ioutil.WriteFile(metafile, []byte(`{"secret":"abc"}`), 0700)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/this-exists-again?a=abc", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "hi there again")
+}
+
+func TestServer_HandleClipboardGetWithSignedURL(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	server := newTestServer(t, conf)
+
+	file := filepath.Join(conf.ClipboardDir, "signed-file")
+	metafile := filepath.Join(conf.ClipboardDir, "signed-file:meta")
+	ioutil.WriteFile(file, []byte("hi there signed"), 0700)
+	ioutil.WriteFile(metafile, []byte(`{}`), 0700)
+
+	signed, _ := url.Parse(server.SignedURL("signed-file", time.Minute))
+	test.StrEquals(t, "/signed-file", signed.Path)
+
+	// Usable more than once
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", signed.RequestURI(), nil)
+		server.Handle(rr, req)
+		test.Response(t, rr, http.StatusOK, "hi there signed")
+	}
+
+	// Only valid for the signed file
+	ioutil.WriteFile(filepath.Join(conf.ClipboardDir, "other-file"), []byte("other"), 0700)
+	ioutil.WriteFile(filepath.Join(conf.ClipboardDir, "other-file:meta"), []byte(`{}`), 0700)
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/other-file?"+signed.RawQuery, nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+}
+
+func TestServer_HandleClipboardGetExistsWithAuthParamFailure(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	server := newTestServer(t, conf)
+
+	file := filepath.Join(conf.ClipboardDir, "this-exists-again")
+	metafile := filepath.Join(conf.ClipboardDir, "this-exists-again:meta")
+	ioutil.WriteFile(file, []byte("hi there again"), 0700)
+	ioutil.WriteFile(metafile, []byte(`{"secret":"abc"}`), 0700)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/this-exists-again?a=invalid", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+}
+
+func TestServer_HandleClipboardGetRange(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/resumable", strings.NewReader("0123456789abcdef"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/resumable", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "0123456789abcdef")
+	test.StrEquals(t, "bytes", rr.Header().Get("Accept-Ranges"))
+	test.StrEquals(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
+	etag := rr.Header().Get("ETag")
+	test.BoolEquals(t, true, etag != "")
+	test.BoolEquals(t, true, rr.Header().Get("Last-Modified") != "")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/resumable", nil)
+	req.Header.Set("Range", "bytes=10-")
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusPartialContent, "abcdef")
+	test.StrEquals(t, "bytes 10-15/16", rr.Header().Get("Content-Range"))
+	test.StrEquals(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/resumable", nil)
+	req.Header.Set("Range", "bytes=100-")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusRequestedRangeNotSatisfiable)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/resumable", nil)
+	req.Header.Set("If-None-Match", etag)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotModified)
+}
+
+func TestServer_HandleClipboardGetNotModified(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/polled?dl=2", strings.NewReader("unchanged"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("HEAD", "/polled", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	etag := rr.Header().Get("ETag")
+	test.BoolEquals(t, true, strings.HasPrefix(etag, `"`))
+
+	// Revalidating does not count as a download
+	for i := 0; i < 3; i++ {
+		rr = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/polled", nil)
+		req.Header.Set("If-None-Match", etag)
+		server.Handle(rr, req)
+		test.Response(t, rr, http.StatusNotModified, "")
+		test.StrEquals(t, etag, rr.Header().Get("ETag"))
+	}
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("HEAD", "/polled", nil)
+	req.Header.Set("If-None-Match", etag)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotModified)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("HEAD", "/polled", nil)
+	server.Handle(rr, req)
+	test.StrEquals(t, "2", rr.Header().Get(HeaderDownloadsRemaining))
+
+	// Changed content has a different ETag
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/polled", strings.NewReader("changed"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/polled", nil)
+	req.Header.Set("If-None-Match", etag)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "changed")
+	test.BoolEquals(t, true, rr.Header().Get("ETag") != etag)
+}
+
+func TestServer_HandleClipboardGetCacheHeaders(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	for _, path := range []string{"/long-lived?t=1h", "/burn-me?t=1h&b=1", "/limited?t=1h&dl=2"} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", path, strings.NewReader("some content"))
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusCreated)
+	}
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/long-lived", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "some content")
+	maxAge, err := strconv.Atoi(strings.TrimPrefix(rr.Header().Get("Cache-Control"), "max-age="))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.BoolEquals(t, true, maxAge > 3590 && maxAge <= 3600)
+	expires, err := http.ParseTime(rr.Header().Get("Expires"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, rr.Header().Get(HeaderExpires), fmt.Sprintf("%d", expires.Unix()))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("HEAD", "/long-lived", nil)
+	server.Handle(rr, req)
+	test.StrContains(t, rr.Header().Get("Cache-Control"), "max-age=")
+
+	// One-time content must not be cached
+	for _, id := range []string{"burn-me", "limited"} {
+		rr = httptest.NewRecorder()
+		req, _ = http.NewRequest("HEAD", "/"+id, nil)
+		server.Handle(rr, req)
+		test.StrEquals(t, "no-store", rr.Header().Get("Cache-Control"))
+		test.StrEquals(t, "", rr.Header().Get("Expires"))
+
+		rr = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/"+id, nil)
+		server.Handle(rr, req)
+		test.Response(t, rr, http.StatusOK, "some content")
+		test.StrEquals(t, "no-store", rr.Header().Get("Cache-Control"))
+	}
+}
+
+func TestServer_HandleClipboardGetCacheHeadersProtected(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/private?t=1h", strings.NewReader("for my eyes only"))
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:some password")))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/private", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:some password")))
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "for my eyes only")
+	test.BoolEquals(t, true, strings.HasPrefix(rr.Header().Get("Cache-Control"), "private, max-age="))
+}
+
+func TestServer_HandleClipboardGetCompressed(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.CompressFiles = true
+	server := newTestServer(t, conf)
+	content := strings.Repeat("this is a long text that compresses well\n", 50)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/compressed", strings.NewReader(content))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	// Without Accept-Encoding, the content is decompressed on the server
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/compressed", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, content)
+	test.StrEquals(t, "", rr.Header().Get("Content-Encoding"))
+	test.StrEquals(t, fmt.Sprintf("%d", len(content)), rr.Header().Get("Length"))
+
+	// With Accept-Encoding, the compressed bytes are sent as is
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/compressed", nil)
+	req.Header.Set("Accept-Encoding", "deflate, gzip;q=0.9")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "gzip", rr.Header().Get("Content-Encoding"))
+	test.StrEquals(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
+	test.BoolEquals(t, true, rr.Body.Len() < len(content))
+	gz, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, _ := ioutil.ReadAll(gz)
+	test.StrEquals(t, content, string(decompressed))
+
+	// gzip;q=0 means not acceptable
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/compressed", nil)
+	req.Header.Set("Accept-Encoding", "gzip;q=0")
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, content)
+}
+
+func TestServer_HandleCompressResponses(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+	content := strings.Repeat("this is a long text that compresses well\n", 50)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/text", strings.NewReader(content))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	get := func(path string, acceptEncoding string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		server.Handle(rr, req)
+		return rr
+	}
+
+	// gzip is preferred
+	rr = get("/text", "deflate, gzip")
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "gzip", rr.Header().Get("Content-Encoding"))
+	test.StrEquals(t, "Accept-Encoding", rr.Header().Get("Vary"))
+	test.StrEquals(t, "", rr.Header().Get("Content-Length"))
+	gz, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, _ := ioutil.ReadAll(gz)
+	test.StrEquals(t, content, string(decompressed))
+
+	// deflate, i.e. zlib
+	rr = get("/text", "deflate")
+	test.StrEquals(t, "deflate", rr.Header().Get("Content-Encoding"))
+	zr, err := zlib.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, _ = ioutil.ReadAll(zr)
+	test.StrEquals(t, content, string(decompressed))
+
+	// Compressed responses have a weak ETag, which still matches when revalidating
+	etag := rr.Header().Get("ETag")
+	test.BoolEquals(t, true, strings.HasPrefix(etag, `W/"`))
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/text", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", etag)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotModified)
+
+	// Static assets of the web UI
+	rr = get("/static/js/app.js", "gzip")
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "gzip", rr.Header().Get("Content-Encoding"))
+
+	// Not accepted by the client
+	rr = get("/text", "br")
+	test.Response(t, rr, http.StatusOK, content)
+	test.StrEquals(t, "", rr.Header().Get("Content-Encoding"))
+}
+
+func TestServer_HandleCompressResponsesSkipped(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+	content := strings.Repeat("this is a long text that compresses well\n", 50)
+	binary := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0x00, 0x01, 0x02}, 1000)...)
+	for id, body := range map[string]string{"text": content, "short": "short text", "binary": string(binary)} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/"+id, strings.NewReader(body))
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusCreated)
+	}
+
+	// Short texts and binary content are sent as is
+	for _, id := range []string{"short", "binary"} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/"+id, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusOK)
+		test.StrEquals(t, "", rr.Header().Get("Content-Encoding"))
+	}
+
+	// Range requests are sent as is
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/text", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-3")
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusPartialContent, "this")
+	test.StrEquals(t, "", rr.Header().Get("Content-Encoding"))
+
+	// Disabled in the config
+	conf.CompressResponses = false
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/text", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, content)
+	test.StrEquals(t, "", rr.Header().Get("Content-Encoding"))
+}
+
+func TestServer_HandleClipboardPutGetEncrypted(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.EncryptAtRest = true
+	conf.AtRestKey = bytes.Repeat([]byte{0x86}, 32)
+	conf.CompressFiles = true
+	server := newTestServer(t, conf)
+	content := strings.Repeat("this is a secret text that compresses well\n", 50)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/secret", strings.NewReader(content))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	raw, _ := ioutil.ReadFile(filepath.Join(conf.ClipboardDir, "secret"))
+	test.BoolEquals(t, false, strings.Contains(string(raw), "secret text"))
+	stat, _ := server.clipboard.Stat("secret")
+	test.Int64Equals(t, int64(len(content)), stat.Size)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/secret", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, content)
+	test.StrEquals(t, fmt.Sprintf("%d", len(content)), rr.Header().Get("Length"))
+
+	// The compressed bytes are decrypted, but not decompressed
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/secret", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "gzip", rr.Header().Get("Content-Encoding"))
+	gz, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, _ := ioutil.ReadAll(gz)
+	test.StrEquals(t, content, string(decompressed))
+}
+
+func TestServer_NewServerAtRestKeyMissing(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.EncryptAtRest = true
+	if _, err := New(conf); err != errAtRestKeyMissing {
+		t.Fatalf("expected errAtRestKeyMissing, got %v", err)
+	}
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	if _, err := New(conf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_HandleClipboardPutCompressedFileSizeLimit(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.CompressFiles = true
+	conf.FileSizeLimit = 100
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/too-large", strings.NewReader(strings.Repeat("a", 200)))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusRequestEntityTooLarge)
+}
+
+func TestServer_HandleClipboardPutFileSizeLimitWithoutContentLength(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileSizeLimit = 1024 * 1024
+	server := newTestServer(t, conf)
+
+	// The size of the body is not announced, so it can only be rejected while reading it
+	body := &readCounter{r: bytes.NewReader(make([]byte, 10*conf.FileSizeLimit))}
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/unannounced", body)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusRequestEntityTooLarge)
+	test.BoolEquals(t, true, int64(body.read) <= conf.FileSizeLimit+2)
+	clipboardtest.NotExist(t, conf, "unannounced")
+}
+
+func TestServer_HandleClipboardBurnAfterReading(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/burn-me?b=1", strings.NewReader("secret stuff"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	stat, _ := server.clipboard.Stat("burn-me")
+	test.StrEquals(t, config.FileModeBurn, stat.Mode)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/burn-me", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "secret stuff", rr.Body.String())
+	clipboardtest.NotExist(t, conf, "burn-me")
+	if _, err := os.Stat(filepath.Join(conf.ClipboardDir, "burn-me:meta")); !os.IsNotExist(err) {
+		t.Fatalf("expected meta file to be deleted, got %v", err)
+	}
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/burn-me", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+}
+
+func TestServer_HandleClipboardBurnAfterReadingViaHeaderNotOverwritable(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/burn-me", strings.NewReader("secret stuff"))
+	req.Header.Set("X-Burn", "1")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/burn-me", strings.NewReader("something else"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusMethodNotAllowed)
+
+	// HEAD and :meta do not burn the file
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("HEAD", "/burn-me", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	clipboardtest.Content(t, conf, "burn-me", "secret stuff")
+}
+
+func TestServer_HandleClipboardBurnAfterReadingWithStreamFails(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/burn-me?b=1&s=1", strings.NewReader("secret stuff"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/burn-me?b=1&r=1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+	clipboardtest.NotExist(t, conf, "burn-me")
+}
+
+func TestServer_HandleClipboardBurnAfterReadingExpires(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	file := filepath.Join(conf.ClipboardDir, "burn-me")
+	metafile := filepath.Join(conf.ClipboardDir, "burn-me:meta")
+	ioutil.WriteFile(file, []byte("never read"), 0700)
+	ioutil.WriteFile(metafile, []byte(fmt.Sprintf(`{"mode":"burn","expires":%d}`, time.Now().Add(-time.Minute).Unix())), 0700)
+
+	server.updateStatsAndExpire()
+	clipboardtest.NotExist(t, conf, "burn-me")
+}
+
+func TestServer_HandleClipboardDownloadLimit(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/limited?dl=2", strings.NewReader("for two"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	for i := 0; i < 2; i++ {
+		rr = httptest.NewRecorder()
+		req, _ = http.NewRequest("HEAD", "/limited", nil)
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusOK)
+		test.StrEquals(t, strconv.Itoa(2-i), rr.Header().Get("X-Downloads-Remaining"))
+
+		rr = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/limited", nil)
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusOK)
+		test.StrEquals(t, "for two", rr.Body.String())
+	}
+	clipboardtest.NotExist(t, conf, "limited")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/limited", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusGone)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("HEAD", "/limited", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusGone)
+
+	// Uploading a new file with the same name makes it available again
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/limited", strings.NewReader("again"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/limited", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "again", rr.Body.String())
+}
+
+func TestServer_HandleClipboardDownloadLimitViaHeaderCounted(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/limited", strings.NewReader("for three"))
+	req.Header.Set("X-Downloads", "3")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/limited", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/limited:meta", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	var meta FileMetadata
+	json.NewDecoder(rr.Body).Decode(&meta)
+	test.Int64Equals(t, 3, int64(meta.DownloadLimit))
+	test.Int64Equals(t, 1, int64(meta.Downloads))
+}
+
+func TestServer_HandleClipboardDownloadLimitInvalid(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	for _, path := range []string{"/limited?dl=0", "/limited?dl=abc", "/limited?dl=-1", "/limited?dl=1&s=1"} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", path, strings.NewReader("nope"))
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusBadRequest)
+	}
+	clipboardtest.NotExist(t, conf, "limited")
+}
+
+func TestServer_HandleClipboardPasswordProtected(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/protected?p=letmein", strings.NewReader("for your eyes only"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	metadata, _ := ioutil.ReadFile(filepath.Join(conf.ClipboardDir, "protected:meta"))
+	if strings.Contains(string(metadata), "letmein") {
+		t.Fatalf("expected password not to be stored, got %s", string(metadata))
+	}
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/protected", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+	test.StrEquals(t, `Basic realm="pcopy"`, rr.Header().Get("WWW-Authenticate"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/protected", nil)
+	req.SetBasicAuth("", "wrong")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/protected", nil)
+	req.SetBasicAuth("", "letmein")
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "for your eyes only")
+}
+
+func TestServer_HandleClipboardPasswordProtectedIgnoresServerKey(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/protected", strings.NewReader("for your eyes only"))
+	req.Header.Set("X-Password", "letmein")
+	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "PUT", "/protected", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/protected", nil)
+	hmac, _ = crypto.GenerateAuthHMAC(conf.Key.Bytes, "GET", "/protected", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+
+	stat, _ := server.clipboard.Stat("protected")
+	fileKey, _ := crypto.DecodeKey(stat.PasswordKey)
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/protected", nil)
+	hmac, _ = crypto.GenerateAuthHMAC(crypto.DeriveKey([]byte("letmein"), fileKey.Salt).Bytes, "GET", "/protected", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "for your eyes only")
+}
+
+func TestServer_HandleClipboardPutNormalize(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/windows?normalize=lf", strings.NewReader("line 1\r\nline 2\r\n"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "windows", "line 1\nline 2\n")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/windows:meta", nil)
+	server.Handle(rr, req)
+	var meta FileMetadata
+	json.NewDecoder(rr.Body).Decode(&meta)
+	test.StrEquals(t, "lf", meta.Normalized)
+	test.Int64Equals(t, 14, meta.Size)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/unix?normalize=crlf", strings.NewReader("line 1\nline 2\n"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "unix", "line 1\r\nline 2\r\n")
+
+	// Binary content is stored as is
+	binary := "\x00\x01\r\n\x02"
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/binary?normalize=lf", strings.NewReader(binary))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "binary", binary)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/binary:meta", nil)
+	server.Handle(rr, req)
+	meta = FileMetadata{}
+	json.NewDecoder(rr.Body).Decode(&meta)
+	test.StrEquals(t, "", meta.Normalized)
+}
+
+func TestServer_HandleClipboardPutNormalizeInvalid(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1?normalize=cr", strings.NewReader("text"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file1?normalize=lf&r=1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+	clipboardtest.NotExist(t, conf, "file1")
+}
+
+func TestServer_HandleClipboardPublic(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	server := newTestServer(t, conf)
+
+	request := func(method string, path string, body string, auth bool) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		if auth {
+			hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, method, strings.Split(path, "?")[0], time.Minute)
+			req.Header.Set("Authorization", hmac)
+		}
+		server.Handle(rr, req)
+		return rr
+	}
+
+	// Creating a public file requires auth
+	test.Status(t, request("PUT", "/shared?public=1", "for everyone", false), http.StatusUnauthorized)
+	test.Status(t, request("PUT", "/shared?public=1", "for everyone", true), http.StatusCreated)
+	test.Status(t, request("PUT", "/private", "for me only", true), http.StatusCreated)
+
+	// Reading it does not
+	test.Response(t, request("GET", "/shared", "", false), http.StatusOK, "for everyone")
+	test.Status(t, request("HEAD", "/shared", "", false), http.StatusOK)
+	test.Status(t, request("GET", "/private", "", false), http.StatusUnauthorized)
+
+	// Writing, deleting and listing still do
+	test.Status(t, request("PUT", "/shared", "overwritten", false), http.StatusUnauthorized)
+	test.Status(t, request("DELETE", "/shared", "", false), http.StatusUnauthorized)
+	test.Status(t, request("GET", "/list", "", false), http.StatusUnauthorized)
+	clipboardtest.Content(t, conf, "shared", "for everyone")
+}
+
+func TestServer_HandleClipboardPublicRequiresKey(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	conf.AuthParamMethods = []string{http.MethodGet, http.MethodPut}
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/shared", strings.NewReader("for me only"))
+	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "PUT", "/shared", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	stat, _ := server.clipboard.Stat("shared")
+
+	// The file secret is not enough to make a file public
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/shared?public=1&a="+stat.Secret, strings.NewReader("for everyone"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+	clipboardtest.Content(t, conf, "shared", "for me only")
+}
+
+func TestServer_HandleClipboardDeleteSuccess(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/delete-me", strings.NewReader("bye"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/delete-me", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "delete-me", rr.Header().Get("X-File"))
+	clipboardtest.NotExist(t, conf, "delete-me")
+	if _, err := os.Stat(filepath.Join(conf.ClipboardDir, "delete-me:meta")); !os.IsNotExist(err) {
+		t.Fatalf("expected meta file to be deleted, got %v", err)
+	}
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/delete-me", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+}
+
+func TestServer_HandleClipboardDeleteReadOnly(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/keep-me?m=ro", strings.NewReader("still here"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/keep-me", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusMethodNotAllowed)
+	clipboardtest.Content(t, conf, "keep-me", "still here")
+}
+
+func TestServer_HandleClipboardDeleteUnauthorized(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	server := newTestServer(t, conf)
+
+	file := filepath.Join(conf.ClipboardDir, "this-exists")
+	metafile := filepath.Join(conf.ClipboardDir, "this-exists:meta")
+	ioutil.WriteFile(file, []byte("hi there"), 0700)
+	ioutil.WriteFile(metafile, []byte(`{"mode":"rw","secret":"abc"}`), 0700)
+
+	// Neither a missing key, nor the file secret (share link) may delete the file
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/this-exists", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/this-exists?a=abc", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+	clipboardtest.Content(t, conf, "this-exists", "hi there")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/this-exists", nil)
+	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "DELETE", "/this-exists", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	clipboardtest.NotExist(t, conf, "this-exists")
+}
+
+func TestServer_HandleClipboardDeleteStreamUnblocksWriter(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	done := make(chan int)
+	go func() {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/stream?s=2", strings.NewReader("nobody will read this"))
+		server.Handle(rr, req)
+		done <- rr.Code
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/stream", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("writer still blocked after deleting stream")
+	}
+	clipboardtest.NotExist(t, conf, "stream")
+}
+
+func TestServer_HandleClipboardPutWithAuthParamNotAllowed(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	server := newTestServer(t, conf)
+
+	file := filepath.Join(conf.ClipboardDir, "this-exists-again")
+	metafile := filepath.Join(conf.ClipboardDir, "this-exists-again:meta")
+	ioutil.WriteFile(file, []byte("hi there again"), 0700)
+	ioutil.WriteFile(metafile, []byte(`{"mode":"rw","secret":"abc"}`), 0700)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/this-exists-again?a=abc", strings.NewReader("overwritten"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+	clipboardtest.Content(t, conf, "this-exists-again", "hi there again")
+}
+
+func TestServer_HandleClipboardPutWithAuthParamAllowed(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = &crypto.Key{Salt: []byte("some salt"), Bytes: []byte("16 bytes exactly")}
+	conf.AuthParamMethods = []string{"GET", "HEAD", "PUT"}
+	server := newTestServer(t, conf)
+
+	file := filepath.Join(conf.ClipboardDir, "this-exists-again")
+	metafile := filepath.Join(conf.ClipboardDir, "this-exists-again:meta")
+	ioutil.WriteFile(file, []byte("hi there again"), 0700)
+	ioutil.WriteFile(metafile, []byte(`{"mode":"rw","secret":"abc"}`), 0700)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/this-exists-again?a=abc", strings.NewReader("overwritten"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "this-exists-again", "overwritten")
+}
+
+func TestServer_HandleClipboardGetVerifyOnReadFail(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.VerifyOnRead = config.VerifyOnReadFail
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/corrupt", strings.NewReader("hi there"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/corrupt", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "hi there")
+
+	ioutil.WriteFile(filepath.Join(conf.ClipboardDir, "corrupt"), []byte("hi thar"), 0600)
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/corrupt", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusInternalServerError)
+	clipboardtest.Content(t, conf, "corrupt", "hi thar")
+}
+
+func TestServer_HandleClipboardGetVerifyOnReadDelete(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.VerifyOnRead = config.VerifyOnReadDelete
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/corrupt", strings.NewReader("hi there"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	ioutil.WriteFile(filepath.Join(conf.ClipboardDir, "corrupt"), []byte("hi thar"), 0600)
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/corrupt", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusGone)
+	clipboardtest.NotExist(t, conf, "corrupt")
+}
+
+func TestServer_HandleClipboardGetHTMLFromBrowser(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	file := filepath.Join(conf.ClipboardDir, "evil")
+	metafile := filepath.Join(conf.ClipboardDir, "evil:meta")
+	ioutil.WriteFile(file, []byte("<html><script>alert('hi')</script></html>"), 0700)
+	ioutil.WriteFile(metafile, []byte("{}"), 0700)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/evil", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64)")
+	req.Header.Set("Accept", "text/html,*/*")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
+	test.StrEquals(t, "nosniff", rr.Header().Get("X-Content-Type-Options"))
+	test.StrEquals(t, "", rr.Header().Get("Content-Disposition"))
+}
+
+func TestServer_HandleClipboardGetHTMLFromBrowserForceDownload(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ForceDownloadForBrowsers = true
+	server := newTestServer(t, conf)
+
+	file := filepath.Join(conf.ClipboardDir, "evil")
+	metafile := filepath.Join(conf.ClipboardDir, "evil:meta")
+	ioutil.WriteFile(file, []byte("<html><script>alert('hi')</script></html>"), 0700)
+	ioutil.WriteFile(metafile, []byte("{}"), 0700)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/evil", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64)")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrContains(t, rr.Header().Get("Content-Disposition"), "attachment")
+}
+
+func TestServer_HandleClipboardGetWithOriginalFilename(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1", strings.NewReader("hi there"))
+	req.Header.Set("X-Filename", "../some/dir/my \"notes\".txt")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file1", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "hi there")
+	test.StrEquals(t, `attachment; filename="my notes.txt"`, rr.Header().Get("Content-Disposition"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file1?f=other.txt", nil)
+	server.Handle(rr, req)
+	test.StrEquals(t, "", rr.Header().Get("Content-Disposition"))
+
+	// Without original filename, only ?d=1 forces a download
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file2", strings.NewReader("hi there"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file2", nil)
+	server.Handle(rr, req)
+	test.StrEquals(t, "", rr.Header().Get("Content-Disposition"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file2?d=1", nil)
+	server.Handle(rr, req)
+	test.StrEquals(t, "attachment; filename=file2.txt", rr.Header().Get("Content-Disposition"))
+}
+
+func TestServer_HandleClipboardGetWithUserMeta(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.AllowedOrigins = []string{"*"}
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1", strings.NewReader("hi there"))
+	req.Header.Set("X-Meta-Author", "phil")
+	req.Header.Add("x-meta-tags", "a")
+	req.Header.Add("X-Meta-Tags", "b")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file1", nil)
+	req.Header.Set("Origin", "https://example.com")
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "hi there")
+	test.StrEquals(t, "phil", rr.Header().Get("X-Meta-Author"))
+	test.StrEquals(t, "a, b", rr.Header().Get("X-Meta-Tags"))
+	test.StrContains(t, rr.Header().Get("Access-Control-Expose-Headers"), "X-Meta-Author, X-Meta-Tags")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("HEAD", "/file1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "phil", rr.Header().Get("X-Meta-Author"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file1:meta", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	var meta FileMetadata
+	json.NewDecoder(rr.Body).Decode(&meta)
+	test.StrEquals(t, "phil", meta.Meta["Author"])
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("OPTIONS", "/file1", nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("Access-Control-Request-Headers", "content-type, x-meta-author")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNoContent)
+	test.StrContains(t, rr.Header().Get("Access-Control-Allow-Headers"), "X-Meta-Author")
+}
+
+func TestServer_HandleClipboardPutUserMetaTooLarge(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1", strings.NewReader("hi there"))
+	for i := 0; i <= userMetaMaxEntries; i++ {
+		req.Header.Set(fmt.Sprintf("X-Meta-Key%d", i), "value")
+	}
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+	test.StrContains(t, rr.Body.String(), "too many metadata headers")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file1", strings.NewReader("hi there"))
+	req.Header.Set("X-Meta-Big", strings.Repeat("x", userMetaMaxSize))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+	test.StrContains(t, rr.Body.String(), "metadata headers too large")
+	clipboardtest.NotExist(t, conf, "file1")
+}
+
+func TestServer_HandleClipboardPutWithChecksum(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+	checksum := "9b96a1fe1d548cbbc960cc6a0286668fd74a763667b06366fb2324269fcabaa4" // SHA-256 of "hi there"
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1", strings.NewReader("hi there"))
+	req.Header.Set("X-SHA256", strings.ToUpper(checksum))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file1", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "hi there")
+	test.StrEquals(t, checksum, rr.Header().Get("X-SHA256"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("HEAD", "/file1", nil)
+	server.Handle(rr, req)
+	test.StrEquals(t, checksum, rr.Header().Get("X-SHA256"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file2", strings.NewReader("hi there!"))
+	req.Header.Set("X-SHA256", checksum)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+	test.StrContains(t, rr.Body.String(), "checksum mismatch")
+	clipboardtest.NotExist(t, conf, "file2")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file2", strings.NewReader("hi there"))
+	req.Header.Set("X-SHA256", "not a checksum")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+	test.StrContains(t, rr.Body.String(), "invalid checksum")
+}
+
+func TestServer_HandleClipboardPutStreamWithChecksumMismatch(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+	httpServer := httptest.NewServer(http.HandlerFunc(server.Handle))
+	defer httpServer.Close()
+
+	go func() {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/file1?s=2", strings.NewReader("hi there!"))
+		req.Header.Set("X-SHA256", "9b96a1fe1d548cbbc960cc6a0286668fd74a763667b06366fb2324269fcabaa4")
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusBadRequest)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// The content has passed through the pipe by the time the mismatch is detected, so the reader must not
+	// mistake it for valid content
+	resp, err := http.Get(httpServer.URL + "/file1")
+	if err == nil {
+		defer resp.Body.Close()
+		if _, err := ioutil.ReadAll(resp.Body); err == nil {
+			t.Fatalf("expected error reading aborted stream, got none")
+		}
+	}
+	clipboardtest.NotExist(t, conf, "file1")
+}
+
+func TestServer_HandleClipboardPutLowDiskSpace(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.MinFreeDiskBytes = 1 << 62 // More than any disk has
+	server := newTestServer(t, conf)
+	server.ExpireNow()
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1", strings.NewReader("hi there"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusInsufficientStorage)
+	test.StrContains(t, rr.Body.String(), "not enough disk space")
+	clipboardtest.NotExist(t, conf, "file1")
+
+	conf.MinFreeDiskBytes = 1
+	server.ExpireNow()
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file1", strings.NewReader("hi there"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+}
+
+func TestServer_HandleClipboardPutConditional(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1", strings.NewReader("version 1"))
+	req.Header.Set("If-Match", "*")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusPreconditionFailed)
+	clipboardtest.NotExist(t, conf, "file1")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file1", strings.NewReader("version 1"))
+	req.Header.Set("If-None-Match", "*")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	etag1 := rr.Header().Get("ETag")
+	test.BoolEquals(t, true, etag1 != "")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file1", strings.NewReader("version 1 again"))
+	req.Header.Set("If-None-Match", "*")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusPreconditionFailed)
+	clipboardtest.Content(t, conf, "file1", "version 1")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file1", strings.NewReader("version 2"))
+	req.Header.Set("If-Match", etag1)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	etag2 := rr.Header().Get("ETag")
+	test.BoolEquals(t, true, etag2 != etag1)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file1", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "version 2")
+	test.StrEquals(t, etag2, rr.Header().Get("ETag"))
+
+	// A concurrent writer that read version 1 loses
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file1", strings.NewReader("version 2 from someone else"))
+	req.Header.Set("If-Match", etag1)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusPreconditionFailed)
+	clipboardtest.Content(t, conf, "file1", "version 2")
+}
+
+func TestServer_HandleClipboardPutConditionalReadOnly(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1?m=ro", strings.NewReader("read-only"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file1", strings.NewReader("overwrite"))
+	req.Header.Set("If-None-Match", "*")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusMethodNotAllowed)
+}
+
+func TestServer_HandleClipboardGetHTMLWithExplicitAccept(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ForceDownloadForBrowsers = true
+	server := newTestServer(t, conf)
+
+	file := filepath.Join(conf.ClipboardDir, "page")
+	metafile := filepath.Join(conf.ClipboardDir, "page:meta")
+	ioutil.WriteFile(file, []byte("<html><body>hi</body></html>"), 0700)
+	ioutil.WriteFile(metafile, []byte("{}"), 0700)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/page", nil)
+	req.Header.Set("User-Agent", "curl/7.68.0")
+	req.Header.Set("Accept", "application/xhtml+xml")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+	test.StrEquals(t, "", rr.Header().Get("Content-Disposition"))
+}
+
+func TestServer_HandleClipboardGetStoredContentType(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	png := []byte{0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00}
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/image", bytes.NewReader(png))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded") // Sent by curl -d, ignored
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	stat, _ := server.clipboard.Stat("image")
+	test.StrEquals(t, "image/png", stat.Type)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("HEAD", "/image", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "image/png", rr.Header().Get("Content-Type"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/image", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "image/png", rr.Header().Get("Content-Type"))
+}
+
+func TestServer_HandleClipboardGetExplicitContentType(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/data", strings.NewReader(`{"hi":"there"}`))
+	req.Header.Set("Content-Type", "application/json")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/data", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "application/json", rr.Header().Get("Content-Type"))
+
+	// Active content types are never rendered in the browser, even if explicitly set
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/evil", strings.NewReader("<script>alert('hi')</script>"))
+	req.Header.Set("Content-Type", "text/html")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/evil", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64)")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
+}
+
+func TestServer_HandleClipboardGetDoesntExist(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/this-does-not-exist", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+}
+
+func TestServer_HandleClipboardPut(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	content := "this is a new thing"
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/new-thing", strings.NewReader(content))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "new-thing", content)
+}
+
+func TestServer_HandleClipboardPutRandom(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/", strings.NewReader("this is a thing"))
+	server.Handle(rr, req)
+
+	test.Status(t, rr, http.StatusCreated)
+
+	test.Int64Equals(t, 10, int64(len(rr.Header().Get("X-File"))))
+	test.StrEquals(t, fmt.Sprintf("%d", 3600*24*7), rr.Header().Get("X-TTL"))
+	clipboardtest.Content(t, conf, rr.Header().Get("X-File"), "this is a thing")
+}
+
+func TestServer_HandleClipboardPutRandomIdempotencyKey(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.SizePerVisitorLimit = 10
+	server := newTestServer(t, conf)
+
+	put := func(path string, key string, remoteAddr string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", path, strings.NewReader("123456"))
+		req.Header.Set("Idempotency-Key", key)
+		req.RemoteAddr = remoteAddr
+		server.Handle(rr, req)
+		return rr
+	}
+
+	rr := put("/", "abc", "1.2.3.4:1234")
+	test.Status(t, rr, http.StatusCreated)
+	id := rr.Header().Get("X-File")
+	test.StrEquals(t, "", rr.Header().Get("Idempotent-Replayed"))
+
+	// Retrying returns the same file, and does not count towards the visitor's quota again
+	rr = put("/", "abc", "1.2.3.4:5678")
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, id, rr.Header().Get("X-File"))
+	test.StrEquals(t, "true", rr.Header().Get("Idempotent-Replayed"))
+	files, _ := server.clipboard.List()
+	test.Int64Equals(t, 1, int64(len(files)))
+
+	// Keys are scoped by visitor, and cannot be reused for another path
+	rr = put("/", "abc", "9.8.7.6:1234")
+	test.Status(t, rr, http.StatusCreated)
+	test.BoolEquals(t, true, id != rr.Header().Get("X-File"))
+	rr = put("/other", "abc", "1.2.3.4:1234")
+	test.Status(t, rr, http.StatusUnprocessableEntity)
+
+	// Failed requests are not recorded
+	rr = put("/", "def", "1.2.3.4:1234")
+	test.Status(t, rr, http.StatusRequestEntityTooLarge)
+	server.clipboard.DeleteFile(id)
+	rr = put("/", "def", "1.2.3.4:1234")
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "", rr.Header().Get("Idempotent-Replayed"))
+}
+
+func TestServer_HandleClipboardPutIdempotencyKeyExpired(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	put := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/", strings.NewReader("some content"))
+		req.Header.Set("Idempotency-Key", "abc")
+		server.Handle(rr, req)
+		return rr
+	}
+
+	rr := put()
+	test.Status(t, rr, http.StatusCreated)
+	id := rr.Header().Get("X-File")
+
+	for _, record := range server.idempotency {
+		record.created = time.Now().Add(-time.Hour)
+	}
+	server.updateStatsAndExpire()
+
+	rr = put()
+	test.Status(t, rr, http.StatusCreated)
+	test.BoolEquals(t, true, id != rr.Header().Get("X-File"))
+	test.StrEquals(t, "", rr.Header().Get("Idempotent-Replayed"))
+}
+
+func TestServer_HandleClipboardPutRandomWithIDMaxLength(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.IDMaxLength = 5
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/", strings.NewReader("this is a thing"))
+	server.Handle(rr, req)
+
+	test.Status(t, rr, http.StatusCreated)
+	test.Int64Equals(t, 5, int64(len(rr.Header().Get("X-File"))))
+	clipboardtest.Content(t, conf, rr.Header().Get("X-File"), "this is a thing")
+}
+
+func TestServer_HandleClipboardPutRandomWithIDLengthAndStyle(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/?idlen=32", strings.NewReader("long id"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.Int64Equals(t, 32, int64(len(rr.Header().Get("X-File"))))
+	clipboardtest.Content(t, conf, rr.Header().Get("X-File"), "long id")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/random?idstyle=words", strings.NewReader("word id"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	if !regexp.MustCompile(`^[a-z]+-[a-z]+-[a-z]+$`).MatchString(rr.Header().Get("X-File")) {
+		t.Fatalf("expected word-based ID, got %s", rr.Header().Get("X-File"))
+	}
+	clipboardtest.Content(t, conf, rr.Header().Get("X-File"), "word id")
+
+	for _, query := range []string{"idlen=1", "idlen=101", "idlen=abc", "idstyle=emoji", "idstyle=words&idlen=20"} {
+		rr = httptest.NewRecorder()
+		req, _ = http.NewRequest("PUT", "/?"+query, strings.NewReader("invalid"))
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusBadRequest)
+	}
+}
+
+func TestServer_HandleClipboardPutRandomDoesNotReplaceExistingFiles(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.PutRateBurst = 1000
+	server := newTestServer(t, conf)
+
+	// There are only 62*62 IDs of length 2, so after a while, random IDs collide with existing files
+	ids := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/?idlen=2", strings.NewReader(fmt.Sprintf("file %d", i)))
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusCreated)
+		id := rr.Header().Get("X-File")
+		if ids[id] {
+			t.Fatalf("random ID %s was generated twice", id)
+		}
+		ids[id] = true
+	}
+}
+
+func TestServer_HandleClipboardPutInvalidID(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.IDMaxLength = 8
+	conf.IDPattern = "[a-z0-9]+"
+	server := newTestServer(t, conf)
+
+	for _, path := range []string{"/UPPER", "/too-long-id", "/a:meta", "/a/b", "/../x", "/a%00b"} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", path, strings.NewReader("this is a thing"))
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusBadRequest)
+	}
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/lower1", strings.NewReader("this is a thing"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "lower1", "this is a thing")
+	clipboardtest.NotExist(t, conf, "UPPER")
+}
+
+func TestServer_HandleClipboardPutCheck(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ClipboardCountLimit = 2
+	conf.FileSizeLimit = 10
+	conf.IDPattern = "[a-z0-9]+"
+	conf.FileModesAllowed = []string{config.FileModeReadWrite}
+	server := newTestServer(t, conf)
+
+	check := func(path string, size string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", path, nil)
+		if size != "" {
+			req.Header.Set(HeaderSize, size)
+		}
+		server.Handle(rr, req)
+		return rr
+	}
+
+	// Valid upload, nothing is stored
+	rr := check("/abc?check=1&t=2h", "10")
+	test.Response(t, rr, http.StatusOK, "")
+	test.StrEquals(t, "abc", rr.Header().Get(HeaderFile))
+	test.StrEquals(t, "7200", rr.Header().Get(HeaderTTL))
+	test.StrEquals(t, "", rr.Header().Get(HeaderURL))
+	clipboardtest.NotExist(t, conf, "abc")
+
+	// Checks do not take a slot of the clipboard's file count limit
+	for _, id := range []string{"new1", "new2", "new3"} {
+		test.Status(t, check("/"+id+"?check=1", ""), http.StatusOK)
+	}
+
+	// Validation errors
+	test.Status(t, check("/UPPER?check=1", ""), http.StatusBadRequest)
+	test.Status(t, check("/abc?check=1&m=ro", ""), http.StatusBadRequest)
+	test.Status(t, check("/abc?check=1", "11"), http.StatusRequestEntityTooLarge)
+	test.Status(t, check("/abc?check=1&touch=1", ""), http.StatusBadRequest)
+	test.Status(t, check("/abc?check=1&append=1", ""), http.StatusBadRequest)
+
+	// Count limit reached
+	for _, id := range []string{"one", "two"} {
+		rr = httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/"+id, strings.NewReader("content"))
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusCreated)
+	}
+	test.Status(t, check("/three?check=1", ""), http.StatusTooManyRequests)
+	test.Status(t, check("/two?check=1", ""), http.StatusOK) // Overwriting is fine
+}
+
+func TestServer_HandleClipboardPutUntilLimitReached(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.PutRateBurst = 2
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/", strings.NewReader("this is a thing"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/", strings.NewReader("this is a another thing"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
 
 	rr = httptest.NewRecorder()
 	req, _ = http.NewRequest("PUT", "/", strings.NewReader("this is a yet another thing"))
 	server.Handle(rr, req)
 	test.Status(t, rr, http.StatusTooManyRequests)
+	test.StrEquals(t, "60", rr.Header().Get("Retry-After"))
+}
+
+func TestServer_HandleClipboardPutRateLimitPerMinute(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.PutRateLimitPerMinute = 6
+	conf.PutRateBurst = 1
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/", strings.NewReader("this is a thing"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/", strings.NewReader("this is a another thing"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusTooManyRequests)
+	test.StrEquals(t, "10", rr.Header().Get("Retry-After"))
+}
+
+func TestServer_HandleClipboardPutRateLimitIdempotencyKeyReplay(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.PutRateLimitPerMinute = 6
+	conf.PutRateBurst = 2
+	server := newTestServer(t, conf)
+
+	put := func(key string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/", strings.NewReader("this is a thing"))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		server.Handle(rr, req)
+		return rr
+	}
+
+	// Replays do not use up the upload rate limit
+	test.Status(t, put("abc"), http.StatusCreated)
+	for i := 0; i < 3; i++ {
+		rr := put("abc")
+		test.Status(t, rr, http.StatusCreated)
+		test.StrEquals(t, "true", rr.Header().Get("Idempotent-Replayed"))
+	}
+	test.Status(t, put(""), http.StatusCreated)
+	test.Status(t, put(""), http.StatusTooManyRequests)
+}
+
+func TestServer_HandleClipboardPutRateLimitDisabled(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.PutRateLimitPerMinute = 0
+	conf.PutRateBurst = 1
+	server := newTestServer(t, conf)
+
+	for i := 0; i < 5; i++ {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/", strings.NewReader("this is a thing"))
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusCreated)
+	}
+}
+
+func TestServer_HandleClipboardPutRateLimitBehindTrustedProxy(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.PutRateBurst = 1
+	conf.TrustedProxies = []string{"127.0.0.1", "10.0.0.0/8"}
+	server := newTestServer(t, conf)
+
+	// Different visitors behind the same proxy have separate limits; trusted proxies in the chain are skipped
+	for _, forwardedFor := range []string{"6.6.6.6, 1.2.3.4", "1.2.3.5, 10.1.1.1"} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/", strings.NewReader("this is a thing"))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusCreated)
+	}
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/", strings.NewReader("this is a thing"))
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusTooManyRequests)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/stats", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	server.Handle(rr, req)
+	var stats Stats
+	json.NewDecoder(rr.Body).Decode(&stats)
+	addrs := make([]string, 0)
+	for _, v := range stats.Visitors {
+		addrs = append(addrs, v.Addr)
+	}
+	sort.Strings(addrs)
+	test.StrEquals(t, "1.2.3.4 1.2.3.5 127.0.0.1", strings.Join(addrs, " "))
+}
+
+func TestServer_HandleClipboardPutRateLimitIgnoresForwardedForFromUntrusted(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.PutRateBurst = 1
+	server := newTestServer(t, conf)
+
+	for i, status := range []int{http.StatusCreated, http.StatusTooManyRequests} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/", strings.NewReader("this is a thing"))
+		req.RemoteAddr = "5.5.5.5:1234"
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("1.2.3.%d", i))
+		server.Handle(rr, req)
+		test.Status(t, rr, status)
+	}
+}
+
+func TestServer_HandleWebRootGetUntilLimitReached(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.LimitGETBurst = 10
+	conf.LimitGET = rate.Every(100 * time.Millisecond)
+	server := newTestServer(t, conf)
+
+	for i := 0; i < 10; i++ {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.TLS = &tls.ConnectionState{} // Pretend that this is TLS, so we don't redirect
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusOK)
+	}
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{} // Pretend that this is TLS, so we don't redirect
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusTooManyRequests)
+
+	time.Sleep(200 * time.Millisecond)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{} // Pretend that this is TLS, so we don't redirect
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+}
+
+func TestServer_handleClipboardClipboardPutInvalidId(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/../invalid-id", strings.NewReader("hi"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+	clipboardtest.NotExist(t, conf, "/../invalid-id")
+}
+
+func TestServer_HandleClipboardPutGetSuccess(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/you-cant-always?t=4d", strings.NewReader("get what you want"))
+	server.Handle(rr, req)
+
+	ttl, _ := strconv.Atoi(rr.Header().Get("X-TTL"))
+	expires, _ := strconv.Atoi(rr.Header().Get("X-Expires"))
+
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "you-cant-always", rr.Header().Get("X-File"))
+	test.StrEquals(t, "https://localhost:12345/you-cant-always", rr.Header().Get("X-URL"))
+	test.StrContains(t, rr.Header().Get("X-Curl"), "https://localhost:12345/you-cant-always")
+	test.StrContains(t, rr.Header().Get("X-Curl"), "--pinnedpubkey")
+	test.Int64Equals(t, int64(time.Hour*24*4), int64(time.Second*time.Duration(ttl)))
+	test.BoolEquals(t, true, time.Until(time.Unix(int64(expires), 0)) <= 24*4*time.Hour)
+	test.StrContains(t, rr.Body.String(), "https://localhost:12345/you-cant-always")
+	test.StrContains(t, rr.Body.String(), "Direct link (valid for 4d")
+	test.StrContains(t, rr.Body.String(), "--pinnedpubkey")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/you-cant-always", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "get what you want")
+}
+
+func TestServer_HandleClipboardPutWithJsonOutputSuccess(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/you-cant-always?f=json", strings.NewReader("get what you want"))
+	req.Header.Set("X-TTL", "2m")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	var info httpResponseFileInfo
+	json.NewDecoder(rr.Body).Decode(&info)
+	test.StrEquals(t, "you-cant-always", info.File)
+	test.StrEquals(t, "https://localhost:12345/you-cant-always", info.URL)
+	test.StrContains(t, info.Curl, "https://localhost:12345/you-cant-always")
+	test.StrContains(t, info.Curl, "--pinnedpubkey")
+	test.Int64Equals(t, int64(time.Minute*2), int64(time.Second*time.Duration(info.TTL)))
+	test.BoolEquals(t, true, time.Until(time.Unix(info.Expires, 0)) <= 2*time.Minute)
+}
+
+func TestServer_HandleClipboardPutTextWithTooLargeTTL(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileExpireAfterDefault = time.Minute
+	conf.FileExpireAfterNonTextMax = time.Hour
+	conf.FileExpireAfterTextMax = 2 * time.Hour
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/too-large-ttl?t=10d", nil) // empty file is "text"
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	ttl, _ := strconv.Atoi(rr.Header().Get("X-TTL"))
+	test.DurationEquals(t, 2*time.Hour, time.Second*time.Duration(ttl))
+}
+
+func TestServer_HandleClipboardPutLongTextWithTooLargeTTL(t *testing.T) {
+	// If the text is longer than 512 KB, it is treated like non-text
+
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileExpireAfterDefault = time.Minute
+	conf.FileExpireAfterNonTextMax = time.Hour
+	conf.FileExpireAfterTextMax = 2 * time.Hour
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/too-large-ttl?t=10d", strings.NewReader(strings.Repeat("12345", 120000))) // > 512 KB
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	ttl, _ := strconv.Atoi(rr.Header().Get("X-TTL"))
+	test.DurationEquals(t, time.Hour, time.Second*time.Duration(ttl))
+}
+
+func TestServer_HandleClipboardPutNonTextWithTooLargeTTL(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileExpireAfterDefault = time.Minute
+	conf.FileExpireAfterNonTextMax = time.Hour
+	conf.FileExpireAfterTextMax = 2 * time.Hour
+	server := newTestServer(t, conf)
+
+	body := make([]byte, 100)
+	rand.Read(body)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/too-large-ttl?t=10d", bytes.NewReader(body))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	ttl, _ := strconv.Atoi(rr.Header().Get("X-TTL"))
+	test.DurationEquals(t, time.Hour, time.Second*time.Duration(ttl))
+}
+
+func TestServer_HandleClipboardPutTTLNever(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileExpireAfterDefault = time.Minute
+	conf.FileExpireAfterNonTextMax = time.Hour
+	conf.FileExpireAfterTextMax = time.Hour
+	server := newTestServer(t, conf)
+
+	// Not allowed: treated like an infinitely long TTL
+	for _, ttl := range []string{"never", "0"} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/forever?t="+ttl, strings.NewReader("some text"))
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusCreated)
+		test.StrEquals(t, "3600", rr.Header().Get("X-TTL"))
+		test.StrEquals(t, "true", rr.Header().Get("X-TTL-Clamped"))
+	}
+
+	// Negative TTLs are rejected, instead of creating a file that never expires
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/forever?t=-1h", strings.NewReader("some text"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+
+	// Allowed
+	conf.AllowNeverExpire = true
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/forever", strings.NewReader("some text"))
+	req.Header.Set("X-TTL", "never")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "0", rr.Header().Get("X-TTL"))
+	test.StrEquals(t, "0", rr.Header().Get("X-Expires"))
+	test.StrEquals(t, "", rr.Header().Get("X-TTL-Clamped"))
+
+	stat, _ := server.clipboard.Stat("forever")
+	test.Int64Equals(t, 0, stat.Expires)
+	server.updateStatsAndExpire()
+	clipboardtest.Content(t, conf, "forever", "some text")
+}
+
+func TestServer_HandleClipboardPutTTLNeverKeyLimit(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	conf.AllowNeverExpire = true
+	conf.KeyLimits = map[string]*config.KeyLimit{crypto.KeyID(conf.Key): {MaxTTL: time.Hour}}
+	server := newTestServer(t, conf)
+
+	// The max. TTL of a key applies even if never-expiring files are allowed
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/forever?t=never", strings.NewReader("some text"))
+	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "PUT", "/forever", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "3600", rr.Header().Get("X-TTL"))
+	test.StrEquals(t, "true", rr.Header().Get("X-TTL-Clamped"))
+}
+
+func TestServer_HandleClipboardPutWithExpires(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileExpireAfterDefault = time.Minute
+	conf.FileExpireAfterNonTextMax = time.Hour
+	conf.FileExpireAfterTextMax = 2 * time.Hour
+	server := newTestServer(t, conf)
+
+	// Unix timestamp
+	expires := time.Now().Add(90 * time.Minute).Unix()
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("/expires-at?expires=%d", expires), strings.NewReader("some text"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	actual, _ := strconv.ParseInt(rr.Header().Get("X-Expires"), 10, 64)
+	test.BoolEquals(t, true, actual >= expires-1 && actual <= expires)
+
+	// RFC3339 via header, clamped to the max. value
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/expires-at", strings.NewReader("some text"))
+	req.Header.Set("X-Expires", time.Now().Add(10*24*time.Hour).Format(time.RFC3339))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	ttl, _ := strconv.Atoi(rr.Header().Get("X-TTL"))
+	test.DurationEquals(t, 2*time.Hour, time.Second*time.Duration(ttl))
+	test.StrEquals(t, "true", rr.Header().Get("X-TTL-Clamped"))
+
+	// ?t= takes precedence
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("/expires-at?t=10m&expires=%d", expires), strings.NewReader("some text"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	ttl, _ = strconv.Atoi(rr.Header().Get("X-TTL"))
+	test.DurationEquals(t, 10*time.Minute, time.Second*time.Duration(ttl))
+	test.StrEquals(t, "", rr.Header().Get("X-TTL-Clamped"))
+}
+
+func TestServer_HandleClipboardPutTTLByMode(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileExpireAfterDefault = 2 * time.Hour
+	conf.FileExpireAfterByMode = map[string]time.Duration{config.FileModeReadOnly: 7 * 24 * time.Hour, config.FileModeReadWrite: time.Hour}
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/ro-file?m=ro", strings.NewReader("read-only"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "604800", rr.Header().Get("X-TTL"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/rw-file?m=rw", strings.NewReader("read-write"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "3600", rr.Header().Get("X-TTL"))
+
+	// Clamped to the mode's max. TTL
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/rw-file?m=rw&t=1d", strings.NewReader("read-write"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "3600", rr.Header().Get("X-TTL"))
+	test.StrEquals(t, "true", rr.Header().Get("X-TTL-Clamped"))
+
+	// Modes without an entry fall back to FileExpireAfter
+	conf.FileExpireAfterByMode = map[string]time.Duration{config.FileModeReadOnly: time.Minute}
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/other-file?m=rw", strings.NewReader("read-write"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "7200", rr.Header().Get("X-TTL"))
+}
+
+func TestServer_HandleClipboardPutTTLClamped(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileExpireAfterTextMax = time.Hour
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/clamped?t=10d&f=json", strings.NewReader("some text"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "3600", rr.Header().Get("X-TTL"))
+	test.StrEquals(t, "true", rr.Header().Get("X-TTL-Clamped"))
+	var info map[string]interface{}
+	json.NewDecoder(rr.Body).Decode(&info)
+	test.BoolEquals(t, true, info["ttlClamped"].(bool))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/clamped?t=10d&f=text", strings.NewReader("some text"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.StrContains(t, rr.Body.String(), "# Note: The requested TTL exceeds the server's max. TTL. The link expires after 1h.")
+
+	// Not clamped: no header, no JSON field and no note
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/clamped?t=30m&f=json", strings.NewReader("some text"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "", rr.Header().Get("X-TTL-Clamped"))
+	test.BoolEquals(t, false, strings.Contains(rr.Body.String(), "ttlClamped"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/clamped?t=30m&f=text", strings.NewReader("some text"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.BoolEquals(t, false, strings.Contains(rr.Body.String(), "# Note"))
+}
+
+func TestServer_HandleClipboardPutWithInvalidExpires(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/expires-at?expires=2020-01-01T00:00:00Z", strings.NewReader("some text"))
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusBadRequest, "Bad Request (expiry time is in the past)\n")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/expires-at?expires=tomorrow", strings.NewReader("some text"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+	clipboardtest.NotExist(t, conf, "expires-at")
+}
+
+func TestServer_HandleClipboardTextPutWithoutTTL(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileExpireAfterDefault = time.Minute
+	conf.FileExpireAfterNonTextMax = time.Hour
+	conf.FileExpireAfterTextMax = 2 * time.Hour
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/no-ttl", nil) // empty body is "text"
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	ttl, _ := strconv.Atoi(rr.Header().Get("X-TTL"))
+	test.DurationEquals(t, time.Minute, time.Second*time.Duration(ttl))
+}
+
+func TestServer_HandleClipboardPutLargeFailed(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileSizeLimit = 10 // bytes
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/too-large", strings.NewReader("more than 10 bytes"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusRequestEntityTooLarge)
+	clipboardtest.NotExist(t, conf, "too-large")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/too-large", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+}
+
+func TestServer_HandleErrorAsJSON(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileSizeLimit = 10 // bytes
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/too-large?f=json", strings.NewReader("more than 10 bytes"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusRequestEntityTooLarge)
+	test.StrEquals(t, "application/json", rr.Header().Get("Content-Type"))
+	var resp ErrorResponse
+	json.NewDecoder(rr.Body).Decode(&resp)
+	test.Int64Equals(t, http.StatusRequestEntityTooLarge, int64(resp.Code))
+	test.StrContains(t, resp.Error, http.StatusText(http.StatusRequestEntityTooLarge))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/does-not-exist", nil)
+	req.Header.Set("Accept", "application/json")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+	resp = ErrorResponse{}
+	json.NewDecoder(rr.Body).Decode(&resp)
+	test.Int64Equals(t, http.StatusNotFound, int64(resp.Code))
+	test.StrEquals(t, http.StatusText(http.StatusNotFound), resp.Error)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/does-not-exist?f=json", nil) // "f" is the filename for GETs
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+	test.StrEquals(t, http.StatusText(http.StatusNotFound)+"\n", rr.Body.String())
+}
+
+func TestServer_HandleClipboardPutMaxConcurrentUploads(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.MaxConcurrentUploads = 1
+	server := newTestServer(t, conf)
+
+	// First upload blocks until the pipe writer is closed
+	pr, pw := io.Pipe()
+	done := make(chan int)
+	go func() {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/first", pr)
+		server.Handle(rr, req)
+		done <- rr.Code
+	}()
+	pw.Write([]byte("first"))
+
+	// Second upload is rejected while the first one is in progress
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/second", strings.NewReader("second"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusServiceUnavailable)
+	test.StrEquals(t, "5", rr.Header().Get("Retry-After"))
+	clipboardtest.NotExist(t, conf, "second")
+
+	// Downloads are not affected
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/does-not-exist", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+
+	pw.Close()
+	test.Int64Equals(t, http.StatusCreated, int64(<-done))
+
+	// Once the first upload is done, uploads are accepted again
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/second", strings.NewReader("second"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+}
+
+func TestServer_HandleClipboardPutMaxConcurrentStreams(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.MaxConcurrentStreams = 1
+	server := newTestServer(t, conf)
+
+	// Reservation takes the only slot
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/first?r=1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/second?s=1", strings.NewReader("second"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusTooManyRequests)
+	clipboardtest.NotExist(t, conf, "second")
+
+	// Streaming to the reservation takes over its slot
+	done := make(chan int)
+	go func() {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/first?s=1", strings.NewReader("first"))
+		server.Handle(rr, req)
+		done <- rr.Code
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/second?r=1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusTooManyRequests)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/first", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "first")
+	test.Int64Equals(t, http.StatusCreated, int64(<-done))
+
+	// Once the stream is done, the slot is free again
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/second?r=1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+}
+
+func TestServer_HandleClipboardPutLargeContentLengthFailed(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileSizeLimit = 10 // bytes
+	server := newTestServer(t, conf)
+
+	body := &readCounter{r: strings.NewReader("more than 10 bytes")}
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/too-large", body)
+	req.ContentLength = 1024 * 1024
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusRequestEntityTooLarge)
+	test.StrContains(t, rr.Body.String(), "limit is 10 B")
+	test.Int64Equals(t, 0, int64(body.read))
+	clipboardtest.NotExist(t, conf, "too-large")
+}
+
+func TestServer_HandleClipboardPutSizeLimitByTypeFailed(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileSizeLimit = 100 // bytes
+	conf.SizeLimitByType = map[string]int64{"text/plain": 10, "image/*": 1000}
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/too-large", strings.NewReader("more than 10 bytes"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusRequestEntityTooLarge)
+	test.StrContains(t, rr.Body.String(), "limit for text/plain is 10 B")
+	clipboardtest.NotExist(t, conf, "too-large")
+}
+
+func TestServer_HandleClipboardPutSizeLimitByTypeWildcardSuccess(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileSizeLimit = 10 // bytes
+	conf.SizeLimitByType = map[string]int64{"image/*": 1000}
+	server := newTestServer(t, conf)
+
+	gif := "GIF89a" + strings.Repeat("x", 100)
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/large-image", strings.NewReader(gif))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "large-image", gif)
+}
+
+func TestServer_HandleClipboardPutManySmallFailed(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ClipboardCountLimit = 2
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1", strings.NewReader("lalala"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "file1", "lalala")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file2", strings.NewReader("another one"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "file2", "another one")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file3", strings.NewReader("yet another one"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusTooManyRequests)
+	clipboardtest.NotExist(t, conf, "file3")
+}
+
+func TestServer_HandleClipboardPutManySmallOverwriteSuccess(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ClipboardCountLimit = 2
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1", strings.NewReader("lalala"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "file1", "lalala")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file2", strings.NewReader("another one"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "file2", "another one")
+
+	// Overwrite file 2 should succeed
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file2", strings.NewReader("overwriting file 2"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "file2", "overwriting file 2")
+}
+
+func TestServer_HandleClipboardPutOverwriteFailure(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileModesAllowed = []string{config.FileModeReadOnly}
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file2", strings.NewReader("another one"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "file2", "another one")
+
+	// Overwrite file 2 should fail
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file2", strings.NewReader("overwriting file 2 fails"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusMethodNotAllowed)
+}
+
+func TestServer_HandleClipboardPutReadWriteFailure(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileModesAllowed = []string{config.FileModeReadOnly}
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file2?m=rw", strings.NewReader("another one"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+}
+
+func TestServer_HandleClipboardPutReadOnlyDisallowOverwriteSuccess(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file2", strings.NewReader("another one"))
+	req.Header.Set("X-Mode", "ro")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file2", strings.NewReader("another one"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusMethodNotAllowed)
+}
+
+func TestServer_HandleClipboardPutTotalSizeLimitFailed(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.ClipboardSizeLimit = 10
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1", strings.NewReader("7 bytes"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "file1", "7 bytes")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file2", strings.NewReader("4 bytes"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusRequestEntityTooLarge)
+	clipboardtest.NotExist(t, conf, "file2")
+}
+
+func TestServer_HandleClipboardPutStreamSuccess(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	payload := string(bytes.Repeat([]byte("this is a 60 byte long string that's being repeated 99 times"), 99))
+
+	go func() {
+		rr1 := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/file1?s=1", strings.NewReader(payload))
+		server.Handle(rr1, req)
+		test.Status(t, rr1, http.StatusCreated)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	filename := filepath.Join(conf.ClipboardDir, "file1")
+	stat, _ := os.Stat(filename)
+	test.BoolEquals(t, true, stat.Mode()&os.ModeNamedPipe == os.ModeNamedPipe)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/file1", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, payload)
+	test.StrEquals(t, fmt.Sprintf("%d", len(payload)), rr.Header().Get("Content-Length"))
+	test.StrEquals(t, "", rr.Header().Get("X-Expected-Size"))
+
+	stat, _ = os.Stat(filename)
+	test.BoolEquals(t, true, stat == nil)
+}
+
+func TestServer_HandleClipboardPutStreamLimitReached(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.FileSizeLimit = 10 // bytes
+	server := newTestServer(t, conf)
+	httpServer := httptest.NewServer(http.HandlerFunc(server.Handle))
+	defer httpServer.Close()
+
+	go func() {
+		rr := httptest.NewRecorder()
+		body := io.MultiReader(strings.NewReader("0123456789"), strings.NewReader("more than 10 bytes"))
+		req, _ := http.NewRequest("PUT", "/file1?s=2", ioutil.NopCloser(body))
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusRequestEntityTooLarge)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// The reader must not mistake the truncated stream for the full content; since the response is aborted,
+	// the connection may be closed before or after the headers were sent
+	resp, err := http.Get(httpServer.URL + "/file1")
+	if err == nil {
+		defer resp.Body.Close()
+		if _, err := ioutil.ReadAll(resp.Body); err == nil {
+			t.Fatalf("expected error reading aborted stream, got none")
+		}
+	}
+	clipboardtest.NotExist(t, conf, "file1")
+}
+
+// TODO add tests to include :meta files
+
+func TestServer_HandleClipboardPutStreamWaitTimeout(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.StreamWaitTimeout = 300 * time.Millisecond
+	server := newTestServer(t, conf)
+
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1?s=2", strings.NewReader("nobody reads this"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusRequestTimeout)
+	test.BoolEquals(t, true, time.Since(start) < 5*time.Second)
+	clipboardtest.NotExist(t, conf, "file1")
+
+	// With immediate headers, the file info was already sent, but the stream is removed all the same
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file2?s=1", strings.NewReader("nobody reads this either"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.NotExist(t, conf, "file2")
+}
+
+func TestServer_HandleClipboardPutMaxUploadDuration(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.MaxUploadDuration = 200 * time.Millisecond
+	server := newTestServer(t, conf)
+
+	// Slow client, sends a few bytes every 100ms
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 10; i++ {
+			time.Sleep(100 * time.Millisecond)
+			if _, err := pw.Write([]byte("trickle ")); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/slow", pr)
+	server.Handle(rr, req)
+	pr.Close()
+	test.Status(t, rr, http.StatusRequestTimeout)
+	clipboardtest.NotExist(t, conf, "slow")
+
+	// Fast clients are not affected
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/fast", strings.NewReader("fast"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "fast", "fast")
+}
+
+func TestServer_HandleClipboardPutStreamWithReserveSuccess(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	payload := string(bytes.Repeat([]byte("this is a 60 byte long string that's being repeated 10 times"), 10))
+
+	go func() {
+		// Reserve
+		rr1 := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/file1?r=1", nil)
+		server.Handle(rr1, req)
+		test.Status(t, rr1, http.StatusCreated)
+		clipboardtest.Content(t, conf, "file1", "")
+
+		// Stream
+		rr1 = httptest.NewRecorder()
+		req, _ = http.NewRequest("PUT", "/file1?s=1", strings.NewReader(payload))
+		server.Handle(rr1, req)
+		test.Status(t, rr1, http.StatusCreated)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	filename := filepath.Join(conf.ClipboardDir, "file1")
+	stat, _ := os.Stat(filename)
+	test.BoolEquals(t, true, stat.Mode()&os.ModeNamedPipe == os.ModeNamedPipe)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/file1", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, payload)
+
+	stat, _ = os.Stat(filename)
+	test.BoolEquals(t, true, stat == nil)
+}
+
+func TestServer_HandleClipboardGetReservedTooEarly(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1?r=1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusTooEarly)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file1?wait=200ms", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusTooEarly)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file1?wait=invalid", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+}
+
+func TestServer_HandleClipboardGetReservedWaitForStream(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1?r=1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	payload := "streamed after the reader started waiting"
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		rr1 := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/file1?s=1", strings.NewReader(payload))
+		server.Handle(rr1, req)
+		test.Status(t, rr1, http.StatusCreated)
+	}()
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file1?wait=5s", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, payload)
+}
+
+func TestServer_HandleClipboardGetReservedWithStreamReadyURL(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1?r=1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	readyURL, err := url.Parse(rr.Header().Get("X-Stream-Ready-URL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "/file1", readyURL.Path)
+	token := readyURL.Query().Get("token")
+	test.BoolEquals(t, true, token != "")
+
+	payload := "streamed to the reader holding the token"
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		rr1 := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/file1?s=1", strings.NewReader(payload))
+		server.Handle(rr1, req)
+		test.Status(t, rr1, http.StatusCreated)
+	}()
+
+	// No ?wait= needed, the token implies waiting for the stream
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", readyURL.RequestURI(), nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, payload)
+}
+
+func TestServer_HandleClipboardGetWithStreamTokenMismatch(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1?r=1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file1?token=wrong", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+
+	// A regular upload replaces the reservation; the token does not return its content
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file1", strings.NewReader("unrelated"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file1?token=wrong&timeout=200ms", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+
+	// Without an existing file, the reader waits until the timeout
+	start := time.Now()
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file2?token=sometoken&timeout=200ms", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+	test.BoolEquals(t, true, time.Since(start) >= 200*time.Millisecond)
+}
+
+func TestServer_HandleClipboardPutStreamWithReserveExpectedSize(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	payload := "streamed content of unknown length"
+
+	go func() {
+		// Reserve, and announce the size
+		rr1 := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/file1?r=1", nil)
+		req.Header.Set("X-Size", fmt.Sprintf("%d", len(payload)))
+		server.Handle(rr1, req)
+		test.Status(t, rr1, http.StatusCreated)
+
+		// Stream without Content-Length
+		rr1 = httptest.NewRecorder()
+		req, _ = http.NewRequest("PUT", "/file1?s=1", ioutil.NopCloser(strings.NewReader(payload)))
+		server.Handle(rr1, req)
+		test.Status(t, rr1, http.StatusCreated)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("HEAD", "/file1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, fmt.Sprintf("%d", len(payload)), rr.Header().Get("X-Expected-Size"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file1", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, payload)
+	test.StrEquals(t, fmt.Sprintf("%d", len(payload)), rr.Header().Get("X-Expected-Size"))
+	test.StrEquals(t, "", rr.Header().Get("Content-Length"))
+}
+
+func TestServer_HandleClipboardPutStreamInvalidSize(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1?r=1", nil)
+	req.Header.Set("X-Size", "lots")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+}
+
+func TestServer_HandleClipboardPutNotifySuccess(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.SMTPAddr = "localhost:25"
+	conf.SMTPFrom = "pcopy <pcopy@example.com>"
+	server := newTestServer(t, conf)
+	mails := make(chan string, 1)
+	server.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		test.StrEquals(t, "localhost:25", addr)
+		test.StrEquals(t, "pcopy@example.com", from)
+		test.StrEquals(t, "phil@example.com", strings.Join(to, ","))
+		mails <- string(msg)
+		return nil
+	}
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/important?t=2h&notify=Phil+%3Cphil@example.com%3E", strings.NewReader("keep this"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	select {
+	case msg := <-mails:
+		test.StrContains(t, msg, "Subject: pcopy: important was copied")
+		test.StrContains(t, msg, "Link: "+conf.ServerAddr+"/important")
+	case <-time.After(time.Second):
+		t.Fatal("expected notification, got none")
+	}
+
+	// Reminder is sent once, when less than 10% of the TTL is left
+	filename := filepath.Join(conf.ClipboardDir, "important")
+	stat, _ := server.clipboard.Stat("important")
+	test.StrEquals(t, "phil@example.com", stat.Notify)
+	created := time.Unix(stat.Expires, 0).Add(-100 * time.Hour)
+	if err := os.Chtimes(filename, created, created); err != nil {
+		t.Fatal(err)
+	}
+	server.updateStatsAndExpire()
+	select {
+	case msg := <-mails:
+		test.StrContains(t, msg, "Subject: pcopy: important expires in")
+	case <-time.After(time.Second):
+		t.Fatal("expected reminder, got none")
+	}
+	server.updateStatsAndExpire()
+	select {
+	case <-mails:
+		t.Fatal("expected no second reminder")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServer_HandleClipboardPutNotifyFailures(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	// Notifications not enabled
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/important?notify=phil@example.com", strings.NewReader("keep this"))
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusBadRequest, "Bad Request (notifications not enabled)\n")
+
+	// Invalid address
+	conf.SMTPAddr = "localhost:25"
+	conf.SMTPFrom = "pcopy@example.com"
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/important", strings.NewReader("keep this"))
+	req.Header.Set("X-Notify", "not an email")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+
+	// Failures to send do not affect the upload
+	server.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		return errors.New("connection refused")
+	}
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/important?notify=phil@example.com", strings.NewReader("keep this"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "important", "keep this")
+}
+
+func TestServer_HandleClipboardPutWebhookSuccess(t *testing.T) {
+	type hook struct {
+		event     string
+		signature string
+		payload   webhookPayload
+	}
+	hooks := make(chan hook, 2)
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		h := hook{event: r.Header.Get(HeaderWebhookEvent), signature: r.Header.Get(HeaderWebhookSignature)}
+		json.Unmarshal(body, &h.payload)
+		test.StrEquals(t, "sha256="+webhookSignature("hooksecret", body), h.signature)
+		hooks <- h
+	}))
+	defer hookServer.Close()
+
+	_, conf := configtest.NewTestConfig(t)
+	conf.WebhookURL = hookServer.URL
+	conf.WebhookSecret = "hooksecret"
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/hooked?t=2h&m=ro", strings.NewReader("hook this"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	select {
+	case h := <-hooks:
+		test.StrEquals(t, webhookEventCreated, h.event)
+		test.StrEquals(t, webhookEventCreated, h.payload.Event)
+		test.StrEquals(t, "hooked", h.payload.ID)
+		test.StrEquals(t, conf.ServerAddr+"/hooked", h.payload.URL)
+		test.Int64Equals(t, 9, h.payload.Size)
+		test.BoolEquals(t, true, h.payload.TTL > 7100 && h.payload.TTL <= 7200)
+		test.StrEquals(t, config.FileModeReadOnly, h.payload.Mode)
+	case <-time.After(time.Second):
+		t.Fatal("expected webhook, got none")
+	}
+
+	// Hidden files do not trigger webhooks
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/secret?hidden=1", strings.NewReader("hush"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	// Expired files trigger an "expired" event
+	stat, _ := server.clipboard.Stat("hooked")
+	stat.Expires = time.Now().Add(-time.Second).Unix()
+	server.clipboard.WriteMeta("hooked", stat)
+	server.updateStatsAndExpire()
+	select {
+	case h := <-hooks:
+		test.StrEquals(t, webhookEventExpired, h.event)
+		test.StrEquals(t, "hooked", h.payload.ID)
+		test.Int64Equals(t, 0, h.payload.TTL)
+	case <-time.After(time.Second):
+		t.Fatal("expected webhook, got none")
+	}
+	select {
+	case h := <-hooks:
+		t.Fatalf("expected no more webhooks, got %#v", h)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServer_HandleClipboardPutWebhookRetry(t *testing.T) {
+	webhookRetryDelay = time.Millisecond
+	defer func() { webhookRetryDelay = 2 * time.Second }()
+
+	attempts := make(chan int, webhookAttempts)
+	count := 0
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		attempts <- count
+		if count < webhookAttempts {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer hookServer.Close()
+
+	_, conf := configtest.NewTestConfig(t)
+	conf.WebhookURL = hookServer.URL
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/hooked", strings.NewReader("hook this"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	for i := 1; i <= webhookAttempts; i++ {
+		select {
+		case attempt := <-attempts:
+			test.Int64Equals(t, int64(i), int64(attempt))
+		case <-time.After(time.Second):
+			t.Fatalf("expected attempt %d, got none", i)
+		}
+	}
+}
+
+func TestServer_HandleClipboardHeadSuccess(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/abc", strings.NewReader("this is a thing"))
+	server.Handle(rr, req)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("HEAD", "/abc", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+
+	test.StrEquals(t, "abc", rr.Header().Get("X-File"))
+	test.StrEquals(t, conf.ServerAddr+"/abc", rr.Header().Get("X-URL"))
+	test.StrContains(t, rr.Header().Get("X-Curl"), "--pinnedpubkey")
+	test.StrEquals(t, "1", rr.Header().Get("X-Available"))
+	test.StrEquals(t, "", rr.Header().Get("X-Streaming"))
+}
+
+func TestServer_HandleClipboardHeadStreaming(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	done := make(chan bool)
+	go func() {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/file1?s=1", strings.NewReader("streamed content"))
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusCreated)
+		done <- true
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// HEAD must not block on the pipe, and must not report a size
+	headDone := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("HEAD", "/file1", nil)
+		server.Handle(rr, req)
+		headDone <- rr
+	}()
+	select {
+	case rr := <-headDone:
+		test.Status(t, rr, http.StatusOK)
+		test.StrEquals(t, "true", rr.Header().Get("X-Streaming"))
+		test.StrEquals(t, "", rr.Header().Get("Length"))
+		test.StrEquals(t, "", rr.Header().Get("Content-Length"))
+	case <-time.After(time.Second):
+		t.Fatal("HEAD on streaming entry blocked")
+	}
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/file1", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "streamed content")
+	test.StrEquals(t, "none", rr.Header().Get("Accept-Ranges"))
+	<-done
+}
+
+func TestServer_HandleClipboardMeta(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1?m=ro", strings.NewReader("this is a text file"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file1:meta", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+
+	if strings.Contains(rr.Body.String(), "secret") {
+		t.Fatalf("meta response must not contain secret: %s", rr.Body.String())
+	}
+	var meta FileMetadata
+	if err := json.NewDecoder(rr.Body).Decode(&meta); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "file1", meta.ID)
+	test.StrEquals(t, "ro", meta.Mode)
+	test.Int64Equals(t, 19, meta.Size)
+	test.StrEquals(t, "text/plain; charset=utf-8", meta.ContentType)
+	test.StrEquals(t, "dadc624d4454e10293dbd1b701b9ee9f99ef83b4cd07b695111d37eb95abcff8", meta.Checksum)
+	test.BoolEquals(t, false, meta.Stream)
+	test.BoolEquals(t, false, meta.Reserved)
+	test.BoolEquals(t, false, meta.Binary)
+	test.Int64Equals(t, 1, meta.Lines)
+	if meta.Created == 0 || meta.Expires <= meta.Created {
+		t.Fatalf("unexpected created/expires: %d/%d", meta.Created, meta.Expires)
+	}
+}
+
+func TestServer_HandleClipboardHeadTextSummary(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/text", strings.NewReader("line 1\nline 2\nline 3 without newline"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("HEAD", "/text", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "3", rr.Header().Get("X-Lines"))
+	test.StrEquals(t, "false", rr.Header().Get("X-Binary"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/binary", bytes.NewReader([]byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0, 0, '\n'}))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("HEAD", "/binary", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "", rr.Header().Get("X-Lines"))
+	test.StrEquals(t, "true", rr.Header().Get("X-Binary"))
+}
+
+func TestServer_HandleClipboardMetaNotFound(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/does-not-exist:meta", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+}
+
+func TestServer_HandleClipboardHeadReservedNotAvailable(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/abc?r=1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("HEAD", "/abc", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "0", rr.Header().Get("X-Available"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/abc", strings.NewReader("now it's here"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("HEAD", "/abc", nil)
+	server.Handle(rr, req)
+	test.StrEquals(t, "1", rr.Header().Get("X-Available"))
+}
+
+func TestServer_LogURIRedactIDs(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	req, _ := http.NewRequest("GET", "/secret-name?a=abc&f=secret.txt", nil)
+	req.RequestURI = "/secret-name?a=abc&f=secret.txt"
+	test.StrEquals(t, "/secret-name?a=abc&f=secret.txt", server.logURI(req))
+
+	conf.RedactIDsInLogs = true
+	test.StrEquals(t, "/"+clipboard.RedactID("secret-name"), server.logURI(req))
+
+	req, _ = http.NewRequest("GET", "/secret-name:meta", nil)
+	test.StrEquals(t, "/"+clipboard.RedactID("secret-name")+":meta", server.logURI(req))
+
+	req, _ = http.NewRequest("GET", "/secret-name/unknown", nil)
+	test.StrEquals(t, "/"+clipboard.RedactID("secret-name")+"/unknown", server.logURI(req))
+
+	for _, path := range []string{"/", "/info", "/static/js/app.js", "/admin/stats", "/favicon.ico"} {
+		req, _ = http.NewRequest("GET", path, nil)
+		test.StrEquals(t, path, server.logURI(req))
+	}
+}
+
+func TestServer_AuthorizeSuccessUnprotected(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	if err := server.authorize(req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_AuthorizeFailureMissingProtected(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	server := newTestServer(t, conf)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	if err := server.authorize(req); err != ErrHTTPUnauthorized {
+		t.Fatalf("expected invalid auth, got %#v", err)
+	}
+}
+
+func TestServer_AuthorizeBasicSuccessProtected(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	server := newTestServer(t, conf)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:some password")))
+	if err := server.authorize(req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_AuthorizeBasicFailureProtected(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	server := newTestServer(t, conf)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:incorrect password")))
+	if err := server.authorize(req); err != ErrHTTPUnauthorized {
+		t.Fatalf("expected invalid auth, got %#v", err)
+	}
+}
+
+func TestServer_AuthorizeHmacSuccessProtected(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	server := newTestServer(t, conf)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "GET", "/", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	if err := server.authorize(req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_AuthorizeHmacFailureWrongPathProtected(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	server := newTestServer(t, conf)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "GET", "/wrong-path", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	if err := server.authorize(req); err != ErrHTTPUnauthorized {
+		t.Fatalf("expected invalid auth, got %#v", err)
+	}
+}
+
+func TestServer_AuthorizeHmacNonce(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	server := newTestServer(t, conf)
+
+	// Header without nonce, as sent by older clients
+	timestamp := time.Now().Unix()
+	hm := hmac.New(sha256.New, conf.Key.Bytes)
+	hm.Write(crypto.AuthHMACData(timestamp, 60, "", "GET", "/"))
+	oldAuth := fmt.Sprintf("HMAC %d 60 %s", timestamp, base64.StdEncoding.EncodeToString(hm.Sum(nil)))
+	newAuth, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "GET", "/", time.Minute)
+
+	// Without RequireAuthNonce, both are accepted, even if replayed
+	for _, auth := range []string{oldAuth, oldAuth, newAuth, newAuth} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", auth)
+		if err := server.authorize(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// With RequireAuthNonce, the nonce is required, and can only be used once
+	conf.RequireAuthNonce = true
+	newAuth, _ = crypto.GenerateAuthHMAC(conf.Key.Bytes, "GET", "/", time.Minute)
+	for _, expected := range []error{nil, ErrHTTPUnauthorized} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", newAuth)
+		if err := server.authorize(req); err != expected {
+			t.Fatalf("expected %v, got %v", expected, err)
+		}
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", oldAuth)
+	if err := server.authorize(req); err != ErrHTTPUnauthorized {
+		t.Fatalf("expected invalid auth, got %#v", err)
+	}
+
+	// Nonces are forgotten once the HMAC has expired
+	test.Int64Equals(t, 1, int64(len(server.authNonces)))
+	for nonce := range server.authNonces {
+		server.authNonces[nonce] = time.Now().Add(-time.Second).Unix()
+	}
+	server.updateStatsAndExpire()
+	test.Int64Equals(t, 0, int64(len(server.authNonces)))
+	test.Int64Equals(t, 0, int64(len(server.authNonceOrder)))
+}
+
+func TestServer_UseAuthNonceEvictsOldest(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+
+	expires := time.Now().Add(time.Hour)
+	for i := 0; i < authNoncesMax; i++ {
+		test.BoolEquals(t, true, server.useAuthNonce(fmt.Sprintf("nonce%d", i), expires))
+	}
+
+	// A fresh nonce is accepted even if the set is full, and the oldest nonce is forgotten to make room
+	test.BoolEquals(t, true, server.useAuthNonce("fresh", expires))
+	test.Int64Equals(t, authNoncesMax, int64(len(server.authNonces)))
+	test.BoolEquals(t, false, server.useAuthNonce("fresh", expires))
+	test.BoolEquals(t, false, server.useAuthNonce(fmt.Sprintf("nonce%d", authNoncesMax-1), expires))
+	_, ok := server.authNonces["nonce0"]
+	test.BoolEquals(t, false, ok)
+}
+
+func TestServer_AuthorizeHmacFailureWrongMethodProtected(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	server := newTestServer(t, conf)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "PUT", "/", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	if err := server.authorize(req); err != ErrHTTPUnauthorized {
+		t.Fatalf("expected invalid auth, got %#v", err)
+	}
+}
+
+func TestServer_AuthorizeHmacFailureWrongKeyProtected(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	server := newTestServer(t, conf)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	hmac, _ := crypto.GenerateAuthHMAC(make([]byte, 32), "GET", "/", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	if err := server.authorize(req); err != ErrHTTPUnauthorized {
+		t.Fatalf("expected invalid auth, got %#v", err)
+	}
+}
+
+func TestServer_AuthorizeParamSuccessProtected(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	server := newTestServer(t, conf)
+
+	req, _ := http.NewRequest("GET", "/?a=some+password", nil)
+	if err := server.authorize(req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_AuthorizeParamFailureMethodNotAllowedProtected(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	server := newTestServer(t, conf)
+
+	req, _ := http.NewRequest("PUT", "/?a=some+password", nil)
+	if err := server.authorize(req); err != ErrHTTPUnauthorized {
+		t.Fatalf("expected invalid auth, got %#v", err)
+	}
+}
+
+func TestServer_AuthorizeWithOldKeyProtected(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("new password"), []byte("new salt"))
+	conf.Keys = []*crypto.Key{crypto.DeriveKey([]byte("some password"), []byte("some salt"))}
+	server := newTestServer(t, conf)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	hmac, _ := crypto.GenerateAuthHMAC(conf.Keys[0].Bytes, "GET", "/", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	if err := server.authorize(req); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:some password")))
+	if err := server.authorize(req); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:other password")))
+	if err := server.authorize(req); err != ErrHTTPUnauthorized {
+		t.Fatalf("expected invalid auth, got %#v", err)
+	}
+}
+
+func TestServer_AuthFailureThreshold(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	conf.AuthFailureThreshold = 3
+	conf.AuthFailureWindow = time.Minute
+	server := newTestServer(t, conf)
+
+	verify := func(remoteAddr string, password string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/verify", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:"+password)))
+		server.Handle(rr, req)
+		return rr
+	}
+
+	// A success resets the counter
+	test.Status(t, verify("1.2.3.4:1234", "wrong"), http.StatusUnauthorized)
+	test.Status(t, verify("1.2.3.4:1234", "wrong"), http.StatusUnauthorized)
+	test.Status(t, verify("1.2.3.4:1234", "some password"), http.StatusOK)
+
+	// Reaching the threshold blocks the visitor, even with the correct password, but not other visitors
+	test.Status(t, verify("1.2.3.4:1234", "wrong"), http.StatusUnauthorized)
+	test.Status(t, verify("1.2.3.4:1234", "wrong"), http.StatusUnauthorized)
+	test.Status(t, verify("1.2.3.4:1234", "wrong"), http.StatusUnauthorized)
+	rr := verify("1.2.3.4:1234", "some password")
+	test.Status(t, rr, http.StatusTooManyRequests)
+	test.StrEquals(t, "60", rr.Header().Get("Retry-After"))
+	test.Status(t, verify("5.6.7.8:1234", "some password"), http.StatusOK)
+
+	// Endpoints that do not require authentication are not blocked
+	rr = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/info", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+
+	// The block ends after the window, and is then pruned by the manager loop
+	server.mu.Lock()
+	server.visitors["1.2.3.4"].authWindowStart = time.Now().Add(-2 * time.Minute)
+	server.visitors["1.2.3.4"].authBlockedUntil = time.Now().Add(-time.Minute)
+	server.mu.Unlock()
+	server.updateStatsAndExpire()
+	test.Int64Equals(t, 0, int64(server.visitors["1.2.3.4"].authWindowFailures))
+	test.Status(t, verify("1.2.3.4:1234", "some password"), http.StatusOK)
 }
 
-func TestServer_HandleWebRootGetUntilLimitReached(t *testing.T) {
+func TestServer_AuthFailureDelay(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.LimitGETBurst = 10
-	conf.LimitGET = rate.Every(100 * time.Millisecond)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	conf.AuthFailureDelay = 100 * time.Millisecond
+	server := newTestServer(t, conf)
+
+	verify := func(remoteAddr string, password string) (int, time.Duration) {
+		start := time.Now()
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/verify", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:"+password)))
+		server.Handle(rr, req)
+		return rr.Code, time.Since(start)
+	}
+
+	// Failures are delayed progressively, successes are not delayed and reset the delay
+	code, took := verify("1.2.3.4:1234", "wrong")
+	test.Int64Equals(t, http.StatusUnauthorized, int64(code))
+	test.BoolEquals(t, true, took >= 100*time.Millisecond && took < 200*time.Millisecond)
+
+	code, took = verify("1.2.3.4:1234", "wrong")
+	test.Int64Equals(t, http.StatusUnauthorized, int64(code))
+	test.BoolEquals(t, true, took >= 200*time.Millisecond)
+
+	code, took = verify("1.2.3.4:1234", "some password")
+	test.Int64Equals(t, http.StatusOK, int64(code))
+	test.BoolEquals(t, true, took < 100*time.Millisecond)
+
+	code, took = verify("1.2.3.4:1234", "wrong")
+	test.Int64Equals(t, http.StatusUnauthorized, int64(code))
+	test.BoolEquals(t, true, took < 200*time.Millisecond)
+
+	// Requests from other visitors are not blocked while a failed request is delayed
+	done := make(chan bool)
+	go func() {
+		verify("1.2.3.4:1234", "wrong")
+		done <- true
+	}()
+	time.Sleep(20 * time.Millisecond)
+	code, took = verify("5.6.7.8:1234", "some password")
+	test.Int64Equals(t, http.StatusOK, int64(code))
+	test.BoolEquals(t, true, took < 100*time.Millisecond)
+	<-done
+}
+
+func TestServer_AuthorizeKeyReturnsMatchingKey(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("new password"), []byte("new salt"))
+	conf.Keys = []*crypto.Key{crypto.DeriveKey([]byte("some password"), []byte("some salt"))}
 	server := newTestServer(t, conf)
 
-	for i := 0; i < 10; i++ {
-		rr := httptest.NewRecorder()
-		req, _ := http.NewRequest("GET", "/", nil)
-		req.TLS = &tls.ConnectionState{} // Pretend that this is TLS, so we don't redirect
+	req, _ := http.NewRequest("GET", "/", nil)
+	hmac, _ := crypto.GenerateAuthHMAC(conf.Keys[0].Bytes, "GET", "/", time.Minute)
+	req.Header.Set("Authorization", hmac)
+	key, err := server.authorizeKey(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.BytesEquals(t, conf.Keys[0].Salt, key.Salt)
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:new password")))
+	key, err = server.authorizeKey(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.BytesEquals(t, conf.Key.Salt, key.Salt)
+}
+
+func TestServer_HandleAuthReadNotRequired(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	conf.AuthReadRequired = false
+	conf.EnableAdmin = true
+	server := newTestServer(t, conf)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/file1", strings.NewReader("hi there"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file1", strings.NewReader("hi there"))
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:some password")))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file1", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "hi there")
+
+	// Wrong credentials are rejected, even if none are required
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file1", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:wrong password")))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+
+	// Listing the clipboard contents always requires auth
+	for _, path := range []string{"/admin/stats", "/list", "/stats", "/search?q=hi", "/changes", "/metrics"} {
+		rr = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", path, nil)
 		server.Handle(rr, req)
-		test.Status(t, rr, http.StatusOK)
+		test.Status(t, rr, http.StatusUnauthorized)
 	}
+}
+
+func TestServer_HandleAuthWriteNotRequired(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	conf.AuthWriteRequired = false
+	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/", nil)
-	req.TLS = &tls.ConnectionState{} // Pretend that this is TLS, so we don't redirect
+	req, _ := http.NewRequest("PUT", "/file1", strings.NewReader("hi there"))
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusTooManyRequests)
+	test.Status(t, rr, http.StatusCreated)
 
-	time.Sleep(200 * time.Millisecond)
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/file1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
 
 	rr = httptest.NewRecorder()
-	req, _ = http.NewRequest("GET", "/", nil)
-	req.TLS = &tls.ConnectionState{} // Pretend that this is TLS, so we don't redirect
+	req, _ = http.NewRequest("GET", "/file1", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:some password")))
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusOK)
+	test.Response(t, rr, http.StatusOK, "hi there")
+
+	// Existing files cannot be replaced, appended to or deleted without auth
+	for _, method := range []string{"PUT", "POST", "DELETE"} {
+		rr = httptest.NewRecorder()
+		req, _ = http.NewRequest(method, "/file1", strings.NewReader("overwritten"))
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusUnauthorized)
+	}
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/file1?append=1", strings.NewReader("appended"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+	clipboardtest.Content(t, conf, "file1", "hi there")
 }
 
-func TestServer_handleClipboardClipboardPutInvalidId(t *testing.T) {
+func TestServer_HandleJSONAccessLog(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
+	conf.LogFormat = config.LogFormatJSON
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
 	server := newTestServer(t, conf)
 
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(ioutil.Discard)
+
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/../invalid-id", strings.NewReader("hi"))
+	req, _ := http.NewRequest("PUT", "/howdy", strings.NewReader("howdy"))
+	req.RequestURI = "/howdy" // Only set by the HTTP server
+	req.RemoteAddr = "1.2.3.4:1234"
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:some password")))
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusBadRequest)
-	clipboardtest.NotExist(t, conf, "/../invalid-id")
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/howdy", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+
+	lines := make([]string, 0) // Other messages (e.g. stats) are still logged as text
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "{") {
+			lines = append(lines, line)
+		}
+	}
+	test.Int64Equals(t, 2, int64(len(lines)))
+	var put, get accessLogEntry
+	if err := json.Unmarshal([]byte(lines[0]), &put); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &get); err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "PUT", put.Method)
+	test.StrEquals(t, "/howdy", put.Path)
+	test.Int64Equals(t, http.StatusCreated, int64(put.Status))
+	test.BoolEquals(t, true, put.Bytes > 0)
+	test.StrEquals(t, "1.2.3.4", put.Visitor)
+	test.StrEquals(t, "ok", put.Auth)
+	test.Int64Equals(t, http.StatusUnauthorized, int64(get.Status))
+	test.StrEquals(t, "failed", get.Auth)
+	test.StrContains(t, get.Error, "Unauthorized")
 }
 
-func TestServer_HandleClipboardPutGetSuccess(t *testing.T) {
+func TestServer_HandleCORS(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
+	conf.AllowedOrigins = []string{"https://app.example.com"}
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/you-cant-always?t=4d", strings.NewReader("get what you want"))
+	req, _ := http.NewRequest("OPTIONS", "/abc", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
 	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNoContent)
+	test.StrEquals(t, "https://app.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	test.StrContains(t, rr.Header().Get("Access-Control-Allow-Methods"), "PUT")
+	test.StrContains(t, rr.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+	test.StrEquals(t, "600", rr.Header().Get("Access-Control-Max-Age"))
+	test.StrEquals(t, "Origin", rr.Header().Get("Vary"))
 
-	ttl, _ := strconv.Atoi(rr.Header().Get("X-TTL"))
-	expires, _ := strconv.Atoi(rr.Header().Get("X-Expires"))
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("OPTIONS", "/abc", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusForbidden)
+	test.StrEquals(t, "", rr.Header().Get("Access-Control-Allow-Origin"))
 
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/abc", strings.NewReader("cross-origin"))
+	req.Header.Set("Origin", "https://app.example.com")
+	server.Handle(rr, req)
 	test.Status(t, rr, http.StatusCreated)
-	test.StrEquals(t, "you-cant-always", rr.Header().Get("X-File"))
-	test.StrEquals(t, "https://localhost:12345/you-cant-always", rr.Header().Get("X-URL"))
-	test.StrContains(t, rr.Header().Get("X-Curl"), "https://localhost:12345/you-cant-always")
-	test.StrContains(t, rr.Header().Get("X-Curl"), "--pinnedpubkey")
-	test.Int64Equals(t, int64(time.Hour*24*4), int64(time.Second*time.Duration(ttl)))
-	test.BoolEquals(t, true, time.Until(time.Unix(int64(expires), 0)) <= 24*4*time.Hour)
-	test.StrContains(t, rr.Body.String(), "https://localhost:12345/you-cant-always")
-	test.StrContains(t, rr.Body.String(), "Direct link (valid for 4d")
-	test.StrContains(t, rr.Body.String(), "--pinnedpubkey")
+	test.StrEquals(t, "https://app.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	test.StrContains(t, rr.Header().Get("Access-Control-Expose-Headers"), "X-File")
 
 	rr = httptest.NewRecorder()
-	req, _ = http.NewRequest("GET", "/you-cant-always", nil)
+	req, _ = http.NewRequest("GET", "/abc", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
 	server.Handle(rr, req)
-	test.Response(t, rr, http.StatusOK, "get what you want")
+	test.Response(t, rr, http.StatusOK, "cross-origin")
+	test.StrEquals(t, "", rr.Header().Get("Access-Control-Allow-Origin"))
 }
 
-func TestServer_HandleClipboardPutWithJsonOutputSuccess(t *testing.T) {
+func TestServer_HandleCORSAllOriginsProtected(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	conf.AllowedOrigins = []string{"*"}
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/you-cant-always?f=json", strings.NewReader("get what you want"))
-	req.Header.Set("X-TTL", "2m")
+	req, _ := http.NewRequest("OPTIONS", "/abc", nil)
+	req.Header.Set("Origin", "https://anywhere.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusCreated)
+	test.Status(t, rr, http.StatusNoContent)
+	test.StrEquals(t, "*", rr.Header().Get("Access-Control-Allow-Origin"))
 
-	var info httpResponseFileInfo
-	json.NewDecoder(rr.Body).Decode(&info)
-	test.StrEquals(t, "you-cant-always", info.File)
-	test.StrEquals(t, "https://localhost:12345/you-cant-always", info.URL)
-	test.StrContains(t, info.Curl, "https://localhost:12345/you-cant-always")
-	test.StrContains(t, info.Curl, "--pinnedpubkey")
-	test.Int64Equals(t, int64(time.Minute*2), int64(time.Second*time.Duration(info.TTL)))
-	test.BoolEquals(t, true, time.Until(time.Unix(info.Expires, 0)) <= 2*time.Minute)
+	// Preflight requests do not need auth, but the actual request does
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/abc", strings.NewReader("no auth"))
+	req.Header.Set("Origin", "https://anywhere.example.com")
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+	test.StrEquals(t, "*", rr.Header().Get("Access-Control-Allow-Origin"))
+	clipboardtest.NotExist(t, conf, "abc")
 }
 
-func TestServer_HandleClipboardPutTextWithTooLargeTTL(t *testing.T) {
+func TestServer_HandleCORSDisabled(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.FileExpireAfterDefault = time.Minute
-	conf.FileExpireAfterNonTextMax = time.Hour
-	conf.FileExpireAfterTextMax = 2 * time.Hour
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/too-large-ttl?t=10d", nil) // empty file is "text"
+	req, _ := http.NewRequest("OPTIONS", "/abc", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusCreated)
-
-	ttl, _ := strconv.Atoi(rr.Header().Get("X-TTL"))
-	test.DurationEquals(t, 2*time.Hour, time.Second*time.Duration(ttl))
+	test.Status(t, rr, http.StatusMethodNotAllowed)
+	test.StrEquals(t, "", rr.Header().Get("Access-Control-Allow-Origin"))
 }
 
-func TestServer_HandleClipboardPutLongTextWithTooLargeTTL(t *testing.T) {
-	// If the text is longer than 512 KB, it is treated like non-text
-
+func TestServer_HandleMethodNotAllowed(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.FileExpireAfterDefault = time.Minute
-	conf.FileExpireAfterNonTextMax = time.Hour
-	conf.FileExpireAfterTextMax = 2 * time.Hour
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/too-large-ttl?t=10d", strings.NewReader(strings.Repeat("12345", 120000))) // > 512 KB
+	req, _ := http.NewRequest("GET", "/admin/expire", nil)
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusCreated)
+	test.Status(t, rr, http.StatusMethodNotAllowed)
+	test.StrEquals(t, "POST", rr.Header().Get("Allow"))
 
-	ttl, _ := strconv.Atoi(rr.Header().Get("X-TTL"))
-	test.DurationEquals(t, time.Hour, time.Second*time.Duration(ttl))
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("OPTIONS", "/abc", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusMethodNotAllowed)
+	test.StrEquals(t, "PUT, POST, PATCH, GET, HEAD, DELETE", rr.Header().Get("Allow"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/does/not/exist", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+	test.StrEquals(t, "", rr.Header().Get("Allow"))
 }
 
-func TestServer_HandleClipboardPutNonTextWithTooLargeTTL(t *testing.T) {
+func TestServer_HandleClipboardPutLink(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.FileExpireAfterDefault = time.Minute
-	conf.FileExpireAfterNonTextMax = time.Hour
-	conf.FileExpireAfterTextMax = 2 * time.Hour
 	server := newTestServer(t, conf)
 
-	body := make([]byte, 100)
-	rand.Read(body)
-
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/too-large-ttl?t=10d", bytes.NewReader(body))
+	req, _ := http.NewRequest("PUT", "/target?t=10m", strings.NewReader("shared content"))
 	server.Handle(rr, req)
 	test.Status(t, rr, http.StatusCreated)
 
-	ttl, _ := strconv.Atoi(rr.Header().Get("X-TTL"))
-	test.DurationEquals(t, time.Hour, time.Second*time.Duration(ttl))
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/nice-name?link=target&t=1h", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "3600", rr.Header().Get("X-TTL"))
+	clipboardtest.Content(t, conf, "nice-name", "")
+
+	// The alias serves the content of the target, but with its own ID and TTL
+	target, _ := server.clipboard.Stat("target")
+	alias, _ := server.clipboard.Stat("nice-name")
+	test.BoolEquals(t, true, alias.Expires > target.Expires)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/nice-name", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "shared content")
+	test.StrEquals(t, "nice-name", rr.Header().Get("X-File"))
+	test.StrEquals(t, fmt.Sprintf("%d", alias.Expires), rr.Header().Get("X-Expires"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("HEAD", "/nice-name", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "14", rr.Header().Get("Length"))
+
+	// No alias chains, no missing targets, no targets that can only be read once
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/other-name?link=nice-name", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/other-name?link=missing", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/burnfile?b=1", strings.NewReader("burn me"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/other-name?link=burnfile", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
+	clipboardtest.NotExist(t, conf, "other-name")
+
+	// Target is gone, alias remains until it expires
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/target", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/nice-name", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusGone)
+
+	// An alias replaced by an alias of an alias is not resolved
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/target", strings.NewReader("new content"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/nice-name", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, "new content")
 }
 
-func TestServer_HandleClipboardTextPutWithoutTTL(t *testing.T) {
+func TestServer_HandleClipboardPutAppend(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.FileExpireAfterDefault = time.Minute
-	conf.FileExpireAfterNonTextMax = time.Hour
-	conf.FileExpireAfterTextMax = 2 * time.Hour
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/no-ttl", nil) // empty body is "text"
+	req, _ := http.NewRequest("PUT", "/log?append=1", strings.NewReader("line1\n"))
 	server.Handle(rr, req)
 	test.Status(t, rr, http.StatusCreated)
 
-	ttl, _ := strconv.Atoi(rr.Header().Get("X-TTL"))
-	test.DurationEquals(t, time.Minute, time.Second*time.Duration(ttl))
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/log?append=1", strings.NewReader("line2\n"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	clipboardtest.Content(t, conf, "log", "line1\nline2\n")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/log?append=close", strings.NewReader(""))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	stat, _ := server.clipboard.Stat("log")
+	test.BoolEquals(t, false, stat.Appending)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/log?follow=1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "line1\nline2\n", rr.Body.String())
 }
 
-func TestServer_HandleClipboardPutLargeFailed(t *testing.T) {
+func TestServer_HandleClipboardPutAppendReadOnly(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.FileSizeLimit = 10 // bytes
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/too-large", strings.NewReader("more than 10 bytes"))
+	req, _ := http.NewRequest("PUT", "/log?append=1&m=ro", strings.NewReader("line1\n"))
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusRequestEntityTooLarge)
-	clipboardtest.NotExist(t, conf, "too-large")
+	test.Status(t, rr, http.StatusCreated)
 
 	rr = httptest.NewRecorder()
-	req, _ = http.NewRequest("GET", "/too-large", nil)
+	req, _ = http.NewRequest("PUT", "/log?append=1", strings.NewReader("line2\n"))
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusNotFound)
+	test.Status(t, rr, http.StatusMethodNotAllowed)
+	clipboardtest.Content(t, conf, "log", "line1\n")
 }
 
-func TestServer_HandleClipboardPutManySmallFailed(t *testing.T) {
+func TestServer_HandleClipboardPutAppendNotAppendable(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.ClipboardCountLimit = 2
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/file1", strings.NewReader("lalala"))
+	req, _ := http.NewRequest("PUT", "/burn?b=1", strings.NewReader("secret"))
 	server.Handle(rr, req)
 	test.Status(t, rr, http.StatusCreated)
-	clipboardtest.Content(t, conf, "file1", "lalala")
 
 	rr = httptest.NewRecorder()
-	req, _ = http.NewRequest("PUT", "/file2", strings.NewReader("another one"))
+	req, _ = http.NewRequest("PUT", "/burn?append=1", strings.NewReader("more"))
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusCreated)
-	clipboardtest.Content(t, conf, "file2", "another one")
+	test.Status(t, rr, http.StatusBadRequest)
 
 	rr = httptest.NewRecorder()
-	req, _ = http.NewRequest("PUT", "/file3", strings.NewReader("yet another one"))
+	req, _ = http.NewRequest("PUT", "/log?append=1&b=1", strings.NewReader("line1\n"))
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusTooManyRequests)
-	clipboardtest.NotExist(t, conf, "file3")
+	test.Status(t, rr, http.StatusBadRequest)
+	clipboardtest.NotExist(t, conf, "log")
 }
 
-func TestServer_HandleClipboardPutManySmallOverwriteSuccess(t *testing.T) {
+func TestServer_HandleClipboardPutAppendFileSizeLimit(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.ClipboardCountLimit = 2
+	conf.FileSizeLimit = 10
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/file1", strings.NewReader("lalala"))
-	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusCreated)
-	clipboardtest.Content(t, conf, "file1", "lalala")
-
-	rr = httptest.NewRecorder()
-	req, _ = http.NewRequest("PUT", "/file2", strings.NewReader("another one"))
+	req, _ := http.NewRequest("PUT", "/log?append=1", strings.NewReader("line1\n"))
 	server.Handle(rr, req)
 	test.Status(t, rr, http.StatusCreated)
-	clipboardtest.Content(t, conf, "file2", "another one")
 
-	// Overwrite file 2 should succeed
 	rr = httptest.NewRecorder()
-	req, _ = http.NewRequest("PUT", "/file2", strings.NewReader("overwriting file 2"))
+	req, _ = http.NewRequest("PUT", "/log?append=1", strings.NewReader("line2\n"))
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusCreated)
-	clipboardtest.Content(t, conf, "file2", "overwriting file 2")
+	test.Status(t, rr, http.StatusRequestEntityTooLarge)
+	clipboardtest.Content(t, conf, "log", "line1\n")
 }
 
-func TestServer_HandleClipboardPutOverwriteFailure(t *testing.T) {
+func TestServer_HandleClipboardGetFollow(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.FileModesAllowed = []string{config.FileModeReadOnly}
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/file2", strings.NewReader("another one"))
+	req, _ := http.NewRequest("PUT", "/log?append=1", strings.NewReader("line1\n"))
 	server.Handle(rr, req)
 	test.Status(t, rr, http.StatusCreated)
-	clipboardtest.Content(t, conf, "file2", "another one")
 
-	// Overwrite file 2 should fail
+	followers := make([]*httptest.ResponseRecorder, 2)
+	var wg sync.WaitGroup
+	for i := range followers {
+		followers[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rr *httptest.ResponseRecorder) {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "/log?follow=1", nil)
+			server.Handle(rr, req)
+		}(followers[i])
+	}
+	time.Sleep(100 * time.Millisecond)
+
 	rr = httptest.NewRecorder()
-	req, _ = http.NewRequest("PUT", "/file2", strings.NewReader("overwriting file 2 fails"))
+	req, _ = http.NewRequest("PUT", "/log?append=1", strings.NewReader("line2\n"))
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusMethodNotAllowed)
+	test.Status(t, rr, http.StatusOK)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/log?append=close", strings.NewReader("line3\n"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+
+	wg.Wait()
+	for _, rr := range followers {
+		test.Status(t, rr, http.StatusOK)
+		test.StrEquals(t, "line1\nline2\nline3\n", rr.Body.String())
+	}
 }
 
-func TestServer_HandleClipboardPutReadWriteFailure(t *testing.T) {
+func TestServer_HandleClipboardPutTouch(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.FileModesAllowed = []string{config.FileModeReadOnly}
+	conf.FileModesAllowed = []string{"rw", "ro"}
+	conf.FileExpireAfterDefault = time.Hour
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/file2?m=rw", strings.NewReader("another one"))
+	req, _ := http.NewRequest("PUT", "/rwfile?t=10m", strings.NewReader("some content"))
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusBadRequest)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/rwfile?touch=1&t=30m", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+	test.StrEquals(t, "1800", rr.Header().Get("X-TTL"))
+	clipboardtest.Content(t, conf, "rwfile", "some content")
+	stat, _ := server.clipboard.Stat("rwfile")
+	test.BoolEquals(t, true, stat.Expires >= time.Now().Add(29*time.Minute).Unix())
+
+	// Read-only files cannot be touched, missing files cannot be created
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/rofile?m=ro", strings.NewReader("read-only"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/rofile?touch=1&t=30m", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusMethodNotAllowed)
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/missing?touch=1", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusNotFound)
+	clipboardtest.NotExist(t, conf, "missing")
 }
 
-func TestServer_HandleClipboardPutReadOnlyDisallowOverwriteSuccess(t *testing.T) {
+func TestServer_ReadOnlyFileIsImmutable(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
+	conf.FileModesAllowed = []string{"rw", "ro"}
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/file2", strings.NewReader("another one"))
-	req.Header.Set("X-Mode", "ro")
+	req, _ := http.NewRequest("PUT", "/rofile?m=ro&t=10m", strings.NewReader("read-only"))
 	server.Handle(rr, req)
 	test.Status(t, rr, http.StatusCreated)
+	before, _ := server.clipboard.Stat("rofile")
+
+	// No request may change the content, or extend (or shorten) the life of the file
+	for _, request := range []struct {
+		method string
+		url    string
+		body   io.Reader
+	}{
+		{"PUT", "/rofile?touch=1&t=2d", nil},
+		{"POST", "/rofile?touch=1&t=2d", nil},
+		{"PUT", "/rofile?t=2d", strings.NewReader("read-only")},
+		{"POST", "/rofile?m=rw", strings.NewReader("overwritten")},
+		{"PUT", "/rofile?r=1", nil},
+		{"PUT", "/rofile?s=1", strings.NewReader("streamed")},
+		{"POST", "/rofile?upload=start", nil},
+		{"POST", "/rofile?upload=finish", nil},
+		{"PATCH", "/rofile?upload=token&offset=0", strings.NewReader("chunk")},
+		{"DELETE", "/rofile", nil},
+		{"PUT", "/?archive=tar", newTestTar(t, map[string]string{"rofile": "overwritten"})},
+	} {
+		rr = httptest.NewRecorder()
+		req, _ = http.NewRequest(request.method, request.url, request.body)
+		server.Handle(rr, req)
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("expected %d for %s %s, got %d", http.StatusMethodNotAllowed, request.method, request.url, rr.Code)
+		}
+	}
 
-	rr = httptest.NewRecorder()
-	req, _ = http.NewRequest("PUT", "/file2", strings.NewReader("another one"))
-	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusMethodNotAllowed)
+	clipboardtest.Content(t, conf, "rofile", "read-only")
+	after, _ := server.clipboard.Stat("rofile")
+	test.Int64Equals(t, before.Expires, after.Expires)
+	test.StrEquals(t, config.FileModeReadOnly, after.Mode)
 }
 
-func TestServer_HandleClipboardPutTotalSizeLimitFailed(t *testing.T) {
+func TestServer_HandleClipboardPutResumableUpload(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.ClipboardSizeLimit = 10
+	conf.FileSizeLimit = 20
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/file1", strings.NewReader("7 bytes"))
+	req, _ := http.NewRequest("POST", "/big?upload=start", nil)
 	server.Handle(rr, req)
 	test.Status(t, rr, http.StatusCreated)
-	clipboardtest.Content(t, conf, "file1", "7 bytes")
+	token := rr.Header().Get(HeaderUploadToken)
+	test.StrEquals(t, token+"\n", rr.Body.String())
 
-	rr = httptest.NewRecorder()
-	req, _ = http.NewRequest("PUT", "/file2", strings.NewReader("4 bytes"))
-	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusRequestEntityTooLarge)
-	clipboardtest.NotExist(t, conf, "file2")
-}
+	patch := func(offset int, content string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PATCH", fmt.Sprintf("/big?upload=%s&offset=%d", token, offset), strings.NewReader(content))
+		server.Handle(rr, req)
+		return rr
+	}
 
-func TestServer_HandleClipboardPutStreamSuccess(t *testing.T) {
-	_, conf := configtest.NewTestConfig(t)
-	server := newTestServer(t, conf)
+	rr = patch(0, "first chunk ")
+	test.Status(t, rr, http.StatusNoContent)
+	test.StrEquals(t, "12", rr.Header().Get(HeaderUploadOffset))
 
-	payload := string(bytes.Repeat([]byte("this is a 60 byte long string that's being repeated 99 times"), 99))
+	// Wrong offset, and chunks exceeding the file size limit are rejected
+	rr = patch(5, "second")
+	test.Status(t, rr, http.StatusConflict)
+	test.StrEquals(t, "12", rr.Header().Get(HeaderUploadOffset))
 
-	go func() {
-		rr1 := httptest.NewRecorder()
-		req, _ := http.NewRequest("PUT", "/file1?s=1", strings.NewReader(payload))
-		server.Handle(rr1, req)
-		test.Status(t, rr1, http.StatusCreated)
-	}()
+	rr = patch(12, "second chunk")
+	test.Status(t, rr, http.StatusRequestEntityTooLarge)
 
-	time.Sleep(100 * time.Millisecond)
+	rr = patch(12, "second")
+	test.Status(t, rr, http.StatusNoContent)
+	test.StrEquals(t, "18", rr.Header().Get(HeaderUploadOffset))
+	clipboardtest.NotExist(t, conf, "big")
 
-	filename := filepath.Join(conf.ClipboardDir, "file1")
-	stat, _ := os.Stat(filename)
-	test.BoolEquals(t, true, stat.Mode()&os.ModeNamedPipe == os.ModeNamedPipe)
+	// Finishing the upload creates the file, with the given params
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/big?upload=finish&t=2h", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "7200", rr.Header().Get("X-TTL"))
+	clipboardtest.Content(t, conf, "big", "first chunk second")
 
-	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/file1", nil)
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/big?upload=finish", nil)
 	server.Handle(rr, req)
-	test.Response(t, rr, http.StatusOK, payload)
+	test.Status(t, rr, http.StatusNotFound)
 
-	stat, _ = os.Stat(filename)
-	test.BoolEquals(t, true, stat == nil)
+	rr = patch(18, "more")
+	test.Status(t, rr, http.StatusNotFound)
 }
 
-// TODO add tests to include :meta files
-
-func TestServer_HandleClipboardPutStreamWithReserveSuccess(t *testing.T) {
+func TestServer_HandleClipboardPutKeyLimits(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("admin"), []byte("admin salt"))
+	conf.Keys = []*crypto.Key{crypto.DeriveKey([]byte("guest"), []byte("guest salt"))}
+	conf.FileExpireAfterNonTextMax = time.Hour
+	conf.FileExpireAfterTextMax = time.Hour
+	conf.KeyLimits = map[string]*config.KeyLimit{
+		crypto.KeyID(conf.Key):     {MaxTTL: 365 * 24 * time.Hour},                               // Admin: beyond the global max
+		crypto.KeyID(conf.Keys[0]): {FileCountLimit: 2, SizeLimit: 10, MaxTTL: 10 * time.Minute}, // Guest: tiny budget
+	}
 	server := newTestServer(t, conf)
 
-	payload := string(bytes.Repeat([]byte("this is a 60 byte long string that's being repeated 10 times"), 10))
-
-	go func() {
-		// Reserve
-		rr1 := httptest.NewRecorder()
-		req, _ := http.NewRequest("PUT", "/file1?r=1", nil)
-		server.Handle(rr1, req)
-		test.Status(t, rr1, http.StatusCreated)
-		clipboardtest.Content(t, conf, "file1", "")
+	put := func(id string, password string, content string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/"+id+"?t=1d", strings.NewReader(content))
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:"+password)))
+		server.Handle(rr, req)
+		return rr
+	}
 
-		// Stream
-		rr1 = httptest.NewRecorder()
-		req, _ = http.NewRequest("PUT", "/file1?s=1", strings.NewReader(payload))
-		server.Handle(rr1, req)
-		test.Status(t, rr1, http.StatusCreated)
-	}()
+	// Admin TTL is not capped by the global max, guest TTL is capped by the key's max TTL
+	rr := put("admin1", "admin", "admin's stuff that is rather long")
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "86400", rr.Header().Get("X-TTL"))
 
-	time.Sleep(100 * time.Millisecond)
+	rr = put("guest1", "guest", "12345")
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "600", rr.Header().Get("X-TTL"))
 
-	filename := filepath.Join(conf.ClipboardDir, "file1")
-	stat, _ := os.Stat(filename)
-	test.BoolEquals(t, true, stat.Mode()&os.ModeNamedPipe == os.ModeNamedPipe)
+	// Guest size quota: 5 of 10 bytes used
+	rr = put("guest2", "guest", "123456")
+	test.Response(t, rr, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request Entity Too Large (quota for key %s exceeded)\n", crypto.KeyID(conf.Keys[0])))
+	clipboardtest.NotExist(t, conf, "guest2")
 
-	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/file1", nil)
-	server.Handle(rr, req)
-	test.Response(t, rr, http.StatusOK, payload)
+	// Overwriting a file does not count against the quota
+	rr = put("guest1", "guest", "1234567")
+	test.Status(t, rr, http.StatusCreated)
 
-	stat, _ = os.Stat(filename)
-	test.BoolEquals(t, true, stat == nil)
+	// Guest count quota
+	rr = put("guest2", "guest", "123")
+	test.Status(t, rr, http.StatusCreated)
+	rr = put("guest3", "guest", "")
+	test.Response(t, rr, http.StatusTooManyRequests, fmt.Sprintf("Too Many Requests (quota for key %s is 2 files)\n", crypto.KeyID(conf.Keys[0])))
 }
 
-func TestServer_HandleClipboardHeadSuccess(t *testing.T) {
+func TestServer_NamespaceByKey(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("alice"), []byte("alice salt"))
+	conf.Keys = []*crypto.Key{crypto.DeriveKey([]byte("bob"), []byte("bob salt"))}
+	conf.NamespaceByKey = true
 	server := newTestServer(t, conf)
 
-	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/abc", strings.NewReader("this is a thing"))
-	server.Handle(rr, req)
+	request := func(method, path, password, content string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(content))
+		if password != "" {
+			req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:"+password)))
+		}
+		server.Handle(rr, req)
+		return rr
+	}
+
+	// The same ID refers to a different file for each key
+	test.Status(t, request("PUT", "/notes", "alice", "alice's notes"), http.StatusCreated)
+	test.Status(t, request("PUT", "/notes", "bob", "bob's notes"), http.StatusCreated)
+	test.Response(t, request("GET", "/notes", "alice", ""), http.StatusOK, "alice's notes")
+	test.Response(t, request("GET", "/notes", "bob", ""), http.StatusOK, "bob's notes")
+	clipboardtest.NotExist(t, conf, "notes")
+
+	// Other keys cannot read or delete another key's files
+	test.Status(t, request("PUT", "/secret-plan", "alice", "world domination"), http.StatusCreated)
+	test.Status(t, request("GET", "/secret-plan", "bob", ""), http.StatusNotFound)
+	test.Status(t, request("DELETE", "/secret-plan", "bob", ""), http.StatusNotFound)
+	test.Response(t, request("GET", "/secret-plan", "alice", ""), http.StatusOK, "world domination")
+
+	// Lists are scoped to the key's namespace
+	var list []*ListEntry
+	rr := request("GET", "/list", "bob", "")
+	test.Status(t, rr, http.StatusOK)
+	if err := json.NewDecoder(rr.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	test.Int64Equals(t, 1, int64(len(list)))
+	test.StrEquals(t, "notes", list[0].ID)
 
+	// Public files can be read without a key, and by other keys
 	rr = httptest.NewRecorder()
-	req, _ = http.NewRequest("HEAD", "/abc", nil)
+	req, _ := http.NewRequest("PUT", "/shared", strings.NewReader("for everyone"))
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:bob")))
+	req.Header.Set(HeaderPublic, HeaderPublicEnabled)
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusOK)
+	test.Status(t, rr, http.StatusCreated)
+	test.Response(t, request("GET", "/shared", "", ""), http.StatusOK, "for everyone")
+	test.Response(t, request("GET", "/shared", "alice", ""), http.StatusOK, "for everyone")
 
-	test.StrEquals(t, "abc", rr.Header().Get("X-File"))
-	test.StrEquals(t, conf.ServerAddr+"/abc", rr.Header().Get("X-URL"))
-	test.StrContains(t, rr.Header().Get("X-Curl"), "--pinnedpubkey")
+	// Stats include all namespaces
+	server.updateStatsAndExpire()
+	test.Int64Equals(t, 4, int64(server.metrics.files))
 }
 
-func TestServer_AuthorizeSuccessUnprotected(t *testing.T) {
+func TestServer_HandleClipboardPutKeyLimitsWithoutMaxTTL(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
+	conf.Key = crypto.DeriveKey([]byte("guest"), []byte("guest salt"))
+	conf.FileExpireAfterNonTextMax = time.Hour
+	conf.FileExpireAfterTextMax = time.Hour
+	conf.KeyLimits = map[string]*config.KeyLimit{
+		crypto.KeyID(conf.Key): {FileCountLimit: 10, SizeLimit: 10 * 1024 * 1024}, // Quota only, no max TTL
+	}
 	server := newTestServer(t, conf)
 
-	req, _ := http.NewRequest("GET", "/", nil)
-	if err := server.authorize(req); err != nil {
-		t.Fatal(err)
+	put := func(id string, ttl string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/"+id+"?t="+ttl, strings.NewReader("guest's stuff"))
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:guest")))
+		server.Handle(rr, req)
+		return rr
 	}
+
+	// The global max values apply, and "never" is only allowed with AllowNeverExpire
+	rr := put("guest1", "never")
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "3600", rr.Header().Get("X-TTL"))
+	test.StrEquals(t, HeaderTTLClampedYes, rr.Header().Get(HeaderTTLClamped))
+
+	rr = put("guest2", "1d")
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "3600", rr.Header().Get("X-TTL"))
+
+	conf.AllowNeverExpire = true
+	rr = put("guest3", "never")
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "0", rr.Header().Get(HeaderExpires))
 }
 
-func TestServer_AuthorizeFailureMissingProtected(t *testing.T) {
+func TestServer_HandleClipboardPutSizePerVisitorLimit(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	conf.SizePerVisitorLimit = 10
 	server := newTestServer(t, conf)
 
-	req, _ := http.NewRequest("GET", "/", nil)
-	if err := server.authorize(req); err != ErrHTTPUnauthorized {
-		t.Fatalf("expected invalid auth, got %#v", err)
+	put := func(id string, remoteAddr string, content string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/"+id, strings.NewReader(content))
+		req.RemoteAddr = remoteAddr
+		server.Handle(rr, req)
+		return rr
 	}
-}
 
-func TestServer_AuthorizeBasicSuccessProtected(t *testing.T) {
-	_, conf := configtest.NewTestConfig(t)
-	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
-	server := newTestServer(t, conf)
+	rr := put("file1", "1.2.3.4:1234", "123456")
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "4", rr.Header().Get(HeaderQuotaRemaining))
 
-	req, _ := http.NewRequest("GET", "/", nil)
-	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:some password")))
-	if err := server.authorize(req); err != nil {
+	// Quota exceeded, but other visitors are not affected
+	rr = put("file2", "1.2.3.4:5678", "12345")
+	test.Response(t, rr, http.StatusRequestEntityTooLarge, "Request Entity Too Large (quota for visitor exceeded)\n")
+	clipboardtest.NotExist(t, conf, "file2")
+
+	rr = put("file3", "9.8.7.6:1234", "12345")
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "5", rr.Header().Get(HeaderQuotaRemaining))
+
+	// Deleted (or expired) files no longer count towards the quota
+	if err := server.clipboard.DeleteFile("file1"); err != nil {
 		t.Fatal(err)
 	}
+	rr = put("file2", "1.2.3.4:5678", "12345")
+	test.Status(t, rr, http.StatusCreated)
+	test.StrEquals(t, "5", rr.Header().Get(HeaderQuotaRemaining))
+	clipboardtest.Content(t, conf, "file2", "12345")
 }
 
-func TestServer_AuthorizeBasicFailureProtected(t *testing.T) {
+func TestServer_ExpireSuccess(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	conf.FileExpireAfterDefault = time.Second
 	server := newTestServer(t, conf)
 
-	req, _ := http.NewRequest("GET", "/", nil)
-	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("x:incorrect password")))
-	if err := server.authorize(req); err != ErrHTTPUnauthorized {
-		t.Fatalf("expected invalid auth, got %#v", err)
-	}
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/new-thing", strings.NewReader("something"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusCreated)
+	clipboardtest.Content(t, conf, "new-thing", "something")
+
+	time.Sleep(1050 * time.Millisecond)
+	server.updateStatsAndExpire()
+	clipboardtest.NotExist(t, conf, "new-thing")
 }
 
-func TestServer_AuthorizeHmacSuccessProtected(t *testing.T) {
+func TestServer_ExpireNow(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
 	server := newTestServer(t, conf)
 
-	req, _ := http.NewRequest("GET", "/", nil)
-	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "GET", "/", time.Minute)
-	req.Header.Set("Authorization", hmac)
-	if err := server.authorize(req); err != nil {
-		t.Fatal(err)
+	for _, id := range []string{"old1", "old2"} {
+		ioutil.WriteFile(filepath.Join(conf.ClipboardDir, id), []byte("old"), 0600)
+		ioutil.WriteFile(filepath.Join(conf.ClipboardDir, id+":meta"), []byte(`{"mode":"rw","expires":1}`), 0600)
 	}
+	ioutil.WriteFile(filepath.Join(conf.ClipboardDir, "new"), []byte("new"), 0600)
+	ioutil.WriteFile(filepath.Join(conf.ClipboardDir, "new:meta"), []byte(`{"mode":"rw","expires":0}`), 0600)
+
+	test.Int64Equals(t, 2, int64(server.ExpireNow()))
+	clipboardtest.NotExist(t, conf, "old1")
+	clipboardtest.NotExist(t, conf, "old2")
+	clipboardtest.Content(t, conf, "new", "new")
+
+	ioutil.WriteFile(filepath.Join(conf.ClipboardDir, "old3"), []byte("old"), 0600)
+	ioutil.WriteFile(filepath.Join(conf.ClipboardDir, "old3:meta"), []byte(`{"mode":"rw","expires":1}`), 0600)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/admin/expire", nil)
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, `{"expired":1}`+"\n")
+	clipboardtest.NotExist(t, conf, "old3")
 }
 
-func TestServer_AuthorizeHmacFailureWrongPathProtected(t *testing.T) {
+func TestServer_HandleAdminDisabled(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
 	server := newTestServer(t, conf)
 
-	req, _ := http.NewRequest("GET", "/", nil)
-	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "GET", "/wrong-path", time.Minute)
-	req.Header.Set("Authorization", hmac)
-	if err := server.authorize(req); err != ErrHTTPUnauthorized {
-		t.Fatalf("expected invalid auth, got %#v", err)
+	for _, route := range []string{"GET /admin/stats", "POST /admin/purge"} {
+		parts := strings.Split(route, " ")
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest(parts[0], parts[1], nil)
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusNotFound)
 	}
 }
 
-func TestServer_AuthorizeHmacFailureWrongMethodProtected(t *testing.T) {
+func TestServer_HandleAdminStats(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	conf.EnableAdmin = true
+	conf.SizePerVisitorLimit = 1000
+	conf.ClipboardCountLimit = 10
 	server := newTestServer(t, conf)
 
-	req, _ := http.NewRequest("GET", "/", nil)
-	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "PUT", "/", time.Minute)
-	req.Header.Set("Authorization", hmac)
-	if err := server.authorize(req); err != ErrHTTPUnauthorized {
-		t.Fatalf("expected invalid auth, got %#v", err)
+	for _, put := range []struct{ id, addr, content string }{{"aa", "1.2.3.4:1234", "first"}, {"bb", "1.2.3.4:1234", "second"}, {"cc", "5.6.7.8:1234", "third!!"}} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/"+put.id+"?h=1", strings.NewReader(put.content))
+		req.RemoteAddr = put.addr
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusCreated)
 	}
+	os.Chtimes(filepath.Join(conf.ClipboardDir, "aa"), time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	os.Chtimes(filepath.Join(conf.ClipboardDir, "cc"), time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/stats", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusOK)
+
+	var stats AdminStats
+	json.NewDecoder(rr.Body).Decode(&stats)
+	test.Int64Equals(t, 3, int64(stats.Count))
+	test.Int64Equals(t, 18, stats.Size)
+	test.BoolEquals(t, true, stats.DiskUsage > stats.Size)
+	test.StrEquals(t, "aa", stats.Oldest.ID)
+	test.StrEquals(t, "cc", stats.Newest.ID)
+	test.Int64Equals(t, 2, int64(len(stats.Visitors)))
+	test.StrEquals(t, "1.2.3.4", stats.Visitors[0].Addr)
+	test.Int64Equals(t, 2, int64(stats.Visitors[0].Count))
+	test.Int64Equals(t, 11, stats.Visitors[0].Size)
+	test.Int64Equals(t, 10, int64(stats.Limits.CountLimit))
+	test.Int64Equals(t, 1000, stats.Limits.SizePerVisitorLimit)
 }
 
-func TestServer_AuthorizeHmacFailureWrongKeyProtected(t *testing.T) {
+func TestServer_HandleAdminPurgeProtected(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
 	conf.Key = crypto.DeriveKey([]byte("some password"), []byte("some salt"))
+	conf.EnableAdmin = true
 	server := newTestServer(t, conf)
 
-	req, _ := http.NewRequest("GET", "/", nil)
-	hmac, _ := crypto.GenerateAuthHMAC(make([]byte, 32), "GET", "/", time.Minute)
+	ioutil.WriteFile(filepath.Join(conf.ClipboardDir, "orphan:meta"), []byte(`{"mode":"rw"}`), 0600)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/admin/purge", nil)
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusUnauthorized)
+	test.FileExist(t, filepath.Join(conf.ClipboardDir, "orphan:meta"))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/admin/purge", nil)
+	hmac, _ := crypto.GenerateAuthHMAC(conf.Key.Bytes, "POST", "/admin/purge", time.Minute)
 	req.Header.Set("Authorization", hmac)
-	if err := server.authorize(req); err != ErrHTTPUnauthorized {
-		t.Fatalf("expected invalid auth, got %#v", err)
-	}
+	server.Handle(rr, req)
+	test.Response(t, rr, http.StatusOK, `{"purged":["orphan"]}`+"\n")
+	test.FileNotExist(t, filepath.Join(conf.ClipboardDir, "orphan:meta"))
 }
 
-func TestServer_ExpireSuccess(t *testing.T) {
+func TestServer_ReservedWordsFailure(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
-	conf.FileExpireAfterDefault = time.Second
 	server := newTestServer(t, conf)
 
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/new-thing", strings.NewReader("something"))
+	req, _ := http.NewRequest("PUT", "/robots.txt", strings.NewReader("something"))
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusCreated)
-	clipboardtest.Content(t, conf, "new-thing", "something")
+	test.Status(t, rr, http.StatusBadRequest)
 
-	time.Sleep(1050 * time.Millisecond)
-	server.updateStatsAndExpire()
-	clipboardtest.NotExist(t, conf, "new-thing")
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/openapi.json", strings.NewReader("something"))
+	server.Handle(rr, req)
+	test.Status(t, rr, http.StatusBadRequest)
 }
 
-func TestServer_ReservedWordsFailure(t *testing.T) {
+func TestServer_ReservedIDsFromRoutesAndConfig(t *testing.T) {
 	_, conf := configtest.NewTestConfig(t)
+	conf.ReservedIDs = []string{"health"}
 	server := newTestServer(t, conf)
 
+	for _, id := range []string{"info", "verify", "static", "favicon.ico", "curl", "nc", "list", "metrics", "changes", "search", "admin", "health"} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/"+id, strings.NewReader("something"))
+		server.Handle(rr, req)
+		test.Status(t, rr, http.StatusBadRequest)
+		clipboardtest.NotExist(t, conf, id)
+	}
+
+	// Route patterns do not reserve IDs that merely look similar
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("PUT", "/robots.txt", strings.NewReader("something"))
+	req, _ := http.NewRequest("PUT", "/openapi-json", strings.NewReader("something"))
 	server.Handle(rr, req)
-	test.Status(t, rr, http.StatusBadRequest)
+	test.Status(t, rr, http.StatusCreated)
+}
+
+func TestServer_ReservedRouteIDs(t *testing.T) {
+	routes := []route{
+		newRoute("GET", "/", nil),
+		newRoute("GET", "/info", nil),
+		newRoute("GET", "/static/.+", nil),
+		newRoute("GET", `/openapi\.json`, nil),
+		newRoute("GET", "/(random)?", nil),
+		newRoute("GET", "/"+clipboard.FileRegexPart, nil),
+	}
+	test.StrEquals(t, "info static openapi.json", strings.Join(reservedRouteIDs(routes), " "))
 }
 
 func TestServer_StartStopManager(t *testing.T) {
@@ -812,6 +5343,51 @@ func TestServer_StartStopManager(t *testing.T) {
 	test.StrEquals(t, "testfile2", cf.ID)
 }
 
+func TestServer_SelfTestSuccess(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	server := newTestServer(t, conf)
+	if err := server.SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_SelfTestReportsAllProblems(t *testing.T) {
+	_, conf := configtest.NewTestConfig(t)
+	_, otherConf := configtest.NewTestConfig(t)
+	conf.KeyFile = otherConf.KeyFile // Does not match certificate
+	conf.ListenTCP = "no-port"
+	conf.ClipboardSizeLimit = 100
+	conf.FileSizeLimit = 200
+
+	err := SelfTest(conf)
+	selfTestErr, ok := err.(*SelfTestError)
+	if !ok {
+		t.Fatalf("expected self-test error, got %v", err)
+	}
+	test.Int64Equals(t, 3, int64(len(selfTestErr.Problems)))
+	test.StrContains(t, selfTestErr.Problems[0], "invalid ListenTCP no-port")
+	test.StrContains(t, selfTestErr.Problems[1], "cannot load certificate")
+	test.StrContains(t, selfTestErr.Problems[2], "FileSizeLimit is larger than ClipboardSizeLimit")
+	test.StrContains(t, err.Error(), "self-test found 3 problem(s)")
+}
+
+func TestServer_SelfTestMissingListenAndKeyFiles(t *testing.T) {
+	conf := config.New()
+	conf.ListenHTTPS = ""
+	conf.ClipboardDir = t.TempDir()
+	if err := SelfTest(conf); err == nil || !strings.Contains(err.Error(), "listen address missing") {
+		t.Fatalf("expected listen address error, got %v", err)
+	}
+
+	conf.ListenHTTPS = ":12345"
+	err := SelfTest(conf)
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	test.StrContains(t, err.Error(), "private key file missing")
+	test.StrContains(t, err.Error(), "certificate file missing")
+}
+
 func newTestServer(t *testing.T, config *config.Config) *Server {
 	server, err := New(config)
 	if err != nil {
@@ -819,3 +5395,42 @@ func newTestServer(t *testing.T, config *config.Config) *Server {
 	}
 	return server
 }
+
+// newTestTar creates a tar archive with the given files, in the order of their names. Names ending with a slash
+// are added as directories.
+func newTestTar(t *testing.T, files map[string]string) io.Reader {
+	names := make([]string, 0)
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		header := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0600, Size: int64(len(files[name]))}
+		if strings.HasSuffix(name, "/") {
+			header = &tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0700}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+type readCounter struct {
+	r    io.Reader
+	read int
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += n
+	return n, err
+}
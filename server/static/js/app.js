@@ -609,6 +609,7 @@ function progressHideHeaders() {
 
 async function req(method, path, body, headers) {
     const key = loadKey()
+    headers['X-Requested-With'] = 'XMLHttpRequest' // Server then sends no WWW-Authenticate, so no login dialog pops up
     if (key) {
         headers['Authorization'] = generateAuthHMAC(key, method, path)
     }
@@ -831,10 +832,11 @@ function generateAuthHMACParam(key, method, path) {
 function generateAuthHMAC(key, method, path) {
     let ttl = 30
     let timestamp = Math.floor(new Date().getTime()/1000)
-    let message = `${timestamp}:${ttl}:${method}:${path}`
+    let nonce = Array.from(window.crypto.getRandomValues(new Uint8Array(12)), b => b.toString(16).padStart(2, '0')).join('')
+    let message = `${timestamp}:${ttl}:${nonce}:${method}:${path}`
     let hash = CryptoJS.HmacSHA256(message, key)
     let hashBase64 = hash.toString(CryptoJS.enc.Base64)
-    return `HMAC ${timestamp} ${ttl} ${hashBase64}`
+    return `HMAC ${timestamp} ${ttl} ${nonce} ${hashBase64}`
 }
 
 function storeKey(key) {
@@ -103,13 +103,26 @@ func (s *tcpForwarder) handleConn(conn net.Conn) error {
 	if err != nil {
 		return fmt.Errorf("cannot create forwarding request: %w", err)
 	}
-	request.RequestURI = fmt.Sprintf("/%s", path)
+	moveAuthParamToHeader(request)
 	request.RemoteAddr = conn.RemoteAddr().String()
 	request.Header.Set(HeaderNoRedirect, "1")
 	s.UpstreamHandler.ServeHTTP(newTCPResponseWriter(conn), request)
 	return nil
 }
 
+// moveAuthParamToHeader moves the "a" query param (if any) to the "Authorization:" header. Unlike a shared link,
+// the password passed via "pcopy:...?a=..." is typed by the user, so it is safe to accept it for uploads regardless
+// of which methods the server allows the query param for.
+func moveAuthParamToHeader(request *http.Request) {
+	query := request.URL.Query()
+	if auth := query.Get(queryParamAuth); auth != "" {
+		query.Del(queryParamAuth)
+		request.URL.RawQuery = query.Encode()
+		request.Header.Set("Authorization", auth)
+	}
+	request.RequestURI = request.URL.RequestURI()
+}
+
 // handleHelp writes the netcat help page to the connection and exits; it does this
 // by forwarding the request to the upstream /nc page.
 func (s *tcpForwarder) handleHelp(conn net.Conn) error {
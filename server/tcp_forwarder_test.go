@@ -29,7 +29,7 @@ func TestTCPForwarder_Help(t *testing.T) {
 	cmd.Stdout = &stdout
 	cmd.Run()
 
-	test.StrContains(t, stdout.String(), `This is is the netcat-endpoint for pcopy`)
+	test.StrContains(t, stdout.String(), `This is the netcat-endpoint for pcopy`)
 
 	forwarder.shutdown()
 	test.WaitForPortDown(t, "12386")
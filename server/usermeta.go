@@ -0,0 +1,69 @@
+package server
+
+import (
+	"heckel.io/pcopy/clipboard"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	userMetaMaxEntries = 20   // Max. number of X-Meta-* headers per file
+	userMetaMaxSize    = 4096 // Max. total size of all X-Meta-* names and values per file, in bytes
+)
+
+// getUserMeta returns the user metadata passed via X-Meta-* headers (see HeaderMetaPrefix), keyed by the
+// header name without the prefix, or nil if there is none. Multiple headers with the same name are joined
+// with ", ", just like HTTP does.
+func (s *Server) getUserMeta(r *http.Request) (map[string]string, error) {
+	var meta map[string]string
+	size := 0
+	for key, values := range r.Header {
+		if !strings.HasPrefix(key, HeaderMetaPrefix) || len(key) == len(HeaderMetaPrefix) {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		name := strings.TrimPrefix(key, HeaderMetaPrefix)
+		value := strings.Join(values, ", ")
+		meta[name] = value
+		size += len(name) + len(value)
+		if len(meta) > userMetaMaxEntries {
+			return nil, errUserMetaTooManyEntries
+		} else if size > userMetaMaxSize {
+			return nil, errUserMetaTooLarge
+		}
+	}
+	return meta, nil
+}
+
+// writeUserMetaHeaders echoes the user metadata of a file back as X-Meta-* headers, see getUserMeta. If
+// the response is a CORS response, the headers are exposed as well, since their names are not known in advance.
+func writeUserMetaHeaders(w http.ResponseWriter, stat *clipboard.File) {
+	if len(stat.UserMeta) == 0 {
+		return
+	}
+	headers := make([]string, 0, len(stat.UserMeta))
+	for name, value := range stat.UserMeta {
+		headers = append(headers, HeaderMetaPrefix+name)
+		w.Header().Set(HeaderMetaPrefix+name, value)
+	}
+	if exposed := w.Header().Get("Access-Control-Expose-Headers"); exposed != "" {
+		sort.Strings(headers)
+		w.Header().Set("Access-Control-Expose-Headers", exposed+", "+strings.Join(headers, ", "))
+	}
+}
+
+// corsAllowedUserMetaHeaders returns the X-Meta-* headers of a preflight request's "Access-Control-Request-Headers",
+// so that they can be allowed in addition to corsAllowedHeaders
+func corsAllowedUserMetaHeaders(r *http.Request) []string {
+	headers := make([]string, 0)
+	for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		header = http.CanonicalHeaderKey(strings.TrimSpace(header))
+		if strings.HasPrefix(header, HeaderMetaPrefix) && len(header) > len(HeaderMetaPrefix) {
+			headers = append(headers, header)
+		}
+	}
+	return headers
+}
@@ -2,15 +2,21 @@ package server
 
 import (
 	"fmt"
+	"heckel.io/pcopy/clipboard"
 	"heckel.io/pcopy/config"
 	"heckel.io/pcopy/crypto"
 	"heckel.io/pcopy/util"
+	"net/http"
+	"net/url"
 	"strings"
+	"time"
 )
 
 const (
 	randomFileIDLength  = 10
 	randomFileIDCharset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	uploadTokenLength   = 32
+	streamTokenLength   = 32
 )
 
 // FileInfoInstructions generates instruction text to download links
@@ -23,7 +29,11 @@ func FileInfoInstructions(info *File) string {
 	if info.TTL == 0 {
 		validFor = "valid forever, does not expire"
 	}
-	return fmt.Sprintf(`# Direct link (%s)
+	clamped := ""
+	if info.TTLClamped {
+		clamped = fmt.Sprintf("# Note: The requested TTL exceeds the server's max. TTL. The link expires after %s.\n\n", util.DurationToHuman(info.TTL))
+	}
+	return fmt.Sprintf(`%s# Direct link (%s)
 %s
 
 # Paste via pcopy (you may need a prefix)
@@ -31,7 +41,7 @@ ppaste %s
 
 # Paste via curl
 %s
-`, validFor, info.URL, id, info.Curl)
+`, clamped, validFor, info.URL, id, info.Curl)
 }
 
 // generateURL generates a URL for the given path. If a secret is given, it is appended as the auth param.
@@ -44,6 +54,35 @@ func generateURL(conf *config.Config, path string, secret string) (string, error
 	return url, nil
 }
 
+// generateStreamReadyURL creates the URL to read the stream to a reserved file, see HeaderStreamReadyURL. The token
+// ties the URL to the reservation, so that reading it never returns the content of an unrelated later upload.
+func generateStreamReadyURL(conf *config.Config, id string, secret string, token string) (string, error) {
+	url, err := generateURL(conf, fmt.Sprintf(clipboardPathFormat, id), secret)
+	if err != nil {
+		return "", err
+	}
+	separator := "?"
+	if secret != "" {
+		separator = "&"
+	}
+	return fmt.Sprintf("%s%s%s=%s", url, separator, queryParamToken, token), nil
+}
+
+// GenerateSignedURL generates a download URL for the given file ID that carries its own authorization (an HMAC
+// in the auth param, signed with the config's key), so that it can be shared with someone who does not have the
+// key. The URL is valid for the given duration. Without a key, the plain URL is returned.
+func GenerateSignedURL(conf *config.Config, id string, validFor time.Duration) (string, error) {
+	path := fmt.Sprintf(clipboardPathFormat, id)
+	if conf.Key == nil {
+		return generateURL(conf, path, "")
+	}
+	auth, err := crypto.GenerateReusableAuthHMAC(conf.Key.Bytes, http.MethodGet, path, validFor)
+	if err != nil {
+		return "", err
+	}
+	return generateURL(conf, path, url.QueryEscape(auth))
+}
+
 // generateCurlCommand creates a curl command to download the given path
 func generateCurlCommand(conf *config.Config, url string) (string, error) {
 	args := make([]string, 0)
@@ -62,12 +101,109 @@ func generateCurlCommand(conf *config.Config, url string) (string, error) {
 	return fmt.Sprintf("curl %s '%s'", strings.Join(args, " "), url), nil
 }
 
-// randomFileID generates a random file name
-func randomFileID() string {
+// randomSecret generates a random secret
+func randomSecret() string {
 	return util.RandomStringWithCharset(randomFileIDLength, randomFileIDCharset)
 }
 
-// randomSecret generates a random secret
-func randomSecret() string {
-	return randomFileID()
+// randomUploadToken generates a random token for a resumable upload
+func randomUploadToken() string {
+	return util.RandomStringWithCharset(uploadTokenLength, randomFileIDCharset)
+}
+
+// randomStreamToken generates a random token for a reservation, see generateStreamReadyURL
+func randomStreamToken() string {
+	return util.RandomStringWithCharset(streamTokenLength, randomFileIDCharset)
+}
+
+// indentLines indents every non-empty line of the given text by n spaces, e.g. to fit custom text into the curl
+// help text, see config.CurlBanner
+func indentLines(n int, s string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			lines[i] = strings.Repeat(" ", n) + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// isBrowser returns true if the request was (likely) made by a web browser
+func isBrowser(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("User-Agent"), "Mozilla/")
+}
+
+// fileETag returns a strong ETag for the file as it is sent to the client: the checksum of its content, or, for
+// files written by older versions without a checksum, its modification time and size. Gzip-encoded responses
+// get a different ETag than identity-encoded ones. Streams have no ETag, since their content is not known in advance.
+func fileETag(r *http.Request, stat *clipboard.File) string {
+	if stat.Pipe {
+		return ""
+	}
+	etag := stat.Checksum
+	if etag == "" {
+		etag = fmt.Sprintf("%x-%x", stat.ModTime.UnixNano(), stat.Size)
+	}
+	if stat.Compressed && acceptsGzip(r) {
+		etag += "-gzip"
+	}
+	return fmt.Sprintf(`"%s"`, etag)
+}
+
+// notModified sets the ETag header for the file, and responds with "304 Not Modified" if it matches the
+// If-None-Match request header. It returns true if the response was sent.
+func notModified(w http.ResponseWriter, r *http.Request, stat *clipboard.File) bool {
+	etag := fileETag(r, stat)
+	if etag == "" {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches returns true if the ETag is in the comma-separated list of an If-None-Match header, or if the
+// header is "*". As required for If-None-Match, weak ETags ("W/...") are compared as if they were strong.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip returns true if the client accepts gzip-compressed responses (Accept-Encoding: gzip)
+func acceptsGzip(r *http.Request) bool {
+	return acceptsEncoding(r, encodingGzip)
+}
+
+// acceptsEncoding returns true if the client accepts responses with the given content encoding (Accept-Encoding)
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(strings.TrimSpace(accepted), ";")
+		if strings.TrimSpace(parts[0]) != encoding {
+			continue
+		}
+		return len(parts) < 2 || strings.ReplaceAll(strings.TrimSpace(parts[1]), " ", "") != "q=0"
+	}
+	return false
+}
+
+// hasExplicitAccept returns true if the client explicitly asked for specific content types,
+// i.e. it sent an "Accept:" header that does not accept anything or HTML
+func hasExplicitAccept(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return accept != "" && !strings.Contains(accept, "*/*") && !strings.Contains(accept, "text/html")
+}
+
+// isGenericContentType returns true if the given media type does not say anything about the content, e.g.
+// because HTTP clients send it by default (curl -d sends application/x-www-form-urlencoded)
+func isGenericContentType(mediaType string) bool {
+	return mediaType == "application/octet-stream" || mediaType == "application/x-www-form-urlencoded" ||
+		strings.HasPrefix(mediaType, "multipart/")
 }
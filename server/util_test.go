@@ -45,3 +45,11 @@ func TestConfig_GenerateURL443(t *testing.T) {
 		t.Fatalf("expected URL mismatched, got %s", url)
 	}
 }
+
+func TestETagMatches(t *testing.T) {
+	test.BoolEquals(t, true, etagMatches(`"abc"`, `"abc"`))
+	test.BoolEquals(t, true, etagMatches(`"xyz", W/"abc"`, `"abc"`))
+	test.BoolEquals(t, true, etagMatches(`*`, `"abc"`))
+	test.BoolEquals(t, false, etagMatches(`"abcd"`, `"abc"`))
+	test.BoolEquals(t, false, etagMatches(``, `"abc"`))
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"heckel.io/pcopy/clipboard"
+	"heckel.io/pcopy/config"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	webhookEventCreated = "created"
+	webhookEventExpired = "expired"
+	webhookAttempts     = 3
+	webhookTimeout      = 10 * time.Second
+
+	// HeaderWebhookEvent is the header containing the event type of a webhook request
+	HeaderWebhookEvent = "X-Pcopy-Event"
+
+	// HeaderWebhookSignature is the header containing the HMAC-SHA256 of the webhook payload, if a
+	// webhook secret is configured. Its format is "sha256=<hex>".
+	HeaderWebhookSignature = "X-Pcopy-Signature"
+)
+
+var (
+	// webhookRetryDelay is the delay before the first retry; it is doubled after every failed attempt.
+	// This is a variable so it can be shortened in tests.
+	webhookRetryDelay = 2 * time.Second
+
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+)
+
+// webhookPayload is the JSON body POSTed to the webhook URL
+type webhookPayload struct {
+	Event string `json:"event"`
+	ID    string `json:"id"`
+	URL   string `json:"url"`
+	Size  int64  `json:"size"`
+	TTL   int64  `json:"ttl"`
+	Mode  string `json:"mode"`
+}
+
+// sendWebhook POSTs the given event for a file to the configured webhook URL, retrying with exponential
+// backoff if the request fails or returns a non-2xx status. This is meant to be called asynchronously;
+// errors are only logged.
+func (s *Server) sendWebhook(event string, id string, meta *clipboard.File, size int64) {
+	url, err := generateURL(s.config, fmt.Sprintf(clipboardPathFormat, id), meta.Secret)
+	if err != nil {
+		log.Printf("[%s] cannot send webhook for %s: %s", config.CollapseServerAddr(s.config.ServerAddr), s.logID(id), err.Error())
+		return
+	}
+	ttl := int64(0)
+	if meta.Expires > 0 && event != webhookEventExpired {
+		ttl = int64(time.Until(time.Unix(meta.Expires, 0)).Seconds())
+	}
+	payload, err := json.Marshal(&webhookPayload{
+		Event: event,
+		ID:    id,
+		URL:   url,
+		Size:  size,
+		TTL:   ttl,
+		Mode:  meta.Mode,
+	})
+	if err != nil {
+		log.Printf("[%s] cannot send webhook for %s: %s", config.CollapseServerAddr(s.config.ServerAddr), s.logID(id), err.Error())
+		return
+	}
+	delay := webhookRetryDelay
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if err = s.postWebhook(event, payload); err == nil {
+			return
+		}
+		if attempt < webhookAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	log.Printf("[%s] cannot send webhook for %s after %d attempts: %s",
+		config.CollapseServerAddr(s.config.ServerAddr), s.logID(id), webhookAttempts, err.Error())
+}
+
+func (s *Server) postWebhook(event string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.config.WebhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderWebhookEvent, event)
+	if s.config.WebhookSecret != "" {
+		req.Header.Set(HeaderWebhookSignature, "sha256="+webhookSignature(s.config.WebhookSecret, payload))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return nil
+}
+
+func webhookSignature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
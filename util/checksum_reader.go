@@ -0,0 +1,46 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+)
+
+// ErrChecksumMismatch is returned by ChecksumReadCloser if the content does not match the expected checksum
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ChecksumReadCloser is a ReadCloser that computes the SHA-256 checksum of the underlying stream while it is read,
+// and compares it to the expected checksum at the end. If it does not match, the final read returns
+// ErrChecksumMismatch instead of io.EOF, so that the content can be discarded. It can be instantiated using
+// NewChecksumReadCloser.
+type ChecksumReadCloser struct {
+	underlying io.ReadCloser
+	expected   []byte
+	hash       hash.Hash
+}
+
+// NewChecksumReadCloser creates a new ChecksumReadCloser that expects the given SHA-256 checksum
+func NewChecksumReadCloser(underlying io.ReadCloser, expected []byte) *ChecksumReadCloser {
+	return &ChecksumReadCloser{
+		underlying: underlying,
+		expected:   expected,
+		hash:       sha256.New(),
+	}
+}
+
+// Read reads from the underlying stream, and verifies the checksum once the end of the stream is reached
+func (r *ChecksumReadCloser) Read(p []byte) (int, error) {
+	n, err := r.underlying.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(r.hash.Sum(nil), r.expected) {
+		return n, ErrChecksumMismatch
+	}
+	return n, err
+}
+
+// Close closes the underlying stream
+func (r *ChecksumReadCloser) Close() error {
+	return r.underlying.Close()
+}
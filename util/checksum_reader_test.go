@@ -0,0 +1,27 @@
+package util
+
+import (
+	"crypto/sha256"
+	"heckel.io/pcopy/test"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestChecksumReadCloser_Match(t *testing.T) {
+	expected := sha256.Sum256([]byte("hi there"))
+	r := NewChecksumReadCloser(io.NopCloser(strings.NewReader("hi there")), expected[:])
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "hi there", string(content))
+}
+
+func TestChecksumReadCloser_Mismatch(t *testing.T) {
+	expected := sha256.Sum256([]byte("something else"))
+	r := NewChecksumReadCloser(io.NopCloser(strings.NewReader("hi there")), expected[:])
+	if _, err := io.ReadAll(r); err != ErrChecksumMismatch {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+}
@@ -10,38 +10,65 @@ var contentTypeExtOverrides = map[string]string{
 	"text/plain": ".txt",
 }
 
+// activeContentTypes are content types that browsers may render as active content (i.e. execute scripts in)
+var activeContentTypes = []string{"text/html", "text/xml", "application/xml", "application/xhtml+xml", "image/svg+xml"}
+
 // ContentTypeWriter is an implementation of io.Writer that will detect the content type and set the
 // Content-Type and (optionally) Content-Disposition headers accordingly.
 //
-// It will always set a Content-Type based on http.DetectContentType, but will never send the "text/html"
-// content type.
+// It will set a Content-Type based on http.DetectContentType (or SetContentType, if the type is already known),
+// but will never send the "text/html" content type (or any other active content type, see activeContentTypes),
+// unless it was created with NewUnfilteredContentTypeWriter.
 //
 // If "download" is set, the Content-Disposition header will be set to "attachment", and will include a
 // filename based on what is passed into the constructor function.
 type ContentTypeWriter struct {
-	w        http.ResponseWriter
-	filename string
-	download bool
-	sniffed  bool
+	w           http.ResponseWriter
+	filename    string
+	download    bool
+	unfiltered  bool
+	sniffed     bool
+	contentType string
 }
 
 // NewContentTypeWriter creates a new ContentTypeWriter
 func NewContentTypeWriter(w http.ResponseWriter, filename string, download bool) *ContentTypeWriter {
-	return &ContentTypeWriter{w, filename, download, false}
+	return &ContentTypeWriter{w, filename, download, false, false, ""}
+}
+
+// NewUnfilteredContentTypeWriter creates a new ContentTypeWriter that sends the detected content type as is, even
+// if it is an active content type such as "text/html". This must only be used for non-browser clients.
+func NewUnfilteredContentTypeWriter(w http.ResponseWriter, filename string, download bool) *ContentTypeWriter {
+	return &ContentTypeWriter{w, filename, download, true, false, ""}
+}
+
+// SetContentType sets a known content type (e.g. detected or provided when the file was uploaded) to be used
+// instead of detecting it from the content. Active content types are still filtered, see NewContentTypeWriter.
+func (w *ContentTypeWriter) SetContentType(contentType string) {
+	w.contentType = contentType
 }
 
 func (w *ContentTypeWriter) Write(p []byte) (n int, err error) {
-	if w.sniffed {
-		return w.w.Write(p)
+	if !w.sniffed {
+		w.Sniff(p)
 	}
+	return w.w.Write(p)
+}
 
+// Sniff detects the content type of p (unless it is already known, see SetContentType) and sets the Content-Type and Content-Disposition headers, but does not
+// write p. Any following writes are passed through as is. This is useful if the content is not written as is,
+// e.g. if it is sent gzip-compressed.
+func (w *ContentTypeWriter) Sniff(p []byte) {
 	// Detect and set Content-Type header
-	contentType := http.DetectContentType(p)
+	contentType := w.contentType
+	if contentType == "" {
+		contentType = http.DetectContentType(p)
+	}
 	if !w.download {
 		// Fix content types that we don't want to inline-render in the browser. In particular,
 		// we don't want to render HTML in the browser for security reasons.
-		if strings.HasPrefix(contentType, "text/html") {
-			contentType = strings.ReplaceAll(contentType, "text/html", "text/plain")
+		if isActiveContentType(contentType) && !w.unfiltered {
+			contentType = "text/plain; charset=utf-8"
 		} else if contentType == "application/octet-stream" {
 			contentType = "" // Reset to let downstream http.ResponseWriter take care of it
 		}
@@ -70,5 +97,13 @@ func (w *ContentTypeWriter) Write(p []byte) (n int, err error) {
 	}
 
 	w.sniffed = true
-	return w.w.Write(p)
+}
+
+func isActiveContentType(contentType string) bool {
+	for _, t := range activeContentTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
 }
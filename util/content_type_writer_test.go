@@ -14,6 +14,45 @@ func TestSniffWriter_WriteHTML(t *testing.T) {
 	test.StrEquals(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
 }
 
+func TestSniffWriter_WriteXML(t *testing.T) {
+	rr := httptest.NewRecorder()
+	sw := NewContentTypeWriter(rr, "", false)
+	sw.Write([]byte("<?xml version=\"1.0\"?><svg onload=\"alert('hi')\"></svg>"))
+	test.StrEquals(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
+}
+
+func TestSniffWriter_UnfilteredWriteHTML(t *testing.T) {
+	rr := httptest.NewRecorder()
+	sw := NewUnfilteredContentTypeWriter(rr, "", false)
+	sw.Write([]byte("<script>alert('hi')</script>"))
+	test.StrEquals(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+}
+
+func TestSniffWriter_SniffThenWrite(t *testing.T) {
+	rr := httptest.NewRecorder()
+	sw := NewContentTypeWriter(rr, "", false)
+	sw.Sniff([]byte{0x25, 0x50, 0x44, 0x46, 0x2d, 0x11, 0x22, 0x33})
+	sw.Write([]byte{0x1f, 0x8b, 0x08})
+	test.StrEquals(t, "application/pdf", rr.Header().Get("Content-Type"))
+	test.BytesEquals(t, []byte{0x1f, 0x8b, 0x08}, rr.Body.Bytes())
+}
+
+func TestSniffWriter_SetContentType(t *testing.T) {
+	rr := httptest.NewRecorder()
+	sw := NewContentTypeWriter(rr, "", false)
+	sw.SetContentType("application/json")
+	sw.Write([]byte("this is not JSON"))
+	test.StrEquals(t, "application/json", rr.Header().Get("Content-Type"))
+}
+
+func TestSniffWriter_SetContentTypeActiveIsFiltered(t *testing.T) {
+	rr := httptest.NewRecorder()
+	sw := NewContentTypeWriter(rr, "", false)
+	sw.SetContentType("text/html")
+	sw.Write([]byte("<script>alert('hi')</script>"))
+	test.StrEquals(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
+}
+
 func TestSniffWriter_WriteTwoWriteCalls(t *testing.T) {
 	rr := httptest.NewRecorder()
 	sw := NewContentTypeWriter(rr, "", false)
@@ -0,0 +1,39 @@
+package util
+
+import (
+	"context"
+	"io"
+)
+
+// ContextReadCloser is a ReadCloser that stops reading from the underlying stream once its context is done,
+// e.g. to limit the duration of an upload. The context is checked before and after every read, so a read that
+// blocks is not interrupted. It can be instantiated using NewContextReadCloser.
+type ContextReadCloser struct {
+	ctx        context.Context
+	underlying io.ReadCloser
+}
+
+// NewContextReadCloser creates a new ContextReadCloser
+func NewContextReadCloser(ctx context.Context, underlying io.ReadCloser) *ContextReadCloser {
+	return &ContextReadCloser{
+		ctx:        ctx,
+		underlying: underlying,
+	}
+}
+
+// Read reads from the underlying stream, unless the context is done, in which case the context's error is returned
+func (r *ContextReadCloser) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.underlying.Read(p)
+	if ctxErr := r.ctx.Err(); ctxErr != nil {
+		return n, ctxErr
+	}
+	return n, err
+}
+
+// Close closes the underlying stream
+func (r *ContextReadCloser) Close() error {
+	return r.underlying.Close()
+}
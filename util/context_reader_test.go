@@ -0,0 +1,34 @@
+package util
+
+import (
+	"context"
+	"heckel.io/pcopy/test"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestContextReadCloser_Success(t *testing.T) {
+	r := NewContextReadCloser(context.Background(), io.NopCloser(strings.NewReader("some content")))
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "some content", string(content))
+}
+
+func TestContextReadCloser_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewContextReadCloser(ctx, io.NopCloser(strings.NewReader("some content")))
+	buf := make([]byte, 4)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "some", string(buf[:n]))
+
+	cancel()
+	if _, err := r.Read(buf); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
@@ -40,6 +40,13 @@ func (l *Limiter) Add(n int64) error {
 	}
 }
 
+// Allowed returns true if n could be added without exceeding the limit. Unlike Add, it does not change the value.
+func (l *Limiter) Allowed(n int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit == 0 || l.value+n <= l.limit
+}
+
 // Sub subtracts a value from the limiters internal value
 func (l *Limiter) Sub(n int64) {
 	l.Add(-n)
@@ -18,6 +18,23 @@ func TestLimiter_Add(t *testing.T) {
 	}
 }
 
+func TestLimiter_Allowed(t *testing.T) {
+	l := NewLimiter(10)
+	l.Add(5)
+	if !l.Allowed(5) {
+		t.Fatalf("expected 5 to be allowed")
+	}
+	if l.Allowed(6) {
+		t.Fatalf("expected 6 not to be allowed")
+	}
+	if l.Value() != 5 {
+		t.Fatalf("expected value to be %d, got %d", 5, l.Value())
+	}
+	if !NewLimiter(0).Allowed(1000) {
+		t.Fatalf("expected unlimited limiter to allow anything")
+	}
+}
+
 func TestLimiter_AddSet(t *testing.T) {
 	l := NewLimiter(10)
 	l.Add(5)
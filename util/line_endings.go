@@ -0,0 +1,81 @@
+package util
+
+import (
+	"io"
+)
+
+const lineEndingBufSize = 32 * 1024
+
+// LineEndingReadCloser is a ReadCloser that converts the line endings of the underlying stream, either from CRLF
+// (Windows) to LF (Unix), or from LF to CRLF. Line endings that are already in the target format are left as they
+// are, and so are lone CRs. It can be instantiated using NewLineEndingReadCloser.
+type LineEndingReadCloser struct {
+	underlying io.ReadCloser
+	crlf       bool   // True if LF is converted to CRLF, false for the reverse
+	buf        []byte // Buffer for reading from the underlying stream
+	out        []byte // Converted bytes that have not been read yet
+	cr         bool   // True if the last byte read from the underlying stream was a CR
+	err        error
+}
+
+// NewLineEndingReadCloser creates a new LineEndingReadCloser. If crlf is true, LF line endings are converted to
+// CRLF; otherwise CRLF line endings are converted to LF.
+func NewLineEndingReadCloser(underlying io.ReadCloser, crlf bool) *LineEndingReadCloser {
+	return &LineEndingReadCloser{
+		underlying: underlying,
+		crlf:       crlf,
+		buf:        make([]byte, lineEndingBufSize),
+	}
+}
+
+// Read reads from the underlying stream and converts the line endings
+func (r *LineEndingReadCloser) Read(p []byte) (int, error) {
+	for len(r.out) == 0 && r.err == nil {
+		n, err := r.underlying.Read(r.buf)
+		r.out = r.convert(r.out[:0], r.buf[:n])
+		if err != nil {
+			if !r.crlf && r.cr {
+				r.out = append(r.out, '\r') // A trailing CR is not a line ending
+			}
+			r.err = err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	if len(r.out) == 0 && r.err != nil {
+		return n, r.err
+	}
+	return n, nil
+}
+
+// Close closes the underlying stream
+func (r *LineEndingReadCloser) Close() error {
+	return r.underlying.Close()
+}
+
+func (r *LineEndingReadCloser) convert(out []byte, in []byte) []byte {
+	for _, b := range in {
+		if r.crlf {
+			if b == '\n' && !r.cr {
+				out = append(out, '\r')
+			}
+			out = append(out, b)
+			r.cr = b == '\r'
+			continue
+		}
+		if r.cr {
+			r.cr = false
+			if b == '\n' {
+				out = append(out, '\n')
+				continue
+			}
+			out = append(out, '\r')
+		}
+		if b == '\r' {
+			r.cr = true
+			continue
+		}
+		out = append(out, b)
+	}
+	return out
+}
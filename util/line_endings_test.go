@@ -0,0 +1,37 @@
+package util
+
+import (
+	"heckel.io/pcopy/test"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestLineEndingReadCloser_ToLF(t *testing.T) {
+	r := NewLineEndingReadCloser(io.NopCloser(strings.NewReader("line 1\r\nline 2\nline\r3\r\n\r\nend\r")), false)
+	converted, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "line 1\nline 2\nline\r3\n\nend\r", string(converted))
+}
+
+func TestLineEndingReadCloser_ToCRLF(t *testing.T) {
+	r := NewLineEndingReadCloser(io.NopCloser(strings.NewReader("line 1\nline 2\r\nline\r3\n\nend")), true)
+	converted, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "line 1\r\nline 2\r\nline\r3\r\n\r\nend", string(converted))
+}
+
+func TestLineEndingReadCloser_ToLFOneByteReads(t *testing.T) {
+	// CRLF split across reads
+	r := NewLineEndingReadCloser(io.NopCloser(iotest.OneByteReader(strings.NewReader("a\r\nb\r\r\nc"))), false)
+	converted, err := io.ReadAll(iotest.OneByteReader(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "a\nb\r\nc", string(converted))
+}
@@ -0,0 +1,167 @@
+package util
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const rotatedCompressedSuffix = ".gz"
+
+// RotatingWriter is an io.WriteCloser that writes to a file, and rotates the file once it reaches a
+// maximum size. Rotated files are renamed to <filename>.1, <filename>.2, and so on (with .1 being the
+// most recent), and are optionally gzip-compressed. Only maxBackups rotated files are kept.
+// Compression happens in the background, so writes are not blocked by it.
+// RotatingWriter may be used by multiple goroutines.
+type RotatingWriter struct {
+	filename    string
+	maxSize     int64
+	maxBackups  int
+	compress    bool
+	file        *os.File
+	size        int64
+	compressing sync.WaitGroup // Pending background compression of the most recent backup
+	mu          sync.Mutex
+}
+
+// NewRotatingWriter opens (or creates) the given file for appending, and returns a writer that rotates
+// the file once its size exceeds maxSize bytes. If maxSize is zero, the file is never rotated.
+func NewRotatingWriter(filename string, maxSize int64, maxBackups int, compress bool) (*RotatingWriter, error) {
+	w := &RotatingWriter{
+		filename:   filename,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		compress:   compress,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write writes p to the current file. If writing p would exceed the maximum size, the file is rotated first.
+// A single write is never split across files. If rotating fails, but the file could be reopened, p is written
+// to the current file anyway, and rotating is retried with the next write.
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil && w.file == nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Close closes the underlying file, and waits for the compression of the most recent backup to finish
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer w.compressing.Wait()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *RotatingWriter) open() error {
+	f, err := os.OpenFile(w.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = stat.Size()
+	return nil
+}
+
+// rotate closes the current file, moves it aside (see shift) and reopens the file. The file is reopened even if
+// moving it aside fails, so that writing can continue.
+func (w *RotatingWriter) rotate() error {
+	err := w.file.Close()
+	w.file = nil
+	if err == nil {
+		err = w.shift()
+	}
+	if openErr := w.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// shift renames the backups to make room for the current file, which becomes the most recent backup. If the
+// backups are compressed, the current file is renamed to an uncompressed backup first, and compressed in the
+// background. If that fails, the uncompressed backup is kept.
+func (w *RotatingWriter) shift() error {
+	if w.maxBackups == 0 {
+		return os.Remove(w.filename)
+	}
+	w.compressing.Wait()                  // Don't rename the previous backup while it is still being compressed
+	os.Remove(w.backupName(w.maxBackups)) // Drop oldest, may not exist
+	for i := w.maxBackups - 1; i >= 1; i-- {
+		os.Rename(w.backupName(i), w.backupName(i+1)) // May not exist
+	}
+	if !w.compress {
+		return os.Rename(w.filename, w.backupName(1))
+	}
+	target := w.backupName(1)
+	source := strings.TrimSuffix(target, rotatedCompressedSuffix)
+	if err := os.Rename(w.filename, source); err != nil {
+		return err
+	}
+	w.compressing.Add(1)
+	go func() {
+		defer w.compressing.Done()
+		if err := compressFile(source, target); err != nil {
+			os.Remove(target)
+		}
+	}()
+	return nil
+}
+
+func (w *RotatingWriter) backupName(n int) string {
+	if w.compress {
+		return fmt.Sprintf("%s.%d%s", w.filename, n, rotatedCompressedSuffix)
+	}
+	return fmt.Sprintf("%s.%d", w.filename, n)
+}
+
+// compressFile gzips source to target, and removes source once the compressed file has been fully written
+func compressFile(source string, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(source)
+}
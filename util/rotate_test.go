@@ -0,0 +1,161 @@
+package util
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRotatingWriter_RotateAndCompress(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "pcopy.log")
+	w, err := NewRotatingWriter(filename, 10, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for _, line := range []string{"line1\n", "line2\n", "line3\n", "line4\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.compressing.Wait()
+
+	current, _ := ioutil.ReadFile(filename)
+	if string(current) != "line4\n" {
+		t.Fatalf("unexpected current log: %q", string(current))
+	}
+	if s := readGzipFile(t, filename+".1.gz"); s != "line3\n" {
+		t.Fatalf("unexpected first backup: %q", s)
+	}
+	if s := readGzipFile(t, filename+".2.gz"); s != "line2\n" {
+		t.Fatalf("unexpected second backup: %q", s)
+	}
+	if _, err := os.Stat(filename + ".3.gz"); !os.IsNotExist(err) {
+		t.Fatalf("expected third backup to be deleted, got %v", err)
+	}
+}
+
+func TestRotatingWriter_NoCompression(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "pcopy.log")
+	w, err := NewRotatingWriter(filename, 10, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.Write([]byte("line1\n"))
+	w.Write([]byte("line2\n"))
+
+	backup, _ := ioutil.ReadFile(filename + ".1")
+	if string(backup) != "line1\n" {
+		t.Fatalf("unexpected backup: %q", string(backup))
+	}
+}
+
+func TestRotatingWriter_AppendsToExisting(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "pcopy.log")
+	ioutil.WriteFile(filename, []byte("existing\n"), 0644)
+
+	w, err := NewRotatingWriter(filename, 12, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.Write([]byte("new\n")) // Existing size counts towards the limit
+
+	backup, _ := ioutil.ReadFile(filename + ".1")
+	current, _ := ioutil.ReadFile(filename)
+	if string(backup) != "existing\n" || string(current) != "new\n" {
+		t.Fatalf("unexpected files: backup=%q, current=%q", string(backup), string(current))
+	}
+}
+
+func TestRotatingWriter_ReopensIfRotatingFails(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "pcopy.log")
+	w, err := NewRotatingWriter(filename, 10, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	os.Mkdir(filename+".1", 0755) // Renaming the file to a non-empty directory fails
+	ioutil.WriteFile(filepath.Join(filename+".1", "blocker"), []byte{}, 0644)
+	w.Write([]byte("line1\n"))
+	if _, err := w.Write([]byte("line2\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	os.RemoveAll(filename + ".1") // Rotating is retried with the next write
+	if _, err := w.Write([]byte("line3\n")); err != nil {
+		t.Fatal(err)
+	}
+	backup, _ := ioutil.ReadFile(filename + ".1")
+	current, _ := ioutil.ReadFile(filename)
+	if string(backup) != "line1\nline2\n" || string(current) != "line3\n" {
+		t.Fatalf("unexpected files: backup=%q, current=%q", string(backup), string(current))
+	}
+}
+
+func TestRotatingWriter_ConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "pcopy.log")
+	w, err := NewRotatingWriter(filename, 100, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := w.Write([]byte("0123456789\n")); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	w.Close()
+
+	// No line may be lost or torn apart
+	files, _ := ioutil.ReadDir(dir)
+	lines := 0
+	for _, f := range files {
+		contents, _ := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		for _, line := range strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n") {
+			if line != "0123456789" {
+				t.Fatalf("unexpected line %q in %s", line, f.Name())
+			}
+			lines++
+		}
+	}
+	if lines != 400 {
+		t.Fatalf("expected 400 lines, got %d", lines)
+	}
+}
+
+func readGzipFile(t *testing.T, filename string) string {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -2,11 +2,13 @@
 package util
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"golang.org/x/term"
 	"io"
-	"math/rand"
+	"math/big"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
@@ -17,7 +19,6 @@ import (
 )
 
 var (
-	random                         = rand.New(rand.NewSource(time.Now().UnixNano()))
 	durationStrSecondsOnlyRegex    = regexp.MustCompile(`(?i)^(\d+)$`)
 	durationStrLongPeriodOnlyRegex = regexp.MustCompile(`(?i)^(\d+)([dwy]|mo)$`)
 	sizeStrRegex                   = regexp.MustCompile(`(?i)^(\d+)([gmkb])?$`)
@@ -145,15 +146,51 @@ func ParseSize(s string) (int64, error) {
 	}
 }
 
-// RandomStringWithCharset returns a random string with a given length, using the defined charset
+// ParseIPNet parses a CIDR like 10.0.0.0/8 or fd00::/8 into a network. A single IP address is treated as a
+// network containing only that address.
+func ParseIPNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	return ipNet, nil
+}
+
+// RandomStringWithCharset returns a random string with a given length, using the defined charset. The string is
+// generated using crypto/rand, so it can be used for IDs and tokens that must not be guessable.
 func RandomStringWithCharset(length int, charset string) string {
 	b := make([]byte, length)
 	for i := range b {
-		b[i] = charset[random.Intn(len(charset))]
+		b[i] = charset[randomIntn(len(charset))]
 	}
 	return string(b)
 }
 
+// RandomElement returns a random element of the given (non-empty) list, using crypto/rand
+func RandomElement(list []string) string {
+	return list[randomIntn(len(list))]
+}
+
+// randomIntn returns a uniformly distributed random number in [0,n) using crypto/rand. It panics if the system's
+// random number generator fails, since nothing that needs random IDs or tokens can continue safely after that.
+func randomIntn(n int) int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(err)
+	}
+	return int(i.Int64())
+}
+
 // ReadPassword will read a password from STDIN. If the terminal supports it, it will not print the
 // input characters to the screen. If not, it'll just read using normal readline semantics (useful for testing).
 func ReadPassword(in io.Reader) ([]byte, error) {
@@ -294,3 +294,34 @@ func TestParseSize_FailureInvalid(t *testing.T) {
 		t.Fatalf("expected error, but got none")
 	}
 }
+
+func TestParseIPNet_CIDRSuccess(t *testing.T) {
+	ipNet, err := ParseIPNet("10.1.2.3/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "10.0.0.0/8", ipNet.String())
+}
+
+func TestParseIPNet_SingleAddressSuccess(t *testing.T) {
+	ipNet, err := ParseIPNet("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "127.0.0.1/32", ipNet.String())
+
+	ipNet, err = ParseIPNet("::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.StrEquals(t, "::1/128", ipNet.String())
+}
+
+func TestParseIPNet_FailureInvalid(t *testing.T) {
+	if _, err := ParseIPNet("not-an-ip"); err == nil {
+		t.Fatalf("expected error, but got none")
+	}
+	if _, err := ParseIPNet("10.0.0.0/99"); err == nil {
+		t.Fatalf("expected error, but got none")
+	}
+}